@@ -1,18 +1,30 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	btcwalletdb "github.com/btcsuite/btcwallet/walletdb"
+	_ "github.com/btcsuite/btcwallet/walletdb/bdb"
 	"github.com/czh0526/btc-wallet/chain"
 	"github.com/czh0526/btc-wallet/wallet"
 	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
-	"os"
-	"runtime"
+	"github.com/lightninglabs/neutrino"
 )
 
 var (
 	cfg *config
 )
 
+// chainConnectAttempts is the number of times the connection to the chain
+// server is tried before giving up.
+const chainConnectAttempts = 10
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -36,16 +48,15 @@ func walletMain() error {
 	loader := wallet.NewLoader(
 		activeNet.Params, netDir, true, cfg.DBTimeout, 250)
 
-	fmt.Println("4) 启动 RPC Server，注册 WalletLoader 服务")
-	rpcs, err := startRPCServers(loader)
+	fmt.Println("4) 启动 RPC Server，注册 WalletLoader 和 Wallet 服务")
+	_, err = startRPCServers(loader)
 	if err != nil {
 		fmt.Printf("Unable to create RPC servers: %v\n", err)
 		return err
 	}
 
 	loader.RunAfterLoad(func(w *wallet.Wallet) {
-		fmt.Println("5) 向 RPC Server 注册 Wallet 服务")
-		startWalletRPCServices(w, rpcs)
+		go startChainClient(w)
 	})
 
 	if !cfg.NoInitialLoad {
@@ -70,12 +81,184 @@ func walletMain() error {
 	return nil
 }
 
+// startChainClient connects to the chain server, to a bitcoind node, to an
+// Electrum server, to an Esplora API or to SPV peers if enabled, and attaches
+// the client to the wallet. The client is stopped along with the wallet when
+// it is unloaded.
+func startChainClient(w *wallet.Wallet) {
+	var (
+		chainClient chain.Interface
+		err         error
+	)
+	if cfg.UseSPV {
+		chainClient, err = startChainNeutrino()
+	} else if cfg.ElectrumServer != "" {
+		chainClient, err = startChainElectrum()
+	} else if cfg.EsploraURL != "" {
+		chainClient, err = startChainEsplora(w)
+	} else if cfg.UseBitcoind {
+		chainClient, err = startChainBitcoind()
+	} else {
+		chainClient, err = startChainRPC(readCAFile())
+	}
+	if err != nil {
+		fmt.Printf("Unable to start chain client: %v \n", err)
+		return
+	}
+
+	w.SynchronizeRPC(chainClient)
+}
+
+// readCAFile reads the certificates of the chain server, returning nil if
+// client TLS is disabled or the file can't be read.
+func readCAFile() []byte {
+	if cfg.DisableClientTLS {
+		return nil
+	}
+	certs, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		fmt.Printf("Cannot open CA file: %v \n", err)
+		// If there's an error reading the CA file, continue
+		// with nil certs and without the client connection.
+		return nil
+	}
+	return certs
+}
+
+// startChainRPC opens a RPC client connection to a btcd server for blockchain
+// services. This function uses the RPC options from the global config and
+// there is no recovery in case the server is not available or if there is an
+// authentication error. Instead, all requests to the client will simply error.
 func startChainRPC(certs []byte) (*chain.RPCClient, error) {
-	fmt.Printf("Attempting RPC client connection to %v", cfg.RPCConnect)
-	rpcc, err := chain.NewRPCClient()
+	fmt.Printf("Attempting RPC client connection to %v \n", cfg.RPCConnect)
+	rpcc, err := chain.NewRPCClient(activeNet.Params, cfg.RPCConnect,
+		cfg.BtcdUsername, cfg.BtcdPassword, certs, cfg.DisableClientTLS, chainConnectAttempts)
 	if err != nil {
 		return nil, err
 	}
 	err = rpcc.Start()
+	return rpcc, err
+}
+
+// startChainBitcoind connects to the JSON-RPC interface of a bitcoind node,
+// receiving new blocks and transactions over ZMQ if the endpoints are set.
+func startChainBitcoind() (*chain.BitcoindClient, error) {
+	fmt.Printf("Attempting bitcoind connection to %v \n", cfg.RPCConnect)
+	client, err := chain.NewBitcoindClient(&chain.BitcoindConfig{
+		ChainParams:  activeNet.Params,
+		Host:         cfg.RPCConnect,
+		User:         cfg.BtcdUsername,
+		Pass:         cfg.BtcdPassword,
+		ZMQBlockHost: cfg.ZMQPubRawBlock,
+		ZMQTxHost:    cfg.ZMQPubRawTx,
+		PollInterval: cfg.BitcoindPollInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = client.Start()
+	return client, err
+}
 
+// startChainElectrum connects to an Electrum server, over TLS if enabled.
+func startChainElectrum() (*chain.ElectrumClient, error) {
+	fmt.Printf("Attempting Electrum server connection to %v \n",
+		cfg.ElectrumServer)
+
+	var tlsConfig *tls.Config
+	if cfg.ElectrumTLS {
+		host, _, err := net.SplitHostPort(cfg.ElectrumServer)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	client := chain.NewElectrumClient(&chain.ElectrumConfig{
+		ChainParams: activeNet.Params,
+		Server:      cfg.ElectrumServer,
+		TLSConfig:   tlsConfig,
+	})
+	err := client.Start()
+	return client, err
+}
+
+// startChainEsplora starts polling an Esplora API. Reorgs are detected
+// against the blocks the wallet synced through.
+func startChainEsplora(w *wallet.Wallet) (*chain.EsploraClient, error) {
+	fmt.Printf("Attempting Esplora API connection to %v \n", cfg.EsploraURL)
+
+	client := chain.NewEsploraClient(&chain.EsploraConfig{
+		ChainParams:     activeNet.Params,
+		URL:             cfg.EsploraURL,
+		PollInterval:    cfg.EsploraPollInterval,
+		SyncedBlockHash: w.BlockHash,
+	})
+	err := client.Start()
+	return client, err
+}
+
+// neutrinoClient closes the database of the SPV chain service once the client
+// shut down, so that the service can be started again for a wallet opened
+// later.
+type neutrinoClient struct {
+	*chain.NeutrinoClient
+
+	db        btcwalletdb.DB
+	closeOnce sync.Once
+}
+
+// WaitForShutdown blocks until the client shut down and closes the database
+// of the chain service.
+func (c *neutrinoClient) WaitForShutdown() {
+	c.NeutrinoClient.WaitForShutdown()
+	c.closeOnce.Do(func() {
+		if err := c.db.Close(); err != nil {
+			fmt.Printf("Unable to close neutrino database: %v \n", err)
+		}
+	})
+}
+
+// startChainNeutrino starts a SPV chain client syncing block headers and
+// compact filters from the peers of the config. Headers and filters are
+// persisted in the network directory, and the database holding them is
+// closed once the client shut down.
+func startChainNeutrino() (*neutrinoClient, error) {
+	netDir := networkDir(cfg.AppDataDir, activeNet.Params)
+	if err := wallet.CheckCreateDir(netDir); err != nil {
+		return nil, err
+	}
+
+	dbPath := filepath.Join(netDir, "neutrino.db")
+	db, err := btcwalletdb.Create("bdb", dbPath, true, cfg.DBTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create neutrino database: %v",
+			err)
+	}
+	neutrino.MaxPeers = cfg.MaxPeers
+	neutrino.BanDuration = cfg.BanDuration
+	neutrino.BanThreshold = cfg.BanThreshold
+
+	fmt.Printf("Starting SPV chain service in %v \n", netDir)
+	chainService, err := chain.NewNeutrinoChainService(neutrino.Config{
+		DataDir:      netDir,
+		Database:     db,
+		ChainParams:  *activeNet.Params,
+		ConnectPeers: cfg.ConnectPeers,
+		AddPeers:     cfg.AddPeers,
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	chainClient := &neutrinoClient{
+		NeutrinoClient: chain.NewNeutrinoClient(
+			activeNet.Params, chainService),
+		db: db,
+	}
+	if err := chainClient.Start(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return chainClient, nil
 }
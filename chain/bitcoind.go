@@ -0,0 +1,608 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/lightninglabs/gozmq"
+)
+
+const (
+	// defaultBitcoindPollInterval is how often bitcoind is polled for new
+	// blocks and mempool transactions when no ZMQ endpoint is configured.
+	defaultBitcoindPollInterval = 10 * time.Second
+
+	// zmqReadTimeout is how long a ZMQ subscription waits for a message
+	// before checking whether the client is shutting down.
+	zmqReadTimeout = 5 * time.Second
+)
+
+// BitcoindConfig describes the connection to a bitcoind node.
+type BitcoindConfig struct {
+	// ChainParams are the parameters of the network the node must be on.
+	ChainParams *chaincfg.Params
+
+	// Host, User and Pass are the address and credentials of the JSON-RPC
+	// interface of the node.
+	Host string
+	User string
+	Pass string
+
+	// ZMQBlockHost and ZMQTxHost are the endpoints the node publishes its
+	// rawblock and rawtx messages on, e.g. tcp://127.0.0.1:28332. The
+	// node is polled for blocks or mempool transactions instead if the
+	// corresponding endpoint is empty or cannot be subscribed to.
+	ZMQBlockHost string
+	ZMQTxHost    string
+
+	// PollInterval is the interval of the polling fallback.
+	PollInterval time.Duration
+}
+
+// BitcoindClient is a chain client backed by bitcoind. Queries are made over
+// JSON-RPC, while new blocks and transactions are learnt about from the ZMQ
+// notifications of the node, or by polling it. As bitcoind does not filter
+// transactions for the wallet, the client matches them itself against the
+// watched addresses and outpoints.
+type BitcoindClient struct {
+	*rpcclient.Client
+	cfg BitcoindConfig
+
+	// tip is the last block the client reported as connected. It is only
+	// accessed by the notification handler once the client started.
+	tip wtxmgr.BlockMeta
+
+	// mempool holds the transactions of the mempool seen by the last poll,
+	// so they are only fetched once.
+	mempool map[chainhash.Hash]struct{}
+
+	watched      *watchedSet
+	notifyBlocks bool
+	watchMtx     sync.Mutex
+
+	zmqConns []*gozmq.Conn
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
+}
+
+// Enforce that BitcoindClient satisfies the chain.Interface interface.
+var _ Interface = (*BitcoindClient)(nil)
+
+// Enforce that BitcoindClient serves compact filters.
+var _ CompactFilterSource = (*BitcoindClient)(nil)
+
+// Enforce that BitcoindClient serves transactions.
+var _ TxSource = (*BitcoindClient)(nil)
+
+// NewBitcoindClient creates a client for the bitcoind node described by the
+// config. No connection is made until Start is called.
+func NewBitcoindClient(cfg *BitcoindConfig) (*BitcoindClient, error) {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultBitcoindPollInterval
+	}
+
+	rpcClient, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         cfg.Host,
+		User:         cfg.User,
+		Pass:         cfg.Pass,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BitcoindClient{
+		Client:        rpcClient,
+		cfg:           *cfg,
+		mempool:       make(map[chainhash.Hash]struct{}),
+		watched:       newWatchedSet(),
+		notifications: make(chan interface{}, notificationBufferSize),
+		quit:          make(chan struct{}),
+	}, nil
+}
+
+// bitcoindChainInfo holds the fields of the getblockchaininfo result used by
+// the client.
+type bitcoindChainInfo struct {
+	Chain         string `json:"chain"`
+	Blocks        int32  `json:"blocks"`
+	BestBlockHash string `json:"bestblockhash"`
+}
+
+// bitcoindChainNames maps the networks to the names bitcoind reports them by.
+var bitcoindChainNames = map[wire.BitcoinNet]string{
+	chaincfg.MainNetParams.Net:       "main",
+	chaincfg.TestNet3Params.Net:      "test",
+	chaincfg.RegressionNetParams.Net: "regtest",
+	chaincfg.SigNetParams.Net:        "signet",
+}
+
+func (c *BitcoindClient) chainInfo() (*bitcoindChainInfo, error) {
+	res, err := c.RawRequest("getblockchaininfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	var info bitcoindChainInfo
+	if err := json.Unmarshal(res, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Start checks that the node is on the network of the client, then starts
+// delivering notifications from the current best block on.
+func (c *BitcoindClient) Start() error {
+	info, err := c.chainInfo()
+	if err != nil {
+		return err
+	}
+	if info.Chain != bitcoindChainNames[c.cfg.ChainParams.Net] {
+		return fmt.Errorf("mismatched networks: bitcoind is on %v, "+
+			"expected %v", info.Chain, c.cfg.ChainParams.Name)
+	}
+
+	hash, err := chainhash.NewHashFromStr(info.BestBlockHash)
+	if err != nil {
+		return err
+	}
+	header, err := c.GetBlockHeader(hash)
+	if err != nil {
+		return err
+	}
+	c.tip = wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: *hash, Height: info.Blocks},
+		Time:  header.Timestamp,
+	}
+
+	var blocks, txs <-chan []byte
+	if c.cfg.ZMQBlockHost != "" {
+		blocks = c.subscribe(c.cfg.ZMQBlockHost, "rawblock")
+	}
+	if c.cfg.ZMQTxHost != "" {
+		txs = c.subscribe(c.cfg.ZMQTxHost, "rawtx")
+	}
+
+	c.wg.Add(1)
+	go c.notificationHandler(blocks, txs)
+
+	c.notify(ClientConnected{})
+	return nil
+}
+
+// subscribe subscribes to the ZMQ topic published at the address, returning
+// the channel the message bodies are delivered on. A nil channel is returned
+// if the subscription failed, in which case the node is polled instead.
+func (c *BitcoindClient) subscribe(addr, topic string) <-chan []byte {
+	conn, err := gozmq.Subscribe(addr, []string{topic}, zmqReadTimeout)
+	if err != nil {
+		fmt.Printf("Unable to subscribe to %s notifications at %s, "+
+			"polling bitcoind instead: %v \n", topic, addr, err)
+		return nil
+	}
+
+	c.quitMtx.Lock()
+	c.zmqConns = append(c.zmqConns, conn)
+	c.quitMtx.Unlock()
+
+	bodies := make(chan []byte)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for {
+			// Messages are made of the topic, the body and a
+			// sequence number.
+			msg, err := conn.Receive(nil)
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			var netErr interface{ Timeout() bool }
+			switch {
+			case err == io.EOF:
+				return
+			case errors.As(err, &netErr) && netErr.Timeout():
+				// Timeouts are returned when nothing was
+				// published, and after reconnecting.
+				continue
+			case err != nil:
+				fmt.Printf("Unable to receive %s notification: "+
+					"%v \n", topic, err)
+				continue
+			}
+			if len(msg) < 2 || string(msg[0]) != topic {
+				continue
+			}
+
+			select {
+			case bodies <- msg[1]:
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+	return bodies
+}
+
+// notificationHandler reconciles the tip of the client with the node whenever
+// a block is published or the poll interval elapses, and reports the relevant
+// transactions entering the mempool.
+func (c *BitcoindClient) notificationHandler(blocks, txs <-chan []byte) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-blocks:
+			// The published block is fetched again while
+			// reconciling, along with any block missed before it.
+			c.reconcileTip()
+
+		case body := <-txs:
+			var tx wire.MsgTx
+			if err := tx.Deserialize(bytes.NewReader(body)); err != nil {
+				fmt.Printf("Unable to decode rawtx notification: "+
+					"%v \n", err)
+				continue
+			}
+			c.notifyTx(&tx, nil)
+
+		case <-ticker.C:
+			if blocks == nil {
+				c.reconcileTip()
+			}
+			if txs == nil {
+				c.pollMempool()
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// reconcileTip disconnects the reported blocks the node no longer has in its
+// best chain, then connects the blocks of its best chain following them.
+func (c *BitcoindClient) reconcileTip() {
+	if err := c.reconcile(); err != nil {
+		fmt.Printf("Unable to sync with bitcoind: %v \n", err)
+	}
+}
+
+func (c *BitcoindClient) reconcile() error {
+	info, err := c.chainInfo()
+	if err != nil {
+		return err
+	}
+	if info.BestBlockHash == c.tip.Hash.String() {
+		return nil
+	}
+
+	for c.tip.Height > 0 {
+		if c.tip.Height <= info.Blocks {
+			hash, err := c.GetBlockHash(int64(c.tip.Height))
+			if err != nil {
+				return err
+			}
+			if *hash == c.tip.Hash {
+				break
+			}
+		}
+
+		header, err := c.GetBlockHeader(&c.tip.Hash)
+		if err != nil {
+			return err
+		}
+		prevHeader, err := c.GetBlockHeader(&header.PrevBlock)
+		if err != nil {
+			return err
+		}
+		if c.blocksNotified() {
+			c.notify(BlockDisconnected(c.tip))
+		}
+		c.tip = wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{
+				Hash:   header.PrevBlock,
+				Height: c.tip.Height - 1,
+			},
+			Time: prevHeader.Timestamp,
+		}
+	}
+
+	for height := c.tip.Height + 1; height <= info.Blocks; height++ {
+		hash, err := c.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		block, err := c.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		meta := wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  block.Header.Timestamp,
+		}
+
+		for _, tx := range block.Transactions {
+			c.notifyTx(tx, &meta)
+		}
+		if c.blocksNotified() {
+			c.notify(BlockConnected(meta))
+		}
+		c.tip = meta
+	}
+	return nil
+}
+
+// pollMempool reports the relevant transactions that entered the mempool
+// since the last poll.
+func (c *BitcoindClient) pollMempool() {
+	hashes, err := c.GetRawMempool()
+	if err != nil {
+		fmt.Printf("Unable to poll bitcoind mempool: %v \n", err)
+		return
+	}
+
+	mempool := make(map[chainhash.Hash]struct{}, len(hashes))
+	for _, hash := range hashes {
+		mempool[*hash] = struct{}{}
+		if _, ok := c.mempool[*hash]; ok {
+			continue
+		}
+
+		tx, err := c.GetRawTransaction(hash)
+		if err != nil {
+			// The transaction may have been mined or evicted
+			// since the mempool was listed.
+			continue
+		}
+		c.notifyTx(tx.MsgTx(), nil)
+	}
+	c.mempool = mempool
+}
+
+// notifyTx sends a RelevantTx notification if the transaction is relevant to
+// the watched set.
+func (c *BitcoindClient) notifyTx(tx *wire.MsgTx, block *wtxmgr.BlockMeta) {
+	c.watchMtx.Lock()
+	relevant := c.watched.relevantTx(tx)
+	c.watchMtx.Unlock()
+	if !relevant {
+		return
+	}
+
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+	if err != nil {
+		fmt.Printf("Cannot create transaction record for relevant "+
+			"tx: %v \n", err)
+		return
+	}
+	c.notify(RelevantTx{rec, block})
+}
+
+func (c *BitcoindClient) blocksNotified() bool {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	return c.notifyBlocks
+}
+
+// Stop signals the shutdown of all goroutines started by Start. The
+// notification channel is closed once the client has shut down.
+func (c *BitcoindClient) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+	for _, conn := range c.zmqConns {
+		conn.Close()
+	}
+	c.Client.Shutdown()
+
+	go func() {
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until all goroutines of the client have exited.
+func (c *BitcoindClient) WaitForShutdown() {
+	c.Client.WaitForShutdown()
+	c.wg.Wait()
+}
+
+// Notifications returns the channel notifications are delivered on.
+func (c *BitcoindClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// GetBestBlock returns the hash and height of the best block of the node.
+// bitcoind does not implement the getbestblock extension of btcd.
+func (c *BitcoindClient) GetBestBlock() (*chainhash.Hash, int32, error) {
+	info, err := c.chainInfo()
+	if err != nil {
+		return nil, 0, err
+	}
+	hash, err := chainhash.NewHashFromStr(info.BestBlockHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hash, info.Blocks, nil
+}
+
+// FilterBlocks scans the blocks of the request, which are fetched from the
+// node and filtered by the client.
+func (c *BitcoindClient) FilterBlocks(
+	req *FilterBlocksRequest) (*FilterBlocksResponse, error) {
+
+	return filterBlocks(c.cfg.ChainParams, req, c.GetBlock)
+}
+
+// SendRawTransaction broadcasts the transaction through bitcoind. The errors of
+// transactions it refuses wrap ErrTxRejected.
+func (c *BitcoindClient) SendRawTransaction(tx *wire.MsgTx,
+	allowHighFees bool) (*chainhash.Hash, error) {
+
+	hash, err := c.Client.SendRawTransaction(tx, allowHighFees)
+	if err != nil {
+		return nil, rpcTxRejection(err)
+	}
+	return hash, nil
+}
+
+// GetCompactFilter returns the basic compact filter of the block, which
+// bitcoind serves when started with -blockfilterindex.
+func (c *BitcoindClient) GetCompactFilter(
+	hash *chainhash.Hash) (*gcs.Filter, error) {
+
+	params := []json.RawMessage{
+		json.RawMessage(`"` + hash.String() + `"`),
+		json.RawMessage(`"basic"`),
+	}
+	res, err := c.RawRequest("getblockfilter", params)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) &&
+		strings.Contains(rpcErr.Message, "Index is not enabled") {
+
+		return nil, fmt.Errorf("%w: %v", ErrCompactFiltersUnavailable,
+			err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result btcjson.GetBlockFilterResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(result.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return gcs.FromNBytes(builder.DefaultP, builder.DefaultM, data)
+}
+
+// Rescan fetches the blocks of the best chain following startHash, reporting
+// the transactions relevant to the addresses and outpoints, followed by a
+// RescanFinished notification for the last block scanned.
+func (c *BitcoindClient) Rescan(startHash *chainhash.Hash,
+	addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	watched := newWatchedSet()
+	if err := watched.addAddrs(addrs); err != nil {
+		return err
+	}
+	if err := watched.addOutPoints(outPoints); err != nil {
+		return err
+	}
+
+	res, err := c.GetBlockHeaderVerbose(startHash)
+	if err != nil {
+		return err
+	}
+	_, bestHeight, err := c.GetBestBlock()
+	if err != nil {
+		return err
+	}
+
+	last := wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: *startHash, Height: res.Height},
+		Time:  time.Unix(res.Time, 0),
+	}
+	for height := res.Height + 1; height <= bestHeight; height++ {
+		hash, err := c.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		block, err := c.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		meta := wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  block.Header.Timestamp,
+		}
+
+		txs, err := watched.filterBlock(block)
+		if err != nil {
+			return err
+		}
+		for _, rec := range txs {
+			c.notify(RelevantTx{rec, &meta})
+		}
+		if len(txs) > 0 {
+			c.notify(RescanProgress{meta.Hash, meta.Height, meta.Time})
+		}
+		last = meta
+	}
+
+	c.notify(RescanFinished{last.Hash, last.Height, last.Time})
+	return nil
+}
+
+// NotifyReceived watches the addresses for payments, and the outputs paying
+// to them for spends.
+func (c *BitcoindClient) NotifyReceived(addrs []btcutil.Address) error {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	return c.watched.addAddrs(addrs)
+}
+
+// NotifyBlocks enables BlockConnected and BlockDisconnected notifications.
+func (c *BitcoindClient) NotifyBlocks() error {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	c.notifyBlocks = true
+	return nil
+}
+
+// notify sends a notification to the consumer, blocking while the buffer is
+// full. Notifications arriving after Stop are dropped.
+func (c *BitcoindClient) notify(n interface{}) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.notifications <- n:
+	case <-c.quit:
+	}
+}
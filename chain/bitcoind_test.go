@@ -0,0 +1,567 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBitcoind serves the JSON-RPC calls made by BitcoindClient from an
+// in-memory chain and mempool. Like bitcoind, it keeps serving the blocks
+// reorganized out of its best chain.
+type fakeBitcoind struct {
+	mu      sync.Mutex
+	chain   string
+	blocks  []*wire.MsgBlock
+	known   map[string]*wire.MsgBlock
+	heights map[string]int
+	mempool []*wire.MsgTx
+	forks   int
+}
+
+func newFakeBitcoind(chain string) *fakeBitcoind {
+	node := &fakeBitcoind{
+		chain:   chain,
+		known:   make(map[string]*wire.MsgBlock),
+		heights: make(map[string]int),
+	}
+	node.extend(node.newBlock(nil))
+	return node
+}
+
+// extend appends the block to the best chain.
+func (n *fakeBitcoind) extend(block *wire.MsgBlock) {
+	hash := block.BlockHash().String()
+	n.known[hash] = block
+	n.heights[hash] = len(n.blocks)
+	n.blocks = append(n.blocks, block)
+}
+
+// newBlock returns a block extending the tip. The header commits to the
+// number of reorgs so blocks of competing chains differ.
+func (n *fakeBitcoind) newBlock(txs []*wire.MsgTx) *wire.MsgBlock {
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: ^uint32(0)},
+		[]byte{byte(len(n.blocks))}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{txscript.OP_TRUE}))
+
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Timestamp: time.Unix(1700000000+int64(len(n.blocks))*600, 0),
+			Nonce:     uint32(n.forks),
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, txs...),
+	}
+	if len(n.blocks) > 0 {
+		block.Header.PrevBlock = n.blocks[len(n.blocks)-1].BlockHash()
+	}
+	return block
+}
+
+// addToMempool adds the transaction to the mempool.
+func (n *fakeBitcoind) addToMempool(tx *wire.MsgTx) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.mempool = append(n.mempool, tx)
+}
+
+// mine extends the chain with a block holding the transactions, removing
+// them from the mempool.
+func (n *fakeBitcoind) mine(txs ...*wire.MsgTx) *wire.MsgBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	mined := make(map[chainhash.Hash]struct{})
+	for _, tx := range txs {
+		mined[tx.TxHash()] = struct{}{}
+	}
+	var mempool []*wire.MsgTx
+	for _, tx := range n.mempool {
+		if _, ok := mined[tx.TxHash()]; !ok {
+			mempool = append(mempool, tx)
+		}
+	}
+	n.mempool = mempool
+
+	block := n.newBlock(txs)
+	n.extend(block)
+	return block
+}
+
+// reorg replaces the blocks from the height on by count empty blocks.
+func (n *fakeBitcoind) reorg(height, count int) []*wire.MsgBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.forks++
+	n.blocks = n.blocks[:height]
+	for i := 0; i < count; i++ {
+		n.extend(n.newBlock(nil))
+	}
+	return n.blocks[height:]
+}
+
+func (n *fakeBitcoind) block(hash string) (*wire.MsgBlock, int) {
+	return n.known[hash], n.heights[hash]
+}
+
+func serializeHex(msg interface{ Serialize(io.Writer) error }) string {
+	var buf bytes.Buffer
+	if err := msg.Serialize(&buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func (n *fakeBitcoind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+		ID     interface{}       `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var hashParam string
+	if len(req.Params) > 0 {
+		json.Unmarshal(req.Params[0], &hashParam)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var (
+		result interface{}
+		rpcErr interface{}
+	)
+	notFound := map[string]interface{}{
+		"code": -5, "message": "not found",
+	}
+	switch req.Method {
+	case "getblockchaininfo":
+		tip := n.blocks[len(n.blocks)-1]
+		result = map[string]interface{}{
+			"chain":         n.chain,
+			"blocks":        len(n.blocks) - 1,
+			"bestblockhash": tip.BlockHash().String(),
+		}
+
+	case "getblockhash":
+		var height int
+		json.Unmarshal(req.Params[0], &height)
+		if height < 0 || height >= len(n.blocks) {
+			rpcErr = notFound
+			break
+		}
+		result = n.blocks[height].BlockHash().String()
+
+	case "getblockheader":
+		block, height := n.block(hashParam)
+		var verbose bool
+		json.Unmarshal(req.Params[1], &verbose)
+		switch {
+		case block == nil:
+			rpcErr = notFound
+		case verbose:
+			result = map[string]interface{}{
+				"hash":   hashParam,
+				"height": height,
+				"time":   block.Header.Timestamp.Unix(),
+			}
+		default:
+			result = serializeHex(&block.Header)
+		}
+
+	case "getblock":
+		block, _ := n.block(hashParam)
+		if block == nil {
+			rpcErr = notFound
+			break
+		}
+		result = serializeHex(block)
+
+	case "getrawmempool":
+		txids := []string{}
+		for _, tx := range n.mempool {
+			txids = append(txids, tx.TxHash().String())
+		}
+		result = txids
+
+	case "getrawtransaction":
+		rpcErr = notFound
+		for _, tx := range n.mempool {
+			if tx.TxHash().String() == hashParam {
+				result, rpcErr = serializeHex(tx), nil
+			}
+		}
+
+	default:
+		rpcErr = map[string]interface{}{
+			"code": -32601, "message": "Method not found",
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result,
+		"error":  rpcErr,
+		"id":     req.ID,
+	})
+}
+
+// fakeZMQPublisher is a ZMQ publisher speaking enough of ZMTP 3.0 for the
+// subscriptions of BitcoindClient.
+type fakeZMQPublisher struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	seq   uint32
+
+	subscribed chan string
+}
+
+func newFakeZMQPublisher(t *testing.T) *fakeZMQPublisher {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	p := &fakeZMQPublisher{
+		listener:   listener,
+		conns:      make(map[string]net.Conn),
+		subscribed: make(chan string, 10),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handshake(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeZMQPublisher) addr() string {
+	return "tcp://" + p.listener.Addr().String()
+}
+
+func (p *fakeZMQPublisher) close() {
+	p.listener.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// handshake exchanges greetings and READY commands with a subscriber, then
+// reads its subscription.
+func (p *fakeZMQPublisher) handshake(conn net.Conn) {
+	greeting := make([]byte, 64)
+	copy(greeting, []byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0x7f, 3, 0})
+	copy(greeting[12:], "NULL")
+	if _, err := conn.Write(greeting); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+
+	ready := []byte{5}
+	ready = append(ready, "READY"...)
+	ready = append(ready, byte(len("Socket-Type")))
+	ready = append(ready, "Socket-Type"...)
+	ready = append(ready, 0, 0, 0, 3)
+	ready = append(ready, "PUB"...)
+	if err := writeZMQFrame(conn, 4, ready); err != nil {
+		return
+	}
+
+	// The READY command of the subscriber, then its subscription.
+	if _, err := readZMQFrame(conn); err != nil {
+		return
+	}
+	subscription, err := readZMQFrame(conn)
+	if err != nil || len(subscription) < 1 {
+		return
+	}
+	topic := string(subscription[1:])
+
+	p.mu.Lock()
+	p.conns[topic] = conn
+	p.mu.Unlock()
+	p.subscribed <- topic
+}
+
+// publish sends the body to the subscriber of the topic.
+func (p *fakeZMQPublisher) publish(t *testing.T, topic string, body []byte) {
+	t.Helper()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var seq [4]byte
+	binary.LittleEndian.PutUint32(seq[:], p.seq)
+	p.seq++
+
+	conn := p.conns[topic]
+	for i, part := range [][]byte{[]byte(topic), body, seq[:]} {
+		flag := byte(1)
+		if i == 2 {
+			flag = 0
+		}
+		if err := writeZMQFrame(conn, flag, part); err != nil {
+			t.Fatalf("unable to publish %s: %v", topic, err)
+		}
+	}
+}
+
+func writeZMQFrame(w io.Writer, flag byte, body []byte) error {
+	header := []byte{flag, byte(len(body))}
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flag | 2
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	}
+	if _, err := w.Write(append(header, body...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readZMQFrame(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	body := make([]byte, header[1])
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// startBitcoindClient starts a client for the node with the config, whose
+// chain parameters, host and credentials are filled in.
+func startBitcoindClient(t *testing.T, node *fakeBitcoind,
+	cfg BitcoindConfig) *BitcoindClient {
+
+	t.Helper()
+
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+
+	cfg.ChainParams = &chaincfg.RegressionNetParams
+	cfg.Host = strings.TrimPrefix(server.URL, "http://")
+	cfg.User, cfg.Pass = "user", "pass"
+	client, err := NewBitcoindClient(&cfg)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+		client.WaitForShutdown()
+	})
+	return client
+}
+
+// watch enables block notifications and watches the address.
+func watch(t *testing.T, client *BitcoindClient, addr btcutil.Address) {
+	t.Helper()
+
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NotifyReceived([]btcutil.Address{addr}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func blockMeta(block *wire.MsgBlock, height int32) wtxmgr.BlockMeta {
+	return wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: block.BlockHash(), Height: height},
+		Time:  block.Header.Timestamp,
+	}
+}
+
+func TestBitcoindClientPolling(t *testing.T) {
+	watched := testAddr(t, 1)
+	node := newFakeBitcoind("regtest")
+	client := startBitcoindClient(t, node, BitcoindConfig{
+		PollInterval: 10 * time.Millisecond,
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+	watch(t, client, watched)
+
+	// A payment entering the mempool is reported unmined.
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	node.addToMempool(payment)
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Nil(t, n.(RelevantTx).Block)
+	}
+
+	// Once mined it is reported again, before its block.
+	b1 := node.mine(payment)
+
+	n = nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, blockMeta(b1, 1), *n.(RelevantTx).Block)
+	}
+	assert.Equal(t, BlockConnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+
+	// A reorg disconnects the replaced block before connecting the
+	// blocks of the new chain.
+	reorged := node.reorg(1, 2)
+	assert.Equal(t, BlockDisconnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[0], 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[1], 2)),
+		nextNotification(t, client))
+
+	client.Stop()
+	client.WaitForShutdown()
+	select {
+	case _, ok := <-client.Notifications():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification channel not closed")
+	}
+}
+
+func TestBitcoindClientZMQ(t *testing.T) {
+	watched := testAddr(t, 1)
+	node := newFakeBitcoind("regtest")
+	publisher := newFakeZMQPublisher(t)
+	defer publisher.close()
+
+	// Polling is disabled in effect, so only the published messages
+	// trigger notifications.
+	client := startBitcoindClient(t, node, BitcoindConfig{
+		ZMQBlockHost: publisher.addr(),
+		ZMQTxHost:    publisher.addr(),
+		PollInterval: time.Hour,
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+	watch(t, client, watched)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-publisher.subscribed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not subscribe")
+		}
+	}
+
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	var buf bytes.Buffer
+	if err := payment.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	publisher.publish(t, "rawtx", buf.Bytes())
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Nil(t, n.(RelevantTx).Block)
+	}
+
+	b1 := node.mine(payment)
+	buf.Reset()
+	if err := b1.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	publisher.publish(t, "rawblock", buf.Bytes())
+
+	n = nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, blockMeta(b1, 1), *n.(RelevantTx).Block)
+	}
+	assert.Equal(t, BlockConnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+}
+
+func TestBitcoindClientRescan(t *testing.T) {
+	watched := testAddr(t, 1)
+	node := newFakeBitcoind("regtest")
+	genesis := node.blocks[0]
+	node.mine()
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	b2 := node.mine(payment)
+	b3 := node.mine()
+	client := startBitcoindClient(t, node, BitcoindConfig{
+		PollInterval: time.Hour,
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	genesisHash := genesis.BlockHash()
+	err := client.Rescan(&genesisHash, []btcutil.Address{watched}, nil)
+	if err != nil {
+		t.Fatalf("unable to rescan: %v", err)
+	}
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, blockMeta(b2, 2), *n.(RelevantTx).Block)
+	}
+	assert.Equal(t, RescanProgress{
+		Hash:   b2.BlockHash(),
+		Height: 2,
+		Time:   b2.Header.Timestamp,
+	}, nextNotification(t, client))
+	assert.Equal(t, RescanFinished{
+		Hash:   b3.BlockHash(),
+		Height: 3,
+		Time:   b3.Header.Timestamp,
+	}, nextNotification(t, client))
+}
+
+func TestBitcoindClientNetworkMismatch(t *testing.T) {
+	server := httptest.NewServer(newFakeBitcoind("main"))
+	defer server.Close()
+
+	client, err := NewBitcoindClient(&BitcoindConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		Host:        strings.TrimPrefix(server.URL, "http://"),
+		User:        "user",
+		Pass:        "pass",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	err = client.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched networks")
+	}
+}
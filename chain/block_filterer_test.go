@@ -0,0 +1,95 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+)
+
+func testAddr(t *testing.T, b byte) btcutil.Address {
+	t.Helper()
+
+	hash := make([]byte, 20)
+	hash[0] = b
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(
+		hash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("unable to create address: %v", err)
+	}
+	return addr
+}
+
+func payTo(t *testing.T, addr btcutil.Address) *wire.TxOut {
+	t.Helper()
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatalf("unable to create script: %v", err)
+	}
+	return wire.NewTxOut(1000, pkScript)
+}
+
+func TestBlockFilterer(t *testing.T) {
+	external := testAddr(t, 1)
+	internal := testAddr(t, 2)
+	watched := wire.OutPoint{Index: 7}
+	req := &FilterBlocksRequest{
+		ExternalAddrs: map[waddrmgr.ScopedIndex]btcutil.Address{
+			{Scope: waddrmgr.KeyScopeBIP0084, Index: 3}: external,
+		},
+		InternalAddrs: map[waddrmgr.ScopedIndex]btcutil.Address{
+			{Scope: waddrmgr.KeyScopeBIP0084, Index: 5}: internal,
+		},
+		WatchedOutPoints: map[wire.OutPoint]btcutil.Address{
+			watched: external,
+		},
+	}
+	bf := NewBlockFilterer(&chaincfg.RegressionNetParams, req)
+
+	unrelated := wire.NewMsgTx(2)
+	unrelated.AddTxOut(payTo(t, testAddr(t, 3)))
+	if bf.FilterBlock(&wire.MsgBlock{
+		Transactions: []*wire.MsgTx{unrelated},
+	}) {
+		t.Fatalf("unrelated block matched")
+	}
+
+	receive := wire.NewMsgTx(2)
+	receive.AddTxOut(payTo(t, testAddr(t, 3)))
+	receive.AddTxOut(payTo(t, internal))
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(wire.NewTxIn(&watched, nil, nil))
+	spend.AddTxOut(payTo(t, external))
+
+	block := &wire.MsgBlock{
+		Transactions: []*wire.MsgTx{unrelated, receive, spend},
+	}
+	if !bf.FilterBlock(block) {
+		t.Fatalf("relevant block did not match")
+	}
+	if len(bf.RelevantTxns) != 2 {
+		t.Fatalf("expected 2 relevant transactions, got %d",
+			len(bf.RelevantTxns))
+	}
+
+	scope := waddrmgr.KeyScopeBIP0084
+	if _, ok := bf.FoundExternal[scope][3]; !ok {
+		t.Fatalf("external address not found")
+	}
+	if _, ok := bf.FoundInternal[scope][5]; !ok {
+		t.Fatalf("internal address not found")
+	}
+	receiveOp := wire.OutPoint{Hash: receive.TxHash(), Index: 1}
+	addr, ok := bf.FoundOutPoints[receiveOp]
+	if !ok || addr.EncodeAddress() != internal.EncodeAddress() {
+		t.Fatalf("outpoint %v not found", receiveOp)
+	}
+	if len(bf.FoundOutPoints) != 2 {
+		t.Fatalf("expected 2 found outpoints, got %d",
+			len(bf.FoundOutPoints))
+	}
+}
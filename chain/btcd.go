@@ -2,16 +2,55 @@ package chain
 
 import (
 	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
 )
 
+// notificationBufferSize is the number of notifications the client buffers
+// before the rpcclient callbacks block on the consumer.
+const notificationBufferSize = 100
+
+// RPCClient represents a persistent client connection to a bitcoin RPC server
+// for information regarding the current best block chain.
 type RPCClient struct {
 	*rpcclient.Client
-	connConfig  *rpcclient.ConnConfig
-	chainParams *chaincfg.Params
+	connConfig        *rpcclient.ConnConfig
+	chainParams       *chaincfg.Params
+	reconnectAttempts int
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
 }
 
+// Enforce that RPCClient satisfies the chain.Interface interface.
+var _ Interface = (*RPCClient)(nil)
+
+// Enforce that RPCClient serves compact filters.
+var _ CompactFilterSource = (*RPCClient)(nil)
+
+// Enforce that RPCClient serves transactions.
+var _ TxSource = (*RPCClient)(nil)
+
+// NewRPCClient creates a client connection to the server described by the
+// connect string. If disableTLS is false, the remote RPC certificate must be
+// provided in the certs slice. The connection is not established immediately,
+// but must be done using the Start method. If the remote server does not
+// operate on the same bitcoin network as described by the passed chain
+// parameters, the connection will be disconnected.
 func NewRPCClient(chainParams *chaincfg.Params, connect, user, pass string, certs []byte,
 	disableTLS bool, reconnectAttempts int) (*RPCClient, error) {
 
@@ -30,16 +69,19 @@ func NewRPCClient(chainParams *chaincfg.Params, connect, user, pass string, cert
 			DisableConnectOnNew:  true,
 			DisableTLS:           disableTLS,
 		},
-		chainParams: chainParams,
+		chainParams:       chainParams,
+		reconnectAttempts: reconnectAttempts,
+		notifications:     make(chan interface{}, notificationBufferSize),
+		quit:              make(chan struct{}),
 	}
 	ntfnCallbacks := &rpcclient.NotificationHandlers{
-		OnClientConnected:   nil,
-		OnBlockConnected:    nil,
-		OnBlockDisconnected: nil,
-		OnRecvTx:            nil,
-		OnRedeemingTx:       nil,
-		OnRescanFinished:    nil,
-		OnRescanProgress:    nil,
+		OnClientConnected:   client.onClientConnect,
+		OnBlockConnected:    client.onBlockConnected,
+		OnBlockDisconnected: client.onBlockDisconnected,
+		OnRecvTx:            client.onRecvTx,
+		OnRedeemingTx:       client.onRedeemingTx,
+		OnRescanFinished:    client.onRescanFinished,
+		OnRescanProgress:    client.onRescanProgress,
 	}
 	rpcClient, err := rpcclient.New(client.connConfig, ntfnCallbacks)
 	if err != nil {
@@ -48,3 +90,223 @@ func NewRPCClient(chainParams *chaincfg.Params, connect, user, pass string, cert
 	client.Client = rpcClient
 	return client, nil
 }
+
+// Start attempts to establish a client connection with the remote server.
+// If successful, the server's network is checked against the chain
+// parameters of the client, and the connection is closed if they differ.
+func (c *RPCClient) Start() error {
+	err := c.Connect(c.reconnectAttempts)
+	if err != nil {
+		return err
+	}
+
+	// Verify that the server is running on the expected network.
+	net, err := c.GetCurrentNet()
+	if err != nil {
+		c.Disconnect()
+		return err
+	}
+	if net != c.chainParams.Net {
+		c.Disconnect()
+		return fmt.Errorf("mismatched networks: server is on %v, "+
+			"expected %v", net, c.chainParams.Net)
+	}
+
+	return nil
+}
+
+// Stop disconnects the client and signals the shutdown of all goroutines
+// started by Start. The notification channel is closed once the client has
+// shut down.
+func (c *RPCClient) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+	c.Client.Shutdown()
+
+	// No handler runs once the client has shut down, so the channel can
+	// be closed after the last of them returned.
+	go func() {
+		c.Client.WaitForShutdown()
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until both the client has finished disconnecting
+// and all handlers have exited.
+func (c *RPCClient) WaitForShutdown() {
+	c.Client.WaitForShutdown()
+	c.wg.Wait()
+}
+
+// Notifications returns a channel of parsed notifications sent by the remote
+// bitcoin RPC server. This channel must be continually read or the process
+// may abort for running out memory, as unread notifications are queued for
+// later reads.
+func (c *RPCClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// Rescan wraps the btcd rescan request, which takes the outpoints to watch as
+// a slice.
+func (c *RPCClient) Rescan(startHash *chainhash.Hash, addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	flatOutpoints := make([]*wire.OutPoint, 0, len(outPoints))
+	for ops := range outPoints {
+		ops := ops
+		flatOutpoints = append(flatOutpoints, &ops)
+	}
+
+	return c.Client.Rescan(startHash, addrs, flatOutpoints)
+}
+
+// FilterBlocks scans the blocks contained in the FilterBlocksRequest for any
+// addresses of interest. For each requested block, the corresponding block is
+// fetched and filtered. When a block containing relevant addresses or
+// outpoints is found, the scan stops and the relevant transactions and the
+// index of the block are returned, so the caller can update its watched set
+// before resuming with the following block.
+func (c *RPCClient) FilterBlocks(
+	req *FilterBlocksRequest) (*FilterBlocksResponse, error) {
+
+	return filterBlocks(c.chainParams, req, c.GetBlock)
+}
+
+// SendRawTransaction broadcasts the transaction through btcd. The errors of
+// transactions it refuses wrap ErrTxRejected.
+func (c *RPCClient) SendRawTransaction(tx *wire.MsgTx,
+	allowHighFees bool) (*chainhash.Hash, error) {
+
+	hash, err := c.Client.SendRawTransaction(tx, allowHighFees)
+	if err != nil {
+		return nil, rpcTxRejection(err)
+	}
+	return hash, nil
+}
+
+// GetCompactFilter returns the basic compact filter of the block, which
+// btcd serves unless started without its filter index.
+func (c *RPCClient) GetCompactFilter(
+	hash *chainhash.Hash) (*gcs.Filter, error) {
+
+	msg, err := c.GetCFilter(hash, wire.GCSFilterRegular)
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCNoCFIndex {
+		return nil, fmt.Errorf("%w: %v", ErrCompactFiltersUnavailable,
+			err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gcs.FromNBytes(builder.DefaultP, builder.DefaultM, msg.Data)
+}
+
+// notify sends a notification to the consumer, blocking while the buffer is
+// full. Notifications arriving after Stop are dropped.
+func (c *RPCClient) notify(n interface{}) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.notifications <- n:
+	case <-c.quit:
+	}
+}
+
+func (c *RPCClient) onClientConnect() {
+	c.notify(ClientConnected{})
+}
+
+func (c *RPCClient) onBlockConnected(hash *chainhash.Hash, height int32,
+	t time.Time) {
+
+	c.notify(BlockConnected{
+		Block: wtxmgr.Block{
+			Hash:   *hash,
+			Height: height,
+		},
+		Time: t,
+	})
+}
+
+func (c *RPCClient) onBlockDisconnected(hash *chainhash.Hash, height int32,
+	t time.Time) {
+
+	c.notify(BlockDisconnected{
+		Block: wtxmgr.Block{
+			Hash:   *hash,
+			Height: height,
+		},
+		Time: t,
+	})
+}
+
+func (c *RPCClient) onRecvTx(tx *btcutil.Tx, block *btcjson.BlockDetails) {
+	blk, err := parseBlock(block)
+	if err != nil {
+		// Log and drop improper notification.
+		fmt.Printf("recvtx notification bad block: %v \n", err)
+		return
+	}
+
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx.MsgTx(), time.Now())
+	if err != nil {
+		fmt.Printf("Cannot create transaction record for relevant "+
+			"tx: %v \n", err)
+		return
+	}
+	c.notify(RelevantTx{rec, blk})
+}
+
+func (c *RPCClient) onRedeemingTx(tx *btcutil.Tx, block *btcjson.BlockDetails) {
+	// Handled exactly like recvtx notifications.
+	c.onRecvTx(tx, block)
+}
+
+func (c *RPCClient) onRescanProgress(hash *chainhash.Hash, height int32,
+	blkTime time.Time) {
+
+	c.notify(RescanProgress{*hash, height, blkTime})
+}
+
+func (c *RPCClient) onRescanFinished(hash *chainhash.Hash, height int32,
+	blkTime time.Time) {
+
+	c.notify(RescanFinished{*hash, height, blkTime})
+}
+
+// parseBlock parses a btcws definition of the block a tx is mined it to the
+// Block structure of the wtxmgr package, and the block index. This is done
+// here since rpcclient doesn't parse this nicely for us.
+func parseBlock(block *btcjson.BlockDetails) (*wtxmgr.BlockMeta, error) {
+	if block == nil {
+		return nil, nil
+	}
+	blkHash, err := chainhash.NewHashFromStr(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+	blk := &wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{
+			Height: block.Height,
+			Hash:   *blkHash,
+		},
+		Time: time.Unix(block.Time, 0),
+	}
+	return blk, nil
+}
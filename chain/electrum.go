@@ -0,0 +1,1264 @@
+package chain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+const (
+	// electrumProtocolVersion is the version of the Electrum protocol
+	// negotiated with the server.
+	electrumProtocolVersion = "1.4"
+
+	// defaultElectrumTimeout is how long a request waits for the response
+	// of the server.
+	defaultElectrumTimeout = 30 * time.Second
+
+	// electrumPingInterval is how often the server is pinged, as servers
+	// drop idle connections.
+	electrumPingInterval = time.Minute
+
+	// maxElectrumHeaders is the most headers a server returns for one
+	// blockchain.block.headers request.
+	maxElectrumHeaders = 2016
+)
+
+// ErrElectrumClosed is returned by requests made after the connection to the
+// Electrum server was closed.
+var ErrElectrumClosed = errors.New("electrum server connection closed")
+
+// ElectrumConfig describes the connection to an Electrum server, such as
+// Electrs or Fulcrum.
+type ElectrumConfig struct {
+	// ChainParams are the parameters of the network the server must
+	// serve.
+	ChainParams *chaincfg.Params
+
+	// Server is the host:port of the server.
+	Server string
+
+	// TLSConfig enables TLS for the connection when set.
+	TLSConfig *tls.Config
+
+	// Timeout is how long requests wait for the response of the server.
+	Timeout time.Duration
+}
+
+// ElectrumClient is a chain client backed by an Electrum server. The server
+// indexes transactions by the hash of the scripts they pay to or spend from,
+// and notifies the client of new headers and of changes to the history of the
+// scripts it subscribed to. Confirmed transactions are only reported once
+// their merkle proof is verified against the header of their block.
+//
+// Electrum servers do not serve full blocks, so GetBlock returns the header
+// of a block along with the watched transactions confirmed in it. Only the
+// addresses passed to NotifyReceived are watched.
+type ElectrumClient struct {
+	cfg ElectrumConfig
+
+	conn     net.Conn
+	writeMtx sync.Mutex
+	nextID   uint64
+
+	// responses holds the channels the responses to pending requests are
+	// delivered on, by request id. connErr is set once the connection was
+	// lost, failing any later request.
+	responses map[uint64]chan *electrumMessage
+	connErr   error
+	respMtx   sync.Mutex
+
+	// updates queues the notifications of the server for the handler, so
+	// the connection is read while the handler makes requests.
+	updates      []*electrumMessage
+	updateSignal chan struct{}
+	updateMtx    sync.Mutex
+
+	// headers holds every header fetched from the server by hash, and
+	// bestChain the hashes of the blocks of the chain the client tracks
+	// by height, from firstHeight up to tip. Every header of the chain
+	// was checked to link to the next one and to carry its proof of
+	// work, and chainMtx serializes the changes to the chain. txHeights
+	// holds the watched transactions by the height they were reported
+	// at, zero for unmined ones, and statuses the watched script hashes
+	// along with their last known status.
+	headers      map[chainhash.Hash]*electrumHeader
+	bestChain    map[int32]chainhash.Hash
+	firstHeight  int32
+	tip          int32
+	chainMtx     sync.Mutex
+	txs          map[chainhash.Hash]*wire.MsgTx
+	txHeights    map[chainhash.Hash]int32
+	statuses     map[string]string
+	notifyBlocks bool
+	stateMtx     sync.Mutex
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
+}
+
+// Enforce that ElectrumClient satisfies the chain.Interface interface.
+var _ Interface = (*ElectrumClient)(nil)
+
+// Enforce that ElectrumClient serves transactions.
+var _ TxSource = (*ElectrumClient)(nil)
+
+// Enforce that ElectrumClient serves the fee histogram of its mempool.
+var _ chainfee.HistogramSource = (*ElectrumClient)(nil)
+
+// electrumHeader is a block header along with its height.
+type electrumHeader struct {
+	height int32
+	header wire.BlockHeader
+}
+
+// electrumMessage is a request, response or notification of the Electrum
+// protocol, which is JSON-RPC 2.0 with one message per line.
+type electrumMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *uint64         `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *ElectrumError  `json:"error,omitempty"`
+}
+
+// ElectrumError is an error returned by an Electrum server.
+type ElectrumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error satisfies the error interface.
+func (e *ElectrumError) Error() string {
+	return fmt.Sprintf("electrum error %d: %s", e.Code, e.Message)
+}
+
+// electrumHeaderResult is the tip of the server, as returned by and notified
+// for blockchain.headers.subscribe.
+type electrumHeaderResult struct {
+	Height int32  `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+// electrumHistoryItem is a transaction of the history of a script hash.
+// Unmined transactions have a height of zero, or -1 if they spend unmined
+// outputs.
+type electrumHistoryItem struct {
+	Height int32  `json:"height"`
+	TxHash string `json:"tx_hash"`
+}
+
+// electrumHeadersResult is a range of headers, as returned by
+// blockchain.block.headers.
+type electrumHeadersResult struct {
+	Count int32  `json:"count"`
+	Hex   string `json:"hex"`
+	Max   int32  `json:"max"`
+}
+
+// electrumMerkleResult is the merkle proof of a transaction.
+type electrumMerkleResult struct {
+	BlockHeight int32    `json:"block_height"`
+	Merkle      []string `json:"merkle"`
+	Pos         uint32   `json:"pos"`
+}
+
+// NewElectrumClient creates a client for the Electrum server described by the
+// config. No connection is made until Start is called.
+func NewElectrumClient(cfg *ElectrumConfig) *ElectrumClient {
+	electrumCfg := *cfg
+	if electrumCfg.Timeout <= 0 {
+		electrumCfg.Timeout = defaultElectrumTimeout
+	}
+
+	return &ElectrumClient{
+		cfg:           electrumCfg,
+		responses:     make(map[uint64]chan *electrumMessage),
+		updateSignal:  make(chan struct{}, 1),
+		headers:       make(map[chainhash.Hash]*electrumHeader),
+		bestChain:     make(map[int32]chainhash.Hash),
+		txs:           make(map[chainhash.Hash]*wire.MsgTx),
+		txHeights:     make(map[chainhash.Hash]int32),
+		statuses:      make(map[string]string),
+		notifications: make(chan interface{}, notificationBufferSize),
+		quit:          make(chan struct{}),
+	}
+}
+
+// Start connects to the server and checks that it serves the network of the
+// client, then subscribes to its headers.
+func (c *ElectrumClient) Start() error {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+	if c.cfg.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(
+			dialer, "tcp", c.cfg.Server, c.cfg.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.cfg.Server)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	c.wg.Add(1)
+	go c.readHandler()
+
+	if err := c.start(); err != nil {
+		c.Stop()
+		return err
+	}
+	return nil
+}
+
+func (c *ElectrumClient) start() error {
+	err := c.call("server.version", []interface{}{
+		"btc-wallet", electrumProtocolVersion,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var features struct {
+		GenesisHash string `json:"genesis_hash"`
+	}
+	if err := c.call("server.features", nil, &features); err != nil {
+		return err
+	}
+	if features.GenesisHash != c.cfg.ChainParams.GenesisHash.String() {
+		return fmt.Errorf("mismatched networks: server genesis block "+
+			"is %v, expected %v", features.GenesisHash,
+			c.cfg.ChainParams.GenesisHash)
+	}
+
+	var tip electrumHeaderResult
+	if err := c.call("blockchain.headers.subscribe", nil, &tip); err != nil {
+		return err
+	}
+	header, err := c.cacheHeader(tip.Hex, tip.Height)
+	if err != nil {
+		return err
+	}
+	if err := c.checkProofOfWork(header); err != nil {
+		return err
+	}
+	c.stateMtx.Lock()
+	c.firstHeight = tip.Height
+	c.tip = tip.Height
+	c.bestChain[tip.Height] = header.BlockHash()
+	c.stateMtx.Unlock()
+
+	c.wg.Add(1)
+	go c.notificationHandler()
+
+	c.notify(ClientConnected{})
+	return nil
+}
+
+// call sends a request to the server and decodes its result into result,
+// unless nil.
+func (c *ElectrumClient) call(method string, params []interface{},
+	result interface{}) error {
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	id := atomic.AddUint64(&c.nextID, 1)
+	req, err := json.Marshal(&electrumMessage{
+		JSONRPC: "2.0",
+		ID:      &id,
+		Method:  method,
+		Params:  rawParams,
+	})
+	if err != nil {
+		return err
+	}
+
+	respChan := make(chan *electrumMessage, 1)
+	c.respMtx.Lock()
+	if c.connErr != nil {
+		c.respMtx.Unlock()
+		return c.connErr
+	}
+	c.responses[id] = respChan
+	c.respMtx.Unlock()
+
+	defer func() {
+		c.respMtx.Lock()
+		delete(c.responses, id)
+		c.respMtx.Unlock()
+	}()
+
+	c.writeMtx.Lock()
+	_, err = c.conn.Write(append(req, '\n'))
+	c.writeMtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			return ErrElectrumClosed
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+
+	case <-time.After(c.cfg.Timeout):
+		return fmt.Errorf("electrum request %s timed out", method)
+
+	case <-c.quit:
+		return ErrElectrumClosed
+	}
+}
+
+// readHandler reads the messages of the server, delivering responses to the
+// pending requests and queueing notifications for the notification handler.
+func (c *ElectrumClient) readHandler() {
+	defer c.wg.Done()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			select {
+			case <-c.quit:
+			default:
+				fmt.Printf("Electrum server connection lost: "+
+					"%v \n", err)
+			}
+			c.failRequests()
+			return
+		}
+
+		var msg electrumMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			fmt.Printf("Unable to decode electrum message: %v \n",
+				err)
+			continue
+		}
+
+		if msg.ID == nil {
+			c.queueUpdate(&msg)
+			continue
+		}
+
+		c.respMtx.Lock()
+		respChan, ok := c.responses[*msg.ID]
+		c.respMtx.Unlock()
+		if ok {
+			respChan <- &msg
+		}
+	}
+}
+
+// queueUpdate queues a notification for the notification handler.
+func (c *ElectrumClient) queueUpdate(update *electrumMessage) {
+	c.updateMtx.Lock()
+	c.updates = append(c.updates, update)
+	c.updateMtx.Unlock()
+
+	select {
+	case c.updateSignal <- struct{}{}:
+	default:
+	}
+}
+
+// failRequests fails the pending and later requests once the connection is
+// lost.
+func (c *ElectrumClient) failRequests() {
+	c.respMtx.Lock()
+	defer c.respMtx.Unlock()
+
+	c.connErr = ErrElectrumClosed
+	for id, respChan := range c.responses {
+		close(respChan)
+		delete(c.responses, id)
+	}
+}
+
+// notificationHandler processes the notifications of the server in order.
+func (c *ElectrumClient) notificationHandler() {
+	defer c.wg.Done()
+
+	ping := time.NewTicker(electrumPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.updateSignal:
+			c.updateMtx.Lock()
+			updates := c.updates
+			c.updates = nil
+			c.updateMtx.Unlock()
+
+			for _, update := range updates {
+				if err := c.handleUpdate(update); err != nil {
+					fmt.Printf("Unable to process electrum "+
+						"%s notification: %v \n",
+						update.Method, err)
+				}
+			}
+
+		case <-ping.C:
+			if err := c.call("server.ping", nil, nil); err != nil {
+				fmt.Printf("Unable to ping electrum server: "+
+					"%v \n", err)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *ElectrumClient) handleUpdate(update *electrumMessage) error {
+	switch update.Method {
+	case "blockchain.headers.subscribe":
+		var params []electrumHeaderResult
+		if err := json.Unmarshal(update.Params, &params); err != nil {
+			return err
+		}
+		if len(params) == 0 {
+			return errors.New("missing header")
+		}
+		return c.reconcileTip(params[0].Height)
+
+	case "blockchain.scripthash.subscribe":
+		var params []*string
+		if err := json.Unmarshal(update.Params, &params); err != nil {
+			return err
+		}
+		if len(params) != 2 || params[0] == nil {
+			return errors.New("missing script hash")
+		}
+		var status string
+		if params[1] != nil {
+			status = *params[1]
+		}
+		return c.updateScriptHash(*params[0], status)
+	}
+	return nil
+}
+
+// reconcileTip disconnects the reported blocks the server no longer has in
+// its best chain, then connects the blocks of its best chain up to the
+// height. The headers connected must extend the tip and carry their proof
+// of work.
+func (c *ElectrumClient) reconcileTip(height int32) error {
+	c.chainMtx.Lock()
+	defer c.chainMtx.Unlock()
+
+	for {
+		c.stateMtx.Lock()
+		tip := c.tip
+		tipHash := c.bestChain[tip]
+		tipHeader := c.headers[tipHash]
+		c.stateMtx.Unlock()
+
+		if tip == 0 {
+			break
+		}
+		if tip <= height {
+			header, err := c.fetchHeader(tip)
+			if err != nil {
+				return err
+			}
+			if header.BlockHash() == tipHash {
+				break
+			}
+		}
+		if tip == c.firstHeight {
+			// The parent of the first block is needed to tell
+			// where the chain of the server forks.
+			if err := c.extendChainDown(tip - 1); err != nil {
+				return err
+			}
+		}
+
+		c.stateMtx.Lock()
+		delete(c.bestChain, tip)
+		c.tip--
+		for txHash, txHeight := range c.txHeights {
+			// The transactions are reported again once the
+			// server notifies their new status.
+			if txHeight == tip {
+				delete(c.txHeights, txHash)
+			}
+		}
+		notifyBlocks := c.notifyBlocks
+		c.stateMtx.Unlock()
+
+		if notifyBlocks {
+			c.notify(BlockDisconnected{
+				Block: wtxmgr.Block{Hash: tipHash, Height: tip},
+				Time:  tipHeader.header.Timestamp,
+			})
+		}
+	}
+
+	for {
+		c.stateMtx.Lock()
+		tip := c.tip
+		tipHash := c.bestChain[tip]
+		c.stateMtx.Unlock()
+
+		if tip >= height {
+			return nil
+		}
+
+		header, err := c.fetchHeader(tip + 1)
+		if err != nil {
+			return err
+		}
+		if header.PrevBlock != tipHash {
+			return fmt.Errorf("header %v at height %d does not "+
+				"extend %v", header.BlockHash(), tip+1, tipHash)
+		}
+		if err := c.checkProofOfWork(header); err != nil {
+			return err
+		}
+
+		c.stateMtx.Lock()
+		c.tip++
+		c.bestChain[c.tip] = header.BlockHash()
+		notifyBlocks := c.notifyBlocks
+		c.stateMtx.Unlock()
+
+		if notifyBlocks {
+			c.notify(BlockConnected{
+				Block: wtxmgr.Block{
+					Hash:   header.BlockHash(),
+					Height: tip + 1,
+				},
+				Time: header.Timestamp,
+			})
+		}
+	}
+}
+
+// updateScriptHash reports the transactions of the history of the script
+// hash that are new, or whose height changed, once its status changed.
+func (c *ElectrumClient) updateScriptHash(scriptHash, status string) error {
+	c.stateMtx.Lock()
+	if c.statuses[scriptHash] == status {
+		c.stateMtx.Unlock()
+		return nil
+	}
+	c.statuses[scriptHash] = status
+	c.stateMtx.Unlock()
+
+	history, err := c.history(scriptHash)
+	if err != nil {
+		return err
+	}
+	for _, item := range history {
+		txHash, err := chainhash.NewHashFromStr(item.TxHash)
+		if err != nil {
+			return err
+		}
+		height := item.Height
+		if height < 0 {
+			height = 0
+		}
+
+		c.stateMtx.Lock()
+		known, ok := c.txHeights[*txHash]
+		tip := c.tip
+		c.stateMtx.Unlock()
+		if ok && known == height {
+			continue
+		}
+
+		// The server may report a transaction before the header of
+		// its block.
+		if height > tip {
+			if err := c.reconcileTip(height); err != nil {
+				return err
+			}
+		}
+
+		tx, block, err := c.fetchTx(txHash, height)
+		if err != nil {
+			return err
+		}
+
+		c.stateMtx.Lock()
+		c.txHeights[*txHash] = height
+		c.stateMtx.Unlock()
+
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+		if err != nil {
+			return err
+		}
+		c.notify(RelevantTx{rec, block})
+	}
+	return nil
+}
+
+// cacheHeader decodes the hex encoded header at the height and caches it.
+func (c *ElectrumClient) cacheHeader(headerHex string,
+	height int32) (*wire.BlockHeader, error) {
+
+	b, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return nil, err
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+
+	c.stateMtx.Lock()
+	c.headers[header.BlockHash()] = &electrumHeader{
+		height: height,
+		header: header,
+	}
+	c.stateMtx.Unlock()
+
+	return &header, nil
+}
+
+// fetchHeader returns the header of the best chain of the server at the
+// height.
+func (c *ElectrumClient) fetchHeader(height int32) (*wire.BlockHeader, error) {
+	var headerHex string
+	err := c.call("blockchain.block.header", []interface{}{height},
+		&headerHex)
+	if err != nil {
+		return nil, err
+	}
+	return c.cacheHeader(headerHex, height)
+}
+
+// checkProofOfWork checks that the hash of the header meets the target of
+// its difficulty bits, within the proof of work limit of the network.
+func (c *ElectrumClient) checkProofOfWork(header *wire.BlockHeader) error {
+	block := btcutil.NewBlock(&wire.MsgBlock{Header: *header})
+	err := blockchain.CheckProofOfWork(block, c.cfg.ChainParams.PowLimit)
+	if err != nil {
+		return fmt.Errorf("invalid header %v: %w", header.BlockHash(),
+			err)
+	}
+	return nil
+}
+
+// chainHeader returns the header of the chain the client tracks at the
+// height. The chain is extended below its first block down to the height
+// with the headers of the server linking to it.
+func (c *ElectrumClient) chainHeader(height int32) (*wire.BlockHeader, error) {
+	c.chainMtx.Lock()
+	defer c.chainMtx.Unlock()
+
+	c.stateMtx.Lock()
+	tip := c.tip
+	c.stateMtx.Unlock()
+
+	if height < 0 || height > tip {
+		return nil, fmt.Errorf("height %d is beyond the tip %d of the "+
+			"chain", height, tip)
+	}
+	if err := c.extendChainDown(height); err != nil {
+		return nil, err
+	}
+
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	hash, ok := c.bestChain[height]
+	if !ok {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	header := c.headers[hash].header
+	return &header, nil
+}
+
+// extendChainDown extends the chain the client tracks below its first block
+// down to the height, with the headers of the server that link to it and
+// carry their proof of work. The caller must hold chainMtx.
+func (c *ElectrumClient) extendChainDown(height int32) error {
+	c.stateMtx.Lock()
+	firstHeight := c.firstHeight
+	c.stateMtx.Unlock()
+
+	for firstHeight > height {
+		start := firstHeight - maxElectrumHeaders
+		if start < height {
+			start = height
+		}
+		var result electrumHeadersResult
+		err := c.call("blockchain.block.headers", []interface{}{
+			start, firstHeight - start,
+		}, &result)
+		if err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(result.Hex)
+		if err != nil {
+			return err
+		}
+		if result.Count != firstHeight-start ||
+			len(b) != int(result.Count)*wire.MaxBlockHeaderPayload {
+
+			return fmt.Errorf("server returned %d headers from "+
+				"height %d, expected %d", result.Count, start,
+				firstHeight-start)
+		}
+
+		headers := make([]wire.BlockHeader, result.Count)
+		for i := range headers {
+			err := headers[i].Deserialize(bytes.NewReader(
+				b[i*wire.MaxBlockHeaderPayload:]))
+			if err != nil {
+				return err
+			}
+		}
+
+		// The headers are linked from the first block of the chain
+		// down.
+		c.stateMtx.Lock()
+		next := c.headers[c.bestChain[firstHeight]].header.PrevBlock
+		c.stateMtx.Unlock()
+		for i := len(headers) - 1; i >= 0; i-- {
+			hash := headers[i].BlockHash()
+			if hash != next {
+				return fmt.Errorf("header %v at height %d "+
+					"does not link to the chain", hash,
+					start+int32(i))
+			}
+			if err := c.checkProofOfWork(&headers[i]); err != nil {
+				return err
+			}
+			next = headers[i].PrevBlock
+		}
+
+		c.stateMtx.Lock()
+		for i := range headers {
+			hash := headers[i].BlockHash()
+			c.headers[hash] = &electrumHeader{
+				height: start + int32(i),
+				header: headers[i],
+			}
+			c.bestChain[start+int32(i)] = hash
+		}
+		c.firstHeight = start
+		c.stateMtx.Unlock()
+		firstHeight = start
+	}
+	return nil
+}
+
+// fetchTx returns the transaction, verifying it is included in the block of
+// the chain the client tracks at the height, unless zero. The block is
+// returned for mined transactions.
+func (c *ElectrumClient) fetchTx(txHash *chainhash.Hash,
+	height int32) (*wire.MsgTx, *wtxmgr.BlockMeta, error) {
+
+	c.stateMtx.Lock()
+	tx, ok := c.txs[*txHash]
+	c.stateMtx.Unlock()
+
+	if !ok {
+		var txHex string
+		err := c.call("blockchain.transaction.get",
+			[]interface{}{txHash.String()}, &txHex)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := hex.DecodeString(txHex)
+		if err != nil {
+			return nil, nil, err
+		}
+		tx = &wire.MsgTx{}
+		if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+			return nil, nil, err
+		}
+		if tx.TxHash() != *txHash {
+			return nil, nil, fmt.Errorf("server returned "+
+				"transaction %v for %v", tx.TxHash(), txHash)
+		}
+
+		c.stateMtx.Lock()
+		c.txs[*txHash] = tx
+		c.stateMtx.Unlock()
+	}
+	if height <= 0 {
+		return tx, nil, nil
+	}
+
+	header, err := c.chainHeader(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.verifyMerkleProof(txHash, height, header); err != nil {
+		return nil, nil, err
+	}
+	return tx, &wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: header.BlockHash(), Height: height},
+		Time:  header.Timestamp,
+	}, nil
+}
+
+// verifyMerkleProof checks the merkle proof of the server that the
+// transaction is included in the block with the header.
+func (c *ElectrumClient) verifyMerkleProof(txHash *chainhash.Hash,
+	height int32, header *wire.BlockHeader) error {
+
+	var proof electrumMerkleResult
+	err := c.call("blockchain.transaction.get_merkle",
+		[]interface{}{txHash.String(), height}, &proof)
+	if err != nil {
+		return err
+	}
+
+	root := *txHash
+	pos := proof.Pos
+	for _, branchHex := range proof.Merkle {
+		branch, err := chainhash.NewHashFromStr(branchHex)
+		if err != nil {
+			return err
+		}
+		if pos&1 == 1 {
+			root = blockchain.HashMerkleBranches(branch, &root)
+		} else {
+			root = blockchain.HashMerkleBranches(&root, branch)
+		}
+		pos >>= 1
+	}
+	if root != header.MerkleRoot {
+		return fmt.Errorf("invalid merkle proof for transaction %v in "+
+			"block %v", txHash, header.BlockHash())
+	}
+	return nil
+}
+
+// history returns the history of the script hash.
+func (c *ElectrumClient) history(
+	scriptHash string) ([]electrumHistoryItem, error) {
+
+	var history []electrumHistoryItem
+	err := c.call("blockchain.scripthash.get_history",
+		[]interface{}{scriptHash}, &history)
+	return history, err
+}
+
+// confirmedHistory returns the hashes of the confirmed transactions of the
+// histories of the addresses by height.
+func (c *ElectrumClient) confirmedHistory(
+	addrs []btcutil.Address) (map[int32][]chainhash.Hash, error) {
+
+	seen := make(map[chainhash.Hash]struct{})
+	txHashes := make(map[int32][]chainhash.Hash)
+	for _, addr := range addrs {
+		scriptHash, err := electrumScriptHash(addr)
+		if err != nil {
+			return nil, err
+		}
+		history, err := c.history(scriptHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range history {
+			if item.Height <= 0 {
+				continue
+			}
+			txHash, err := chainhash.NewHashFromStr(item.TxHash)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := seen[*txHash]; ok {
+				continue
+			}
+			seen[*txHash] = struct{}{}
+			txHashes[item.Height] = append(
+				txHashes[item.Height], *txHash)
+		}
+	}
+	return txHashes, nil
+}
+
+// electrumScriptHash returns the hash Electrum servers index the output
+// script of the address by, the reversed SHA256 of the script in hex.
+func electrumScriptHash(addr btcutil.Address) (string, error) {
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(script)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Stop closes the connection and signals the shutdown of all goroutines
+// started by Start. The notification channel is closed once the client has
+// shut down.
+func (c *ElectrumClient) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	go func() {
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until all goroutines of the client have exited.
+func (c *ElectrumClient) WaitForShutdown() {
+	c.wg.Wait()
+}
+
+// Notifications returns the channel notifications are delivered on.
+func (c *ElectrumClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// GetBestBlock returns the hash and height of the last block reported
+// connected.
+func (c *ElectrumClient) GetBestBlock() (*chainhash.Hash, int32, error) {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	hash := c.bestChain[c.tip]
+	return &hash, c.tip, nil
+}
+
+// GetBlockHash returns the hash of the block of the best chain of the server
+// at the height.
+func (c *ElectrumClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	header, err := c.fetchHeader(int32(height))
+	if err != nil {
+		return nil, err
+	}
+	hash := header.BlockHash()
+	return &hash, nil
+}
+
+// GetBlockHeader returns the header of the block. Electrum servers only serve
+// headers by height, so only the headers the client fetched before are
+// known.
+func (c *ElectrumClient) GetBlockHeader(
+	hash *chainhash.Hash) (*wire.BlockHeader, error) {
+
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	header, ok := c.headers[*hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown block %v", hash)
+	}
+	headerCopy := header.header
+	return &headerCopy, nil
+}
+
+// GetRawTransaction returns the transaction with the hash.
+func (c *ElectrumClient) GetRawTransaction(
+	txHash *chainhash.Hash) (*btcutil.Tx, error) {
+
+	tx, _, err := c.fetchTx(txHash, 0)
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.NewTx(tx), nil
+}
+
+// GetBlock returns the header of the block along with the watched
+// transactions confirmed in it. The block must be part of the best chain
+// reported by the client.
+func (c *ElectrumClient) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	c.stateMtx.Lock()
+	header, ok := c.headers[*hash]
+	if !ok || c.bestChain[header.height] != *hash {
+		c.stateMtx.Unlock()
+		return nil, fmt.Errorf("block %v is not part of the best chain",
+			hash)
+	}
+	var txHashes []chainhash.Hash
+	for txHash, height := range c.txHeights {
+		if height == header.height {
+			txHashes = append(txHashes, txHash)
+		}
+	}
+	c.stateMtx.Unlock()
+
+	return c.filteredBlock(header.height, txHashes)
+}
+
+// filteredBlock returns the block of the chain the client tracks at the
+// height, holding only the transactions.
+func (c *ElectrumClient) filteredBlock(height int32,
+	txHashes []chainhash.Hash) (*wire.MsgBlock, error) {
+
+	header, err := c.chainHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	block := &wire.MsgBlock{Header: *header}
+	for i := range txHashes {
+		tx, _, err := c.fetchTx(&txHashes[i], height)
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	return block, nil
+}
+
+// FilterBlocks scans the blocks of the request, made of the transactions of
+// the histories of the requested addresses confirmed in them.
+func (c *ElectrumClient) FilterBlocks(
+	req *FilterBlocksRequest) (*FilterBlocksResponse, error) {
+
+	var addrs []btcutil.Address
+	for _, addr := range req.ExternalAddrs {
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range req.InternalAddrs {
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range req.WatchedOutPoints {
+		addrs = append(addrs, addr)
+	}
+	txHashes, err := c.confirmedHistory(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	heights := make(map[chainhash.Hash]int32, len(req.Blocks))
+	for _, block := range req.Blocks {
+		heights[block.Hash] = block.Height
+	}
+	return filterBlocks(c.cfg.ChainParams, req, func(
+		hash *chainhash.Hash) (*wire.MsgBlock, error) {
+
+		height := heights[*hash]
+		if len(txHashes[height]) == 0 {
+			return nil, nil
+		}
+		block, err := c.filteredBlock(height, txHashes[height])
+		if err != nil {
+			return nil, err
+		}
+		if block.BlockHash() != *hash {
+			return nil, fmt.Errorf("block %v is not part of the "+
+				"best chain", hash)
+		}
+		return block, nil
+	})
+}
+
+// Rescan reports the confirmed transactions of the histories of the
+// addresses, and of the addresses of the outpoints, in the blocks following
+// startHash, followed by a RescanFinished notification for the tip. The whole
+// histories are reported if the start block is unknown to the client.
+func (c *ElectrumClient) Rescan(startHash *chainhash.Hash,
+	addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	for _, addr := range outPoints {
+		addrs = append(addrs, addr)
+	}
+	txHashes, err := c.confirmedHistory(addrs)
+	if err != nil {
+		return err
+	}
+
+	c.stateMtx.Lock()
+	var startHeight int32
+	if header, ok := c.headers[*startHash]; ok {
+		startHeight = header.height
+	}
+	tipHeight := c.tip
+	c.stateMtx.Unlock()
+
+	// The transactions of the blocks following the tip are reported once
+	// the blocks are connected.
+	heights := make([]int32, 0, len(txHashes))
+	for height := range txHashes {
+		if height > startHeight && height <= tipHeight {
+			heights = append(heights, height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool {
+		return heights[i] < heights[j]
+	})
+
+	for _, height := range heights {
+		var block *wtxmgr.BlockMeta
+		for i := range txHashes[height] {
+			var tx *wire.MsgTx
+			tx, block, err = c.fetchTx(&txHashes[height][i], height)
+			if err != nil {
+				return err
+			}
+			rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+			if err != nil {
+				return err
+			}
+			c.notify(RelevantTx{rec, block})
+		}
+		c.notify(RescanProgress{block.Hash, block.Height, block.Time})
+	}
+
+	c.stateMtx.Lock()
+	tipHash := c.bestChain[c.tip]
+	tip := RescanFinished{
+		Hash:   tipHash,
+		Height: c.tip,
+		Time:   c.headers[tipHash].header.Timestamp,
+	}
+	c.stateMtx.Unlock()
+
+	c.notify(tip)
+	return nil
+}
+
+// SendRawTransaction broadcasts the transaction through the server.
+// Electrum servers apply the fee checks of their node, and the errors of
+// transactions they refuse wrap ErrTxRejected.
+func (c *ElectrumClient) SendRawTransaction(tx *wire.MsgTx,
+	_ bool) (*chainhash.Hash, error) {
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	var txid string
+	err := c.call("blockchain.transaction.broadcast",
+		[]interface{}{hex.EncodeToString(buf.Bytes())}, &txid)
+	var electrumErr *ElectrumError
+	if errors.As(err, &electrumErr) {
+		return nil, fmt.Errorf("%w: %w", ErrTxRejected, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(txid)
+}
+
+// FeeHistogram returns the fee histogram of the mempool of the server.
+func (c *ElectrumClient) FeeHistogram() ([]chainfee.FeeHistogramBin, error) {
+	var histogram [][2]float64
+	err := c.call("mempool.get_fee_histogram", nil, &histogram)
+	if err != nil {
+		return nil, err
+	}
+	return feeHistogramBins(histogram), nil
+}
+
+// NotifyReceived subscribes to the script hashes of the addresses, reporting
+// the transactions of their histories, and later the changes to them.
+func (c *ElectrumClient) NotifyReceived(addrs []btcutil.Address) error {
+	for _, addr := range addrs {
+		scriptHash, err := electrumScriptHash(addr)
+		if err != nil {
+			return err
+		}
+
+		c.stateMtx.Lock()
+		_, ok := c.statuses[scriptHash]
+		if !ok {
+			c.statuses[scriptHash] = ""
+		}
+		c.stateMtx.Unlock()
+		if ok {
+			continue
+		}
+
+		var status *string
+		err = c.call("blockchain.scripthash.subscribe",
+			[]interface{}{scriptHash}, &status)
+		if err != nil {
+			return err
+		}
+		if status == nil {
+			continue
+		}
+
+		// The history is reported by the notification handler, in
+		// order with the notifications of the server.
+		params, err := json.Marshal([]interface{}{scriptHash, *status})
+		if err != nil {
+			return err
+		}
+		c.queueUpdate(&electrumMessage{
+			Method: "blockchain.scripthash.subscribe",
+			Params: params,
+		})
+	}
+	return nil
+}
+
+// NotifyBlocks enables BlockConnected and BlockDisconnected notifications.
+func (c *ElectrumClient) NotifyBlocks() error {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	c.notifyBlocks = true
+	return nil
+}
+
+// notify sends a notification to the consumer, blocking while the buffer is
+// full. Notifications arriving after Stop are dropped.
+func (c *ElectrumClient) notify(n interface{}) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.notifications <- n:
+	case <-c.quit:
+	}
+}
@@ -0,0 +1,714 @@
+package chain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeElectrum is an Electrum server indexing an in-memory chain and mempool.
+// Its subscribers are notified of the changes made through mine, reorg and
+// addToMempool.
+type fakeElectrum struct {
+	mu          sync.Mutex
+	genesisHash string
+	blocks      []*wire.MsgBlock
+	mempool     []*wire.MsgTx
+	txs         map[chainhash.Hash]*wire.MsgTx
+	forks       int
+	badProofs   bool
+	histogram   [][2]float64
+
+	listener net.Listener
+	conns    []*fakeElectrumConn
+}
+
+// fakeElectrumConn is a connection to the fake server, along with the script
+// hashes it subscribed to and their last notified status.
+type fakeElectrumConn struct {
+	conn     net.Conn
+	writeMtx sync.Mutex
+	headers  bool
+	statuses map[string]interface{}
+}
+
+func newFakeElectrum(t *testing.T, genesisHash string) *fakeElectrum {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	s := &fakeElectrum{
+		genesisHash: genesisHash,
+		txs:         make(map[chainhash.Hash]*wire.MsgTx),
+		listener:    listener,
+	}
+	s.blocks = append(s.blocks, s.newBlock(nil))
+	t.Cleanup(s.close)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := &fakeElectrumConn{
+				conn:     conn,
+				statuses: make(map[string]interface{}),
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeElectrum) close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// newBlock returns a block holding the transactions extending the tip, with
+// its proof of work. The header commits to the number of reorgs so blocks of
+// competing chains differ.
+func (s *fakeElectrum) newBlock(txs []*wire.MsgTx) *wire.MsgBlock {
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: ^uint32(0)},
+		[]byte{byte(len(s.blocks))}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{txscript.OP_TRUE}))
+
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   int32(s.forks),
+			Timestamp: time.Unix(1700000000+int64(len(s.blocks))*600, 0),
+			Bits:      chaincfg.RegressionNetParams.PowLimitBits,
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, txs...),
+	}
+	if len(s.blocks) > 0 {
+		block.Header.PrevBlock = s.blocks[len(s.blocks)-1].BlockHash()
+	}
+	block.Header.MerkleRoot = blockchain.CalcMerkleRoot(
+		btcutil.NewBlock(block).Transactions(), false)
+	for blockchain.CheckProofOfWork(btcutil.NewBlock(block),
+		chaincfg.RegressionNetParams.PowLimit) != nil {
+
+		block.Header.Nonce++
+	}
+
+	for _, tx := range block.Transactions {
+		s.txs[tx.TxHash()] = tx
+	}
+	return block
+}
+
+// addToMempool adds the transaction to the mempool.
+func (s *fakeElectrum) addToMempool(tx *wire.MsgTx) {
+	s.mu.Lock()
+	s.txs[tx.TxHash()] = tx
+	s.mempool = append(s.mempool, tx)
+	s.mu.Unlock()
+
+	s.notifySubscribers()
+}
+
+// mine extends the chain with a block holding the transactions, removing
+// them from the mempool.
+func (s *fakeElectrum) mine(txs ...*wire.MsgTx) *wire.MsgBlock {
+	s.mu.Lock()
+	block := s.newBlock(txs)
+	s.blocks = append(s.blocks, block)
+	s.removeFromMempool(txs)
+	s.mu.Unlock()
+
+	s.notifySubscribers()
+	return block
+}
+
+func (s *fakeElectrum) removeFromMempool(txs []*wire.MsgTx) {
+	mined := make(map[chainhash.Hash]struct{})
+	for _, tx := range txs {
+		mined[tx.TxHash()] = struct{}{}
+	}
+	var mempool []*wire.MsgTx
+	for _, tx := range s.mempool {
+		if _, ok := mined[tx.TxHash()]; !ok {
+			mempool = append(mempool, tx)
+		}
+	}
+	s.mempool = mempool
+}
+
+// reorg replaces the blocks from the height on by count empty blocks. The
+// transactions of the replaced blocks return to the mempool.
+func (s *fakeElectrum) reorg(height, count int) []*wire.MsgBlock {
+	s.mu.Lock()
+	for _, block := range s.blocks[height:] {
+		s.mempool = append(s.mempool, block.Transactions[1:]...)
+	}
+	s.forks++
+	s.blocks = s.blocks[:height]
+	for i := 0; i < count; i++ {
+		s.blocks = append(s.blocks, s.newBlock(nil))
+	}
+	blocks := s.blocks[height:]
+	s.mu.Unlock()
+
+	s.notifySubscribers()
+	return blocks
+}
+
+// pays returns whether the transaction pays to or spends from a script with
+// the script hash.
+func (s *fakeElectrum) pays(tx *wire.MsgTx, scriptHash string) bool {
+	matches := func(script []byte) bool {
+		hash := sha256.Sum256(script)
+		for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+			hash[i], hash[j] = hash[j], hash[i]
+		}
+		return hex.EncodeToString(hash[:]) == scriptHash
+	}
+	for _, txOut := range tx.TxOut {
+		if matches(txOut.PkScript) {
+			return true
+		}
+	}
+	for _, txIn := range tx.TxIn {
+		prevTx, ok := s.txs[txIn.PreviousOutPoint.Hash]
+		if !ok || int(txIn.PreviousOutPoint.Index) >= len(prevTx.TxOut) {
+			continue
+		}
+		if matches(prevTx.TxOut[txIn.PreviousOutPoint.Index].PkScript) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeElectrum) history(scriptHash string) []electrumHistoryItem {
+	history := []electrumHistoryItem{}
+	for height, block := range s.blocks {
+		for _, tx := range block.Transactions {
+			if s.pays(tx, scriptHash) {
+				history = append(history, electrumHistoryItem{
+					Height: int32(height),
+					TxHash: tx.TxHash().String(),
+				})
+			}
+		}
+	}
+	for _, tx := range s.mempool {
+		if s.pays(tx, scriptHash) {
+			history = append(history, electrumHistoryItem{
+				TxHash: tx.TxHash().String(),
+			})
+		}
+	}
+	return history
+}
+
+// status returns the status of the script hash, the hash of its history, or
+// nil if it has none.
+func (s *fakeElectrum) status(scriptHash string) interface{} {
+	history := s.history(scriptHash)
+	if len(history) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, item := range history {
+		fmt.Fprintf(&buf, "%s:%d:", item.TxHash, item.Height)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *fakeElectrum) tipResult() electrumHeaderResult {
+	tip := s.blocks[len(s.blocks)-1]
+	return electrumHeaderResult{
+		Height: int32(len(s.blocks) - 1),
+		Hex:    serializeHex(&tip.Header),
+	}
+}
+
+// merkleProof returns the merkle proof of the transaction in the block at
+// the height.
+func (s *fakeElectrum) merkleProof(txHash string,
+	height int) (*electrumMerkleResult, bool) {
+
+	if height < 0 || height >= len(s.blocks) {
+		return nil, false
+	}
+	txs := btcutil.NewBlock(s.blocks[height]).Transactions()
+	pos := -1
+	for i, tx := range txs {
+		if tx.Hash().String() == txHash {
+			pos = i
+		}
+	}
+	if pos < 0 {
+		return nil, false
+	}
+
+	store := blockchain.BuildMerkleTreeStore(txs, false)
+	proof := &electrumMerkleResult{
+		BlockHeight: int32(height),
+		Merkle:      []string{},
+		Pos:         uint32(pos),
+	}
+	width := (len(store) + 1) / 2
+	for offset, idx := 0, pos; width > 1; width /= 2 {
+		sibling := store[offset+(idx^1)]
+		if sibling == nil {
+			sibling = store[offset+idx]
+		}
+		proof.Merkle = append(proof.Merkle, sibling.String())
+		offset += width
+		idx /= 2
+	}
+	if s.badProofs {
+		proof.Merkle = append(proof.Merkle, chainhash.Hash{}.String())
+	}
+	return proof, true
+}
+
+// serve answers the requests of the connection.
+func (s *fakeElectrum) serve(c *fakeElectrumConn) {
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(line, &req); err != nil {
+			return
+		}
+		var param string
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params[0], &param)
+		}
+
+		s.mu.Lock()
+		var (
+			result interface{}
+			rpcErr *ElectrumError
+		)
+		notFound := &ElectrumError{Code: 1, Message: "not found"}
+		switch req.Method {
+		case "server.version":
+			result = []string{"fake", electrumProtocolVersion}
+
+		case "server.features":
+			result = map[string]interface{}{
+				"genesis_hash": s.genesisHash,
+			}
+
+		case "server.ping":
+
+		case "blockchain.headers.subscribe":
+			c.headers = true
+			result = s.tipResult()
+
+		case "blockchain.block.header":
+			var height int
+			json.Unmarshal(req.Params[0], &height)
+			if height < 0 || height >= len(s.blocks) {
+				rpcErr = notFound
+				break
+			}
+			result = serializeHex(&s.blocks[height].Header)
+
+		case "blockchain.block.headers":
+			var start, count int
+			json.Unmarshal(req.Params[0], &start)
+			json.Unmarshal(req.Params[1], &count)
+			if start < 0 || start+count > len(s.blocks) {
+				rpcErr = notFound
+				break
+			}
+			var headersHex string
+			for _, block := range s.blocks[start : start+count] {
+				headersHex += serializeHex(&block.Header)
+			}
+			result = electrumHeadersResult{
+				Count: int32(count),
+				Hex:   headersHex,
+				Max:   maxElectrumHeaders,
+			}
+
+		case "blockchain.scripthash.subscribe":
+			result = s.status(param)
+			c.statuses[param] = result
+
+		case "blockchain.scripthash.get_history":
+			result = s.history(param)
+
+		case "blockchain.transaction.get":
+			hash, err := chainhash.NewHashFromStr(param)
+			if err != nil || s.txs[*hash] == nil {
+				rpcErr = notFound
+				break
+			}
+			result = serializeHex(s.txs[*hash])
+
+		case "mempool.get_fee_histogram":
+			result = s.histogram
+
+		case "blockchain.transaction.get_merkle":
+			var height int
+			json.Unmarshal(req.Params[1], &height)
+			proof, ok := s.merkleProof(param, height)
+			if !ok {
+				rpcErr = notFound
+				break
+			}
+			result = proof
+
+		default:
+			rpcErr = &ElectrumError{Code: -32601, Message: "unknown method"}
+		}
+		s.mu.Unlock()
+
+		resp := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+		}
+		if rpcErr != nil {
+			resp["error"] = rpcErr
+		} else {
+			resp["result"] = result
+		}
+		c.send(resp)
+	}
+}
+
+func (c *fakeElectrumConn) send(msg interface{}) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	c.conn.Write(append(b, '\n'))
+}
+
+// notifySubscribers notifies the subscribers of the tip, then of the script
+// hashes whose status changed.
+func (s *fakeElectrum) notifySubscribers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		if c.headers {
+			c.send(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "blockchain.headers.subscribe",
+				"params":  []interface{}{s.tipResult()},
+			})
+		}
+		for scriptHash, last := range c.statuses {
+			status := s.status(scriptHash)
+			if status == last {
+				continue
+			}
+			c.statuses[scriptHash] = status
+			c.send(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "blockchain.scripthash.subscribe",
+				"params":  []interface{}{scriptHash, status},
+			})
+		}
+	}
+}
+
+func txHashes(txs ...*wire.MsgTx) []chainhash.Hash {
+	hashes := make([]chainhash.Hash, 0, len(txs))
+	for _, tx := range txs {
+		hashes = append(hashes, tx.TxHash())
+	}
+	return hashes
+}
+
+// startElectrumClient starts a client for the regression test network
+// connected to the server.
+func startElectrumClient(t *testing.T, s *fakeElectrum) *ElectrumClient {
+	t.Helper()
+
+	client := NewElectrumClient(&ElectrumConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		Server:      s.listener.Addr().String(),
+		Timeout:     5 * time.Second,
+	})
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+		client.WaitForShutdown()
+	})
+	return client
+}
+
+func TestElectrumClientNotifications(t *testing.T) {
+	watched := testAddr(t, 1)
+	server := newFakeElectrum(t,
+		chaincfg.RegressionNetParams.GenesisHash.String())
+	client := startElectrumClient(t, server)
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NotifyReceived([]btcutil.Address{watched}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A payment entering the mempool is reported unmined.
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	server.addToMempool(payment)
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Nil(t, n.(RelevantTx).Block)
+	}
+
+	// Once mined its block is reported, then the payment again along
+	// with it.
+	b1 := server.mine(payment)
+	assert.Equal(t, BlockConnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+	n = nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, blockMeta(b1, 1), *n.(RelevantTx).Block)
+	}
+
+	// The block served holds the header and the watched transactions.
+	b1Hash := b1.BlockHash()
+	block, err := client.GetBlock(&b1Hash)
+	if err != nil {
+		t.Fatalf("unable to get block: %v", err)
+	}
+	assert.Equal(t, b1.Header, block.Header)
+	assert.Equal(t, txHashes(payment), txHashes(block.Transactions...))
+
+	// A reorg disconnects the replaced block before connecting the
+	// blocks of the new chain, and the payment is reported unmined
+	// again.
+	reorged := server.reorg(1, 2)
+	assert.Equal(t, BlockDisconnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[0], 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[1], 2)),
+		nextNotification(t, client))
+	n = nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Nil(t, n.(RelevantTx).Block)
+	}
+
+	_, err = client.GetBlock(&b1Hash)
+	assert.Error(t, err)
+}
+
+// electrumTestChain returns a server whose chain holds a payment to the
+// address at height 2, among other transactions, so its merkle proof isn't
+// trivial.
+func electrumTestChain(t *testing.T, addr btcutil.Address) (*fakeElectrum,
+	*wire.MsgTx) {
+
+	server := newFakeElectrum(t,
+		chaincfg.RegressionNetParams.GenesisHash.String())
+	server.mine()
+	payment := spend(t, wire.OutPoint{Index: 1}, addr)
+	server.mine(
+		spend(t, wire.OutPoint{Index: 2}, testAddr(t, 2)),
+		spend(t, wire.OutPoint{Index: 3}, testAddr(t, 2)),
+		payment,
+		spend(t, wire.OutPoint{Index: 4}, testAddr(t, 2)),
+	)
+	server.mine()
+	return server, payment
+}
+
+func TestElectrumClientRescan(t *testing.T) {
+	watched := testAddr(t, 1)
+	server, payment := electrumTestChain(t, watched)
+	client := startElectrumClient(t, server)
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	b2, b3 := server.blocks[2], server.blocks[3]
+	genesisHash := server.blocks[0].BlockHash()
+	err := client.Rescan(&genesisHash, []btcutil.Address{watched}, nil)
+	if err != nil {
+		t.Fatalf("unable to rescan: %v", err)
+	}
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, blockMeta(b2, 2), *n.(RelevantTx).Block)
+	}
+	assert.Equal(t, RescanProgress{
+		Hash:   b2.BlockHash(),
+		Height: 2,
+		Time:   b2.Header.Timestamp,
+	}, nextNotification(t, client))
+	assert.Equal(t, RescanFinished{
+		Hash:   b3.BlockHash(),
+		Height: 3,
+		Time:   b3.Header.Timestamp,
+	}, nextNotification(t, client))
+}
+
+func TestElectrumClientFilterBlocks(t *testing.T) {
+	watched := testAddr(t, 1)
+	server, payment := electrumTestChain(t, watched)
+	client := startElectrumClient(t, server)
+
+	var blocks []wtxmgr.BlockMeta
+	for height, block := range server.blocks {
+		blocks = append(blocks, blockMeta(block, int32(height)))
+	}
+	resp, err := client.FilterBlocks(&FilterBlocksRequest{
+		Blocks: blocks,
+		ExternalAddrs: map[waddrmgr.ScopedIndex]btcutil.Address{
+			{Scope: waddrmgr.KeyScopeBIP0084, Index: 4}: watched,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to filter blocks: %v", err)
+	}
+
+	assert.Equal(t, uint32(2), resp.BatchIndex)
+	assert.Equal(t, txHashes(payment), txHashes(resp.RelevantTxns...))
+	assert.Contains(t,
+		resp.FoundExternalAddrs[waddrmgr.KeyScopeBIP0084], uint32(4))
+}
+
+func TestElectrumClientFeeHistogram(t *testing.T) {
+	server := newFakeElectrum(t,
+		chaincfg.RegressionNetParams.GenesisHash.String())
+	server.histogram = [][2]float64{{20.5, 120000}, {5, 800000}}
+	client := startElectrumClient(t, server)
+
+	histogram, err := client.FeeHistogram()
+	if err != nil {
+		t.Fatalf("unable to fetch fee histogram: %v", err)
+	}
+	assert.Equal(t, []chainfee.FeeHistogramBin{
+		{FeeRate: 20.5, VSize: 120000},
+		{FeeRate: 5, VSize: 800000},
+	}, histogram)
+}
+
+func TestElectrumClientInvalidMerkleProof(t *testing.T) {
+	watched := testAddr(t, 1)
+	server, _ := electrumTestChain(t, watched)
+	server.mu.Lock()
+	server.badProofs = true
+	server.mu.Unlock()
+	client := startElectrumClient(t, server)
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	genesisHash := server.blocks[0].BlockHash()
+	err := client.Rescan(&genesisHash, []btcutil.Address{watched}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid merkle proof")
+	}
+}
+
+func TestElectrumClientForgedBlock(t *testing.T) {
+	watched := testAddr(t, 1)
+	server, _ := electrumTestChain(t, watched)
+	client := startElectrumClient(t, server)
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	// The server serves a block of its own at height 1 paying to the
+	// address, along with a valid merkle proof, but the block doesn't
+	// link to the chain.
+	server.mu.Lock()
+	server.blocks = server.blocks[:1]
+	forged := server.newBlock([]*wire.MsgTx{
+		spend(t, wire.OutPoint{Index: 5}, watched),
+	})
+	server.blocks = append(server.blocks, forged)
+	server.blocks = append(server.blocks, server.newBlock(nil),
+		server.newBlock(nil))
+	server.mu.Unlock()
+
+	genesisHash := server.blocks[0].BlockHash()
+	err := client.Rescan(&genesisHash, []btcutil.Address{watched}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "does not link")
+	}
+}
+
+func TestElectrumClientInvalidProofOfWork(t *testing.T) {
+	server := newFakeElectrum(t,
+		chaincfg.RegressionNetParams.GenesisHash.String())
+	tip := server.mine()
+
+	// The tip of the server lacks the work its difficulty requires.
+	server.mu.Lock()
+	tip.Header.Bits = 0x1d00ffff
+	server.mu.Unlock()
+
+	client := NewElectrumClient(&ElectrumConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		Server:      server.listener.Addr().String(),
+	})
+	err := client.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid header")
+	}
+	client.WaitForShutdown()
+}
+
+func TestElectrumClientNetworkMismatch(t *testing.T) {
+	server := newFakeElectrum(t,
+		chaincfg.MainNetParams.GenesisHash.String())
+
+	client := NewElectrumClient(&ElectrumConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		Server:      server.listener.Addr().String(),
+	})
+	err := client.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched networks")
+	}
+	client.WaitForShutdown()
+}
@@ -0,0 +1,752 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+const (
+	// defaultEsploraPollInterval is how often the Esplora server is polled
+	// for new blocks and mempool transactions.
+	defaultEsploraPollInterval = 30 * time.Second
+
+	// esploraChainTxsPageSize is the number of confirmed transactions the
+	// Esplora server returns per page of the history of a script.
+	esploraChainTxsPageSize = 25
+
+	// esploraReorgDepth is the number of recent blocks the client keeps
+	// the reported hashes of. Deeper reorgs are only detected against the
+	// blocks the wallet synced through.
+	esploraReorgDepth = 10000
+
+	// esploraMempoolBatchSize is the most watched scripts whose mempool
+	// transactions are polled per interval. The API has no batch request,
+	// so each script costs one request. With more watched scripts, the
+	// following ones are polled at the next intervals, each script being
+	// polled once every ceil(scripts/esploraMempoolBatchSize) intervals.
+	esploraMempoolBatchSize = 100
+)
+
+// EsploraConfig describes the connection to an Esplora HTTP API.
+type EsploraConfig struct {
+	// ChainParams are the parameters of the network the server must
+	// serve.
+	ChainParams *chaincfg.Params
+
+	// URL is the base URL of the API, e.g. https://blockstream.info/api.
+	URL string
+
+	// PollInterval is how often the server is polled.
+	PollInterval time.Duration
+
+	// HTTPClient makes the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// SyncedBlockHash returns the hash of the block the wallet synced
+	// through at the height, as recorded by waddrmgr, failing with
+	// waddrmgr.ErrBlockNotFound for the heights it did not sync through.
+	// The hashes are compared against the server to detect the blocks a
+	// reorg replaced. Only the blocks the client reported are compared if
+	// nil.
+	SyncedBlockHash func(height int32) (*chainhash.Hash, error)
+}
+
+// EsploraClient is a chain client polling an Esplora HTTP API, which serves
+// blocks and the transactions of scripts without requiring a full node. New
+// blocks are learnt about by polling the tip of the server, and unmined
+// transactions by polling the mempool transactions of the watched scripts,
+// esploraMempoolBatchSize of them per poll.
+type EsploraClient struct {
+	cfg        EsploraConfig
+	httpClient *http.Client
+
+	// tip is the last block the client reported connected, and reported
+	// the hashes of the last reorgDepth blocks it reported connected by
+	// height. mempool holds the unmined transactions last seen for each
+	// watched script hash, and mempoolNext the index, in sorted order, of
+	// the script hash polled next. They are only accessed by the poll
+	// handler once the client started.
+	tip          wtxmgr.BlockMeta
+	reported     map[int32]chainhash.Hash
+	reorgDepth   int32
+	mempool      map[string]map[chainhash.Hash]struct{}
+	mempoolNext  int
+	mempoolBatch int
+
+	// watched holds the script hashes of the addresses passed to
+	// NotifyReceived.
+	watched      map[string]struct{}
+	notifyBlocks bool
+	watchMtx     sync.Mutex
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
+}
+
+// Enforce that EsploraClient satisfies the chain.Interface interface.
+var _ Interface = (*EsploraClient)(nil)
+
+// Enforce that EsploraClient serves transactions.
+var _ TxSource = (*EsploraClient)(nil)
+
+// Enforce that EsploraClient serves the fee histogram of its mempool.
+var _ chainfee.HistogramSource = (*EsploraClient)(nil)
+
+// esploraTx is a transaction as described by the Esplora API.
+type esploraTx struct {
+	TxID   string `json:"txid"`
+	Status struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight int32  `json:"block_height"`
+		BlockHash   string `json:"block_hash"`
+		BlockTime   int64  `json:"block_time"`
+	} `json:"status"`
+}
+
+// esploraBlock is a block as described by the Esplora API.
+type esploraBlock struct {
+	ID        string `json:"id"`
+	Height    int32  `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// NewEsploraClient creates a client for the Esplora API described by the
+// config. No request is made until Start is called.
+func NewEsploraClient(cfg *EsploraConfig) *EsploraClient {
+	esploraCfg := *cfg
+	esploraCfg.URL = strings.TrimSuffix(esploraCfg.URL, "/")
+	if esploraCfg.PollInterval <= 0 {
+		esploraCfg.PollInterval = defaultEsploraPollInterval
+	}
+	httpClient := esploraCfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &EsploraClient{
+		cfg:           esploraCfg,
+		httpClient:    httpClient,
+		reported:      make(map[int32]chainhash.Hash),
+		reorgDepth:    esploraReorgDepth,
+		mempool:       make(map[string]map[chainhash.Hash]struct{}),
+		mempoolBatch:  esploraMempoolBatchSize,
+		watched:       make(map[string]struct{}),
+		notifications: make(chan interface{}, notificationBufferSize),
+		quit:          make(chan struct{}),
+	}
+}
+
+// get requests the path of the API, returning the response body.
+func (c *EsploraClient) get(path string) ([]byte, error) {
+	resp, err := c.httpClient.Get(c.cfg.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	return readEsploraResponse(resp)
+}
+
+func readEsploraResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("esplora request %v failed: %v: %s",
+			resp.Request.URL.Path, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// getJSON requests the path of the API, decoding the response into v.
+func (c *EsploraClient) getJSON(path string, v interface{}) error {
+	body, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// getHash requests the path of the API, whose response is a hash.
+func (c *EsploraClient) getHash(path string) (*chainhash.Hash, error) {
+	body, err := c.get(path)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(strings.TrimSpace(string(body)))
+}
+
+// Start checks that the server serves the network of the client, then starts
+// polling it from its current tip on.
+func (c *EsploraClient) Start() error {
+	genesisHash, err := c.GetBlockHash(0)
+	if err != nil {
+		return err
+	}
+	if *genesisHash != *c.cfg.ChainParams.GenesisHash {
+		return fmt.Errorf("mismatched networks: server genesis block "+
+			"is %v, expected %v", genesisHash,
+			c.cfg.ChainParams.GenesisHash)
+	}
+
+	hash, height, err := c.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	header, err := c.GetBlockHeader(hash)
+	if err != nil {
+		return err
+	}
+	c.tip = wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: *hash, Height: height},
+		Time:  header.Timestamp,
+	}
+	c.reported[height] = *hash
+
+	c.wg.Add(1)
+	go c.pollHandler()
+
+	c.notify(ClientConnected{})
+	return nil
+}
+
+// pollHandler polls the server for new blocks and mempool transactions until
+// the client is stopped.
+func (c *EsploraClient) pollHandler() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.reconcile(); err != nil {
+				fmt.Printf("Unable to sync with esplora server: "+
+					"%v \n", err)
+			}
+			if err := c.pollMempool(); err != nil {
+				fmt.Printf("Unable to poll esplora mempool: %v \n",
+					err)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// knownHash returns the hash the block at the height is expected to have:
+// the one the client reported connected, or else the one the wallet synced
+// through. The reported hashes take precedence as the wallet may not have
+// processed the latest notifications yet. False is returned if neither is
+// known.
+func (c *EsploraClient) knownHash(height int32) (*chainhash.Hash, bool,
+	error) {
+
+	if hash, ok := c.reported[height]; ok {
+		return &hash, true, nil
+	}
+	if c.cfg.SyncedBlockHash == nil {
+		return nil, false, nil
+	}
+
+	hash, err := c.cfg.SyncedBlockHash(height)
+	switch {
+	case err == nil:
+		return hash, true, nil
+	case waddrmgr.IsError(err, waddrmgr.ErrBlockNotFound):
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// reconcile disconnects the blocks the server no longer has in its best
+// chain, walking back from the tip of the client until the hash the wallet
+// synced through, or the client reported, matches the server. The blocks of
+// the best chain of the server following them are connected.
+func (c *EsploraClient) reconcile() error {
+	bestHash, bestHeight, err := c.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	if *bestHash == c.tip.Hash {
+		return nil
+	}
+
+	height := c.tip.Height
+	for ; height > 0; height-- {
+		known, ok, err := c.knownHash(height)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Blocks below the first block known are trusted.
+			break
+		}
+		if height <= bestHeight {
+			hash, err := c.GetBlockHash(int64(height))
+			if err != nil {
+				return err
+			}
+			if *hash == *known {
+				break
+			}
+		}
+
+		// The server keeps serving the blocks reorganized out of its
+		// best chain, though the time is only informative.
+		var t time.Time
+		if header, err := c.GetBlockHeader(known); err == nil {
+			t = header.Timestamp
+		}
+		delete(c.reported, height)
+		if c.blocksNotified() {
+			c.notify(BlockDisconnected{
+				Block: wtxmgr.Block{Hash: *known, Height: height},
+				Time:  t,
+			})
+		}
+	}
+
+	if height < c.tip.Height {
+		hash, err := c.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		header, err := c.GetBlockHeader(hash)
+		if err != nil {
+			return err
+		}
+		c.tip = wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  header.Timestamp,
+		}
+	}
+
+	for height++; height <= bestHeight; height++ {
+		hash, err := c.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		header, err := c.GetBlockHeader(hash)
+		if err != nil {
+			return err
+		}
+
+		c.reported[height] = *hash
+		delete(c.reported, height-c.reorgDepth)
+		c.tip = wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  header.Timestamp,
+		}
+		if c.blocksNotified() {
+			c.notify(BlockConnected(c.tip))
+		}
+	}
+	return nil
+}
+
+// pollMempool reports the unmined transactions of the watched scripts that
+// entered the mempool since they were last polled. At most mempoolBatch
+// scripts are polled, the next ones being polled by the following call.
+func (c *EsploraClient) pollMempool() error {
+	c.watchMtx.Lock()
+	scriptHashes := make([]string, 0, len(c.watched))
+	for scriptHash := range c.watched {
+		scriptHashes = append(scriptHashes, scriptHash)
+	}
+	c.watchMtx.Unlock()
+	sort.Strings(scriptHashes)
+
+	if c.mempoolNext >= len(scriptHashes) {
+		c.mempoolNext = 0
+	}
+	batch := scriptHashes[c.mempoolNext:]
+	if len(batch) > c.mempoolBatch {
+		batch = batch[:c.mempoolBatch]
+	}
+	c.mempoolNext += len(batch)
+
+	for _, scriptHash := range batch {
+		var txs []esploraTx
+		err := c.getJSON("/scripthash/"+scriptHash+"/txs/mempool", &txs)
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[chainhash.Hash]struct{}, len(txs))
+		for _, tx := range txs {
+			txHash, err := chainhash.NewHashFromStr(tx.TxID)
+			if err != nil {
+				return err
+			}
+			if !c.seenUnmined(txHash) {
+				err := c.notifyTx(txHash, nil)
+				if err != nil {
+					return err
+				}
+			}
+			seen[*txHash] = struct{}{}
+		}
+		c.mempool[scriptHash] = seen
+	}
+	return nil
+}
+
+// seenUnmined returns whether the transaction was seen in the mempool by
+// the last poll of any watched script.
+func (c *EsploraClient) seenUnmined(txHash *chainhash.Hash) bool {
+	for _, seen := range c.mempool {
+		if _, ok := seen[*txHash]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyTx fetches the transaction and sends a RelevantTx notification for
+// it.
+func (c *EsploraClient) notifyTx(txHash *chainhash.Hash,
+	block *wtxmgr.BlockMeta) error {
+
+	tx, err := c.GetRawTransaction(txHash)
+	if err != nil {
+		return err
+	}
+
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx.MsgTx(), time.Now())
+	if err != nil {
+		return err
+	}
+	c.notify(RelevantTx{rec, block})
+	return nil
+}
+
+func (c *EsploraClient) blocksNotified() bool {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	return c.notifyBlocks
+}
+
+// Stop signals the shutdown of all goroutines started by Start. The
+// notification channel is closed once the client has shut down.
+func (c *EsploraClient) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+
+	go func() {
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until all goroutines of the client have exited.
+func (c *EsploraClient) WaitForShutdown() {
+	c.wg.Wait()
+}
+
+// Notifications returns the channel notifications are delivered on.
+func (c *EsploraClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// GetBestBlock returns the hash and height of the tip of the server.
+func (c *EsploraClient) GetBestBlock() (*chainhash.Hash, int32, error) {
+	hash, err := c.getHash("/blocks/tip/hash")
+	if err != nil {
+		return nil, 0, err
+	}
+	var block esploraBlock
+	if err := c.getJSON("/block/"+hash.String(), &block); err != nil {
+		return nil, 0, err
+	}
+	return hash, block.Height, nil
+}
+
+// GetBlockHash returns the hash of the block of the best chain of the server
+// at the height.
+func (c *EsploraClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	return c.getHash("/block-height/" + strconv.FormatInt(height, 10))
+}
+
+// GetBlockHeader returns the header of the block.
+func (c *EsploraClient) GetBlockHeader(
+	hash *chainhash.Hash) (*wire.BlockHeader, error) {
+
+	body, err := c.get("/block/" + hash.String() + "/header")
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	var header wire.BlockHeader
+	if err := header.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// GetBlock returns the block.
+func (c *EsploraClient) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	body, err := c.get("/block/" + hash.String() + "/raw")
+	if err != nil {
+		return nil, err
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	if block.BlockHash() != *hash {
+		return nil, fmt.Errorf("server returned block %v for %v",
+			block.BlockHash(), hash)
+	}
+	return &block, nil
+}
+
+// GetRawTransaction returns the transaction with the hash.
+func (c *EsploraClient) GetRawTransaction(
+	txHash *chainhash.Hash) (*btcutil.Tx, error) {
+
+	body, err := c.get("/tx/" + txHash.String() + "/hex")
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	if tx.TxHash() != *txHash {
+		return nil, fmt.Errorf("server returned transaction %v for %v",
+			tx.TxHash(), txHash)
+	}
+	return btcutil.NewTx(&tx), nil
+}
+
+// FilterBlocks scans the blocks of the request, which are fetched from the
+// server and filtered by the client.
+func (c *EsploraClient) FilterBlocks(
+	req *FilterBlocksRequest) (*FilterBlocksResponse, error) {
+
+	return filterBlocks(c.cfg.ChainParams, req, c.GetBlock)
+}
+
+// chainTxs returns the confirmed transactions of the history of the script
+// hash, newest first, paging through the history.
+func (c *EsploraClient) chainTxs(scriptHash string) ([]esploraTx, error) {
+	var txs []esploraTx
+	path := "/scripthash/" + scriptHash + "/txs/chain"
+	for {
+		var page []esploraTx
+		if err := c.getJSON(path, &page); err != nil {
+			return nil, err
+		}
+		txs = append(txs, page...)
+		if len(page) < esploraChainTxsPageSize {
+			return txs, nil
+		}
+		path = "/scripthash/" + scriptHash + "/txs/chain/" +
+			page[len(page)-1].TxID
+	}
+}
+
+// Rescan reports the confirmed transactions of the histories of the
+// addresses, and of the addresses of the outpoints, in the blocks following
+// startHash, followed by a RescanFinished notification for the tip.
+func (c *EsploraClient) Rescan(startHash *chainhash.Hash,
+	addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	var start esploraBlock
+	if err := c.getJSON("/block/"+startHash.String(), &start); err != nil {
+		return err
+	}
+
+	for _, addr := range outPoints {
+		addrs = append(addrs, addr)
+	}
+	seen := make(map[string]struct{})
+	var txs []esploraTx
+	for _, addr := range addrs {
+		scriptHash, err := electrumScriptHash(addr)
+		if err != nil {
+			return err
+		}
+		history, err := c.chainTxs(scriptHash)
+		if err != nil {
+			return err
+		}
+		for _, tx := range history {
+			if _, ok := seen[tx.TxID]; ok {
+				continue
+			}
+			seen[tx.TxID] = struct{}{}
+			if tx.Status.Confirmed && tx.Status.BlockHeight > start.Height {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Status.BlockHeight < txs[j].Status.BlockHeight
+	})
+
+	for i, tx := range txs {
+		txHash, err := chainhash.NewHashFromStr(tx.TxID)
+		if err != nil {
+			return err
+		}
+		blockHash, err := chainhash.NewHashFromStr(tx.Status.BlockHash)
+		if err != nil {
+			return err
+		}
+		block := &wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{
+				Hash:   *blockHash,
+				Height: tx.Status.BlockHeight,
+			},
+			Time: time.Unix(tx.Status.BlockTime, 0),
+		}
+		if err := c.notifyTx(txHash, block); err != nil {
+			return err
+		}
+
+		// Progress is reported once every transaction of the block
+		// was.
+		if i == len(txs)-1 ||
+			txs[i+1].Status.BlockHeight != block.Height {
+
+			c.notify(RescanProgress{
+				block.Hash, block.Height, block.Time,
+			})
+		}
+	}
+
+	hash, height, err := c.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	header, err := c.GetBlockHeader(hash)
+	if err != nil {
+		return err
+	}
+	c.notify(RescanFinished{*hash, height, header.Timestamp})
+	return nil
+}
+
+// SendRawTransaction broadcasts the transaction through the server. The
+// server applies the fee checks of its node, and answers the transactions it
+// refuses with a client error, which wraps ErrTxRejected.
+func (c *EsploraClient) SendRawTransaction(tx *wire.MsgTx,
+	_ bool) (*chainhash.Hash, error) {
+
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Post(c.cfg.URL+"/tx", "text/plain",
+		strings.NewReader(hex.EncodeToString(buf.Bytes())))
+	if err != nil {
+		return nil, err
+	}
+	rejected := resp.StatusCode == http.StatusBadRequest
+	body, err := readEsploraResponse(resp)
+	if err != nil && rejected {
+		return nil, fmt.Errorf("%w: %w", ErrTxRejected, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(strings.TrimSpace(string(body)))
+}
+
+// FeeHistogram returns the fee histogram of the mempool of the server.
+func (c *EsploraClient) FeeHistogram() ([]chainfee.FeeHistogramBin, error) {
+	var mempool struct {
+		FeeHistogram [][2]float64 `json:"fee_histogram"`
+	}
+	if err := c.getJSON("/mempool", &mempool); err != nil {
+		return nil, err
+	}
+	return feeHistogramBins(mempool.FeeHistogram), nil
+}
+
+// NotifyReceived watches the scripts of the addresses for unmined
+// transactions.
+func (c *EsploraClient) NotifyReceived(addrs []btcutil.Address) error {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	for _, addr := range addrs {
+		scriptHash, err := electrumScriptHash(addr)
+		if err != nil {
+			return err
+		}
+		c.watched[scriptHash] = struct{}{}
+	}
+	return nil
+}
+
+// NotifyBlocks enables BlockConnected and BlockDisconnected notifications.
+func (c *EsploraClient) NotifyBlocks() error {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	c.notifyBlocks = true
+	return nil
+}
+
+// notify sends a notification to the consumer, blocking while the buffer is
+// full. Notifications arriving after Stop are dropped.
+func (c *EsploraClient) notify(n interface{}) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.notifications <- n:
+	case <-c.quit:
+	}
+}
@@ -0,0 +1,513 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEsplora serves the Esplora API from the chain and mempool of a
+// fakeBitcoind, whose genesis block is the one of the network.
+type fakeEsplora struct {
+	*fakeBitcoind
+	mux *http.ServeMux
+
+	// mempoolPolls counts the requests for the mempool transactions of
+	// a script.
+	mempoolPolls int
+
+	// histogram is the fee histogram of the mempool.
+	histogram [][2]float64
+}
+
+func newFakeEsplora(genesis *wire.MsgBlock) *fakeEsplora {
+	node := &fakeBitcoind{
+		known:   make(map[string]*wire.MsgBlock),
+		heights: make(map[string]int),
+	}
+	node.extend(genesis)
+
+	s := &fakeEsplora{fakeBitcoind: node, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /blocks/tip/hash", s.tipHash)
+	s.mux.HandleFunc("GET /block-height/{height}", s.blockHash)
+	s.mux.HandleFunc("GET /block/{hash}", s.blockInfo)
+	s.mux.HandleFunc("GET /block/{hash}/header", s.blockHeader)
+	s.mux.HandleFunc("GET /block/{hash}/raw", s.rawBlock)
+	s.mux.HandleFunc("GET /scripthash/{sh}/txs/mempool", s.mempoolTxs)
+	s.mux.HandleFunc("GET /scripthash/{sh}/txs/chain", s.chainTxs)
+	s.mux.HandleFunc("GET /scripthash/{sh}/txs/chain/{last}", s.chainTxs)
+	s.mux.HandleFunc("GET /tx/{txid}/hex", s.txHex)
+	s.mux.HandleFunc("POST /tx", s.broadcast)
+	s.mux.HandleFunc("GET /mempool", s.mempoolInfo)
+	return s
+}
+
+func (s *fakeEsplora) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *fakeEsplora) tipHash(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprint(w, s.blocks[len(s.blocks)-1].BlockHash())
+}
+
+func (s *fakeEsplora) blockHash(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.Atoi(r.PathValue("height"))
+	if err != nil || height < 0 || height >= len(s.blocks) {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, s.blocks[height].BlockHash())
+}
+
+// knownBlock returns the block of the request, writing an error if it is
+// unknown.
+func (s *fakeEsplora) knownBlock(w http.ResponseWriter,
+	r *http.Request) (*wire.MsgBlock, int) {
+
+	block, height := s.block(r.PathValue("hash"))
+	if block == nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+	}
+	return block, height
+}
+
+func (s *fakeEsplora) blockInfo(w http.ResponseWriter, r *http.Request) {
+	if block, height := s.knownBlock(w, r); block != nil {
+		json.NewEncoder(w).Encode(esploraBlock{
+			ID:        block.BlockHash().String(),
+			Height:    int32(height),
+			Timestamp: block.Header.Timestamp.Unix(),
+		})
+	}
+}
+
+func (s *fakeEsplora) blockHeader(w http.ResponseWriter, r *http.Request) {
+	if block, _ := s.knownBlock(w, r); block != nil {
+		fmt.Fprint(w, serializeHex(&block.Header))
+	}
+}
+
+func (s *fakeEsplora) rawBlock(w http.ResponseWriter, r *http.Request) {
+	if block, _ := s.knownBlock(w, r); block != nil {
+		block.Serialize(w)
+	}
+}
+
+// pays returns whether an output of the transaction pays to the script of
+// the script hash of the request.
+func pays(tx *wire.MsgTx, r *http.Request) bool {
+	for _, txOut := range tx.TxOut {
+		hash := sha256.Sum256(txOut.PkScript)
+		for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+			hash[i], hash[j] = hash[j], hash[i]
+		}
+		if hex.EncodeToString(hash[:]) == r.PathValue("sh") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeEsplora) mempoolTxs(w http.ResponseWriter, r *http.Request) {
+	s.mempoolPolls++
+	txs := []esploraTx{}
+	for _, tx := range s.mempool {
+		if pays(tx, r) {
+			txs = append(txs, esploraTx{TxID: tx.TxHash().String()})
+		}
+	}
+	json.NewEncoder(w).Encode(txs)
+}
+
+// chainTxs serves the confirmed transactions paying to the script hash,
+// newest first, by pages following the last transaction seen.
+func (s *fakeEsplora) chainTxs(w http.ResponseWriter, r *http.Request) {
+	var txs []esploraTx
+	for height := len(s.blocks) - 1; height >= 0; height-- {
+		block := s.blocks[height]
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			if !pays(block.Transactions[i], r) {
+				continue
+			}
+			tx := esploraTx{TxID: block.Transactions[i].TxHash().String()}
+			tx.Status.Confirmed = true
+			tx.Status.BlockHeight = int32(height)
+			tx.Status.BlockHash = block.BlockHash().String()
+			tx.Status.BlockTime = block.Header.Timestamp.Unix()
+			txs = append(txs, tx)
+		}
+	}
+
+	if last := r.PathValue("last"); last != "" {
+		for i, tx := range txs {
+			if tx.TxID == last {
+				txs = txs[i+1:]
+				break
+			}
+		}
+	}
+	if len(txs) > esploraChainTxsPageSize {
+		txs = txs[:esploraChainTxsPageSize]
+	}
+	json.NewEncoder(w).Encode(append([]esploraTx{}, txs...))
+}
+
+func (s *fakeEsplora) txHex(w http.ResponseWriter, r *http.Request) {
+	txs := s.mempool
+	for _, block := range s.known {
+		txs = append(txs, block.Transactions...)
+	}
+	for _, tx := range txs {
+		if tx.TxHash().String() == r.PathValue("txid") {
+			fmt.Fprint(w, serializeHex(tx))
+			return
+		}
+	}
+	http.Error(w, "Transaction not found", http.StatusNotFound)
+}
+
+func (s *fakeEsplora) broadcast(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := hex.DecodeString(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(strings.NewReader(string(b))); err != nil {
+		http.Error(w, "sendrawtransaction RPC error: TX decode failed",
+			http.StatusBadRequest)
+		return
+	}
+	s.mempool = append(s.mempool, &tx)
+	fmt.Fprint(w, tx.TxHash())
+}
+
+func (s *fakeEsplora) mempoolInfo(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":         len(s.mempool),
+		"fee_histogram": s.histogram,
+	})
+}
+
+// newEsploraClient creates a client for the server with the config, whose
+// chain parameters and URL are filled in.
+func newEsploraClient(t *testing.T, s *fakeEsplora,
+	cfg EsploraConfig) *EsploraClient {
+
+	t.Helper()
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	cfg.ChainParams = &chaincfg.RegressionNetParams
+	cfg.URL = server.URL + "/"
+	client := NewEsploraClient(&cfg)
+	t.Cleanup(func() {
+		client.Stop()
+		client.WaitForShutdown()
+	})
+	return client
+}
+
+// startEsploraClient creates and starts a client for the server with the
+// config.
+func startEsploraClient(t *testing.T, s *fakeEsplora,
+	cfg EsploraConfig) *EsploraClient {
+
+	t.Helper()
+
+	client := newEsploraClient(t, s, cfg)
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	return client
+}
+
+func TestEsploraClientPolling(t *testing.T) {
+	watched := testAddr(t, 1)
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	client := startEsploraClient(t, s, EsploraConfig{
+		PollInterval: 10 * time.Millisecond,
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NotifyReceived([]btcutil.Address{watched}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A payment entering the mempool is reported unmined, once.
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	s.addToMempool(payment)
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Nil(t, n.(RelevantTx).Block)
+	}
+
+	// Its block is then reported connected, the wallet fetching the
+	// block to find the payment.
+	b1 := s.mine(payment)
+	assert.Equal(t, BlockConnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+
+	// A reorg disconnects the replaced block before connecting the
+	// blocks of the new chain.
+	reorged := s.reorg(1, 2)
+	assert.Equal(t, BlockDisconnected(blockMeta(b1, 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[0], 1)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockConnected(blockMeta(reorged[1], 2)),
+		nextNotification(t, client))
+
+	client.Stop()
+	client.WaitForShutdown()
+	select {
+	case _, ok := <-client.Notifications():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification channel not closed")
+	}
+}
+
+func TestEsploraClientReportedWindow(t *testing.T) {
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	client := newEsploraClient(t, s, EsploraConfig{
+		PollInterval: 10 * time.Millisecond,
+	})
+	client.reorgDepth = 2
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the hashes of the most recent blocks are kept.
+	var blocks []*wire.MsgBlock
+	for height := int32(1); height <= 5; height++ {
+		block := s.mine()
+		blocks = append(blocks, block)
+		assert.Equal(t, BlockConnected(blockMeta(block, height)),
+			nextNotification(t, client))
+	}
+	client.Stop()
+	client.WaitForShutdown()
+
+	assert.Equal(t, map[int32]chainhash.Hash{
+		4: blocks[3].BlockHash(),
+		5: blocks[4].BlockHash(),
+	}, client.reported)
+}
+
+func TestEsploraClientMempoolBatch(t *testing.T) {
+	watched := []btcutil.Address{testAddr(t, 1), testAddr(t, 2)}
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	client := newEsploraClient(t, s, EsploraConfig{})
+	client.mempoolBatch = 1
+	if err := client.NotifyReceived(watched); err != nil {
+		t.Fatal(err)
+	}
+	payments := map[chainhash.Hash]struct{}{}
+	for i, addr := range watched {
+		payment := spend(t, wire.OutPoint{Index: uint32(i)}, addr)
+		s.addToMempool(payment)
+		payments[payment.TxHash()] = struct{}{}
+	}
+
+	// Each poll requests the mempool transactions of a single script,
+	// reporting its payment.
+	for polls := 1; polls <= 2; polls++ {
+		if err := client.pollMempool(); err != nil {
+			t.Fatalf("unable to poll mempool: %v", err)
+		}
+		assert.Equal(t, polls, s.mempoolPolls)
+
+		n := nextNotification(t, client)
+		if assert.IsType(t, RelevantTx{}, n) {
+			txHash := n.(RelevantTx).TxRecord.Hash
+			assert.Contains(t, payments, txHash)
+			delete(payments, txHash)
+		}
+	}
+
+	// The polls then start over, the payments being reported once.
+	if err := client.pollMempool(); err != nil {
+		t.Fatalf("unable to poll mempool: %v", err)
+	}
+	assert.Equal(t, 3, s.mempoolPolls)
+	select {
+	case n := <-client.Notifications():
+		t.Fatalf("unexpected notification %v", n)
+	default:
+	}
+}
+
+func TestEsploraClientSyncedReorg(t *testing.T) {
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	b1, b2, b3 := s.mine(), s.mine(), s.mine()
+
+	// The wallet synced through the blocks before the client started,
+	// which only knows of the tip it started at.
+	synced := map[int32]chainhash.Hash{
+		0: *chaincfg.RegressionNetParams.GenesisHash,
+		1: b1.BlockHash(),
+		2: b2.BlockHash(),
+		3: b3.BlockHash(),
+	}
+	client := startEsploraClient(t, s, EsploraConfig{
+		PollInterval: 10 * time.Millisecond,
+		SyncedBlockHash: func(height int32) (*chainhash.Hash, error) {
+			hash, ok := synced[height]
+			if !ok {
+				return nil, waddrmgr.ManagerError{
+					ErrorCode: waddrmgr.ErrBlockNotFound,
+				}
+			}
+			return &hash, nil
+		},
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced blocks the wallet synced through are disconnected
+	// down to the fork point.
+	reorged := s.reorg(2, 3)
+	assert.Equal(t, BlockDisconnected(blockMeta(b3, 3)),
+		nextNotification(t, client))
+	assert.Equal(t, BlockDisconnected(blockMeta(b2, 2)),
+		nextNotification(t, client))
+	for i, block := range reorged {
+		assert.Equal(t, BlockConnected(blockMeta(block, int32(i+2))),
+			nextNotification(t, client))
+	}
+}
+
+func TestEsploraClientRescan(t *testing.T) {
+	watched := testAddr(t, 1)
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	b1 := s.mine(spend(t, wire.OutPoint{Index: 1}, watched))
+
+	// More payments than fit a page of the history follow the start of
+	// the rescan.
+	var payments []*wire.MsgTx
+	var blocks []*wire.MsgBlock
+	for i := 0; i < esploraChainTxsPageSize+5; i++ {
+		payment := spend(t, wire.OutPoint{Index: uint32(i + 2)}, watched)
+		payments = append(payments, payment)
+		blocks = append(blocks, s.mine(payment))
+	}
+	tip := s.mine()
+	client := startEsploraClient(t, s, EsploraConfig{
+		PollInterval: time.Hour,
+	})
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	b1Hash := b1.BlockHash()
+	err := client.Rescan(&b1Hash, []btcutil.Address{watched}, nil)
+	if err != nil {
+		t.Fatalf("unable to rescan: %v", err)
+	}
+
+	for i, payment := range payments {
+		height := int32(i + 2)
+		n := nextNotification(t, client)
+		if assert.IsType(t, RelevantTx{}, n) {
+			assert.Equal(t, payment.TxHash(),
+				n.(RelevantTx).TxRecord.Hash)
+			assert.Equal(t, blockMeta(blocks[i], height),
+				*n.(RelevantTx).Block)
+		}
+		assert.Equal(t, RescanProgress{
+			Hash:   blocks[i].BlockHash(),
+			Height: height,
+			Time:   blocks[i].Header.Timestamp,
+		}, nextNotification(t, client))
+	}
+	assert.Equal(t, RescanFinished{
+		Hash:   tip.BlockHash(),
+		Height: int32(len(s.blocks) - 1),
+		Time:   tip.Header.Timestamp,
+	}, nextNotification(t, client))
+}
+
+func TestEsploraClientSendRawTransaction(t *testing.T) {
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	client := startEsploraClient(t, s, EsploraConfig{
+		PollInterval: time.Hour,
+	})
+
+	tx := spend(t, wire.OutPoint{Index: 1}, testAddr(t, 1))
+	hash, err := client.SendRawTransaction(tx, false)
+	if err != nil {
+		t.Fatalf("unable to broadcast: %v", err)
+	}
+	assert.Equal(t, tx.TxHash(), *hash)
+
+	s.mu.Lock()
+	assert.Equal(t, txHashes(tx), txHashes(s.mempool...))
+	s.mu.Unlock()
+}
+
+func TestEsploraClientFeeHistogram(t *testing.T) {
+	s := newFakeEsplora(chaincfg.RegressionNetParams.GenesisBlock)
+	s.histogram = [][2]float64{{20.5, 120000}, {5, 800000}}
+	client := startEsploraClient(t, s, EsploraConfig{
+		PollInterval: time.Hour,
+	})
+
+	histogram, err := client.FeeHistogram()
+	if err != nil {
+		t.Fatalf("unable to fetch fee histogram: %v", err)
+	}
+	assert.Equal(t, []chainfee.FeeHistogramBin{
+		{FeeRate: 20.5, VSize: 120000},
+		{FeeRate: 5, VSize: 800000},
+	}, histogram)
+}
+
+func TestEsploraClientNetworkMismatch(t *testing.T) {
+	s := newFakeEsplora(chaincfg.MainNetParams.GenesisBlock)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	client := NewEsploraClient(&EsploraConfig{
+		ChainParams: &chaincfg.RegressionNetParams,
+		URL:         server.URL,
+	})
+	err := client.Start()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mismatched networks")
+	}
+}
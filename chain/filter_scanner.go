@@ -0,0 +1,143 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// ErrCompactFiltersUnavailable is returned by a CompactFilterSource that
+// can't serve compact filters, e.g. a bitcoind node without a block filter
+// index.
+var ErrCompactFiltersUnavailable = errors.New("compact filters unavailable")
+
+// CompactFilterSource is implemented by the backends serving the BIP-158
+// basic compact filters of blocks.
+type CompactFilterSource interface {
+	// GetCompactFilter returns the basic compact filter of the block.
+	GetCompactFilter(*chainhash.Hash) (*gcs.Filter, error)
+}
+
+// FilterScanner scans a range of blocks for the transactions relevant to a
+// set of scripts and outpoints. When the backend serves compact filters,
+// they are matched locally and only the blocks they match are downloaded.
+// The watched set may grow while scanning, so the addresses derived from the
+// transactions found are matched against the following blocks.
+//
+// A FilterScanner is not safe for concurrent use.
+type FilterScanner struct {
+	client  Interface
+	filters CompactFilterSource
+	watched *watchedSet
+}
+
+// NewFilterScanner returns a scanner fetching blocks, and filters if served,
+// from the backend.
+func NewFilterScanner(client Interface) *FilterScanner {
+	filters, _ := client.(CompactFilterSource)
+	return &FilterScanner{
+		client:  client,
+		filters: filters,
+		watched: newWatchedSet(),
+	}
+}
+
+// WatchAddrs watches the output scripts of the addresses.
+func (s *FilterScanner) WatchAddrs(addrs []btcutil.Address) error {
+	return s.watched.addAddrs(addrs)
+}
+
+// WatchOutPoints watches the spends of the outpoints, which pay to the
+// addresses.
+func (s *FilterScanner) WatchOutPoints(
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	return s.watched.addOutPoints(outPoints)
+}
+
+// Scan scans the blocks of the best chain of the backend from startHeight
+// through endHeight, calling onBlock for each of them in order. The block is
+// nil if it holds no transaction relevant to the watched set, in which case
+// it was not downloaded. The outputs of the blocks scanned paying to watched
+// scripts are watched, and so are the addresses and outpoints onBlock
+// watches, from the following block on.
+func (s *FilterScanner) Scan(startHeight, endHeight int32,
+	onBlock func(wtxmgr.BlockMeta, *wire.MsgBlock) error) error {
+
+	for height := startHeight; height <= endHeight; height++ {
+		hash, err := s.client.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		matched, err := s.match(hash)
+		if err != nil {
+			return err
+		}
+
+		var (
+			block     *wire.MsgBlock
+			timestamp time.Time
+		)
+		if matched {
+			block, err = s.client.GetBlock(hash)
+			if err != nil {
+				return err
+			}
+			for _, tx := range block.Transactions {
+				s.watched.relevantTx(tx)
+			}
+			timestamp = block.Header.Timestamp
+		} else {
+			header, err := s.client.GetBlockHeader(hash)
+			if err != nil {
+				return err
+			}
+			timestamp = header.Timestamp
+		}
+
+		meta := wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  timestamp,
+		}
+		if err := onBlock(meta, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match returns whether the block may hold transactions relevant to the
+// watched set, which is the case of every block if the backend serves no
+// compact filters.
+func (s *FilterScanner) match(hash *chainhash.Hash) (bool, error) {
+	if s.watched.isEmpty() {
+		return false, nil
+	}
+	if s.filters == nil {
+		return true, nil
+	}
+
+	filter, err := s.filters.GetCompactFilter(hash)
+	if errors.Is(err, ErrCompactFiltersUnavailable) {
+		fmt.Printf("Compact filters unavailable, scanning full "+
+			"blocks: %v \n", err)
+		s.filters = nil
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if filter.N() == 0 {
+		return false, nil
+	}
+
+	key := builder.DeriveKey(hash)
+	return filter.MatchAny(key, s.watched.scriptList())
+}
@@ -0,0 +1,88 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterScanner(t *testing.T) {
+	watched := testAddr(t, 1)
+	derived := testAddr(t, 2)
+	watchedScript, err := txscript.PayToAddrScript(watched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newFakeChainService()
+	cs.addBlock(t, nil)
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	b1 := cs.addBlock(t, nil, payment)
+	cs.addBlock(t, nil, spend(t, wire.OutPoint{Index: 2}, testAddr(t, 3)))
+
+	// The spend of the payment only matches through the script of the
+	// output it spends.
+	spendPayment := spend(t, wire.OutPoint{Hash: payment.TxHash()},
+		testAddr(t, 3))
+	b3 := cs.addBlock(t, [][]byte{watchedScript}, spendPayment)
+	b4 := cs.addBlock(t, nil, spend(t, wire.OutPoint{Index: 4}, derived))
+	client := NewNeutrinoClient(&chaincfg.RegressionNetParams, cs)
+
+	scanner := NewFilterScanner(client)
+	if err := scanner.WatchAddrs([]btcutil.Address{watched}); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		heights []int32
+		found   []*wire.MsgBlock
+	)
+	err = scanner.Scan(1, 4, func(meta wtxmgr.BlockMeta,
+		block *wire.MsgBlock) error {
+
+		heights = append(heights, meta.Height)
+		if block == nil {
+			return nil
+		}
+		found = append(found, block)
+
+		// The address following the one found is derived, and
+		// watched from the next block on.
+		return scanner.WatchAddrs([]btcutil.Address{derived})
+	})
+	if err != nil {
+		t.Fatalf("unable to scan: %v", err)
+	}
+
+	assert.Equal(t, []int32{1, 2, 3, 4}, heights)
+	assert.Equal(t, []*wire.MsgBlock{b1, b3, b4}, found)
+
+	// Only the blocks whose filter matched were downloaded.
+	assert.Equal(t, 3, cs.blockRequests)
+}
+
+func TestFilterScannerNothingWatched(t *testing.T) {
+	cs := newFakeChainService()
+	cs.addBlock(t, nil)
+	cs.addBlock(t, nil, spend(t, wire.OutPoint{Index: 1}, testAddr(t, 1)))
+	client := NewNeutrinoClient(&chaincfg.RegressionNetParams, cs)
+
+	var blocks int
+	err := NewFilterScanner(client).Scan(0, 1, func(_ wtxmgr.BlockMeta,
+		block *wire.MsgBlock) error {
+
+		assert.Nil(t, block)
+		blocks++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to scan: %v", err)
+	}
+	assert.Equal(t, 2, blocks)
+	assert.Zero(t, cs.blockRequests)
+}
@@ -0,0 +1,157 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// ErrTxRejected is wrapped by the errors of SendRawTransaction when the
+// backend refused the transaction, as opposed to errors, like timeouts, that
+// leave unknown whether it was accepted and relayed.
+var ErrTxRejected = errors.New("transaction rejected")
+
+// rpcTxRejection wraps the error of a sendrawtransaction call with
+// ErrTxRejected if the node refused the transaction.
+func rpcTxRejection(err error) error {
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) {
+		return err
+	}
+	switch rpcErr.Code {
+	case btcjson.ErrRPCDeserialization, btcjson.ErrRPCVerify,
+		btcjson.ErrRPCVerifyRejected:
+
+		return fmt.Errorf("%w: %w", ErrTxRejected, err)
+	}
+	return err
+}
+
+// Interface allows more than one backing blockchain source, such as a btcd
+// RPC chain server, or an SPV library, as long as we write a driver for it.
+type Interface interface {
+	// Start connects to the backend and Stop disconnects from it, closing
+	// the notification channel once every notification is delivered.
+	Start() error
+	Stop()
+	WaitForShutdown()
+
+	GetBestBlock() (*chainhash.Hash, int32, error)
+	GetBlock(*chainhash.Hash) (*wire.MsgBlock, error)
+	GetBlockHash(int64) (*chainhash.Hash, error)
+	GetBlockHeader(*chainhash.Hash) (*wire.BlockHeader, error)
+
+	// FilterBlocks scans the blocks of the request for transactions
+	// relevant to the addresses and outpoints watched by it, returning
+	// the first block with a match, or nil if none matched.
+	FilterBlocks(*FilterBlocksRequest) (*FilterBlocksResponse, error)
+
+	SendRawTransaction(*wire.MsgTx, bool) (*chainhash.Hash, error)
+
+	// Rescan sends RelevantTx notifications for the transactions paying
+	// to addrs or spending outPoints in the blocks after startHash,
+	// followed by a RescanFinished notification.
+	Rescan(startHash *chainhash.Hash, addrs []btcutil.Address,
+		outPoints map[wire.OutPoint]btcutil.Address) error
+	NotifyReceived([]btcutil.Address) error
+	NotifyBlocks() error
+	Notifications() <-chan interface{}
+}
+
+// TxSource is implemented by the backends serving transactions by hash,
+// whether mined or in the mempool.
+type TxSource interface {
+	// GetRawTransaction returns the transaction with the hash.
+	GetRawTransaction(*chainhash.Hash) (*btcutil.Tx, error)
+}
+
+// feeHistogramBins converts the fee histogram of an Electrum or Esplora
+// server, given as pairs of fee rate, in sat/vB, and the virtual size of the
+// mempool transactions paying it.
+func feeHistogramBins(pairs [][2]float64) []chainfee.FeeHistogramBin {
+	bins := make([]chainfee.FeeHistogramBin, 0, len(pairs))
+	for _, pair := range pairs {
+		bins = append(bins, chainfee.FeeHistogramBin{
+			FeeRate: pair[0],
+			VSize:   int64(pair[1]),
+		})
+	}
+	return bins
+}
+
+// FilterBlocksRequest specifies a range of blocks and the set of
+// internal and external addresses of interest, indexed by corresponding
+// scoped-index of the child address. A global set of watched outpoints
+// is also included to monitor for spends.
+type FilterBlocksRequest struct {
+	Blocks           []wtxmgr.BlockMeta
+	ExternalAddrs    map[waddrmgr.ScopedIndex]btcutil.Address
+	InternalAddrs    map[waddrmgr.ScopedIndex]btcutil.Address
+	WatchedOutPoints map[wire.OutPoint]btcutil.Address
+}
+
+// FilterBlocksResponse reports the set of all internal and external
+// addresses found in response to a FilterBlockRequest, any outpoints
+// found that correspond to those addresses, as well as the relevant
+// transactions that can modify the wallet's balance. The index of the
+// block within the FilterBlocksRequest is returned, such that the
+// caller can reinitiate a request for the subsequent block after
+// updating the addresses of interest.
+type FilterBlocksResponse struct {
+	BatchIndex         uint32
+	BlockMeta          wtxmgr.BlockMeta
+	FoundExternalAddrs map[waddrmgr.KeyScope]map[uint32]struct{}
+	FoundInternalAddrs map[waddrmgr.KeyScope]map[uint32]struct{}
+	FoundOutPoints     map[wire.OutPoint]btcutil.Address
+	RelevantTxns       []*wire.MsgTx
+}
+
+// Notification types. These are defined here and processed from reading a
+// notificationChan to avoid handling these notifications directly in
+// rpcclient callbacks, which isn't very Go-like and doesn't allow blocking
+// client calls.
+type (
+	// ClientConnected is a notification for when a client connection is
+	// opened or reestablished to the chain server.
+	ClientConnected struct{}
+
+	// BlockConnected is a notification for a newly-attached block to the
+	// best chain.
+	BlockConnected wtxmgr.BlockMeta
+
+	// BlockDisconnected is a notification that the block described by the
+	// BlockStamp was reorganized out of the best chain.
+	BlockDisconnected wtxmgr.BlockMeta
+
+	// RelevantTx is a notification for a transaction which spends wallet
+	// inputs or pays to a watched address. Block is nil for transactions
+	// that are not mined yet.
+	RelevantTx struct {
+		TxRecord *wtxmgr.TxRecord
+		Block    *wtxmgr.BlockMeta
+	}
+
+	// RescanProgress is a notification describing the current status
+	// of an in-progress rescan.
+	RescanProgress struct {
+		Hash   chainhash.Hash
+		Height int32
+		Time   time.Time
+	}
+
+	// RescanFinished is a notification that a previous rescan request
+	// has finished.
+	RescanFinished struct {
+		Hash   chainhash.Hash
+		Height int32
+		Time   time.Time
+	}
+)
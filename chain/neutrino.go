@@ -0,0 +1,518 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/lightninglabs/neutrino"
+	"github.com/lightninglabs/neutrino/blockntfns"
+	"github.com/lightninglabs/neutrino/headerfs"
+	"github.com/lightninglabs/neutrino/pushtx"
+)
+
+// NeutrinoChainService is the subset of the neutrino chain service the
+// NeutrinoClient relies on. It is satisfied by the chain service returned by
+// NewNeutrinoChainService, and lets the client be driven by an in-process
+// fake.
+type NeutrinoChainService interface {
+	Start() error
+	Stop() error
+
+	BestBlock() (*headerfs.BlockStamp, error)
+	GetBlock(chainhash.Hash, ...neutrino.QueryOption) (*btcutil.Block,
+		error)
+	GetBlockHash(int64) (*chainhash.Hash, error)
+	GetBlockHeader(*chainhash.Hash) (*wire.BlockHeader, error)
+	GetBlockHeight(*chainhash.Hash) (int32, error)
+	GetCFilter(chainhash.Hash, wire.FilterType,
+		...neutrino.QueryOption) (*gcs.Filter, error)
+	SendTransaction(*wire.MsgTx) error
+
+	// Subscribe delivers the blocks connected to and disconnected from
+	// the best chain, in order.
+	Subscribe(bestHeight uint32) (*blockntfns.Subscription, error)
+}
+
+// neutrinoChainService adds block subscriptions, which neutrino only exposes
+// to its rescans, to the neutrino chain service.
+type neutrinoChainService struct {
+	*neutrino.ChainService
+}
+
+// Subscribe returns a subscription to the blocks connected to and
+// disconnected from the best chain.
+func (s *neutrinoChainService) Subscribe(
+	bestHeight uint32) (*blockntfns.Subscription, error) {
+
+	source := &neutrino.RescanChainSource{ChainService: s.ChainService}
+	return source.Subscribe(bestHeight)
+}
+
+// NewNeutrinoChainService creates a neutrino chain service, which syncs block
+// headers and compact filters from the peers of the configuration and
+// persists them under its data directory.
+func NewNeutrinoChainService(cfg neutrino.Config) (NeutrinoChainService,
+	error) {
+
+	chainService, err := neutrino.NewChainService(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &neutrinoChainService{chainService}, nil
+}
+
+// NeutrinoClient is a chain client backed by a neutrino SPV chain service.
+// Blocks are only downloaded when their BIP-158 compact filter matches the
+// scripts watched by the wallet. As SPV peers don't relay unmined
+// transactions, the transactions of the wallet are only reported once mined.
+type NeutrinoClient struct {
+	CS          NeutrinoChainService
+	chainParams *chaincfg.Params
+
+	// watched holds the addresses passed to NotifyReceived, and the
+	// outputs paying to them, whose spends are reported too.
+	watched      *watchedSet
+	notifyBlocks bool
+	watchMtx     sync.Mutex
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
+}
+
+// Enforce that NeutrinoClient satisfies the chain.Interface interface.
+var _ Interface = (*NeutrinoClient)(nil)
+
+// Enforce that NeutrinoClient serves compact filters.
+var _ CompactFilterSource = (*NeutrinoClient)(nil)
+
+// NewNeutrinoClient creates a chain client on top of the chain service, which
+// is started by Start.
+func NewNeutrinoClient(chainParams *chaincfg.Params,
+	chainService NeutrinoChainService) *NeutrinoClient {
+
+	return &NeutrinoClient{
+		CS:            chainService,
+		chainParams:   chainParams,
+		watched:       newWatchedSet(),
+		notifications: make(chan interface{}, notificationBufferSize),
+		quit:          make(chan struct{}),
+	}
+}
+
+// Start starts the chain service and the delivery of its block
+// notifications.
+func (c *NeutrinoClient) Start() error {
+	if err := c.CS.Start(); err != nil {
+		return err
+	}
+
+	subscription, err := c.CS.Subscribe(0)
+	if err != nil {
+		_ = c.CS.Stop()
+		return err
+	}
+
+	c.wg.Add(1)
+	go c.notificationHandler(subscription)
+	return nil
+}
+
+// Stop stops the chain service and signals the shutdown of the notification
+// handler. The notification channel is closed once the handler has exited.
+func (c *NeutrinoClient) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+	if err := c.CS.Stop(); err != nil {
+		fmt.Printf("Unable to stop neutrino chain service: %v \n", err)
+	}
+
+	go func() {
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until the notification handler has exited.
+func (c *NeutrinoClient) WaitForShutdown() {
+	c.wg.Wait()
+}
+
+// GetBestBlock returns the best block for which the chain service synced
+// both the header and the compact filter.
+func (c *NeutrinoClient) GetBestBlock() (*chainhash.Hash, int32, error) {
+	bs, err := c.CS.BestBlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &bs.Hash, bs.Height, nil
+}
+
+// GetBlock downloads a block from the peers of the chain service.
+func (c *NeutrinoClient) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock,
+	error) {
+
+	block, err := c.CS.GetBlock(*hash)
+	if err != nil {
+		return nil, err
+	}
+	return block.MsgBlock(), nil
+}
+
+// GetBlockHash returns the hash of the block of the best chain at the given
+// height.
+func (c *NeutrinoClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	return c.CS.GetBlockHash(height)
+}
+
+// GetBlockHeader returns the header of a block.
+func (c *NeutrinoClient) GetBlockHeader(
+	hash *chainhash.Hash) (*wire.BlockHeader, error) {
+
+	return c.CS.GetBlockHeader(hash)
+}
+
+// SendRawTransaction broadcasts a transaction to the peers of the chain
+// service. High fees are never rejected, as peers don't check them. The
+// errors of transactions peers refuse as invalid or paying too little fee
+// wrap ErrTxRejected.
+func (c *NeutrinoClient) SendRawTransaction(tx *wire.MsgTx,
+	_ bool) (*chainhash.Hash, error) {
+
+	err := c.CS.SendTransaction(tx)
+	var broadcastErr *pushtx.BroadcastError
+	if errors.As(err, &broadcastErr) {
+		switch broadcastErr.Code {
+		case pushtx.Invalid, pushtx.InsufficientFee:
+			return nil, fmt.Errorf("%w: %w", ErrTxRejected, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash := tx.TxHash()
+	return &hash, nil
+}
+
+// FilterBlocks scans the blocks of the request for the addresses and
+// outpoints it watches. Only the blocks whose compact filter matches are
+// downloaded, and the scan stops at the first one containing a relevant
+// transaction.
+func (c *NeutrinoClient) FilterBlocks(
+	req *FilterBlocksRequest) (*FilterBlocksResponse, error) {
+
+	watched := newWatchedSet()
+	for _, addrs := range []map[waddrmgr.ScopedIndex]btcutil.Address{
+		req.ExternalAddrs, req.InternalAddrs,
+	} {
+		for _, addr := range addrs {
+			err := watched.addAddrs([]btcutil.Address{addr})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := watched.addOutPoints(req.WatchedOutPoints); err != nil {
+		return nil, err
+	}
+
+	// The filter may match falsely, so the blocks it matches are still
+	// filtered.
+	watchList := watched.scriptList()
+	return filterBlocks(c.chainParams, req, func(
+		hash *chainhash.Hash) (*wire.MsgBlock, error) {
+
+		matched, err := c.matchFilter(hash, watchList)
+		if err != nil || !matched {
+			return nil, err
+		}
+		return c.GetBlock(hash)
+	})
+}
+
+// Rescan sends RelevantTx notifications for the transactions of the blocks
+// following startHash that pay to addrs or spend outPoints, or the outputs
+// paying to addrs found along the way. Progress is reported for every block
+// whose filter matched, and a RescanFinished notification is sent once the
+// tip is reached.
+func (c *NeutrinoClient) Rescan(startHash *chainhash.Hash,
+	addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	startHeight, err := c.CS.GetBlockHeight(startHash)
+	if err != nil {
+		return err
+	}
+
+	watched := newWatchedSet()
+	if err := watched.addAddrs(addrs); err != nil {
+		return err
+	}
+	if err := watched.addOutPoints(outPoints); err != nil {
+		return err
+	}
+
+	var last *wtxmgr.BlockMeta
+	for height := startHeight + 1; ; height++ {
+		_, bestHeight, err := c.GetBestBlock()
+		if err != nil {
+			return err
+		}
+		if height > bestHeight {
+			break
+		}
+
+		meta, err := c.blockMeta(height)
+		if err != nil {
+			return err
+		}
+		last = meta
+
+		txs, err := c.filterBlock(meta, watched)
+		if err != nil {
+			return err
+		}
+		if len(txs) == 0 {
+			continue
+		}
+		for _, rec := range txs {
+			c.notify(RelevantTx{TxRecord: rec, Block: meta})
+		}
+		c.notify(RescanProgress{
+			Hash:   meta.Hash,
+			Height: meta.Height,
+			Time:   meta.Time,
+		})
+	}
+
+	if last == nil {
+		header, err := c.CS.GetBlockHeader(startHash)
+		if err != nil {
+			return err
+		}
+		last = &wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *startHash, Height: startHeight},
+			Time:  header.Timestamp,
+		}
+	}
+	c.notify(RescanFinished{
+		Hash:   last.Hash,
+		Height: last.Height,
+		Time:   last.Time,
+	})
+	return nil
+}
+
+// NotifyReceived watches the addresses for transactions mined in the blocks
+// connected from now on. Outputs paying to them are watched for spends.
+func (c *NeutrinoClient) NotifyReceived(addrs []btcutil.Address) error {
+	c.watchMtx.Lock()
+	defer c.watchMtx.Unlock()
+
+	return c.watched.addAddrs(addrs)
+}
+
+// NotifyBlocks starts the delivery of BlockConnected and BlockDisconnected
+// notifications.
+func (c *NeutrinoClient) NotifyBlocks() error {
+	c.watchMtx.Lock()
+	c.notifyBlocks = true
+	c.watchMtx.Unlock()
+	return nil
+}
+
+// Notifications returns the channel of notifications of the client. It must
+// be read continually, as the delivery of blocks stops while it is full.
+func (c *NeutrinoClient) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// notificationHandler delivers the blocks connected to and disconnected from
+// the best chain, along with the watched transactions of connected blocks.
+// It must be run as a goroutine.
+func (c *NeutrinoClient) notificationHandler(
+	subscription *blockntfns.Subscription) {
+
+	defer c.wg.Done()
+	defer subscription.Cancel()
+
+	c.notify(ClientConnected{})
+
+	for {
+		select {
+		case ntfn, ok := <-subscription.Notifications:
+			if !ok {
+				return
+			}
+
+			var err error
+			switch ntfn := ntfn.(type) {
+			case *blockntfns.Connected:
+				err = c.onBlockConnected(ntfn)
+
+			case *blockntfns.Disconnected:
+				c.onBlockDisconnected(ntfn)
+			}
+			if err != nil {
+				fmt.Printf("Unable to process block %v: %v \n",
+					ntfn, err)
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *NeutrinoClient) onBlockConnected(ntfn *blockntfns.Connected) error {
+	header := ntfn.Header()
+	meta := &wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{
+			Hash:   header.BlockHash(),
+			Height: int32(ntfn.Height()),
+		},
+		Time: header.Timestamp,
+	}
+
+	c.watchMtx.Lock()
+	notifyBlocks := c.notifyBlocks
+	txs, err := c.filterBlock(meta, c.watched)
+	c.watchMtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range txs {
+		c.notify(RelevantTx{TxRecord: rec, Block: meta})
+	}
+	if notifyBlocks {
+		c.notify(BlockConnected(*meta))
+	}
+	return nil
+}
+
+func (c *NeutrinoClient) onBlockDisconnected(ntfn *blockntfns.Disconnected) {
+	c.watchMtx.Lock()
+	notifyBlocks := c.notifyBlocks
+	c.watchMtx.Unlock()
+	if !notifyBlocks {
+		return
+	}
+
+	header := ntfn.Header()
+	c.notify(BlockDisconnected{
+		Block: wtxmgr.Block{
+			Hash:   header.BlockHash(),
+			Height: int32(ntfn.Height()),
+		},
+		Time: header.Timestamp,
+	})
+}
+
+// filterBlock returns the relevant transactions of a block for the watched
+// set. The block is only downloaded if its filter matches.
+func (c *NeutrinoClient) filterBlock(meta *wtxmgr.BlockMeta,
+	watched *watchedSet) ([]*wtxmgr.TxRecord, error) {
+
+	matched, err := c.matchFilter(&meta.Hash, watched.scriptList())
+	if err != nil || !matched {
+		return nil, err
+	}
+
+	block, err := c.GetBlock(&meta.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return watched.filterBlock(block)
+}
+
+// matchFilter returns whether the compact filter of a block matches any of
+// the scripts.
+func (c *NeutrinoClient) matchFilter(hash *chainhash.Hash,
+	watchList [][]byte) (bool, error) {
+
+	if len(watchList) == 0 {
+		return false, nil
+	}
+
+	filter, err := c.GetCompactFilter(hash)
+	if err != nil {
+		return false, err
+	}
+	if filter.N() == 0 {
+		return false, nil
+	}
+
+	key := builder.DeriveKey(hash)
+	return filter.MatchAny(key, watchList)
+}
+
+// GetCompactFilter returns the basic compact filter of the block, fetched
+// from peers unless cached.
+func (c *NeutrinoClient) GetCompactFilter(
+	hash *chainhash.Hash) (*gcs.Filter, error) {
+
+	filter, err := c.CS.GetCFilter(*hash, wire.GCSFilterRegular)
+	if err != nil {
+		return nil, err
+	}
+	if filter == nil {
+		return nil, errors.New("compact filter not found for block " +
+			hash.String())
+	}
+	return filter, nil
+}
+
+// blockMeta returns the metadata of the block of the best chain at the given
+// height.
+func (c *NeutrinoClient) blockMeta(height int32) (*wtxmgr.BlockMeta, error) {
+	hash, err := c.CS.GetBlockHash(int64(height))
+	if err != nil {
+		return nil, err
+	}
+	header, err := c.CS.GetBlockHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: *hash, Height: height},
+		Time:  header.Timestamp,
+	}, nil
+}
+
+// notify sends a notification to the consumer, blocking while the buffer is
+// full. Notifications arriving after Stop are dropped.
+func (c *NeutrinoClient) notify(n interface{}) {
+	c.wg.Add(1)
+	defer c.wg.Done()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.notifications <- n:
+	case <-c.quit:
+	}
+}
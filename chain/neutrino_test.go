@@ -0,0 +1,336 @@
+package chain
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/lightninglabs/neutrino"
+	"github.com/lightninglabs/neutrino/blockntfns"
+	"github.com/lightninglabs/neutrino/headerfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChainService is an in-process neutrino chain service serving a chain
+// of blocks along with their compact filters.
+type fakeChainService struct {
+	mu            sync.Mutex
+	blocks        []*wire.MsgBlock
+	filters       map[chainhash.Hash]*gcs.Filter
+	blockRequests int
+	sent          []*wire.MsgTx
+
+	ntfns chan blockntfns.BlockNtfn
+}
+
+var _ NeutrinoChainService = (*fakeChainService)(nil)
+
+func newFakeChainService() *fakeChainService {
+	return &fakeChainService{
+		filters: make(map[chainhash.Hash]*gcs.Filter),
+		ntfns:   make(chan blockntfns.BlockNtfn, 10),
+	}
+}
+
+// addBlock extends the chain with a block holding the transactions, whose
+// filter also commits to the scripts of the outputs they spend.
+func (s *fakeChainService) addBlock(t *testing.T, prevOutScripts [][]byte,
+	txs ...*wire.MsgTx) *wire.MsgBlock {
+
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: ^uint32(0)},
+		[]byte{byte(len(s.blocks))}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{txscript.OP_TRUE}))
+
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Timestamp: time.Unix(1700000000+int64(len(s.blocks))*600, 0),
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, txs...),
+	}
+	if len(s.blocks) > 0 {
+		block.Header.PrevBlock = s.blocks[len(s.blocks)-1].BlockHash()
+	}
+
+	filter, err := builder.BuildBasicFilter(block, prevOutScripts)
+	if err != nil {
+		t.Fatalf("unable to build filter: %v", err)
+	}
+	s.blocks = append(s.blocks, block)
+	s.filters[block.BlockHash()] = filter
+	return block
+}
+
+func (s *fakeChainService) height(hash *chainhash.Hash) (int32, error) {
+	for height, block := range s.blocks {
+		if block.BlockHash() == *hash {
+			return int32(height), nil
+		}
+	}
+	return 0, errors.New("block not found")
+}
+
+func (s *fakeChainService) Start() error { return nil }
+
+func (s *fakeChainService) Stop() error { return nil }
+
+func (s *fakeChainService) BestBlock() (*headerfs.BlockStamp, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tip := s.blocks[len(s.blocks)-1]
+	return &headerfs.BlockStamp{
+		Height:    int32(len(s.blocks) - 1),
+		Hash:      tip.BlockHash(),
+		Timestamp: tip.Header.Timestamp,
+	}, nil
+}
+
+func (s *fakeChainService) GetBlock(hash chainhash.Hash,
+	_ ...neutrino.QueryOption) (*btcutil.Block, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	height, err := s.height(&hash)
+	if err != nil {
+		return nil, err
+	}
+	s.blockRequests++
+	return btcutil.NewBlock(s.blocks[height]), nil
+}
+
+func (s *fakeChainService) GetBlockHash(height int64) (*chainhash.Hash,
+	error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if height < 0 || height >= int64(len(s.blocks)) {
+		return nil, errors.New("height out of range")
+	}
+	hash := s.blocks[height].BlockHash()
+	return &hash, nil
+}
+
+func (s *fakeChainService) GetBlockHeader(
+	hash *chainhash.Hash) (*wire.BlockHeader, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	height, err := s.height(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &s.blocks[height].Header, nil
+}
+
+func (s *fakeChainService) GetBlockHeight(hash *chainhash.Hash) (int32,
+	error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.height(hash)
+}
+
+func (s *fakeChainService) GetCFilter(hash chainhash.Hash,
+	_ wire.FilterType, _ ...neutrino.QueryOption) (*gcs.Filter, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.filters[hash], nil
+}
+
+func (s *fakeChainService) SendTransaction(tx *wire.MsgTx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, tx)
+	return nil
+}
+
+func (s *fakeChainService) Subscribe(
+	uint32) (*blockntfns.Subscription, error) {
+
+	return &blockntfns.Subscription{
+		Notifications: s.ntfns,
+		Cancel:        func() {},
+	}, nil
+}
+
+// spend returns a transaction spending the outpoint to the address.
+func spend(t *testing.T, op wire.OutPoint, addr btcutil.Address) *wire.MsgTx {
+	t.Helper()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(payTo(t, addr))
+	return tx
+}
+
+// nextNotification returns the next notification of the client.
+func nextNotification(t *testing.T, c Interface) interface{} {
+	t.Helper()
+
+	select {
+	case n := <-c.Notifications():
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+		return nil
+	}
+}
+
+func TestNeutrinoClientFilterBlocks(t *testing.T) {
+	external := testAddr(t, 1)
+	cs := newFakeChainService()
+	genesis := cs.addBlock(t, nil)
+	b1 := cs.addBlock(t, nil, spend(t, wire.OutPoint{}, testAddr(t, 3)))
+	b2 := cs.addBlock(t, nil, spend(t, wire.OutPoint{Index: 1}, external))
+	client := NewNeutrinoClient(&chaincfg.RegressionNetParams, cs)
+
+	var blocks []wtxmgr.BlockMeta
+	for height, block := range []*wire.MsgBlock{genesis, b1, b2} {
+		blocks = append(blocks, wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{
+				Hash:   block.BlockHash(),
+				Height: int32(height),
+			},
+		})
+	}
+	resp, err := client.FilterBlocks(&FilterBlocksRequest{
+		Blocks: blocks,
+		ExternalAddrs: map[waddrmgr.ScopedIndex]btcutil.Address{
+			{Scope: waddrmgr.KeyScopeBIP0084, Index: 4}: external,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to filter blocks: %v", err)
+	}
+
+	assert.Equal(t, uint32(2), resp.BatchIndex)
+	assert.Len(t, resp.RelevantTxns, 1)
+	assert.Contains(t,
+		resp.FoundExternalAddrs[waddrmgr.KeyScopeBIP0084], uint32(4))
+
+	// Only the block whose filter matched was downloaded.
+	assert.Equal(t, 1, cs.blockRequests)
+}
+
+func TestNeutrinoClientNotifications(t *testing.T) {
+	watched := testAddr(t, 1)
+	watchedScript, err := txscript.PayToAddrScript(watched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs := newFakeChainService()
+	cs.addBlock(t, nil)
+	client := NewNeutrinoClient(&chaincfg.RegressionNetParams, cs)
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	assert.IsType(t, ClientConnected{}, nextNotification(t, client))
+
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NotifyReceived([]btcutil.Address{watched}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block paying to a watched address reports the payment before the
+	// block.
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	b1 := cs.addBlock(t, nil, payment)
+	cs.ntfns <- blockntfns.NewBlockConnected(b1.Header, 1)
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, int32(1), n.(RelevantTx).Block.Height)
+	}
+	assert.Equal(t, BlockConnected{
+		Block: wtxmgr.Block{Hash: b1.BlockHash(), Height: 1},
+		Time:  b1.Header.Timestamp,
+	}, nextNotification(t, client))
+
+	// The output of the payment is watched for spends.
+	spender := spend(t, wire.OutPoint{Hash: payment.TxHash()},
+		testAddr(t, 2))
+	b2 := cs.addBlock(t, [][]byte{watchedScript}, spender)
+	cs.ntfns <- blockntfns.NewBlockConnected(b2.Header, 2)
+
+	n = nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, spender.TxHash(), n.(RelevantTx).TxRecord.Hash)
+	}
+	assert.IsType(t, BlockConnected{}, nextNotification(t, client))
+
+	cs.ntfns <- blockntfns.NewBlockDisconnected(b2.Header, 2, b1.Header)
+	assert.Equal(t, BlockDisconnected{
+		Block: wtxmgr.Block{Hash: b2.BlockHash(), Height: 2},
+		Time:  b2.Header.Timestamp,
+	}, nextNotification(t, client))
+
+	client.Stop()
+	client.WaitForShutdown()
+	select {
+	case _, ok := <-client.Notifications():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification channel not closed")
+	}
+}
+
+func TestNeutrinoClientRescan(t *testing.T) {
+	watched := testAddr(t, 1)
+	cs := newFakeChainService()
+	genesis := cs.addBlock(t, nil)
+	cs.addBlock(t, nil)
+	payment := spend(t, wire.OutPoint{Index: 1}, watched)
+	b2 := cs.addBlock(t, nil, payment)
+	b3 := cs.addBlock(t, nil)
+	client := NewNeutrinoClient(&chaincfg.RegressionNetParams, cs)
+
+	genesisHash := genesis.BlockHash()
+	err := client.Rescan(&genesisHash, []btcutil.Address{watched}, nil)
+	if err != nil {
+		t.Fatalf("unable to rescan: %v", err)
+	}
+
+	n := nextNotification(t, client)
+	if assert.IsType(t, RelevantTx{}, n) {
+		assert.Equal(t, payment.TxHash(), n.(RelevantTx).TxRecord.Hash)
+		assert.Equal(t, b2.BlockHash(), n.(RelevantTx).Block.Hash)
+	}
+	assert.Equal(t, RescanProgress{
+		Hash:   b2.BlockHash(),
+		Height: 2,
+		Time:   b2.Header.Timestamp,
+	}, nextNotification(t, client))
+	assert.Equal(t, RescanFinished{
+		Hash:   b3.BlockHash(),
+		Height: 3,
+		Time:   b3.Header.Timestamp,
+	}, nextNotification(t, client))
+	assert.Equal(t, 1, cs.blockRequests)
+}
@@ -0,0 +1,428 @@
+package simchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// Client is a chain client of a simulated chain. Notifications are queued
+// without bound, so mining never blocks on a slow consumer, and delivered in
+// order after the configured delay.
+type Client struct {
+	chain *Chain
+
+	// scripts and outPoints are watched for relevant transactions.
+	scripts      map[string]struct{}
+	outPoints    map[wire.OutPoint]struct{}
+	notifyBlocks bool
+	started      bool
+
+	// queue holds the notifications not delivered yet, and delay is how
+	// long each of them is held back before delivery.
+	queue    []interface{}
+	queued   chan struct{}
+	delay    time.Duration
+	queueMtx sync.Mutex
+
+	notifications chan interface{}
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	quitMtx sync.Mutex
+}
+
+// Enforce that Client satisfies the chain.Interface interface.
+var _ chain.Interface = (*Client)(nil)
+
+// Enforce that Client serves compact filters.
+var _ chain.CompactFilterSource = (*Client)(nil)
+
+// Enforce that Client serves transactions.
+var _ chain.TxSource = (*Client)(nil)
+
+// NewClient creates a client of the chain. It receives notifications once
+// started.
+func (c *Chain) NewClient() *Client {
+	client := &Client{
+		chain:         c,
+		scripts:       make(map[string]struct{}),
+		outPoints:     make(map[wire.OutPoint]struct{}),
+		queued:        make(chan struct{}, 1),
+		notifications: make(chan interface{}),
+		quit:          make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	c.clients = append(c.clients, client)
+	c.mu.Unlock()
+
+	return client
+}
+
+// SetNotificationDelay holds every notification delivered from now on back
+// for the duration, letting tests exercise a wallet lagging behind its
+// backend.
+func (c *Client) SetNotificationDelay(delay time.Duration) {
+	c.queueMtx.Lock()
+	defer c.queueMtx.Unlock()
+
+	c.delay = delay
+}
+
+// Start starts delivering notifications, the first being ClientConnected.
+func (c *Client) Start() error {
+	c.chain.mu.Lock()
+	c.started = true
+	c.chain.mu.Unlock()
+
+	c.wg.Add(1)
+	go c.notificationHandler()
+
+	c.notify(chain.ClientConnected{})
+	return nil
+}
+
+// notificationHandler delivers the queued notifications until the client is
+// stopped.
+func (c *Client) notificationHandler() {
+	defer c.wg.Done()
+
+	for {
+		c.queueMtx.Lock()
+		if len(c.queue) == 0 {
+			c.queueMtx.Unlock()
+
+			select {
+			case <-c.queued:
+				continue
+			case <-c.quit:
+				return
+			}
+		}
+		n := c.queue[0]
+		c.queue = c.queue[1:]
+		delay := c.delay
+		c.queueMtx.Unlock()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-c.quit:
+				return
+			}
+		}
+
+		select {
+		case c.notifications <- n:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// notify queues the notification for delivery.
+func (c *Client) notify(n interface{}) {
+	c.queueMtx.Lock()
+	c.queue = append(c.queue, n)
+	c.queueMtx.Unlock()
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// relevantTx returns whether the transaction pays to a watched script or
+// spends a watched outpoint, watching the outputs paying to watched scripts.
+// The chain lock must be held.
+func (c *Client) relevantTx(tx *wire.MsgTx) bool {
+	relevant := false
+	for _, txIn := range tx.TxIn {
+		if _, ok := c.outPoints[txIn.PreviousOutPoint]; ok {
+			relevant = true
+		}
+	}
+
+	txHash := tx.TxHash()
+	for i, txOut := range tx.TxOut {
+		if _, ok := c.scripts[string(txOut.PkScript)]; ok {
+			relevant = true
+			c.outPoints[*wire.NewOutPoint(&txHash, uint32(i))] =
+				struct{}{}
+		}
+	}
+	return relevant
+}
+
+// notifyTx queues a RelevantTx notification for the transaction.
+func (c *Client) notifyTx(tx *wire.MsgTx, block *wtxmgr.BlockMeta) {
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+	if err != nil {
+		fmt.Printf("Unable to create record of tx %v: %v \n",
+			tx.TxHash(), err)
+		return
+	}
+	c.notify(chain.RelevantTx{TxRecord: rec, Block: block})
+}
+
+// blockConnected queues the notifications of a block connected to the best
+// chain: its relevant transactions, then the block if enabled. The chain
+// lock must be held.
+func (c *Client) blockConnected(block *wire.MsgBlock, meta wtxmgr.BlockMeta) {
+	if !c.started {
+		return
+	}
+	for _, tx := range block.Transactions {
+		if c.relevantTx(tx) {
+			c.notifyTx(tx, &meta)
+		}
+	}
+	if c.notifyBlocks {
+		c.notify(chain.BlockConnected(meta))
+	}
+}
+
+// blockDisconnected queues the notification of a block disconnected from the
+// best chain if enabled. The chain lock must be held.
+func (c *Client) blockDisconnected(meta wtxmgr.BlockMeta) {
+	if c.started && c.notifyBlocks {
+		c.notify(chain.BlockDisconnected(meta))
+	}
+}
+
+// txAccepted queues the notification of a transaction accepted into the
+// mempool if relevant. The chain lock must be held.
+func (c *Client) txAccepted(tx *wire.MsgTx) {
+	if c.started && c.relevantTx(tx) {
+		c.notifyTx(tx, nil)
+	}
+}
+
+// Stop signals the shutdown of the notification handler. The notification
+// channel is closed once it exited.
+func (c *Client) Stop() {
+	c.quitMtx.Lock()
+	defer c.quitMtx.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	close(c.quit)
+
+	c.chain.mu.Lock()
+	for i, client := range c.chain.clients {
+		if client == c {
+			c.chain.clients = append(c.chain.clients[:i:i],
+				c.chain.clients[i+1:]...)
+			break
+		}
+	}
+	c.chain.mu.Unlock()
+
+	go func() {
+		c.wg.Wait()
+		close(c.notifications)
+	}()
+}
+
+// WaitForShutdown blocks until the notification handler exited.
+func (c *Client) WaitForShutdown() {
+	c.wg.Wait()
+}
+
+// Notifications returns the channel notifications are delivered on.
+func (c *Client) Notifications() <-chan interface{} {
+	return c.notifications
+}
+
+// GetBestBlock returns the hash and height of the tip of the best chain.
+func (c *Client) GetBestBlock() (*chainhash.Hash, int32, error) {
+	tip, height := c.chain.Tip()
+	hash := tip.BlockHash()
+	return &hash, height, nil
+}
+
+// GetBlock returns the block, which may have been reorganized out of the best
+// chain.
+func (c *Client) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	block, _, err := c.chain.block(hash)
+	return block, err
+}
+
+// GetBlockHash returns the hash of the block of the best chain at the height.
+func (c *Client) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+
+	if height < 0 || height >= int64(len(c.chain.blocks)) {
+		return nil, ErrBlockNotFound
+	}
+	hash := c.chain.blocks[height].BlockHash()
+	return &hash, nil
+}
+
+// GetBlockHeader returns the header of the block.
+func (c *Client) GetBlockHeader(
+	hash *chainhash.Hash) (*wire.BlockHeader, error) {
+
+	block, _, err := c.chain.block(hash)
+	if err != nil {
+		return nil, err
+	}
+	header := block.Header
+	return &header, nil
+}
+
+// GetRawTransaction returns the transaction of the mempool or of the best
+// chain with the hash.
+func (c *Client) GetRawTransaction(
+	txHash *chainhash.Hash) (*btcutil.Tx, error) {
+
+	tx, err := c.chain.tx(txHash)
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.NewTx(tx), nil
+}
+
+// GetCompactFilter returns the basic compact filter of the block, built from
+// the block and the scripts of the outputs it spends that the chain holds.
+func (c *Client) GetCompactFilter(hash *chainhash.Hash) (*gcs.Filter, error) {
+	block, _, err := c.chain.block(hash)
+	if err != nil {
+		return nil, err
+	}
+	return builder.BuildBasicFilter(block, c.chain.prevOutScripts(block))
+}
+
+// FilterBlocks scans the blocks of the request, returning the first block
+// holding relevant transactions.
+func (c *Client) FilterBlocks(
+	req *chain.FilterBlocksRequest) (*chain.FilterBlocksResponse, error) {
+
+	blockFilterer := chain.NewBlockFilterer(c.chain.params, req)
+	for i, meta := range req.Blocks {
+		block, err := c.GetBlock(&meta.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if !blockFilterer.FilterBlock(block) {
+			continue
+		}
+
+		return &chain.FilterBlocksResponse{
+			BatchIndex:         uint32(i),
+			BlockMeta:          meta,
+			FoundExternalAddrs: blockFilterer.FoundExternal,
+			FoundInternalAddrs: blockFilterer.FoundInternal,
+			FoundOutPoints:     blockFilterer.FoundOutPoints,
+			RelevantTxns:       blockFilterer.RelevantTxns,
+		}, nil
+	}
+	return nil, nil
+}
+
+// SendRawTransaction accepts the transaction into the mempool of the chain,
+// replacing the mempool transactions it conflicts with. The errors of the
+// transactions it refuses wrap chain.ErrTxRejected.
+func (c *Client) SendRawTransaction(tx *wire.MsgTx,
+	_ bool) (*chainhash.Hash, error) {
+
+	if err := c.chain.broadcast(tx); err != nil {
+		return nil, fmt.Errorf("%w: %w", chain.ErrTxRejected, err)
+	}
+	txHash := tx.TxHash()
+	return &txHash, nil
+}
+
+// addAddrs watches the output scripts of the addresses. The chain lock must
+// be held.
+func (c *Client) addAddrs(addrs []btcutil.Address) error {
+	for _, addr := range addrs {
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return err
+		}
+		c.scripts[string(script)] = struct{}{}
+	}
+	return nil
+}
+
+// Rescan watches the addresses and outpoints, then queues the relevant
+// transactions of the blocks of the best chain following startHash, each
+// block with a match followed by a RescanProgress notification, and a
+// RescanFinished notification for the tip.
+func (c *Client) Rescan(startHash *chainhash.Hash, addrs []btcutil.Address,
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	_, startHeight, err := c.chain.block(startHash)
+	if err != nil {
+		return err
+	}
+
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+
+	if err := c.addAddrs(addrs); err != nil {
+		return err
+	}
+	for op := range outPoints {
+		c.outPoints[op] = struct{}{}
+	}
+
+	for _, block := range c.chain.blocks[startHeight+1:] {
+		meta := c.chain.blockMeta(block)
+		matched := false
+		for _, tx := range block.Transactions {
+			if c.relevantTx(tx) {
+				c.notifyTx(tx, &meta)
+				matched = true
+			}
+		}
+		if matched {
+			c.notify(chain.RescanProgress{
+				Hash:   meta.Hash,
+				Height: meta.Height,
+				Time:   meta.Time,
+			})
+		}
+	}
+
+	tip := c.chain.blockMeta(c.chain.blocks[len(c.chain.blocks)-1])
+	c.notify(chain.RescanFinished{
+		Hash:   tip.Hash,
+		Height: tip.Height,
+		Time:   tip.Time,
+	})
+	return nil
+}
+
+// NotifyReceived watches the addresses for relevant transactions.
+func (c *Client) NotifyReceived(addrs []btcutil.Address) error {
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+
+	return c.addAddrs(addrs)
+}
+
+// NotifyBlocks enables BlockConnected and BlockDisconnected notifications.
+func (c *Client) NotifyBlocks() error {
+	c.chain.mu.Lock()
+	defer c.chain.mu.Unlock()
+
+	c.notifyBlocks = true
+	return nil
+}
@@ -0,0 +1,374 @@
+// Package simchain implements chain.Interface with an in-memory chain, so
+// the wallet can be exercised against blocks, mempool transactions and reorgs
+// without running a node. Blocks carry no proof of work and transactions are
+// not validated beyond conflicts between their inputs.
+package simchain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// blockInterval is the time between the timestamps of consecutive blocks.
+const blockInterval = 10 * time.Minute
+
+var (
+	// ErrBlockNotFound is returned for blocks the chain never held.
+	ErrBlockNotFound = errors.New("block not found")
+
+	// ErrTxNotFound is returned for transactions neither in the mempool
+	// nor in a block of the best chain.
+	ErrTxNotFound = errors.New("transaction not found")
+
+	// ErrTxConflict is returned when broadcasting a transaction spending
+	// an output already spent by a mined transaction.
+	ErrTxConflict = errors.New("transaction spends a spent output")
+)
+
+// Chain is an in-memory blockchain with a mempool, shared by the clients
+// created with NewClient. Blocks are only mined when asked to, and every
+// change is announced to the clients as a backend would.
+type Chain struct {
+	params *chaincfg.Params
+
+	// blocks is the best chain, indexed by height. known holds every
+	// block ever mined, including those reorganized out of the best
+	// chain, along with its height.
+	blocks  []*wire.MsgBlock
+	known   map[chainhash.Hash]*wire.MsgBlock
+	heights map[chainhash.Hash]int32
+
+	// mempool holds the unmined transactions in the order they were
+	// accepted.
+	mempool []*wire.MsgTx
+
+	// nonce is incremented for every block mined so that blocks of
+	// competing chains differ.
+	nonce uint32
+
+	clients []*Client
+
+	mu sync.Mutex
+}
+
+// New creates a chain holding only the genesis block of the network.
+func New(params *chaincfg.Params) *Chain {
+	c := &Chain{
+		params:  params,
+		known:   make(map[chainhash.Hash]*wire.MsgBlock),
+		heights: make(map[chainhash.Hash]int32),
+	}
+	c.extend(params.GenesisBlock)
+	return c
+}
+
+// extend appends the block to the best chain.
+func (c *Chain) extend(block *wire.MsgBlock) {
+	hash := block.BlockHash()
+	c.known[hash] = block
+	c.heights[hash] = int32(len(c.blocks))
+	c.blocks = append(c.blocks, block)
+}
+
+// newBlock returns a block extending the tip, holding a coinbase paying to
+// the outputs followed by the transactions.
+func (c *Chain) newBlock(coinbaseOuts []*wire.TxOut,
+	txs []*wire.MsgTx) *wire.MsgBlock {
+
+	prev := c.blocks[len(c.blocks)-1]
+	height := len(c.blocks)
+
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		[]byte{byte(height), byte(height >> 8), byte(height >> 16),
+			byte(height >> 24)}, nil))
+	if len(coinbaseOuts) == 0 {
+		coinbaseOuts = []*wire.TxOut{
+			wire.NewTxOut(0, []byte{txscript.OP_TRUE}),
+		}
+	}
+	for _, txOut := range coinbaseOuts {
+		coinbase.AddTxOut(txOut)
+	}
+
+	c.nonce++
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Header.Timestamp.Add(blockInterval),
+			Bits:      c.params.PowLimitBits,
+			Nonce:     c.nonce,
+		},
+		Transactions: append([]*wire.MsgTx{coinbase}, txs...),
+	}
+	utilTxs := make([]*btcutil.Tx, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		utilTxs = append(utilTxs, btcutil.NewTx(tx))
+	}
+	merkles := blockchain.BuildMerkleTreeStore(utilTxs, false)
+	block.Header.MerkleRoot = *merkles[len(merkles)-1]
+	return block
+}
+
+// Mine mines a block holding every mempool transaction, whose coinbase pays
+// to the outputs, or to an anyone-can-spend script if none is given. The
+// clients are notified of the block and of its relevant transactions.
+func (c *Chain) Mine(coinbaseOuts ...*wire.TxOut) *wire.MsgBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	block := c.newBlock(coinbaseOuts, c.mempool)
+	c.mempool = nil
+	c.extend(block)
+	c.connected(block)
+	return block
+}
+
+// MineEmpty mines count blocks holding only their coinbase, leaving the
+// mempool as is.
+func (c *Chain) MineEmpty(count int) []*wire.MsgBlock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	blocks := make([]*wire.MsgBlock, 0, count)
+	for i := 0; i < count; i++ {
+		block := c.newBlock(nil, nil)
+		c.extend(block)
+		c.connected(block)
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// Reorg replaces the depth blocks at the tip of the best chain by count
+// empty blocks. The transactions of the replaced blocks return to the
+// mempool, as they would on a node, where they are mined by the next call to
+// Mine. The clients are notified of the disconnected blocks, tip first, then
+// of the connected ones.
+func (c *Chain) Reorg(depth, count int) ([]*wire.MsgBlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if depth < 1 || depth >= len(c.blocks) {
+		return nil, fmt.Errorf("invalid reorg depth %d at height %d",
+			depth, len(c.blocks)-1)
+	}
+	if count < depth {
+		return nil, fmt.Errorf("reorg of %d blocks by %d would not "+
+			"replace the best chain", depth, count)
+	}
+
+	var restored []*wire.MsgTx
+	for i := 0; i < depth; i++ {
+		tip := c.blocks[len(c.blocks)-1]
+		c.blocks = c.blocks[:len(c.blocks)-1]
+		c.disconnected(tip)
+
+		// Blocks are disconnected tip first, so the transactions of
+		// lower blocks go first to keep their dependencies ordered.
+		restored = append(append([]*wire.MsgTx(nil),
+			tip.Transactions[1:]...), restored...)
+	}
+	c.mempool = append(restored, c.mempool...)
+	for _, tx := range restored {
+		c.accepted(tx)
+	}
+
+	blocks := make([]*wire.MsgBlock, 0, count)
+	for i := 0; i < count; i++ {
+		block := c.newBlock(nil, nil)
+		c.extend(block)
+		c.connected(block)
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Mempool returns the unmined transactions.
+func (c *Chain) Mempool() []*wire.MsgTx {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*wire.MsgTx(nil), c.mempool...)
+}
+
+// Tip returns the block at the tip of the best chain and its height.
+func (c *Chain) Tip() (*wire.MsgBlock, int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.blocks[len(c.blocks)-1], int32(len(c.blocks) - 1)
+}
+
+// tx returns the transaction of the mempool or of the best chain with the
+// hash.
+func (c *Chain) tx(txHash *chainhash.Hash) (*wire.MsgTx, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tx := range c.mempool {
+		if tx.TxHash() == *txHash {
+			return tx, nil
+		}
+	}
+	for _, block := range c.blocks {
+		for _, tx := range block.Transactions {
+			if tx.TxHash() == *txHash {
+				return tx, nil
+			}
+		}
+	}
+	return nil, ErrTxNotFound
+}
+
+// spent returns the transaction of the best chain spending the outpoint, or
+// nil if it is unspent.
+func (c *Chain) spent(op wire.OutPoint) *wire.MsgTx {
+	for _, block := range c.blocks {
+		for _, tx := range block.Transactions[1:] {
+			for _, txIn := range tx.TxIn {
+				if txIn.PreviousOutPoint == op {
+					return tx
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// prevOutScripts returns the scripts of the outputs the block spends, out of
+// the known blocks.
+func (c *Chain) prevOutScripts(block *wire.MsgBlock) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txs := make(map[chainhash.Hash]*wire.MsgTx)
+	for _, known := range c.known {
+		for _, tx := range known.Transactions {
+			txs[tx.TxHash()] = tx
+		}
+	}
+
+	var scripts [][]byte
+	for _, tx := range block.Transactions[1:] {
+		for _, txIn := range tx.TxIn {
+			prevTx, ok := txs[txIn.PreviousOutPoint.Hash]
+			if !ok || int(txIn.PreviousOutPoint.Index) >=
+				len(prevTx.TxOut) {
+
+				continue
+			}
+			scripts = append(scripts,
+				prevTx.TxOut[txIn.PreviousOutPoint.Index].PkScript)
+		}
+	}
+	return scripts
+}
+
+// broadcast accepts the transaction into the mempool. Mempool transactions
+// spending one of its inputs are replaced by it, along with the
+// transactions spending their outputs, which is how replace-by-fee plays out
+// on a node accepting the replacement.
+func (c *Chain) broadcast(tx *wire.MsgTx) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	txHash := tx.TxHash()
+	for _, mempoolTx := range c.mempool {
+		if mempoolTx.TxHash() == txHash {
+			return nil
+		}
+	}
+	for _, txIn := range tx.TxIn {
+		if c.spent(txIn.PreviousOutPoint) != nil {
+			return fmt.Errorf("%w: %v", ErrTxConflict,
+				txIn.PreviousOutPoint)
+		}
+	}
+
+	// Replaced transactions are removed along with their descendants.
+	removed := make(map[chainhash.Hash]struct{})
+	spends := make(map[wire.OutPoint]struct{})
+	for _, txIn := range tx.TxIn {
+		spends[txIn.PreviousOutPoint] = struct{}{}
+	}
+	mempool := c.mempool[:0]
+	for _, mempoolTx := range c.mempool {
+		conflicts := false
+		for _, txIn := range mempoolTx.TxIn {
+			_, spendsReplaced := removed[txIn.PreviousOutPoint.Hash]
+			if _, ok := spends[txIn.PreviousOutPoint]; ok ||
+				spendsReplaced {
+
+				conflicts = true
+			}
+		}
+		if conflicts {
+			removed[mempoolTx.TxHash()] = struct{}{}
+			continue
+		}
+		mempool = append(mempool, mempoolTx)
+	}
+	c.mempool = append(mempool, tx)
+
+	c.accepted(tx)
+	return nil
+}
+
+// blockMeta returns the metadata of a known block.
+func (c *Chain) blockMeta(block *wire.MsgBlock) wtxmgr.BlockMeta {
+	hash := block.BlockHash()
+	return wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: hash, Height: c.heights[hash]},
+		Time:  block.Header.Timestamp,
+	}
+}
+
+// connected announces the block connected to the best chain to the clients.
+func (c *Chain) connected(block *wire.MsgBlock) {
+	meta := c.blockMeta(block)
+	for _, client := range c.clients {
+		client.blockConnected(block, meta)
+	}
+}
+
+// disconnected announces the block disconnected from the best chain to the
+// clients.
+func (c *Chain) disconnected(block *wire.MsgBlock) {
+	meta := c.blockMeta(block)
+	for _, client := range c.clients {
+		client.blockDisconnected(meta)
+	}
+}
+
+// accepted announces the transaction accepted into the mempool to the
+// clients.
+func (c *Chain) accepted(tx *wire.MsgTx) {
+	for _, client := range c.clients {
+		client.txAccepted(tx)
+	}
+}
+
+// block returns a known block and its height.
+func (c *Chain) block(hash *chainhash.Hash) (*wire.MsgBlock, int32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	block, ok := c.known[*hash]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %v", ErrBlockNotFound, hash)
+	}
+	return block, c.heights[*hash], nil
+}
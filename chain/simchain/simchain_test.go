@@ -0,0 +1,290 @@
+package simchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAddr(t *testing.T, b byte) btcutil.Address {
+	t.Helper()
+
+	hash := make([]byte, 20)
+	hash[0] = b
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(
+		hash, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatalf("unable to create address: %v", err)
+	}
+	return addr
+}
+
+func payTo(t *testing.T, addr btcutil.Address, value int64) *wire.TxOut {
+	t.Helper()
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatalf("unable to create script: %v", err)
+	}
+	return wire.NewTxOut(value, pkScript)
+}
+
+// spend returns a transaction spending the outpoint to the address.
+func spend(t *testing.T, op wire.OutPoint, addr btcutil.Address,
+	value int64) *wire.MsgTx {
+
+	t.Helper()
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(payTo(t, addr, value))
+	return tx
+}
+
+// startClient starts a client of the chain watching the address for
+// transactions and blocks, consuming the ClientConnected notification.
+func startClient(t *testing.T, c *Chain, addr btcutil.Address) *Client {
+	t.Helper()
+
+	client := c.NewClient()
+	if err := client.Start(); err != nil {
+		t.Fatalf("unable to start client: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Stop()
+		client.WaitForShutdown()
+	})
+	assert.IsType(t, chain.ClientConnected{}, nextNotification(t, client))
+
+	if err := client.NotifyBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NotifyReceived([]btcutil.Address{addr}); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// nextNotification returns the next notification of the client.
+func nextNotification(t *testing.T, c *Client) interface{} {
+	t.Helper()
+
+	select {
+	case n := <-c.Notifications():
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+		return nil
+	}
+}
+
+// assertRelevantTx asserts the notification reports the transaction mined in
+// the block, or unmined if nil.
+func assertRelevantTx(t *testing.T, n interface{}, tx *wire.MsgTx,
+	block *wtxmgr.BlockMeta) {
+
+	t.Helper()
+
+	if assert.IsType(t, chain.RelevantTx{}, n) {
+		assert.Equal(t, tx.TxHash(), n.(chain.RelevantTx).TxRecord.Hash)
+		assert.Equal(t, block, n.(chain.RelevantTx).Block)
+	}
+}
+
+func blockMeta(block *wire.MsgBlock, height int32) *wtxmgr.BlockMeta {
+	return &wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: block.BlockHash(), Height: height},
+		Time:  block.Header.Timestamp,
+	}
+}
+
+func TestMineAndReorg(t *testing.T) {
+	watched := testAddr(t, 1)
+	c := New(&chaincfg.RegressionNetParams)
+	client := startClient(t, c, watched)
+
+	// A coinbase paying to a watched address is reported with its block.
+	b1 := c.Mine(payTo(t, watched, 5000000000))
+	assertRelevantTx(t, nextNotification(t, client), b1.Transactions[0],
+		blockMeta(b1, 1))
+	assert.Equal(t, chain.BlockConnected(*blockMeta(b1, 1)),
+		nextNotification(t, client))
+
+	// A broadcast payment is reported unmined, then mined.
+	payment := spend(t, wire.OutPoint{Index: 1}, watched, 1000)
+	if _, err := client.SendRawTransaction(payment, false); err != nil {
+		t.Fatalf("unable to broadcast: %v", err)
+	}
+	assertRelevantTx(t, nextNotification(t, client), payment, nil)
+
+	b2 := c.Mine()
+	assert.Equal(t, payment.TxHash(), b2.Transactions[1].TxHash())
+	assertRelevantTx(t, nextNotification(t, client), payment,
+		blockMeta(b2, 2))
+	assert.Equal(t, chain.BlockConnected(*blockMeta(b2, 2)),
+		nextNotification(t, client))
+	assert.Empty(t, c.Mempool())
+
+	// A reorg disconnects the replaced blocks tip first, returns their
+	// transactions to the mempool and connects the new chain.
+	reorged, err := c.Reorg(2, 3)
+	if err != nil {
+		t.Fatalf("unable to reorg: %v", err)
+	}
+	assert.Equal(t, chain.BlockDisconnected(*blockMeta(b2, 2)),
+		nextNotification(t, client))
+	assert.Equal(t, chain.BlockDisconnected(*blockMeta(b1, 1)),
+		nextNotification(t, client))
+	assertRelevantTx(t, nextNotification(t, client), payment, nil)
+	for i, block := range reorged {
+		assert.Equal(t, chain.BlockConnected(*blockMeta(block, int32(i+1))),
+			nextNotification(t, client))
+	}
+	assert.Equal(t, []*wire.MsgTx{payment}, c.Mempool())
+
+	hash, height, err := client.GetBestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reorged[2].BlockHash(), *hash)
+	assert.Equal(t, int32(3), height)
+
+	// Reorganized blocks are still served.
+	b1Hash := b1.BlockHash()
+	block, err := client.GetBlock(&b1Hash)
+	if err != nil {
+		t.Fatalf("unable to get reorganized block: %v", err)
+	}
+	assert.Equal(t, b1, block)
+
+	_, err = c.Reorg(4, 4)
+	assert.Error(t, err)
+	_, err = c.Reorg(2, 1)
+	assert.Error(t, err)
+}
+
+func TestReplacement(t *testing.T) {
+	watched := testAddr(t, 1)
+	c := New(&chaincfg.RegressionNetParams)
+	client := c.NewClient()
+
+	// A replacement evicts the transaction it conflicts with along with
+	// its descendants.
+	op := wire.OutPoint{Hash: chainhash.Hash{0x01}}
+	original := spend(t, op, watched, 2000)
+	child := spend(t, wire.OutPoint{Hash: original.TxHash()}, watched, 1000)
+	unrelated := spend(t, wire.OutPoint{Hash: chainhash.Hash{0x02}},
+		watched, 1000)
+	for _, tx := range []*wire.MsgTx{original, child, unrelated} {
+		if _, err := client.SendRawTransaction(tx, false); err != nil {
+			t.Fatalf("unable to broadcast: %v", err)
+		}
+	}
+	replacement := spend(t, op, watched, 1500)
+	if _, err := client.SendRawTransaction(replacement, false); err != nil {
+		t.Fatalf("unable to broadcast replacement: %v", err)
+	}
+	assert.Equal(t, []*wire.MsgTx{unrelated, replacement}, c.Mempool())
+
+	// Once mined, the spent output can't be spent again.
+	c.Mine()
+	_, err := client.SendRawTransaction(original, false)
+	assert.True(t, errors.Is(err, ErrTxConflict))
+}
+
+func TestRescan(t *testing.T) {
+	watched := testAddr(t, 1)
+	c := New(&chaincfg.RegressionNetParams)
+	client := c.NewClient()
+
+	payment := spend(t, wire.OutPoint{Index: 1}, watched, 1000)
+	if _, err := client.SendRawTransaction(payment, false); err != nil {
+		t.Fatal(err)
+	}
+	b1 := c.Mine()
+	c.MineEmpty(2)
+
+	// The spend of the payment is only relevant to the rescan once the
+	// payment is found.
+	change := spend(t, wire.OutPoint{Hash: payment.TxHash()},
+		testAddr(t, 2), 500)
+	if _, err := client.SendRawTransaction(change, false); err != nil {
+		t.Fatal(err)
+	}
+	b4 := c.Mine()
+	tip, _ := c.Tip()
+
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		client.Stop()
+		client.WaitForShutdown()
+	}()
+	assert.IsType(t, chain.ClientConnected{}, nextNotification(t, client))
+
+	genesisHash := chaincfg.RegressionNetParams.GenesisHash
+	err := client.Rescan(genesisHash, []btcutil.Address{watched}, nil)
+	if err != nil {
+		t.Fatalf("unable to rescan: %v", err)
+	}
+	assertRelevantTx(t, nextNotification(t, client), payment,
+		blockMeta(b1, 1))
+	assert.Equal(t, chain.RescanProgress{
+		Hash:   b1.BlockHash(),
+		Height: 1,
+		Time:   b1.Header.Timestamp,
+	}, nextNotification(t, client))
+	assertRelevantTx(t, nextNotification(t, client), change,
+		blockMeta(b4, 4))
+	assert.Equal(t, chain.RescanProgress{
+		Hash:   b4.BlockHash(),
+		Height: 4,
+		Time:   b4.Header.Timestamp,
+	}, nextNotification(t, client))
+	assert.Equal(t, chain.RescanFinished{
+		Hash:   tip.BlockHash(),
+		Height: 4,
+		Time:   tip.Header.Timestamp,
+	}, nextNotification(t, client))
+}
+
+func TestNotificationDelay(t *testing.T) {
+	watched := testAddr(t, 1)
+	c := New(&chaincfg.RegressionNetParams)
+	client := startClient(t, c, watched)
+
+	// Mining doesn't wait for the delayed notifications to be delivered.
+	const delay = 50 * time.Millisecond
+	client.SetNotificationDelay(delay)
+	start := time.Now()
+	blocks := c.MineEmpty(2)
+	assert.Less(t, time.Since(start), delay)
+
+	for i, block := range blocks {
+		assert.Equal(t, chain.BlockConnected(*blockMeta(block, int32(i+1))),
+			nextNotification(t, client))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 2*delay)
+
+	// Stopping closes the notification channel, dropping what is still
+	// queued.
+	c.MineEmpty(1)
+	client.Stop()
+	client.WaitForShutdown()
+	select {
+	case _, ok := <-client.Notifications():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification channel not closed")
+	}
+}
@@ -0,0 +1,108 @@
+package chain
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// watchedSet holds the output scripts and outpoints watched by backends that
+// match transactions themselves rather than letting the node do it. A
+// transaction is relevant if it pays to a watched script or spends a watched
+// outpoint, and the outputs paying to watched scripts are watched in turn.
+type watchedSet struct {
+	scripts   map[string]struct{}
+	outPoints map[wire.OutPoint]struct{}
+}
+
+func newWatchedSet() *watchedSet {
+	return &watchedSet{
+		scripts:   make(map[string]struct{}),
+		outPoints: make(map[wire.OutPoint]struct{}),
+	}
+}
+
+// addAddrs watches the output scripts of the addresses.
+func (s *watchedSet) addAddrs(addrs []btcutil.Address) error {
+	for _, addr := range addrs {
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return err
+		}
+		s.scripts[string(script)] = struct{}{}
+	}
+	return nil
+}
+
+// addOutPoints watches the outpoints, along with the scripts of the
+// addresses they pay to, which compact filters commit to when spent.
+func (s *watchedSet) addOutPoints(
+	outPoints map[wire.OutPoint]btcutil.Address) error {
+
+	for op, addr := range outPoints {
+		script, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return err
+		}
+		s.scripts[string(script)] = struct{}{}
+		s.outPoints[op] = struct{}{}
+	}
+	return nil
+}
+
+// isEmpty returns whether nothing is watched.
+func (s *watchedSet) isEmpty() bool {
+	return len(s.scripts) == 0 && len(s.outPoints) == 0
+}
+
+// scriptList returns the watched scripts.
+func (s *watchedSet) scriptList() [][]byte {
+	scripts := make([][]byte, 0, len(s.scripts))
+	for script := range s.scripts {
+		scripts = append(scripts, []byte(script))
+	}
+	return scripts
+}
+
+// relevantTx returns whether the transaction pays to a watched script or
+// spends a watched outpoint, watching the outputs paying to watched scripts.
+func (s *watchedSet) relevantTx(tx *wire.MsgTx) bool {
+	relevant := false
+	for _, txIn := range tx.TxIn {
+		if _, ok := s.outPoints[txIn.PreviousOutPoint]; ok {
+			relevant = true
+		}
+	}
+
+	txHash := tx.TxHash()
+	for i, txOut := range tx.TxOut {
+		if _, ok := s.scripts[string(txOut.PkScript)]; ok {
+			relevant = true
+			s.outPoints[*wire.NewOutPoint(&txHash, uint32(i))] =
+				struct{}{}
+		}
+	}
+	return relevant
+}
+
+// filterBlock returns the records of the relevant transactions of a block.
+func (s *watchedSet) filterBlock(
+	block *wire.MsgBlock) ([]*wtxmgr.TxRecord, error) {
+
+	var recs []*wtxmgr.TxRecord
+	for _, tx := range block.Transactions {
+		if !s.relevantTx(tx) {
+			continue
+		}
+
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
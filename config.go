@@ -40,6 +40,20 @@ type config struct {
 	ProxyUser        string `long:"proxyuser" description:"Username for proxy server"`
 	ProxyPass        string `long:"proxypass" default-mask:"-" description:"Password for proxy server"`
 
+	// bitcoind client options
+	UseBitcoind          bool          `long:"usebitcoind" description:"Use a bitcoind node at rpcconnect rather than btcd for chain synchronization"`
+	ZMQPubRawBlock       string        `long:"zmqpubrawblock" description:"ZMQ endpoint bitcoind publishes raw blocks on (eg. tcp://127.0.0.1:28332) -- bitcoind is polled for new blocks if unset"`
+	ZMQPubRawTx          string        `long:"zmqpubrawtx" description:"ZMQ endpoint bitcoind publishes raw transactions on (eg. tcp://127.0.0.1:28333) -- the bitcoind mempool is polled if unset"`
+	BitcoindPollInterval time.Duration `long:"bitcoindpollinterval" description:"How often bitcoind is polled for what is not received over ZMQ.  Valid time units are {s, m, h}"`
+
+	// Electrum client options
+	ElectrumServer string `long:"electrumserver" description:"Hostname/IP and port of an Electrum server (eg. Electrs or Fulcrum) to use rather than btcd for chain synchronization"`
+	ElectrumTLS    bool   `long:"electrumtls" description:"Connect to the Electrum server over TLS"`
+
+	// Esplora client options
+	EsploraURL          string        `long:"esplora" description:"Base URL of an Esplora HTTP API (eg. https://blockstream.info/api) to poll rather than btcd for chain synchronization"`
+	EsploraPollInterval time.Duration `long:"esplorapollinterval" description:"How often the Esplora API is polled for new blocks and transactions.  The mempool transactions of at most 100 watched addresses are polled per interval.  Valid time units are {s, m, h}"`
+
 	// SPV client options
 	UseSPV       bool          `long:"usespv" description:"Enables the experimental use of SPV rather than RPC for chain synchronization"`
 	AddPeers     []string      `short:"a" long:"addpeer" description:"Add a peer to connect with at startup"`
@@ -82,13 +96,15 @@ func loadConfig() (*config, []string, error) {
 		ConfigFile:             "/Users/zhihongcai/Library/Application Support/Btcwallet/btc-wallet.conf",
 		AppDataDir:             "/Users/zhihongcai/Library/Application Support/Btcwallet",
 		LogDir:                 "/Users/zhihongcai/Library/Application Support/Btcwallet/logs/mainnet",
-		WalletPass:             "public",
+		WalletPass:             wallet.InsecurePubPassphrase,
 		CAFile:                 "/Users/zhihongcai/Library/Application Support/Btcd/rpc.cert",
 		RPCKey:                 "/Users/zhihongcai/Library/Application Support/Btcwallet/rpc.key",
 		RPCCert:                "/Users/zhihongcai/Library/Application Support/Btcwallet/rpc.cert",
 		LegacyRPCMaxClients:    10,
 		LegacyRPCMaxWebsockets: 25,
 		DataDir:                "/Users/zhihongcai/Library/Application Support/Btcwallet",
+		BitcoindPollInterval:   10 * time.Second,
+		EsploraPollInterval:    30 * time.Second,
 		UseSPV:                 false,
 		AddPeers:               []string{},
 		ConnectPeers:           []string{},
@@ -153,7 +169,7 @@ func loadConfig() (*config, []string, error) {
 		keystorePath := filepath.Join(netDir, "wallet.bin")
 		keystoreExists, err := cfgutil.FileExists(keystorePath)
 		if err != nil {
-			fmt.Println(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, err)
 			return nil, nil, err
 		}
 		if !keystoreExists {
@@ -0,0 +1,54 @@
+//go:build linux
+
+package securemem
+
+import (
+	"os"
+	"syscall"
+)
+
+// alloc maps size bytes between two PROT_NONE guard pages and locks the data
+// pages into RAM. The data is placed at the end of the usable area so that
+// an overrun immediately hits the trailing guard page.
+func alloc(size int) (data, region []byte, locked bool, err error) {
+	pageSize := os.Getpagesize()
+	dataPages := (size + pageSize - 1) / pageSize
+	if dataPages == 0 {
+		dataPages = 1
+	}
+	total := (dataPages + 2) * pageSize
+
+	region, err = syscall.Mmap(-1, 0, total,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	err = syscall.Mprotect(region[:pageSize], syscall.PROT_NONE)
+	if err == nil {
+		err = syscall.Mprotect(region[total-pageSize:], syscall.PROT_NONE)
+	}
+	if err != nil {
+		_ = syscall.Munmap(region)
+		return nil, nil, false, err
+	}
+
+	inner := region[pageSize : total-pageSize]
+
+	// Failing to lock usually means RLIMIT_MEMLOCK is exhausted. The
+	// buffer is still usable, it just may be swapped out.
+	locked = syscall.Mlock(inner) == nil
+
+	data = inner[len(inner)-size:]
+	return data, region, locked, nil
+}
+
+// free unlocks and unmaps a region returned by alloc.
+func free(region []byte) {
+	pageSize := os.Getpagesize()
+	inner := region[pageSize : len(region)-pageSize]
+
+	_ = syscall.Munlock(inner)
+	_ = syscall.Munmap(region)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package securemem
+
+// alloc backs buffers with the Go heap on platforms without a locked memory
+// implementation.
+func alloc(size int) (data, region []byte, locked bool, err error) {
+	return make([]byte, size), nil, false, nil
+}
+
+func free(region []byte) {}
@@ -0,0 +1,135 @@
+package securemem
+
+import (
+	"os"
+	"sync"
+
+	"github.com/czh0526/btc-wallet/internal/zero"
+)
+
+// Pool hands out small fixed-size slots carved from locked pages. It is
+// meant for many short secrets, such as cached private keys, where a
+// dedicated guarded mapping per secret would exhaust the mlock limit.
+type Pool struct {
+	mu       sync.Mutex
+	slotSize int
+	chunks   []*Buffer
+	free     [][]byte
+	gen      uint64
+}
+
+// Slot is a piece of pool memory holding a single secret.
+type Slot struct {
+	pool *Pool
+	data []byte
+	gen  uint64
+}
+
+// NewPool creates a pool of slots of slotSize bytes each.
+func NewPool(slotSize int) *Pool {
+	return &Pool{slotSize: slotSize}
+}
+
+// Get returns a zeroed slot. The slot must be returned to the pool by
+// Release; a slot dropped without it stays in use until the next Wipe.
+func (p *Pool) Get() *Slot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.free) == 0 {
+		p.grow()
+	}
+
+	n := len(p.free) - 1
+	s := &Slot{pool: p, data: p.free[n], gen: p.gen}
+	p.free[n] = nil
+	p.free = p.free[:n]
+
+	return s
+}
+
+// grow adds one page worth of slots to the free list. The pool lock must be
+// held.
+func (p *Pool) grow() {
+	size := os.Getpagesize()
+	if size < p.slotSize {
+		size = p.slotSize
+	}
+	chunk := New(size - size%p.slotSize)
+	p.chunks = append(p.chunks, chunk)
+
+	mem := chunk.Bytes()
+	for i := 0; i+p.slotSize <= len(mem); i += p.slotSize {
+		p.free = append(p.free, mem[i:i+p.slotSize:i+p.slotSize])
+	}
+}
+
+// Wipe zeroes every slot, including ones still held by callers, and makes
+// all of them available again. Slots obtained before the call are
+// invalidated: their Bytes returns nil and their Release becomes a no-op. The memory stays mapped so concurrent
+// readers never fault.
+func (p *Pool) Wipe() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.gen++
+	p.free = p.free[:0]
+	for _, chunk := range p.chunks {
+		chunk.Wipe()
+
+		mem := chunk.Bytes()
+		for i := 0; i+p.slotSize <= len(mem); i += p.slotSize {
+			p.free = append(p.free, mem[i:i+p.slotSize:i+p.slotSize])
+		}
+	}
+}
+
+// Destroy wipes and unmaps all memory owned by the pool. Neither the pool nor
+// any of its slots may be used afterwards.
+func (p *Pool) Destroy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.gen++
+	for _, chunk := range p.chunks {
+		chunk.Destroy()
+	}
+	p.chunks = nil
+	p.free = nil
+}
+
+// Bytes returns the contents of the slot, or nil if the pool has been wiped
+// or destroyed since the slot was handed out, as its memory may since have
+// been given to another slot. The result must not be kept beyond the current
+// use.
+func (s *Slot) Bytes() []byte {
+	p := s.pool
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.gen != p.gen {
+		return nil
+	}
+	return s.data
+}
+
+// Release wipes the slot and returns it to its pool.
+func (s *Slot) Release() {
+	p := s.pool
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	if s.gen == p.gen {
+		zero.Bytes(s.data)
+		p.free = append(p.free, s.data)
+	}
+	p.mu.Unlock()
+
+	s.pool, s.data = nil, nil
+}
@@ -0,0 +1,81 @@
+// Package securemem provides memory for secret key material that is kept out
+// of swap and wiped deterministically.
+//
+// On Linux every Buffer is placed in its own anonymous mapping, locked into
+// RAM with mlock(2) and surrounded by inaccessible guard pages, so that a
+// linear overrun faults instead of reading or corrupting neighbouring secrets.
+// On other platforms, or when the mapping cannot be created, buffers fall back
+// to ordinary heap memory and only the wiping guarantees remain.
+package securemem
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/czh0526/btc-wallet/internal/zero"
+)
+
+// Buffer is a fixed-size region of memory holding secret material.
+type Buffer struct {
+	mu     sync.Mutex
+	data   []byte
+	region []byte
+	locked bool
+}
+
+// New allocates a zeroed buffer of size bytes. It never fails: if locked
+// memory is unavailable the buffer is backed by the heap instead, which can
+// be checked with Locked.
+func New(size int) *Buffer {
+	b := &Buffer{}
+
+	data, region, locked, err := alloc(size)
+	if err != nil {
+		data, region, locked = make([]byte, size), nil, false
+	}
+	b.data, b.region, b.locked = data, region, locked
+
+	if region != nil {
+		runtime.SetFinalizer(b, (*Buffer).Destroy)
+	}
+	return b
+}
+
+// Bytes returns the contents of the buffer. The returned slice aliases the
+// buffer and must not be retained after Destroy.
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Len returns the size of the buffer in bytes.
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+// Locked reports whether the buffer is locked into RAM.
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// Wipe zeroes the buffer. The buffer stays usable afterwards.
+func (b *Buffer) Wipe() {
+	b.mu.Lock()
+	zero.Bytes(b.data)
+	b.mu.Unlock()
+}
+
+// Destroy wipes the buffer and releases the underlying memory. The buffer
+// must not be used afterwards.
+func (b *Buffer) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	zero.Bytes(b.data)
+	if b.region != nil {
+		free(b.region)
+		b.region = nil
+	}
+	b.data = nil
+	b.locked = false
+	runtime.SetFinalizer(b, nil)
+}
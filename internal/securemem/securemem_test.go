@@ -0,0 +1,72 @@
+package securemem
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+func TestBufferWipeAndDestroy(t *testing.T) {
+	b := New(32)
+	if b.Len() != 32 {
+		t.Fatalf("unexpected length %d", b.Len())
+	}
+	if runtime.GOOS == "linux" && b.region == nil {
+		t.Fatalf("buffer not placed in its own mapping")
+	}
+
+	copy(b.Bytes(), bytes.Repeat([]byte{0xaa}, 32))
+	b.Wipe()
+	if !bytes.Equal(b.Bytes(), make([]byte, 32)) {
+		t.Fatalf("buffer not wiped: %x", b.Bytes())
+	}
+
+	// The buffer remains usable after a wipe.
+	b.Bytes()[31] = 1
+
+	b.Destroy()
+	if b.Bytes() != nil || b.Locked() {
+		t.Fatalf("buffer still accessible after destroy")
+	}
+}
+
+func TestPoolWipe(t *testing.T) {
+	p := NewPool(32)
+	defer p.Destroy()
+
+	s1, s2 := p.Get(), p.Get()
+	copy(s1.Bytes(), bytes.Repeat([]byte{0x11}, 32))
+	copy(s2.Bytes(), bytes.Repeat([]byte{0x22}, 32))
+
+	// Releasing a slot wipes it and makes it available again.
+	s1Mem := s1.Bytes()
+	s1.Release()
+	if !bytes.Equal(s1Mem, make([]byte, 32)) {
+		t.Fatalf("released slot not wiped: %x", s1Mem)
+	}
+
+	// Wiping the pool clears slots still held by callers and invalidates
+	// them, and their later release must not hand the memory out twice.
+	s2Mem := s2.Bytes()
+	p.Wipe()
+	if !bytes.Equal(s2Mem, make([]byte, 32)) {
+		t.Fatalf("held slot not wiped: %x", s2Mem)
+	}
+	if s2.Bytes() != nil {
+		t.Fatalf("stale slot still readable after wipe")
+	}
+
+	// A slot handed out after the wipe may reuse the memory of the stale
+	// one, which must not see its contents.
+	s3 := p.Get()
+	defer s3.Release()
+	copy(s3.Bytes(), bytes.Repeat([]byte{0x33}, 32))
+	if s2.Bytes() != nil {
+		t.Fatalf("stale slot aliases reused memory")
+	}
+	free := len(p.free)
+	s2.Release()
+	if len(p.free) != free {
+		t.Fatalf("stale slot returned to pool")
+	}
+}
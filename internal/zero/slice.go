@@ -1,8 +1,12 @@
 package zero
 
-// Bytes
+import "runtime"
+
+// Bytes sets all bytes in the passed slice to zero. This is used to
+// explicitly clear private key material from memory.
 func Bytes(b []byte) {
 	for i := range b {
 		b[i] = 0
 	}
+	runtime.KeepAlive(b)
 }
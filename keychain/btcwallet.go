@@ -0,0 +1,372 @@
+package keychain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+var (
+	// waddrmgrNamespaceKey is the namespace key that the waddrmgr state is
+	// stored within the top-level walletdb buckets of the wallet.
+	waddrmgrNamespaceKey = []byte("waddrmgr")
+
+	// lightningAddrSchema is the scope addr schema for all keys that we
+	// derive. We'll treat them all as p2wkh addresses, as atm we must
+	// specify a particular type.
+	lightningAddrSchema = waddrmgr.ScopeAddrSchema{
+		ExternalAddrType: waddrmgr.WitnessPubKey,
+		InternalAddrType: waddrmgr.WitnessPubKey,
+	}
+
+	// ErrCannotDerivePrivKey is returned when DerivePrivKey is unable to
+	// derive a private key given only the public key and target key
+	// family.
+	ErrCannotDerivePrivKey = errors.New("unable to derive private key")
+)
+
+// BtcWalletKeyRing is an implementation of both the KeyRing and SecretKeyRing
+// interfaces backed by the wallet's address manager. All keys are derived
+// under the custom BIP0043Purpose key scope, with each KeyFamily mapped to an
+// account within that scope.
+type BtcWalletKeyRing struct {
+	db      walletdb.DB
+	addrMgr *waddrmgr.Manager
+
+	// chainKeyScope defines the purpose and coin type to be used when
+	// generating keys for this keyring.
+	chainKeyScope waddrmgr.KeyScope
+}
+
+// NewBtcWalletKeyRing creates a new implementation of the
+// keychain.SecretKeyRing interface backed by the address manager stored in
+// db.
+//
+// NOTE: The passed address manager MUST be unlocked in order for the keychain
+// to function.
+func NewBtcWalletKeyRing(db walletdb.DB, addrMgr *waddrmgr.Manager,
+	coinType uint32) SecretKeyRing {
+
+	keyScope := waddrmgr.KeyScope{
+		Purpose: BIP0043Purpose,
+		Coin:    coinType,
+	}
+
+	return &BtcWalletKeyRing{
+		db:            db,
+		addrMgr:       addrMgr,
+		chainKeyScope: keyScope,
+	}
+}
+
+// keyScope attempts to return the key scope that we'll use to derive all of
+// our keys. If the scope has already been fetched from the database, then a
+// cached version will be returned. Otherwise, we'll fetch it from the
+// database and cache it for subsequent accesses.
+func (b *BtcWalletKeyRing) keyScope() (*waddrmgr.ScopedKeyManager, error) {
+	scope, err := b.addrMgr.FetchScopedKeyManager(b.chainKeyScope)
+	if err == nil {
+		return scope, nil
+	}
+	if !waddrmgr.IsError(err, waddrmgr.ErrScopeNotFound) {
+		return nil, err
+	}
+
+	// If the scope hasn't yet been created (it wouldn't be in the
+	// database by default), then we'll create it now.
+	err = walletdb.Update(b.db, func(tx walletdb.ReadWriteTx) error {
+		addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		scope, err = b.addrMgr.NewScopedKeyManager(
+			addrmgrNs, b.chainKeyScope, lightningAddrSchema)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return scope, nil
+}
+
+// createAccountIfNotExists will create the corresponding account for a key
+// family if it doesn't already exist in the database.
+func (b *BtcWalletKeyRing) createAccountIfNotExists(
+	addrmgrNs walletdb.ReadWriteBucket, keyFam KeyFamily,
+	scope *waddrmgr.ScopedKeyManager) error {
+
+	// If this is the multi-sig key family, then we can return early as
+	// this is the default account that's created.
+	if keyFam == KeyFamilyMultiSig {
+		return nil
+	}
+
+	// Otherwise, we'll check if the account already exists, if so, we
+	// can once again bail early.
+	_, err := scope.AccountProperties(addrmgrNs, uint32(keyFam))
+	if err == nil {
+		return nil
+	}
+	if !waddrmgr.IsError(err, waddrmgr.ErrAccountNotFound) {
+		return err
+	}
+
+	// If we reach this point, then the account hasn't yet been created,
+	// so we'll need to create it before we can proceed.
+	return scope.NewRawAccount(addrmgrNs, uint32(keyFam))
+}
+
+// DeriveNextKey attempts to derive the *next* key within the key family
+// (account in BIP43) specified. This method should return the next external
+// child within this branch.
+//
+// NOTE: This is part of the keychain.KeyRing interface.
+func (b *BtcWalletKeyRing) DeriveNextKey(keyFam KeyFamily) (
+	KeyDescriptor, error) {
+
+	var (
+		pubKey *btcec.PublicKey
+		keyLoc KeyLocator
+	)
+
+	scope, err := b.keyScope()
+	if err != nil {
+		return KeyDescriptor{}, err
+	}
+
+	err = walletdb.Update(b.db, func(tx walletdb.ReadWriteTx) error {
+		addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		// If the account doesn't exist, then we may need to create it
+		// for the first time in order to derive the keys that we
+		// require.
+		err := b.createAccountIfNotExists(addrmgrNs, keyFam, scope)
+		if err != nil {
+			return err
+		}
+
+		addrs, err := scope.NextExternalAddresses(
+			addrmgrNs, uint32(keyFam), 1)
+		if err != nil {
+			return err
+		}
+
+		// Now that we have this address, we'll populate the key
+		// locator and public key to return to the caller.
+		addr := addrs[0].(waddrmgr.ManagedPubKeyAddress)
+		_, path, _ := addr.DerivationInfo()
+
+		pubKey = addr.PubKey()
+		keyLoc = KeyLocator{
+			Family: keyFam,
+			Index:  path.Index,
+		}
+
+		return nil
+	})
+	if err != nil {
+		return KeyDescriptor{}, err
+	}
+
+	return KeyDescriptor{
+		PubKey:     pubKey,
+		KeyLocator: keyLoc,
+	}, nil
+}
+
+// DeriveKey attempts to derive an arbitrary key specified by the passed
+// KeyLocator. This may be used in several recovery scenarios, or when
+// manually rotating something like our current default node key.
+//
+// NOTE: This is part of the keychain.KeyRing interface.
+func (b *BtcWalletKeyRing) DeriveKey(keyLoc KeyLocator) (KeyDescriptor, error) {
+	var keyDesc KeyDescriptor
+
+	scope, err := b.keyScope()
+	if err != nil {
+		return keyDesc, err
+	}
+
+	err = walletdb.Update(b.db, func(tx walletdb.ReadWriteTx) error {
+		addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		// If the account doesn't exist, then we may need to create it
+		// for the first time in order to derive the keys that we
+		// require.
+		err := b.createAccountIfNotExists(
+			addrmgrNs, keyLoc.Family, scope)
+		if err != nil {
+			return err
+		}
+
+		path := waddrmgr.DerivationPath{
+			InternalAccount: uint32(keyLoc.Family),
+			Branch:          0,
+			Index:           keyLoc.Index,
+		}
+		addr, err := scope.DeriveFromKeyPath(addrmgrNs, path)
+		if err != nil {
+			return err
+		}
+
+		keyDesc.KeyLocator = keyLoc
+		keyDesc.PubKey = addr.(waddrmgr.ManagedPubKeyAddress).PubKey()
+
+		return nil
+	})
+	if err != nil {
+		return keyDesc, err
+	}
+
+	return keyDesc, nil
+}
+
+// DerivePrivKey attempts to derive the private key that corresponds to the
+// passed key descriptor.
+//
+// NOTE: This is part of the keychain.SecretKeyRing interface.
+func (b *BtcWalletKeyRing) DerivePrivKey(keyDesc KeyDescriptor) (
+	*btcec.PrivateKey, error) {
+
+	var key *btcec.PrivateKey
+
+	scope, err := b.keyScope()
+	if err != nil {
+		return nil, err
+	}
+
+	err = walletdb.Update(b.db, func(tx walletdb.ReadWriteTx) error {
+		addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		// If the account doesn't exist, then we may need to create it
+		// for the first time in order to derive the keys that we
+		// require.
+		err := b.createAccountIfNotExists(
+			addrmgrNs, keyDesc.Family, scope)
+		if err != nil {
+			return err
+		}
+
+		// If the public key isn't set or they have a non-zero index,
+		// then we know that the caller instead knows the derivation
+		// path for a key.
+		if keyDesc.PubKey == nil || keyDesc.Index != 0 {
+			path := waddrmgr.DerivationPath{
+				InternalAccount: uint32(keyDesc.Family),
+				Branch:          0,
+				Index:           keyDesc.Index,
+			}
+			key, err = derivePrivKeyFromPath(addrmgrNs, scope, path)
+			return err
+		}
+
+		// If the public key isn't nil, then this indicates that we
+		// need to scan for the private key, assuming that we know the
+		// valid key family.
+		nextPath := waddrmgr.DerivationPath{
+			InternalAccount: uint32(keyDesc.Family),
+			Branch:          0,
+			Index:           0,
+		}
+
+		// We'll now iterate through our key range in an attempt to
+		// find the target public key.
+		for i := 0; i < MaxKeyRangeScan; i++ {
+			privKey, err := derivePrivKeyFromPath(
+				addrmgrNs, scope, nextPath)
+			if err != nil {
+				return err
+			}
+
+			// If we derive the public key that matches, then we'll
+			// return the private key.
+			if keyDesc.PubKey.IsEqual(privKey.PubKey()) {
+				key = privKey
+				return nil
+			}
+
+			// Otherwise, we'll increment the index and try the
+			// next key.
+			nextPath.Index++
+		}
+
+		// If we reach this point, then we weren't able to derive the
+		// private key, so we'll return an error.
+		return ErrCannotDerivePrivKey
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ECDH performs a scalar multiplication (ECDH-like operation) between the
+// target key descriptor and remote public key. The output returned will be
+// the sha256 of the resulting shared point serialized in compressed format.
+//
+// NOTE: This is part of the keychain.SecretKeyRing interface.
+func (b *BtcWalletKeyRing) ECDH(keyDesc KeyDescriptor,
+	pubKey *btcec.PublicKey) ([32]byte, error) {
+
+	privKey, err := b.DerivePrivKey(keyDesc)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	var (
+		pubJacobian btcec.JacobianPoint
+		s           btcec.JacobianPoint
+	)
+	pubKey.AsJacobian(&pubJacobian)
+
+	btcec.ScalarMultNonConst(&privKey.Key, &pubJacobian, &s)
+	s.ToAffine()
+	sPubKey := btcec.NewPublicKey(&s.X, &s.Y)
+	h := sha256.Sum256(sPubKey.SerializeCompressed())
+
+	return h, nil
+}
+
+// SignMessage signs the given message, single or double SHA256 hashing it
+// first, with the private key described in the key descriptor.
+//
+// NOTE: This is part of the keychain.SecretKeyRing interface.
+func (b *BtcWalletKeyRing) SignMessage(keyDesc KeyDescriptor, msg []byte,
+	doubleHash bool) (*ecdsa.Signature, error) {
+
+	privKey, err := b.DerivePrivKey(keyDesc)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving private key: %w", err)
+	}
+
+	var digest []byte
+	if doubleHash {
+		digest = chainhash.DoubleHashB(msg)
+	} else {
+		digest = chainhash.HashB(msg)
+	}
+	return ecdsa.Sign(privKey, digest), nil
+}
+
+// derivePrivKeyFromPath derives the private key for the given derivation
+// path within the passed scope.
+func derivePrivKeyFromPath(addrmgrNs walletdb.ReadBucket,
+	scope *waddrmgr.ScopedKeyManager,
+	path waddrmgr.DerivationPath) (*btcec.PrivateKey, error) {
+
+	addr, err := scope.DeriveFromKeyPath(addrmgrNs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return addr.(waddrmgr.ManagedPubKeyAddress).PrivKey()
+}
+
+// A compile time check to ensure that BtcWalletKeyRing implements the
+// SecretKeyRing interface.
+var _ SecretKeyRing = (*BtcWalletKeyRing)(nil)
@@ -0,0 +1,229 @@
+package keychain
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testHDSeed = chainhash.Hash{
+		0xb7, 0x94, 0x38, 0x5f, 0x2d, 0x1e, 0xf7, 0xab,
+		0x4d, 0x92, 0x73, 0xd1, 0x90, 0x63, 0x81, 0xb4,
+		0x4f, 0x2f, 0x6f, 0x25, 0x88, 0xa3, 0xef, 0xb9,
+		0x6a, 0x49, 0x18, 0x83, 0x31, 0x98, 0x47, 0x53,
+	}
+
+	pubPassphrase  = []byte("public")
+	privPassphrase = []byte("private")
+
+	testKeyFamilies = []KeyFamily{
+		KeyFamilyMultiSig,
+		KeyFamilyRevocationBase,
+		KeyFamilyHtlcBase,
+		KeyFamilyNodeKey,
+	}
+)
+
+func createTestKeyRing(t *testing.T) (SecretKeyRing, func()) {
+	dirName, err := os.MkdirTemp("", "keyringtest")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	dbPath := filepath.Join(dirName, "keyring.db")
+	db, err := walletdb.Create("bdb", dbPath, true, 10*time.Second)
+	if err != nil {
+		_ = os.RemoveAll(dirName)
+		t.Fatalf("unable to create db: %v", err)
+	}
+	cleanUp := func() {
+		db.Close()
+		_ = os.RemoveAll(dirName)
+	}
+
+	rootKey, err := hdkeychain.NewMaster(
+		testHDSeed[:], &chaincfg.RegressionNetParams)
+	if err != nil {
+		cleanUp()
+		t.Fatalf("unable to create root key: %v", err)
+	}
+
+	var mgr *waddrmgr.Manager
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = waddrmgr.Create(
+			ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.RegressionNetParams,
+			&waddrmgr.FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = waddrmgr.Open(
+			ns, pubPassphrase, &chaincfg.RegressionNetParams)
+		if err != nil {
+			return err
+		}
+
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		cleanUp()
+		t.Fatalf("unable to create address manager: %v", err)
+	}
+
+	keyRing := NewBtcWalletKeyRing(
+		db, mgr, chaincfg.RegressionNetParams.HDCoinType)
+	return keyRing, cleanUp
+}
+
+func TestKeyRingDerivation(t *testing.T) {
+	t.Parallel()
+
+	keyRing, cleanUp := createTestKeyRing(t)
+	defer cleanUp()
+
+	const numKeysToDerive = 5
+	for _, keyFam := range testKeyFamilies {
+		var keyDesc KeyDescriptor
+		for i := 0; i < numKeysToDerive; i++ {
+			var err error
+			keyDesc, err = keyRing.DeriveNextKey(keyFam)
+			if err != nil {
+				t.Fatalf("unable to derive next key for family "+
+					"%v: %v", keyFam, err)
+			}
+
+			if keyDesc.Family != keyFam {
+				t.Fatalf("wrong family: expected %v, got %v",
+					keyFam, keyDesc.Family)
+			}
+			if keyDesc.Index != uint32(i) {
+				t.Fatalf("wrong index: expected %v, got %v",
+					i, keyDesc.Index)
+			}
+		}
+
+		// Deriving the same locator directly must yield the same
+		// public key.
+		derivedDesc, err := keyRing.DeriveKey(keyDesc.KeyLocator)
+		if err != nil {
+			t.Fatalf("unable to derive key: %v", err)
+		}
+		if !keyDesc.PubKey.IsEqual(derivedDesc.PubKey) {
+			t.Fatalf("public keys for family %v mismatch: %x vs %x",
+				keyFam, keyDesc.PubKey.SerializeCompressed(),
+				derivedDesc.PubKey.SerializeCompressed())
+		}
+	}
+}
+
+func TestSecretKeyRingDerivation(t *testing.T) {
+	t.Parallel()
+
+	keyRing, cleanUp := createTestKeyRing(t)
+	defer cleanUp()
+
+	for _, keyFam := range testKeyFamilies {
+		// Derive a few keys so there is something to scan over.
+		var keyDesc KeyDescriptor
+		for i := 0; i < 3; i++ {
+			var err error
+			keyDesc, err = keyRing.DeriveNextKey(keyFam)
+			if err != nil {
+				t.Fatalf("unable to derive next key: %v", err)
+			}
+		}
+
+		// The private key obtained from the full locator must match
+		// the public key.
+		privKey, err := keyRing.DerivePrivKey(keyDesc)
+		if err != nil {
+			t.Fatalf("unable to derive priv key: %v", err)
+		}
+		if !keyDesc.PubKey.IsEqual(privKey.PubKey()) {
+			t.Fatalf("pubkey doesn't match for family %v", keyFam)
+		}
+
+		// With only the public key and family known, the key ring
+		// must locate the private key by scanning.
+		scanDesc := KeyDescriptor{
+			KeyLocator: KeyLocator{Family: keyFam},
+			PubKey:     keyDesc.PubKey,
+		}
+		privKey, err = keyRing.DerivePrivKey(scanDesc)
+		if err != nil {
+			t.Fatalf("unable to derive priv key via scan: %v", err)
+		}
+		if !keyDesc.PubKey.IsEqual(privKey.PubKey()) {
+			t.Fatalf("scanned pubkey doesn't match for family %v",
+				keyFam)
+		}
+	}
+}
+
+func TestECDHAndSignMessage(t *testing.T) {
+	t.Parallel()
+
+	keyRing, cleanUp := createTestKeyRing(t)
+	defer cleanUp()
+
+	keyDesc, err := keyRing.DeriveNextKey(KeyFamilyNodeKey)
+	if err != nil {
+		t.Fatalf("unable to derive next key: %v", err)
+	}
+
+	remotePriv, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("unable to generate remote key: %v", err)
+	}
+
+	// Both sides of the exchange must arrive at the same secret.
+	localSecret, err := keyRing.ECDH(keyDesc, remotePriv.PubKey())
+	if err != nil {
+		t.Fatalf("unable to perform ecdh: %v", err)
+	}
+
+	var (
+		localJacobian btcec.JacobianPoint
+		shared        btcec.JacobianPoint
+	)
+	keyDesc.PubKey.AsJacobian(&localJacobian)
+	btcec.ScalarMultNonConst(&remotePriv.Key, &localJacobian, &shared)
+	shared.ToAffine()
+	remoteSecret := chainhash.HashH(
+		btcec.NewPublicKey(&shared.X, &shared.Y).SerializeCompressed())
+	if !bytes.Equal(localSecret[:], remoteSecret[:]) {
+		t.Fatalf("ecdh secrets mismatch: %x vs %x", localSecret,
+			remoteSecret)
+	}
+
+	msg := []byte("the truth is out there")
+	for _, doubleHash := range []bool{false, true} {
+		sig, err := keyRing.SignMessage(keyDesc, msg, doubleHash)
+		if err != nil {
+			t.Fatalf("unable to sign message: %v", err)
+		}
+
+		digest := chainhash.HashB(msg)
+		if doubleHash {
+			digest = chainhash.DoubleHashB(msg)
+		}
+		if !sig.Verify(digest, keyDesc.PubKey) {
+			t.Fatalf("signature invalid (doubleHash=%v)", doubleHash)
+		}
+	}
+}
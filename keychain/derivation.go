@@ -0,0 +1,128 @@
+package keychain
+
+import (
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+const (
+	// KeyDerivationVersion is the version of the key derivation schema
+	// defined below.
+	KeyDerivationVersion = 0
+
+	// BIP0043Purpose is the "purpose" value that we'll use for the first
+	// version of our key derivation scheme. All keys are expected to be
+	// derived from this purpose, then the particular coin type of the
+	// chain where the keys are to be used.
+	//
+	//   * m/1017'/coinType'/keyFamily'/0/index
+	BIP0043Purpose = 1017
+
+	// MaxKeyRangeScan is the maximum number of keys that we'll attempt to
+	// scan with if a caller knows the public key, but not the KeyLocator
+	// and wishes to derive a private key.
+	MaxKeyRangeScan = 100000
+)
+
+// KeyFamily represents a "family" of keys that will be used within various
+// contracts created by a protocol daemon. Each family maps to an account
+// under the BIP0043Purpose key scope.
+type KeyFamily uint32
+
+const (
+	// KeyFamilyMultiSig are keys to be used within multi-sig scripts.
+	KeyFamilyMultiSig KeyFamily = 0
+
+	// KeyFamilyRevocationBase are keys that are used within channels to
+	// create revocation basepoints that the remote party will use to
+	// create revocation keys for us.
+	KeyFamilyRevocationBase KeyFamily = 1
+
+	// KeyFamilyHtlcBase are keys used within channels that will be
+	// combined with per-state randomness to produce public keys that will
+	// be used in HTLC scripts.
+	KeyFamilyHtlcBase KeyFamily = 2
+
+	// KeyFamilyPaymentBase are keys used within channels that will be
+	// combined with per-state randomness to produce public keys that will
+	// be used in scripts that pay directly to us without any delay.
+	KeyFamilyPaymentBase KeyFamily = 3
+
+	// KeyFamilyDelayBase are keys used within channels that will be
+	// combined with per-state randomness to produce public keys that will
+	// be used in scripts that pay to us, but require a CSV delay before we
+	// can sweep the funds.
+	KeyFamilyDelayBase KeyFamily = 4
+
+	// KeyFamilyRevocationRoot is a family of keys which will be used to
+	// derive the root of a revocation tree.
+	KeyFamilyRevocationRoot KeyFamily = 5
+
+	// KeyFamilyNodeKey is a family of keys that will be used to derive
+	// keys that will be advertised on the network to represent our
+	// current "identity".
+	KeyFamilyNodeKey KeyFamily = 6
+)
+
+// KeyLocator is a two-tuple that can be used to derive *any* key that has
+// ever been used under the key derivation mechanisms described in this file.
+type KeyLocator struct {
+	// Family is the family of key being identified.
+	Family KeyFamily
+
+	// Index is the precise index of the key being identified.
+	Index uint32
+}
+
+// IsEmpty returns true if a KeyLocator is "empty". This may be the case where
+// we learn of a key from a remote party for a contract, but don't know the
+// precise details of its derivation.
+func (k KeyLocator) IsEmpty() bool {
+	return k.Family == 0 && k.Index == 0
+}
+
+// KeyDescriptor wraps a KeyLocator and also optionally includes a public key.
+// Either the KeyLocator must be non-empty, or the public key pointer be
+// non-nil.
+type KeyDescriptor struct {
+	KeyLocator
+
+	// PubKey is an optional public key that fully describes a target key.
+	// If this is nil, the KeyLocator MUST NOT be empty.
+	PubKey *btcec.PublicKey
+}
+
+// KeyRing is the primary interface that will be used to perform public
+// derivation of various keys used within the protocol daemon.
+type KeyRing interface {
+	// DeriveNextKey attempts to derive the *next* key within the key
+	// family (account in BIP43) specified.
+	DeriveNextKey(keyFam KeyFamily) (KeyDescriptor, error)
+
+	// DeriveKey attempts to derive an arbitrary key specified by the
+	// passed KeyLocator.
+	DeriveKey(keyLoc KeyLocator) (KeyDescriptor, error)
+}
+
+// SecretKeyRing is a ring similar to the regular KeyRing interface, but it is
+// also able to derive *private keys*.
+type SecretKeyRing interface {
+	KeyRing
+
+	// DerivePrivKey attempts to derive the private key that corresponds to
+	// the passed key descriptor. If the public key is set, but the
+	// KeyLocator is empty, then a scan over the key family is performed
+	// to locate the matching private key.
+	DerivePrivKey(keyDesc KeyDescriptor) (*btcec.PrivateKey, error)
+
+	// ECDH performs a scalar multiplication (ECDH-like operation) between
+	// the target key descriptor and remote public key. The output
+	// returned will be the sha256 of the resulting shared point serialized
+	// in compressed format.
+	ECDH(keyDesc KeyDescriptor, pubKey *btcec.PublicKey) ([32]byte, error)
+
+	// SignMessage signs the given message, single or double SHA256 hashing
+	// it first, with the private key described in the key descriptor.
+	SignMessage(keyDesc KeyDescriptor, msg []byte,
+		doubleHash bool) (*ecdsa.Signature, error)
+}
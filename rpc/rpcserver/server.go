@@ -1,15 +1,213 @@
 package rpcserver
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/internal/zero"
 	"github.com/czh0526/btc-wallet/netparams"
+	"github.com/czh0526/btc-wallet/waddrmgr"
 	"github.com/czh0526/btc-wallet/wallet"
+	"github.com/czh0526/btc-wallet/wallet/txauthor"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/czh0526/btc-wallet/rpc/walletrpc"
 )
 
+// translateError creates a new gRPC error with an appropriate error code for
+// recognized errors.
+func translateError(err error) error {
+	code := errorCode(err)
+	return status.Errorf(code, "%s", err.Error())
+}
+
+func errorCode(err error) codes.Code {
+	var mgrErr waddrmgr.ManagerError
+	if errors.As(err, &mgrErr) {
+		switch mgrErr.ErrorCode {
+		case waddrmgr.ErrWrongPassphrase, waddrmgr.ErrInvalidAccount,
+			waddrmgr.ErrWrongNet, waddrmgr.ErrAccountNumTooHigh:
+
+			return codes.InvalidArgument
+		case waddrmgr.ErrAccountNotFound, waddrmgr.ErrAddressNotFound,
+			waddrmgr.ErrScopeNotFound:
+
+			return codes.NotFound
+		case waddrmgr.ErrDuplicateAccount, waddrmgr.ErrDuplicateAddress:
+			return codes.AlreadyExists
+		case waddrmgr.ErrLocked, waddrmgr.ErrWatchingOnly:
+			return codes.FailedPrecondition
+		}
+	}
+
+	switch {
+	case errors.Is(err, wallet.ErrExists):
+		return codes.AlreadyExists
+	case errors.Is(err, wallet.ErrLoaded),
+		errors.Is(err, wallet.ErrNotLoaded):
+
+		return codes.FailedPrecondition
+	case errors.Is(err, hdkeychain.ErrInvalidSeedLen):
+		return codes.InvalidArgument
+	case errors.Is(err, txauthor.ErrInsufficientFunds):
+		return codes.FailedPrecondition
+	case errors.Is(err, txrules.ErrAmountNegative),
+		errors.Is(err, txrules.ErrAmountExceedsMax),
+		errors.Is(err, txrules.ErrOutputIsDust):
+
+		return codes.InvalidArgument
+	}
+
+	return codes.Unknown
+}
+
+// keyScopeFromProto returns the key scope of a request, or nil if it
+// doesn't set one.
+func keyScopeFromProto(scope *pb.KeyScope) *waddrmgr.KeyScope {
+	if scope == nil {
+		return nil
+	}
+	return &waddrmgr.KeyScope{
+		Purpose: scope.Purpose,
+		Coin:    scope.Coin,
+	}
+}
+
+// keyScopeOrDefault returns the key scope of a request, or the BIP-0084 one
+// if it doesn't set one.
+func keyScopeOrDefault(scope *pb.KeyScope) waddrmgr.KeyScope {
+	if keyScope := keyScopeFromProto(scope); keyScope != nil {
+		return *keyScope
+	}
+	return waddrmgr.KeyScopeBIP0084
+}
+
+func keyScopeToProto(scope waddrmgr.KeyScope) *pb.KeyScope {
+	return &pb.KeyScope{
+		Purpose: scope.Purpose,
+		Coin:    scope.Coin,
+	}
+}
+
+// addressTypeScope returns the key scope deriving the addresses of the type.
+func addressTypeScope(t pb.AddressType) (waddrmgr.KeyScope, error) {
+	switch t {
+	case pb.AddressType_ADDRESS_TYPE_WITNESS_PUBKEY_HASH:
+		return waddrmgr.KeyScopeBIP0084, nil
+	case pb.AddressType_ADDRESS_TYPE_NESTED_WITNESS_PUBKEY_HASH:
+		return waddrmgr.KeyScopeBIP0049Plus, nil
+	case pb.AddressType_ADDRESS_TYPE_PUBKEY_HASH:
+		return waddrmgr.KeyScopeBIP0044, nil
+	case pb.AddressType_ADDRESS_TYPE_TAPROOT_PUBKEY:
+		return waddrmgr.KeyScopeBIP0086, nil
+	default:
+		return waddrmgr.KeyScope{}, status.Errorf(codes.InvalidArgument,
+			"unknown address type %v", t)
+	}
+}
+
+func coinSelectionStrategy(s pb.CoinSelectionStrategy) (
+	wallet.CoinSelectionStrategy, error) {
+
+	switch s {
+	case pb.CoinSelectionStrategy_COIN_SELECTION_LARGEST:
+		return wallet.CoinSelectionLargest, nil
+	case pb.CoinSelectionStrategy_COIN_SELECTION_RANDOM_IMPROVE:
+		return wallet.CoinSelectionRandomImprove, nil
+	case pb.CoinSelectionStrategy_COIN_SELECTION_BNB:
+		return wallet.CoinSelectionBnB, nil
+	default:
+		return 0, status.Errorf(codes.InvalidArgument,
+			"unknown coin selection strategy %v", s)
+	}
+}
+
+// psbtGlobalVersion is the key type of the global version of a PSBT, which
+// is absent from version 0 packets.
+const psbtGlobalVersion = 0xfb
+
+// psbtVersion returns the version of a serialized PSBT, as given by its
+// global map, or 0 if the packet is malformed and left to the psbt package
+// to reject.
+func psbtVersion(b []byte) uint32 {
+	r := bytes.NewReader(b)
+	magic := make([]byte, 5)
+	if _, err := r.Read(magic); err != nil ||
+		!bytes.Equal(magic, []byte("psbt\xff")) {
+
+		return 0
+	}
+	for {
+		keyLen, err := wire.ReadVarInt(r, 0)
+		if err != nil || keyLen == 0 || keyLen > uint64(r.Len()) {
+			return 0
+		}
+		key := make([]byte, keyLen)
+		r.Read(key)
+		valueLen, err := wire.ReadVarInt(r, 0)
+		if err != nil || valueLen > uint64(r.Len()) {
+			return 0
+		}
+		value := make([]byte, valueLen)
+		r.Read(value)
+
+		if len(key) == 1 && key[0] == psbtGlobalVersion &&
+			len(value) == 4 {
+
+			return binary.LittleEndian.Uint32(value)
+		}
+	}
+}
+
+// parsePsbt parses a serialized PSBT. Only version 0 packets (BIP-174) are
+// supported, and version 2 packets (BIP-370) are rejected as unimplemented.
+func parsePsbt(b []byte) (*psbt.Packet, error) {
+	if version := psbtVersion(b); version != 0 {
+		return nil, status.Errorf(codes.Unimplemented,
+			"PSBT version %d is not supported, only version 0 is",
+			version)
+	}
+	packet, err := psbt.NewFromRawBytes(bytes.NewReader(b), false)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"bytes do not represent a valid PSBT: %v", err)
+	}
+	return packet, nil
+}
+
+func serializePsbt(packet *psbt.Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		return nil, translateError(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// unlockWallet unlocks the wallet for the duration of a single request if a
+// passphrase is given. The returned function releases the unlock, relocking
+// the wallet unless it was unlocked beyond the request.
+func unlockWallet(w *wallet.Wallet, passphrase []byte) (func(), error) {
+	if len(passphrase) == 0 {
+		return func() {}, nil
+	}
+
+	release, err := w.UnlockForRequest(passphrase)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return release, nil
+}
+
 ///////////////////////////////
 //	LoaderServer
 ///////////////////////////////
@@ -20,22 +218,90 @@ type loaderServer struct {
 	activeNet *netparams.Params
 }
 
+// CreateWallet creates a wallet from the seed of the request and loads it.
+// The wallet is encrypted with the private passphrase, and with the insecure
+// default public passphrase if none is given.
 func (s *loaderServer) CreateWallet(ctx context.Context, req *pb.CreateWalletRequest) (
 	*pb.CreateWalletResponse, error) {
 
-	return nil, errors.New("CreateWallet is not implemented yet")
+	defer func() {
+		zero.Bytes(req.PublicPassphrase)
+		zero.Bytes(req.PrivatePassphrase)
+		zero.Bytes(req.Seed)
+	}()
+
+	pubPassphrase := req.PublicPassphrase
+	if len(pubPassphrase) == 0 {
+		pubPassphrase = []byte(wallet.InsecurePubPassphrase)
+	}
+	if len(req.PrivatePassphrase) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"private passphrase is required")
+	}
+	if len(req.Seed) < hdkeychain.MinSeedBytes ||
+		len(req.Seed) > hdkeychain.MaxSeedBytes {
+
+		return nil, status.Errorf(codes.InvalidArgument,
+			"seed must be between %d and %d bytes",
+			hdkeychain.MinSeedBytes, hdkeychain.MaxSeedBytes)
+	}
+
+	_, err := s.loader.CreateNewWallet(pubPassphrase, req.PrivatePassphrase,
+		req.Seed, time.Now())
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.CreateWalletResponse{}, nil
 }
 
+// OpenWallet opens the existing wallet with the public passphrase of the
+// request, or the insecure default one if none is given, and loads it.
 func (s *loaderServer) OpenWallet(ctx context.Context, req *pb.OpenWalletRequest) (
 	*pb.OpenWalletResponse, error) {
 
-	return nil, errors.New("OpenWallet is not implemented yet")
+	defer zero.Bytes(req.PublicPassphrase)
+
+	pubPassphrase := req.PublicPassphrase
+	if len(pubPassphrase) == 0 {
+		pubPassphrase = []byte(wallet.InsecurePubPassphrase)
+	}
+
+	exists, err := s.loader.WalletExists()
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "wallet does not exist")
+	}
+
+	_, err = s.loader.OpenExistingWallet(pubPassphrase, false)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.OpenWalletResponse{}, nil
+}
+
+// CloseWallet stops and unloads the loaded wallet.
+func (s *loaderServer) CloseWallet(ctx context.Context, req *pb.CloseWalletRequest) (
+	*pb.CloseWalletResponse, error) {
+
+	if err := s.loader.UnloadWallet(); err != nil {
+		return nil, translateError(err)
+	}
+	return &pb.CloseWalletResponse{}, nil
 }
 
+// WalletExists returns whether the wallet database of the loader exists.
 func (s *loaderServer) WalletExists(ctx context.Context, req *pb.WalletExistsRequest) (
 	*pb.WalletExistsResponse, error) {
 
-	return nil, errors.New("WalletExists is not implemented yet")
+	exists, err := s.loader.WalletExists()
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return &pb.WalletExistsResponse{Exists: exists}, nil
 }
 
 func StartWalletLoaderService(server *grpc.Server, loader *wallet.Loader, activeNet *netparams.Params) {
@@ -52,12 +318,581 @@ func StartWalletLoaderService(server *grpc.Server, loader *wallet.Loader, active
 
 type walletServer struct {
 	pb.UnimplementedWalletServiceServer
-	wallet *wallet.Wallet
+
+	loader *wallet.Loader
+}
+
+// loadedWallet returns the wallet loaded by the loader, or a
+// FailedPrecondition error if none is loaded.
+func (s *walletServer) loadedWallet() (*wallet.Wallet, error) {
+	w, ok := s.loader.LoadedWallet()
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"wallet is not loaded")
+	}
+	return w, nil
+}
+
+// requestFeeRate returns the fee rate of a request, in sat/kvB. A zero rate
+// is replaced by the estimate of the chain backend of the wallet for
+// wallet.DefaultFeeTarget blocks.
+func requestFeeRate(w *wallet.Wallet, satPerKvbyte int64) (btcutil.Amount,
+	error) {
+
+	if satPerKvbyte == 0 {
+		estimator, err := w.FeeEstimator()
+		if err != nil {
+			return 0, status.Errorf(codes.FailedPrecondition,
+				"unable to estimate fee rate: %v", err)
+		}
+		feeRate, err := estimator.EstimateFeePerKB(
+			wallet.DefaultFeeTarget)
+		if err != nil {
+			return 0, status.Errorf(codes.Unavailable,
+				"unable to estimate fee rate: %v", err)
+		}
+		return feeRate, nil
+	}
+
+	feeRate := btcutil.Amount(satPerKvbyte)
+	if feeRate < txrules.DefaultRelayFeePerKb {
+		return 0, status.Errorf(codes.InvalidArgument,
+			"fee rate %d sat/kvB is below the minimum relay fee %d",
+			satPerKvbyte, int64(txrules.DefaultRelayFeePerKb))
+	}
+	return feeRate, nil
+}
+
+// Unlock unlocks the wallet, relocking it once the timeout of the request
+// expires, if it has one. A wrong passphrase locks the wallet.
+func (s *walletServer) Unlock(ctx context.Context, req *pb.UnlockRequest) (
+	*pb.UnlockResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	var lock <-chan time.Time
+	if req.TimeoutSeconds > 0 {
+		lock = time.After(time.Duration(req.TimeoutSeconds) * time.Second)
+	}
+	if err := w.Unlock(req.Passphrase, lock); err != nil {
+		return nil, translateError(err)
+	}
+	return &pb.UnlockResponse{}, nil
+}
+
+// Lock locks the wallet, cancelling the timeout of a previous unlock.
+func (s *walletServer) Lock(ctx context.Context, req *pb.LockRequest) (
+	*pb.LockResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	w.Lock()
+	return &pb.LockResponse{}, nil
 }
 
-func StartWalletService(server *grpc.Server, wallet *wallet.Wallet) {
-	service := &walletServer{
-		wallet: wallet,
+func (s *walletServer) FundPsbt(ctx context.Context, req *pb.FundPsbtRequest) (
+	*pb.FundPsbtResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	packet, err := parsePsbt(req.Psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	feeRate, err := requestFeeRate(w, req.SatPerKvbyte)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy, err := coinSelectionStrategy(req.CoinSelectionStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	changeIndex, err := w.FundPsbt(packet,
+		keyScopeFromProto(req.KeyScope), req.RequiredConfirmations,
+		req.Account, feeRate, strategy)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	leases, err := w.ListLeasedOutputs()
+	if err != nil {
+		return nil, translateError(err)
+	}
+	leased := make(map[wire.OutPoint]*pb.UtxoLease, len(leases))
+	for _, lease := range leases {
+		if lease.LockID != wallet.PsbtLockID {
+			continue
+		}
+		leased[lease.Outpoint] = &pb.UtxoLease{
+			Id: lease.LockID[:],
+			Outpoint: &pb.OutPoint{
+				Txid:        lease.Outpoint.Hash[:],
+				OutputIndex: lease.Outpoint.Index,
+			},
+			Expiration: lease.Expiration.Unix(),
+		}
 	}
+	var lockedUtxos []*pb.UtxoLease
+	for _, txIn := range packet.UnsignedTx.TxIn {
+		if lease, ok := leased[txIn.PreviousOutPoint]; ok {
+			lockedUtxos = append(lockedUtxos, lease)
+		}
+	}
+
+	funded, err := serializePsbt(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.FundPsbtResponse{
+		FundedPsbt:        funded,
+		ChangeOutputIndex: changeIndex,
+		LockedUtxos:       lockedUtxos,
+	}, nil
+}
+
+func (s *walletServer) SignPsbt(ctx context.Context, req *pb.SignPsbtRequest) (
+	*pb.SignPsbtResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	packet, err := parsePsbt(req.Psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	relock, err := unlockWallet(w, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer relock()
+
+	signed, err := w.SignPsbt(packet)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	signedPsbt, err := serializePsbt(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SignPsbtResponse{
+		SignedPsbt:   signedPsbt,
+		SignedInputs: signed,
+	}, nil
+}
+
+// FinalizePsbt finalizes a fully signed PSBT and extracts its transaction. It
+// never signs: a packet missing signatures, which SignPsbt adds, is rejected
+// with FailedPrecondition.
+func (s *walletServer) FinalizePsbt(ctx context.Context, req *pb.FinalizePsbtRequest) (
+	*pb.FinalizePsbtResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	packet, err := parsePsbt(req.Psbt)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := w.FinalizePsbt(packet)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
+	signedPsbt, err := serializePsbt(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.FinalizePsbtResponse{
+		SignedPsbt: signedPsbt,
+		RawFinalTx: buf.Bytes(),
+	}, nil
+}
+
+// StartWalletService registers the wallet service on the server. gRPC
+// services can't be registered once the server is serving, so the service
+// is registered up front and serves the wallet of the loader while one is
+// loaded, failing with FailedPrecondition otherwise.
+func StartWalletService(server *grpc.Server, loader *wallet.Loader) {
+	service := &walletServer{loader: loader}
 	pb.RegisterWalletServiceServer(server, service)
 }
+
+func (s *walletServer) SendOutputs(ctx context.Context, req *pb.SendOutputsRequest) (
+	*pb.SendOutputsResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Outputs) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"at least one output is required")
+	}
+	outputs := make([]*wire.TxOut, 0, len(req.Outputs))
+	for _, output := range req.Outputs {
+		outputs = append(outputs, wire.NewTxOut(
+			output.Amount, output.PkScript))
+	}
+
+	feeRate, err := requestFeeRate(w, req.SatPerKvbyte)
+	if err != nil {
+		return nil, err
+	}
+
+	keyScope := keyScopeFromProto(req.KeyScope)
+
+	strategy, err := coinSelectionStrategy(req.CoinSelectionStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	relock, err := unlockWallet(w, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer relock()
+
+	tx, err := w.SendOutputs(outputs, keyScope, req.Account,
+		req.RequiredConfirmations, feeRate, strategy, req.Label)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, translateError(err)
+	}
+	txHash := tx.TxHash()
+
+	return &pb.SendOutputsResponse{
+		Transaction: buf.Bytes(),
+		Txid:        txHash[:],
+	}, nil
+}
+
+// ImportPrivateKey imports a WIF-encoded private key into the imported
+// account of the BIP-44 scope, rescanning the chain for its transactions if
+// requested, from the requested height or else the wallet's birthday block.
+func (s *walletServer) ImportPrivateKey(ctx context.Context, req *pb.ImportPrivateKeyRequest) (
+	*pb.ImportPrivateKeyResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	wif, err := btcutil.DecodeWIF(req.PrivateKeyWif)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"invalid WIF-encoded private key: %v", err)
+	}
+	if req.Account != waddrmgr.ImportedAddrAccount {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"private keys may only be imported into the imported "+
+				"account")
+	}
+	if req.ScanFromHeight < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"negative scan height %d", req.ScanFromHeight)
+	}
+
+	relock, err := unlockWallet(w, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer relock()
+
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif,
+		req.ScanFromHeight, req.Rescan)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.ImportPrivateKeyResponse{}, nil
+}
+
+// NextAddress derives the next external or internal address of an account
+// of the scope deriving addresses of the requested type.
+func (s *walletServer) NextAddress(ctx context.Context, req *pb.NextAddressRequest) (
+	*pb.NextAddressResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	scope, err := addressTypeScope(req.AddressType)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr btcutil.Address
+	switch req.Kind {
+	case pb.NextAddressRequest_EXTERNAL:
+		addr, err = w.NewAddress(req.Account, scope)
+	case pb.NextAddressRequest_INTERNAL:
+		addr, err = w.NewChangeAddress(req.Account, scope)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unknown address kind %v", req.Kind)
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.NextAddressResponse{Address: addr.EncodeAddress()}, nil
+}
+
+// Accounts returns the accounts of the scope with their balances.
+func (s *walletServer) Accounts(ctx context.Context, req *pb.AccountsRequest) (
+	*pb.AccountsResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := w.Accounts(keyScopeOrDefault(req.KeyScope))
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	accounts := make([]*pb.AccountsResponse_Account, 0,
+		len(result.Accounts))
+	for _, account := range result.Accounts {
+		accounts = append(accounts, &pb.AccountsResponse_Account{
+			AccountNumber:    account.AccountNumber,
+			AccountName:      account.AccountName,
+			TotalBalance:     int64(account.TotalBalance),
+			ExternalKeyCount: account.ExternalKeyCount,
+			InternalKeyCount: account.InternalKeyCount,
+			ImportedKeyCount: account.ImportedKeyCount,
+		})
+	}
+
+	return &pb.AccountsResponse{
+		Accounts:           accounts,
+		CurrentBlockHash:   result.CurrentBlockHash[:],
+		CurrentBlockHeight: result.CurrentBlockHeight,
+	}, nil
+}
+
+// NextAccount creates the account following the last one of the scope.
+func (s *walletServer) NextAccount(ctx context.Context, req *pb.NextAccountRequest) (
+	*pb.NextAccountResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	relock, err := unlockWallet(w, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer relock()
+
+	account, err := w.NextAccount(keyScopeOrDefault(req.KeyScope),
+		req.AccountName)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.NextAccountResponse{AccountNumber: account}, nil
+}
+
+// RenameAccount renames an account of the scope.
+func (s *walletServer) RenameAccount(ctx context.Context, req *pb.RenameAccountRequest) (
+	*pb.RenameAccountResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.RenameAccount(keyScopeOrDefault(req.KeyScope), req.Account,
+		req.NewName)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.RenameAccountResponse{}, nil
+}
+
+// AccountProperties returns the properties of an account of the scope,
+// looked up by name if the request names one.
+func (s *walletServer) AccountProperties(ctx context.Context, req *pb.AccountPropertiesRequest) (
+	*pb.AccountPropertiesResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	scope := keyScopeOrDefault(req.KeyScope)
+	account := req.Account
+	if req.AccountName != "" {
+		account, err = w.AccountNumber(scope, req.AccountName)
+		if err != nil {
+			return nil, translateError(err)
+		}
+	}
+
+	props, err := w.AccountProperties(scope, account)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	var accountPubKey string
+	if props.AccountPubKey != nil {
+		accountPubKey = props.AccountPubKey.String()
+	}
+
+	return &pb.AccountPropertiesResponse{
+		AccountNumber:        props.AccountNumber,
+		AccountName:          props.AccountName,
+		ExternalKeyCount:     props.ExternalKeyCount,
+		InternalKeyCount:     props.InternalKeyCount,
+		ImportedKeyCount:     props.ImportedKeyCount,
+		AccountPubKey:        accountPubKey,
+		MasterKeyFingerprint: props.MasterKeyFingerprint,
+		KeyScope:             keyScopeToProto(props.KeyScope),
+		WatchOnly:            props.IsWatchOnly,
+	}, nil
+}
+
+// ValidateAddress returns whether an address is valid for the network of the
+// wallet and, if it is one of the wallet's, what the wallet knows of it.
+func (s *walletServer) ValidateAddress(ctx context.Context, req *pb.ValidateAddressRequest) (
+	*pb.ValidateAddressResponse, error) {
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := btcutil.DecodeAddress(req.Address, w.ChainParams())
+	if err != nil || !addr.IsForNet(w.ChainParams()) {
+		return &pb.ValidateAddressResponse{}, nil
+	}
+
+	resp := &pb.ValidateAddressResponse{IsValid: true}
+	managed, scope, err := w.AddressInfo(addr)
+	if waddrmgr.IsError(err, waddrmgr.ErrAddressNotFound) {
+		return resp, nil
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	props, err := w.AccountProperties(scope, managed.InternalAccount())
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	resp.IsMine = true
+	resp.KeyScope = keyScopeToProto(scope)
+	resp.AccountNumber = managed.InternalAccount()
+	resp.AccountName = props.AccountName
+	resp.IsInternal = managed.Internal()
+	resp.IsImported = managed.Imported()
+	resp.IsCompressed = managed.Compressed()
+	switch managed := managed.(type) {
+	case waddrmgr.ManagedPubKeyAddress:
+		if managed.Compressed() {
+			resp.PubKey = managed.PubKey().SerializeCompressed()
+		} else {
+			resp.PubKey = managed.PubKey().SerializeUncompressed()
+		}
+	case waddrmgr.ManagedScriptAddress:
+		resp.IsScript = true
+	}
+
+	return resp, nil
+}
+
+func (s *walletServer) SignTransaction(ctx context.Context, req *pb.SignTransactionRequest) (
+	*pb.SignTransactionResponse, error) {
+
+	defer zero.Bytes(req.Passphrase)
+
+	w, err := s.loadedWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	var tx wire.MsgTx
+	err = tx.Deserialize(bytes.NewReader(req.SerializedTransaction))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"bytes do not represent a valid raw transaction: %v", err)
+	}
+	for _, idx := range req.InputIndexes {
+		if int(idx) >= len(tx.TxIn) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"input index %d out of range", idx)
+		}
+	}
+
+	relock, err := unlockWallet(w, req.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer relock()
+
+	unsigned, err := w.SignTransaction(&tx, req.InputIndexes)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, translateError(err)
+	}
+
+	return &pb.SignTransactionResponse{
+		Transaction:          buf.Bytes(),
+		UnsignedInputIndexes: unsigned,
+	}, nil
+}
@@ -0,0 +1,370 @@
+package rpcserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain/simchain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet"
+	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/czh0526/btc-wallet/rpc/walletrpc"
+)
+
+func TestParsePsbt(t *testing.T) {
+	packet, err := psbt.New([]*wire.OutPoint{{Hash: chainhash.Hash{1}}},
+		[]*wire.TxOut{wire.NewTxOut(1000, []byte{0x51})}, 2, 0,
+		[]uint32{wire.MaxTxInSequenceNum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parsePsbt(buf.Bytes())
+	if assert.NoError(t, err) {
+		assert.Equal(t, packet.UnsignedTx.TxHash(),
+			parsed.UnsignedTx.TxHash())
+	}
+
+	_, err = parsePsbt([]byte("psbt"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A version 2 packet, holding its transaction version, input and
+	// output counts and version in its global map, is rejected.
+	v2 := []byte("psbt\xff")
+	v2 = append(v2, 0x01, 0x02, 0x04, 0x02, 0x00, 0x00, 0x00)
+	v2 = append(v2, 0x01, 0x04, 0x01, 0x00)
+	v2 = append(v2, 0x01, 0x05, 0x01, 0x00)
+	v2 = append(v2, 0x01, 0xfb, 0x04, 0x02, 0x00, 0x00, 0x00)
+	v2 = append(v2, 0x00)
+	_, err = parsePsbt(v2)
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+// assertZeroed asserts that every byte of the buffer was cleared.
+func assertZeroed(t *testing.T, b []byte) {
+	t.Helper()
+
+	assert.Equal(t, 0, len(bytes.Trim(b, "\x00")),
+		"buffer %x not zeroed", b)
+}
+
+func TestLoaderService(t *testing.T) {
+	loader := wallet.NewLoader(&chaincfg.RegressionNetParams, t.TempDir(),
+		true, 10*time.Second, 0)
+	loaderSvc := &loaderServer{loader: loader}
+	walletSvc := &walletServer{loader: loader}
+	ctx := context.Background()
+
+	// Every loaded wallet is given a backend, as the wallet process does.
+	sim := simchain.New(&chaincfg.RegressionNetParams)
+	var clients []*simchain.Client
+	loader.RunAfterLoad(func(w *wallet.Wallet) {
+		client := sim.NewClient()
+		if err := client.Start(); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		w.SynchronizeRPC(client)
+	})
+
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loaderSvc.OpenWallet(ctx, &pb.OpenWalletRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = loaderSvc.CloseWallet(ctx, &pb.CloseWalletRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = walletSvc.loadedWallet()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Seeds of an invalid length and a missing private passphrase are
+	// rejected, the buffers of the request being zeroed all the same.
+	for _, req := range []*pb.CreateWalletRequest{{
+		PrivatePassphrase: []byte("priv"),
+		Seed:              bytes.Repeat([]byte{1}, hdkeychain.MinSeedBytes-1),
+	}, {
+		PrivatePassphrase: []byte("priv"),
+		Seed:              bytes.Repeat([]byte{1}, hdkeychain.MaxSeedBytes+1),
+	}, {
+		Seed: bytes.Repeat([]byte{1}, hdkeychain.RecommendedSeedLen),
+	}} {
+		_, err := loaderSvc.CreateWallet(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assertZeroed(t, req.Seed)
+		assertZeroed(t, req.PrivatePassphrase)
+	}
+
+	createReq := &pb.CreateWalletRequest{
+		PublicPassphrase:  []byte("pub"),
+		PrivatePassphrase: []byte("priv"),
+		Seed:              append([]byte(nil), seed...),
+	}
+	_, err = loaderSvc.CreateWallet(ctx, createReq)
+	if err != nil {
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	assertZeroed(t, createReq.PublicPassphrase)
+	assertZeroed(t, createReq.PrivatePassphrase)
+	assertZeroed(t, createReq.Seed)
+	_, err = walletSvc.loadedWallet()
+	assert.NoError(t, err)
+
+	_, err = loaderSvc.CreateWallet(ctx, &pb.CreateWalletRequest{
+		PrivatePassphrase: []byte("priv"),
+		Seed:              append([]byte(nil), seed...),
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = loaderSvc.OpenWallet(ctx, &pb.OpenWalletRequest{
+		PublicPassphrase: []byte("pub"),
+	})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = loaderSvc.CloseWallet(ctx, &pb.CloseWalletRequest{})
+	if err != nil {
+		t.Fatalf("unable to close wallet: %v", err)
+	}
+	_, err = walletSvc.loadedWallet()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assertStopped(t, clients[0])
+
+	// Once closed, the wallet exists and is opened again.
+	_, err = loaderSvc.CreateWallet(ctx, &pb.CreateWalletRequest{
+		PrivatePassphrase: []byte("priv"),
+		Seed:              append([]byte(nil), seed...),
+	})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	openReq := &pb.OpenWalletRequest{PublicPassphrase: []byte("pub")}
+	_, err = loaderSvc.OpenWallet(ctx, openReq)
+	if err != nil {
+		t.Fatalf("unable to open wallet: %v", err)
+	}
+	assertZeroed(t, openReq.PublicPassphrase)
+	w, err := walletSvc.loadedWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reopened wallet is given a backend of its own.
+	if assert.Len(t, clients, 2) {
+		assert.Equal(t, clients[1], w.ChainClient())
+	}
+
+	_, err = loaderSvc.CloseWallet(ctx, &pb.CloseWalletRequest{})
+	assert.NoError(t, err)
+	assertStopped(t, clients[1])
+}
+
+func TestLockService(t *testing.T) {
+	loader := wallet.NewLoader(&chaincfg.RegressionNetParams, t.TempDir(),
+		true, 10*time.Second, 0)
+	walletSvc := &walletServer{loader: loader}
+	ctx := context.Background()
+
+	_, err := walletSvc.Lock(ctx, &pb.LockRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := loader.CreateNewWallet([]byte("pub"), []byte("priv"), seed,
+		time.Now())
+	if err != nil {
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	defer loader.UnloadWallet()
+
+	req := &pb.UnlockRequest{Passphrase: []byte("wrong")}
+	_, err = walletSvc.Unlock(ctx, req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assertZeroed(t, req.Passphrase)
+
+	// An unlock without timeout lasts until the wallet is locked.
+	req = &pb.UnlockRequest{Passphrase: []byte("priv")}
+	_, err = walletSvc.Unlock(ctx, req)
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	assertZeroed(t, req.Passphrase)
+	assert.False(t, w.Locked())
+
+	_, err = walletSvc.Lock(ctx, &pb.LockRequest{})
+	assert.NoError(t, err)
+	assert.True(t, w.Locked())
+
+	// A timed unlock relocks the wallet on its own.
+	_, err = walletSvc.Unlock(ctx, &pb.UnlockRequest{
+		Passphrase:     []byte("priv"),
+		TimeoutSeconds: 1,
+	})
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	assert.Eventually(t, w.Locked, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestFinalizePsbt(t *testing.T) {
+	loader := wallet.NewLoader(&chaincfg.RegressionNetParams, t.TempDir(),
+		true, 10*time.Second, 0)
+	walletSvc := &walletServer{loader: loader}
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := loader.CreateNewWallet([]byte("pub"), []byte("priv"), seed,
+		time.Now())
+	if err != nil {
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	defer loader.UnloadWallet()
+
+	// The input spends an output of the wallet, which it could sign for
+	// while unlocked.
+	if err := w.Unlock([]byte("priv"), nil); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	addr, err := w.NewAddress(0, waddrmgr.KeyScopeBIP0084)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := psbt.New([]*wire.OutPoint{{Hash: chainhash.Hash{1}}},
+		[]*wire.TxOut{wire.NewTxOut(90000, pkScript)}, 2, 0,
+		[]uint32{wire.MaxTxInSequenceNum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Inputs[0].WitnessUtxo = wire.NewTxOut(100000, pkScript)
+
+	// The key origin lets SignPsbt find the key of the input.
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterPub, err := master.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := binary.LittleEndian.Uint32(
+		btcutil.Hash160(masterPub.SerializeCompressed())[:4])
+	ma, _, err := w.AddressInfo(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpka := ma.(waddrmgr.ManagedPubKeyAddress)
+	scope, path, _ := mpka.DerivationInfo()
+	packet.Inputs[0].Bip32Derivation = []*psbt.Bip32Derivation{{
+		PubKey:               mpka.PubKey().SerializeCompressed(),
+		MasterKeyFingerprint: fingerprint,
+		Bip32Path: []uint32{
+			scope.Purpose + hdkeychain.HardenedKeyStart,
+			scope.Coin + hdkeychain.HardenedKeyStart,
+			path.Account, path.Branch, path.Index,
+		},
+	}}
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = walletSvc.FinalizePsbt(context.Background(),
+		&pb.FinalizePsbtRequest{Psbt: buf.Bytes()})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// Once signed, the packet is finalized.
+	if _, err := w.SignPsbt(packet); err != nil {
+		t.Fatalf("unable to sign: %v", err)
+	}
+	buf.Reset()
+	if err := packet.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := walletSvc.FinalizePsbt(context.Background(),
+		&pb.FinalizePsbtRequest{Psbt: buf.Bytes()})
+	if err != nil {
+		t.Fatalf("unable to finalize: %v", err)
+	}
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(resp.RawFinalTx)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, packet.UnsignedTx.TxHash(), tx.TxHash())
+}
+
+func TestRequestFeeRate(t *testing.T) {
+	loader := wallet.NewLoader(&chaincfg.RegressionNetParams, t.TempDir(),
+		true, 10*time.Second, 0)
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := loader.CreateNewWallet([]byte("pub"), []byte("priv"), seed,
+		time.Now())
+	if err != nil {
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	defer loader.UnloadWallet()
+
+	// Explicit rates are taken as is, as long as they are relayed.
+	feeRate, err := requestFeeRate(w, 5000)
+	assert.NoError(t, err)
+	assert.Equal(t, btcutil.Amount(5000), feeRate)
+	_, err = requestFeeRate(w, 999)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A zero rate is estimated by the backend, so one is required.
+	_, err = requestFeeRate(w, 0)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	client := simchain.New(&chaincfg.RegressionNetParams).NewClient()
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.SynchronizeRPC(client)
+
+	feeRate, err = requestFeeRate(w, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, wallet.FallbackFeePerKB, feeRate)
+}
+
+// assertStopped asserts that the client was stopped, its notification
+// channel being closed.
+func assertStopped(t *testing.T, client *simchain.Client) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-client.Notifications():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("chain client not stopped")
+		}
+	}
+}
@@ -17,12 +17,6 @@ import (
 	"time"
 )
 
-func startWalletRPCServices(wallet *wallet.Wallet, server *grpc.Server) {
-	if server != nil {
-		rpcserver.StartWalletService(server, wallet)
-	}
-}
-
 func startRPCServers(walletLoader *wallet.Loader) (*grpc.Server, error) {
 	var (
 		server  *grpc.Server
@@ -58,6 +52,8 @@ func startRPCServers(walletLoader *wallet.Loader) (*grpc.Server, error) {
 			server = grpc.NewServer(grpc.Creds(creds))
 			// 将 WalletLoader 注册进 grpc server
 			rpcserver.StartWalletLoaderService(server, walletLoader, activeNet)
+			// 注册 Wallet 服务，钱包加载后开始提供服务
+			rpcserver.StartWalletService(server, walletLoader)
 			// 打开守护端口
 			for _, lis := range listeners {
 				lis := lis
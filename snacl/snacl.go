@@ -5,7 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"github.com/czh0526/btc-wallet/internal/securemem"
 	"github.com/czh0526/btc-wallet/internal/zero"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/scrypt"
 	"io"
@@ -19,6 +21,60 @@ const (
 	DefaultN = 16384
 	DefaultR = 8
 	DefaultP = 1
+
+	DefaultArgon2idTime    = 3
+	DefaultArgon2idMemory  = 64 * 1024
+	DefaultArgon2idThreads = 4
+
+	// MinArgon2idTime and MinArgon2idThreads are the least number of
+	// passes and lanes Argon2id is defined for.
+	MinArgon2idTime    = 1
+	MinArgon2idThreads = 1
+
+	// MaxArgon2idMemory bounds, in KiB, the memory a stored parameter set
+	// can make key derivation allocate.
+	MaxArgon2idMemory = 1024 * 1024
+)
+
+// KDF identifies the password-based key derivation function used to derive a
+// SecretKey.
+type KDF uint8
+
+const (
+	// KDFScrypt derives keys with scrypt using the N, R and P parameters.
+	KDFScrypt KDF = 0
+
+	// KDFArgon2id derives keys with Argon2id using the Time, Memory and
+	// Threads parameters.
+	KDFArgon2id KDF = 1
+)
+
+func (k KDF) String() string {
+	switch k {
+	case KDFScrypt:
+		return "scrypt"
+	case KDFArgon2id:
+		return "argon2id"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// paramsVersion is the version of the tagged parameter encoding
+	// produced by Marshal.
+	paramsVersion = 1
+
+	// legacyParamsSize is the size of the untagged encoding used before
+	// parameters were versioned. It only ever described scrypt keys.
+	legacyParamsSize = KeySize + sha256.Size + 24
+
+	// paramsHeaderSize is the size of the version and KDF tag that prefix
+	// the versioned encoding.
+	paramsHeaderSize = 2
+
+	scryptParamsSize   = 24
+	argon2idParamsSize = 9
 )
 
 var (
@@ -29,6 +85,8 @@ var (
 	ErrInvalidPassword = errors.New("invalid password")
 	ErrMalformed       = errors.New("malformed data")
 	ErrDecryptFailed   = errors.New("unable to decrypt")
+	ErrUnknownKDF      = errors.New("unknown key derivation function")
+	ErrUnknownVersion  = errors.New("unknown parameters version")
 )
 
 type CryptoKey [KeySize]byte
@@ -77,14 +135,36 @@ func GenerateCryptoKey() (*CryptoKey, error) {
 type Parameters struct {
 	Salt   [KeySize]byte
 	Digest [sha256.Size]byte
-	N      int
-	R      int
-	P      int
+	KDF    KDF
+
+	// scrypt
+	N int
+	R int
+	P int
+
+	// argon2id, Memory is in KiB.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
 }
 
 type SecretKey struct {
 	Key        *CryptoKey
 	Parameters Parameters
+
+	// mem backs Key when it was allocated by this package, keeping the
+	// derived key in locked memory.
+	mem *securemem.Buffer
+}
+
+// allocKey places the key in locked memory unless the caller already
+// provided one.
+func (sk *SecretKey) allocKey() {
+	if sk.Key != nil {
+		return
+	}
+	sk.mem = securemem.New(KeySize)
+	sk.Key = (*CryptoKey)(sk.mem.Bytes())
 }
 
 func (sk *SecretKey) Encrypt(in []byte) ([]byte, error) {
@@ -95,51 +175,131 @@ func (sk *SecretKey) Decrypt(in []byte) ([]byte, error) {
 	return sk.Key.Decrypt(in)
 }
 
+// Marshal returns the parameters needed to re-derive the key. The output is
+// tagged with the encoding version and the KDF so that further algorithms can
+// be added without breaking existing wallets.
 func (sk *SecretKey) Marshal() []byte {
 	params := &sk.Parameters
 
-	marshalled := make([]byte, KeySize+sha256.Size+24)
+	kdfSize := scryptParamsSize
+	if params.KDF == KDFArgon2id {
+		kdfSize = argon2idParamsSize
+	}
+	marshalled := make([]byte, paramsHeaderSize+KeySize+sha256.Size+kdfSize)
 
-	// Salt + Digest + N + R + P
+	// Version + KDF + Salt + Digest + KDF params
 	b := marshalled
+	b[0] = paramsVersion
+	b[1] = byte(params.KDF)
+	b = b[paramsHeaderSize:]
 	copy(b[:KeySize], params.Salt[:])
 	b = b[KeySize:]
 	copy(b[:sha256.Size], params.Digest[:])
 	b = b[sha256.Size:]
-	binary.LittleEndian.PutUint64(b[:8], uint64(params.N))
-	b = b[8:]
-	binary.LittleEndian.PutUint64(b[:8], uint64(params.R))
-	b = b[8:]
-	binary.LittleEndian.PutUint64(b[:8], uint64(params.P))
+
+	switch params.KDF {
+	case KDFArgon2id:
+		binary.LittleEndian.PutUint32(b[:4], params.Time)
+		b = b[4:]
+		binary.LittleEndian.PutUint32(b[:4], params.Memory)
+		b = b[4:]
+		b[0] = params.Threads
+	default:
+		putScryptParams(b, params)
+	}
 
 	return marshalled
 }
 
+// Unmarshal restores the parameters produced by Marshal. The untagged scrypt
+// encoding written by earlier versions is still understood.
 func (sk *SecretKey) Unmarshal(marshalled []byte) error {
-	if sk.Key == nil {
-		sk.Key = (*CryptoKey)(&[KeySize]byte{})
+	sk.allocKey()
+
+	params := &sk.Parameters
+
+	if len(marshalled) == legacyParamsSize {
+		params.KDF = KDFScrypt
+		copy(params.Salt[:], marshalled[:KeySize])
+		marshalled = marshalled[KeySize:]
+		copy(params.Digest[:], marshalled[:sha256.Size])
+		marshalled = marshalled[sha256.Size:]
+		getScryptParams(marshalled, params)
+		return nil
 	}
 
-	if len(marshalled) != KeySize+sha256.Size+24 {
+	if len(marshalled) < paramsHeaderSize+KeySize+sha256.Size {
 		return ErrMalformed
 	}
+	if marshalled[0] != paramsVersion {
+		return ErrUnknownVersion
+	}
 
-	params := &sk.Parameters
+	kdf := KDF(marshalled[1])
+	var kdfSize int
+	switch kdf {
+	case KDFScrypt:
+		kdfSize = scryptParamsSize
+	case KDFArgon2id:
+		kdfSize = argon2idParamsSize
+	default:
+		return ErrUnknownKDF
+	}
+	if len(marshalled) != paramsHeaderSize+KeySize+sha256.Size+kdfSize {
+		return ErrMalformed
+	}
+	marshalled = marshalled[paramsHeaderSize:]
+
+	params.KDF = kdf
 	copy(params.Salt[:], marshalled[:KeySize])
 	marshalled = marshalled[KeySize:]
 
 	copy(params.Digest[:], marshalled[:sha256.Size])
 	marshalled = marshalled[sha256.Size:]
 
-	params.N = int(binary.LittleEndian.Uint64(marshalled[:8]))
-	marshalled = marshalled[8:]
-	params.R = int(binary.LittleEndian.Uint64(marshalled[:8]))
-	marshalled = marshalled[8:]
-	params.P = int(binary.LittleEndian.Uint64(marshalled[:8]))
+	switch kdf {
+	case KDFArgon2id:
+		params.Time = binary.LittleEndian.Uint32(marshalled[:4])
+		marshalled = marshalled[4:]
+		params.Memory = binary.LittleEndian.Uint32(marshalled[:4])
+		marshalled = marshalled[4:]
+		params.Threads = marshalled[0]
+		if !validArgon2idParams(params) {
+			return ErrMalformed
+		}
+	default:
+		getScryptParams(marshalled, params)
+	}
 
 	return nil
 }
 
+// validArgon2idParams returns whether the Argon2id parameters are within the
+// bounds keys are derived with. The memory must also cover the 8 KiB each
+// lane needs at least.
+func validArgon2idParams(params *Parameters) bool {
+	return params.Time >= MinArgon2idTime &&
+		params.Threads >= MinArgon2idThreads &&
+		params.Memory >= 8*uint32(params.Threads) &&
+		params.Memory <= MaxArgon2idMemory
+}
+
+func putScryptParams(b []byte, params *Parameters) {
+	binary.LittleEndian.PutUint64(b[:8], uint64(params.N))
+	b = b[8:]
+	binary.LittleEndian.PutUint64(b[:8], uint64(params.R))
+	b = b[8:]
+	binary.LittleEndian.PutUint64(b[:8], uint64(params.P))
+}
+
+func getScryptParams(b []byte, params *Parameters) {
+	params.N = int(binary.LittleEndian.Uint64(b[:8]))
+	b = b[8:]
+	params.R = int(binary.LittleEndian.Uint64(b[:8]))
+	b = b[8:]
+	params.P = int(binary.LittleEndian.Uint64(b[:8]))
+}
+
 func (sk *SecretKey) Zero() {
 	sk.Key.Zero()
 }
@@ -158,15 +318,39 @@ func (sk *SecretKey) DeriveKey(password *[]byte) error {
 }
 
 func (sk *SecretKey) deriveKey(password *[]byte) error {
-	key, err := scrypt.Key(
-		*password,
-		sk.Parameters.Salt[:],
-		sk.Parameters.N,
-		sk.Parameters.R,
-		sk.Parameters.P,
-		len(sk.Key))
-	if err != nil {
-		return err
+	sk.allocKey()
+
+	var (
+		key []byte
+		err error
+	)
+	switch sk.Parameters.KDF {
+	case KDFScrypt:
+		key, err = scrypt.Key(
+			*password,
+			sk.Parameters.Salt[:],
+			sk.Parameters.N,
+			sk.Parameters.R,
+			sk.Parameters.P,
+			len(sk.Key))
+		if err != nil {
+			return err
+		}
+
+	case KDFArgon2id:
+		if !validArgon2idParams(&sk.Parameters) {
+			return ErrMalformed
+		}
+		key = argon2.IDKey(
+			*password,
+			sk.Parameters.Salt[:],
+			sk.Parameters.Time,
+			sk.Parameters.Memory,
+			sk.Parameters.Threads,
+			uint32(len(sk.Key)))
+
+	default:
+		return ErrUnknownKDF
 	}
 
 	copy(sk.Key[:], key)
@@ -177,14 +361,35 @@ func (sk *SecretKey) deriveKey(password *[]byte) error {
 }
 
 func NewSecretKey(password *[]byte, n, r, p int) (*SecretKey, error) {
-	sk := SecretKey{
-		Key: (*CryptoKey)(&[KeySize]byte{}),
+	params := Parameters{
+		KDF: KDFScrypt,
+		N:   n,
+		R:   r,
+		P:   p,
 	}
+	return newSecretKey(password, &params)
+}
+
+// NewArgon2idSecretKey returns a SecretKey derived from password with
+// Argon2id. memory is expressed in KiB.
+func NewArgon2idSecretKey(password *[]byte, time, memory uint32,
+	threads uint8) (*SecretKey, error) {
+
+	params := Parameters{
+		KDF:     KDFArgon2id,
+		Time:    time,
+		Memory:  memory,
+		Threads: threads,
+	}
+	return newSecretKey(password, &params)
+}
+
+func newSecretKey(password *[]byte, params *Parameters) (*SecretKey, error) {
+	var sk SecretKey
+	sk.allocKey()
 
 	// 填充参数
-	sk.Parameters.N = n
-	sk.Parameters.R = r
-	sk.Parameters.P = p
+	sk.Parameters = *params
 	_, err := io.ReadFull(prng, sk.Parameters.Salt[:])
 	if err != nil {
 		return nil, err
@@ -79,3 +79,102 @@ func TestEncryptAndDecrypt(t *testing.T) {
 
 	assert.Equal(t, message, decryptedMessage)
 }
+
+func TestArgon2idUnmarshalAndDeriveKey(t *testing.T) {
+	key1, err := NewArgon2idSecretKey(&password, 1, 1024, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, KDFArgon2id, key1.Parameters.KDF)
+
+	marshalled := key1.Marshal()
+	assert.Equal(t, byte(paramsVersion), marshalled[0])
+	assert.Equal(t, byte(KDFArgon2id), marshalled[1])
+
+	var key2 SecretKey
+	err = key2.Unmarshal(marshalled)
+	assert.NoError(t, err)
+	assert.Equal(t, KDFArgon2id, key2.Parameters.KDF)
+	assert.Equal(t, uint32(1), key2.Parameters.Time)
+	assert.Equal(t, uint32(1024), key2.Parameters.Memory)
+	assert.Equal(t, uint8(1), key2.Parameters.Threads)
+
+	err = key2.DeriveKey(&password)
+	assert.NoError(t, err)
+	assert.Equal(t, key1.Key, key2.Key)
+
+	wrong := []byte("wrong")
+	var key3 SecretKey
+	assert.NoError(t, key3.Unmarshal(marshalled))
+	assert.Equal(t, ErrInvalidPassword, key3.DeriveKey(&wrong))
+}
+
+func TestUnmarshalLegacyScryptParams(t *testing.T) {
+	key1, err := NewSecretKey(&password, DefaultN, DefaultR, DefaultP)
+	assert.NoError(t, err)
+
+	// Rebuild the untagged encoding written before parameters were
+	// versioned: Salt + Digest + N + R + P.
+	legacy := make([]byte, 0, legacyParamsSize)
+	legacy = append(legacy, key1.Parameters.Salt[:]...)
+	legacy = append(legacy, key1.Parameters.Digest[:]...)
+	legacy = append(legacy, key1.Marshal()[paramsHeaderSize+KeySize+32:]...)
+	assert.Len(t, legacy, legacyParamsSize)
+
+	var key2 SecretKey
+	err = key2.Unmarshal(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, KDFScrypt, key2.Parameters.KDF)
+	assert.Equal(t, DefaultN, key2.Parameters.N)
+
+	err = key2.DeriveKey(&password)
+	assert.NoError(t, err)
+	assert.Equal(t, key1.Key, key2.Key)
+}
+
+func TestUnmarshalUnknownParams(t *testing.T) {
+	key1, err := NewSecretKey(&password, DefaultN, DefaultR, DefaultP)
+	assert.NoError(t, err)
+
+	marshalled := key1.Marshal()
+
+	badVersion := append([]byte{}, marshalled...)
+	badVersion[0] = paramsVersion + 1
+	var key2 SecretKey
+	assert.Equal(t, ErrUnknownVersion, key2.Unmarshal(badVersion))
+
+	badKDF := append([]byte{}, marshalled...)
+	badKDF[1] = 0xff
+	assert.Equal(t, ErrUnknownKDF, key2.Unmarshal(badKDF))
+
+	assert.Equal(t, ErrMalformed, key2.Unmarshal(marshalled[:40]))
+}
+
+func TestUnmarshalArgon2idParamsBounds(t *testing.T) {
+	key1, err := NewArgon2idSecretKey(&password, 1, 1024, 1)
+	assert.NoError(t, err)
+
+	// Parameters are rejected before any key is derived with them.
+	tests := []struct {
+		name    string
+		time    uint32
+		memory  uint32
+		threads uint8
+	}{
+		{"zero time", 0, 1024, 1},
+		{"zero threads", 1, 1024, 0},
+		{"memory below lanes", 1, 15, 2},
+		{"memory above max", 1, MaxArgon2idMemory + 1, 1},
+	}
+	for _, test := range tests {
+		key2 := *key1
+		key2.Parameters.Time = test.time
+		key2.Parameters.Memory = test.memory
+		key2.Parameters.Threads = test.threads
+
+		var key3 SecretKey
+		assert.Equal(t, ErrMalformed, key3.Unmarshal(key2.Marshal()),
+			test.name)
+	}
+
+	_, err = NewArgon2idSecretKey(&password, 1, MaxArgon2idMemory+1, 1)
+	assert.Equal(t, ErrMalformed, err)
+}
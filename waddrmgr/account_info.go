@@ -137,6 +137,26 @@ func putAccountNameIndex(ns walletdb.ReadWriteBucket, scope *KeyScope,
 	return nil
 }
 
+// deleteAccountNameIndex removes the name of an account from the account
+// name index, leaving the name free for another account.
+func deleteAccountNameIndex(ns walletdb.ReadWriteBucket, scope *KeyScope,
+	name string) error {
+
+	scopedBucket, err := fetchWriteScopeBucket(ns, scope)
+	if err != nil {
+		return err
+	}
+
+	bucket := scopedBucket.NestedReadWriteBucket(acctNameIdxBucketName)
+	err = bucket.Delete(stringToBytes(name))
+	if err != nil {
+		str := fmt.Sprintf("failed to delete account name index key %s", name)
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
 func fetchAccountByName(ns walletdb.ReadBucket, scope *KeyScope,
 	name string) (uint32, error) {
 
@@ -42,7 +42,7 @@ func (a *baseScriptAddress) unlock(key EncryptorDecryptor) ([]byte, error) {
 	defer a.scriptMutex.Unlock()
 
 	if len(a.scriptClearText) == 0 {
-		script, err := key.Decrypt(a.scriptClearText)
+		script, err := key.Decrypt(a.scriptEncrypted)
 		if err != nil {
 			str := fmt.Sprintf("failed to decrypt script for %s", a.address)
 			return nil, managerError(ErrCrypto, str, err)
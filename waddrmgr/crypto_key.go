@@ -1,23 +1,51 @@
 package waddrmgr
 
-import "github.com/czh0526/btc-wallet/snacl"
+import (
+	"crypto/rand"
+	"io"
 
+	"github.com/czh0526/btc-wallet/internal/securemem"
+	"github.com/czh0526/btc-wallet/snacl"
+)
+
+// cryptoKey is a snacl.CryptoKey kept in locked memory.
 type cryptoKey struct {
-	snacl.CryptoKey
+	mem *securemem.Buffer
+}
+
+func newLockedCryptoKey() *cryptoKey {
+	return &cryptoKey{mem: securemem.New(snacl.KeySize)}
+}
+
+func (ck *cryptoKey) key() *snacl.CryptoKey {
+	return (*snacl.CryptoKey)(ck.mem.Bytes())
+}
+
+func (ck *cryptoKey) Encrypt(in []byte) ([]byte, error) {
+	return ck.key().Encrypt(in)
+}
+
+func (ck *cryptoKey) Decrypt(in []byte) ([]byte, error) {
+	return ck.key().Decrypt(in)
 }
 
 func (ck *cryptoKey) Bytes() []byte {
-	return ck.CryptoKey[:]
+	return ck.mem.Bytes()
 }
 
 func (ck *cryptoKey) CopyBytes(from []byte) {
-	copy(ck.CryptoKey[:], from)
+	copy(ck.mem.Bytes(), from)
+}
+
+func (ck *cryptoKey) Zero() {
+	ck.mem.Wipe()
 }
 
 func defaultNewCryptoKey() (EncryptorDecryptor, error) {
-	key, err := snacl.GenerateCryptoKey()
-	if err != nil {
+	key := newLockedCryptoKey()
+	if _, err := io.ReadFull(rand.Reader, key.Bytes()); err != nil {
+		key.Zero()
 		return nil, err
 	}
-	return &cryptoKey{*key}, nil
+	return key, nil
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/czh0526/btc-wallet/walletdb"
 	"time"
 )
@@ -45,6 +46,12 @@ var (
 
 	watchingOnlyName = []byte("watchonly")
 	birthdayName     = []byte("birthday")
+	syncedToName     = []byte("syncedto")
+
+	birthdayBlockName             = []byte("birthdayblock")
+	birthdayBlockVerificationName = []byte("birthdayblockverification")
+
+	recoveryWindowName = []byte("recoverywindow")
 )
 
 var (
@@ -372,6 +379,182 @@ func putBirthday(ns walletdb.ReadWriteBucket, t time.Time) error {
 	return nil
 }
 
+// putSyncedTo stores the block the manager is synced to. The value is the
+// height, hash and timestamp of the block.
+func putSyncedTo(ns walletdb.ReadWriteBucket, bs *BlockStamp) error {
+	buf := make([]byte, 44)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(bs.Height))
+	copy(buf[4:36], bs.Hash[:])
+	binary.LittleEndian.PutUint64(buf[36:44], uint64(bs.Timestamp.Unix()))
+
+	bucket := ns.NestedReadWriteBucket(syncBucketName)
+	if err := bucket.Put(syncedToName, buf); err != nil {
+		str := fmt.Sprintf("failed to store sync information %v", bs.Hash)
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
+// putBirthdayBlock stores the birthday block of the manager, encoded like
+// the block the manager is synced to.
+func putBirthdayBlock(ns walletdb.ReadWriteBucket, bs *BlockStamp) error {
+	buf := make([]byte, 44)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(bs.Height))
+	copy(buf[4:36], bs.Hash[:])
+	binary.LittleEndian.PutUint64(buf[36:44], uint64(bs.Timestamp.Unix()))
+
+	bucket := ns.NestedReadWriteBucket(syncBucketName)
+	if err := bucket.Put(birthdayBlockName, buf); err != nil {
+		str := fmt.Sprintf("failed to store birthday block %v", bs.Hash)
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
+// fetchBirthdayBlock loads the birthday block of the manager.
+// ErrBirthdayBlockNotSet is returned if none was stored.
+func fetchBirthdayBlock(ns walletdb.ReadBucket) (*BlockStamp, error) {
+	bucket := ns.NestedReadBucket(syncBucketName)
+	buf := bucket.Get(birthdayBlockName)
+	if buf == nil {
+		str := "birthday block not set"
+		return nil, managerError(ErrBirthdayBlockNotSet, str, nil)
+	}
+	if len(buf) != 44 {
+		str := "malformed birthday block stored in database"
+		return nil, managerError(ErrDatabase, str, nil)
+	}
+
+	var bs BlockStamp
+	bs.Height = int32(binary.LittleEndian.Uint32(buf[0:4]))
+	copy(bs.Hash[:], buf[4:36])
+	bs.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(buf[36:44])), 0)
+	return &bs, nil
+}
+
+// putBirthdayBlockVerification stores whether the birthday block of the
+// manager was verified against the chain.
+func putBirthdayBlockVerification(ns walletdb.ReadWriteBucket,
+	verified bool) error {
+
+	var buf [1]byte
+	if verified {
+		buf[0] = 1
+	}
+
+	bucket := ns.NestedReadWriteBucket(syncBucketName)
+	if err := bucket.Put(birthdayBlockVerificationName, buf[:]); err != nil {
+		str := "failed to store birthday block verification"
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
+// fetchBirthdayBlockVerification loads whether the birthday block of the
+// manager was verified against the chain.
+func fetchBirthdayBlockVerification(ns walletdb.ReadBucket) bool {
+	bucket := ns.NestedReadBucket(syncBucketName)
+	buf := bucket.Get(birthdayBlockVerificationName)
+	return len(buf) == 1 && buf[0] == 1
+}
+
+// putRecoveryWindow stores the recovery window of a recovery of the manager
+// in progress. A zero window removes it, marking the recovery finished.
+func putRecoveryWindow(ns walletdb.ReadWriteBucket, window uint32) error {
+	bucket := ns.NestedReadWriteBucket(syncBucketName)
+
+	var err error
+	if window == 0 {
+		err = bucket.Delete(recoveryWindowName)
+	} else {
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], window)
+		err = bucket.Put(recoveryWindowName, buf[:])
+	}
+	if err != nil {
+		str := "failed to store recovery window"
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
+// fetchRecoveryWindow loads the recovery window of a recovery of the manager
+// in progress, or zero if none is.
+func fetchRecoveryWindow(ns walletdb.ReadBucket) uint32 {
+	bucket := ns.NestedReadBucket(syncBucketName)
+	buf := bucket.Get(recoveryWindowName)
+	if len(buf) != 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(buf)
+}
+
+// putBlockHash stores the hash of the block the manager synced through at the
+// given height, keyed by the big-endian height within the sync bucket.
+func putBlockHash(ns walletdb.ReadWriteBucket, height int32,
+	hash *chainhash.Hash) error {
+
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(height))
+
+	bucket := ns.NestedReadWriteBucket(syncBucketName)
+	if err := bucket.Put(key[:], hash[:]); err != nil {
+		str := fmt.Sprintf("failed to store block hash %v", hash)
+		return managerError(ErrDatabase, str, err)
+	}
+
+	return nil
+}
+
+// fetchBlockHash loads the hash of the block the manager synced through at
+// the given height.
+func fetchBlockHash(ns walletdb.ReadBucket, height int32) (*chainhash.Hash,
+	error) {
+
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], uint32(height))
+
+	bucket := ns.NestedReadBucket(syncBucketName)
+	hashBytes := bucket.Get(key[:])
+	if hashBytes == nil {
+		str := fmt.Sprintf("no block hash stored for height %d", height)
+		return nil, managerError(ErrBlockNotFound, str, nil)
+	}
+	if len(hashBytes) != chainhash.HashSize {
+		str := fmt.Sprintf("malformed block hash stored for height %d",
+			height)
+		return nil, managerError(ErrDatabase, str, nil)
+	}
+
+	var hash chainhash.Hash
+	copy(hash[:], hashBytes)
+	return &hash, nil
+}
+
+// fetchSyncedTo loads the block the manager is synced to. A manager that has
+// never been synced reports the zero BlockStamp.
+func fetchSyncedTo(ns walletdb.ReadBucket) (*BlockStamp, error) {
+	bucket := ns.NestedReadBucket(syncBucketName)
+	buf := bucket.Get(syncedToName)
+	if buf == nil {
+		return &BlockStamp{}, nil
+	}
+	if len(buf) != 44 {
+		str := "malformed sync information stored in database"
+		return nil, managerError(ErrDatabase, str, nil)
+	}
+
+	var bs BlockStamp
+	bs.Height = int32(binary.LittleEndian.Uint32(buf[0:4]))
+	copy(bs.Hash[:], buf[4:36])
+	bs.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(buf[36:44])), 0)
+	return &bs, nil
+}
+
 func fetchReadScopeBucket(ns walletdb.ReadBucket, scope *KeyScope) (walletdb.ReadBucket, error) {
 	rootScopeBucket := ns.NestedReadBucket(scopeBucketName)
 
@@ -612,7 +795,7 @@ func fetchBirthday(ns walletdb.ReadBucket) (time.Time, error) {
 		return t, managerError(ErrDatabase, str, nil)
 	}
 
-	t = time.Unix(int64(binary.BigEndian.Uint64(birthdayTimestamp)), 0)
+	t = time.Unix(int64(binary.LittleEndian.Uint64(birthdayTimestamp)), 0)
 	return t, nil
 }
 
@@ -671,6 +854,30 @@ func forEachAccountAddress(ns walletdb.ReadBucket, scope *KeyScope,
 	return nil
 }
 
+// forEachActiveAddress calls fn with the row of every address of the scope,
+// of every account.
+func forEachActiveAddress(ns walletdb.ReadBucket, scope *KeyScope,
+	fn func(rowInterface interface{}) error) error {
+
+	scopedBucket, err := fetchReadScopeBucket(ns, scope)
+	if err != nil {
+		return err
+	}
+
+	bucket := scopedBucket.NestedReadBucket(addrBucketName)
+	err = bucket.ForEach(func(k, v []byte) error {
+		addrRow, err := readAddressRow(v)
+		if err != nil {
+			return err
+		}
+		return fn(addrRow)
+	})
+	if err != nil {
+		return maybeConvertDbError(err)
+	}
+	return nil
+}
+
 type dbAddressRow struct {
 	addrType   addressType
 	account    uint32
@@ -686,7 +893,7 @@ type dbChainAddressRow struct {
 }
 
 func serializeChainedAddress(branch, index uint32) []byte {
-	rawData := make([]byte, 0)
+	rawData := make([]byte, 8)
 	binary.LittleEndian.PutUint32(rawData[0:4], branch)
 	binary.LittleEndian.PutUint32(rawData[4:8], index)
 	return rawData
@@ -867,7 +1074,14 @@ func serializeAddressRow(row *dbAddressRow) []byte {
 }
 
 func deserializeAddressRow(serializeAddress []byte) (*dbAddressRow, error) {
-	if len(serializeAddress) != 18 {
+	// The 18 byte header is followed by the raw data of the length it
+	// records.
+	if len(serializeAddress) < 18 {
+		str := "malformed serialized address"
+		return nil, managerError(ErrDatabase, str, nil)
+	}
+	rdlen := binary.LittleEndian.Uint32(serializeAddress[14:18])
+	if uint64(len(serializeAddress)) != 18+uint64(rdlen) {
 		str := "malformed serialized address"
 		return nil, managerError(ErrDatabase, str, nil)
 	}
@@ -877,7 +1091,6 @@ func deserializeAddressRow(serializeAddress []byte) (*dbAddressRow, error) {
 	row.account = binary.LittleEndian.Uint32(serializeAddress[1:5])
 	row.addTime = binary.LittleEndian.Uint64(serializeAddress[5:13])
 	row.syncStatus = syncStatus(serializeAddress[13])
-	rdlen := binary.LittleEndian.Uint32(serializeAddress[14:18])
 	row.rawData = make([]byte, rdlen)
 	copy(row.rawData, serializeAddress[18:18+rdlen])
 
@@ -953,7 +1166,7 @@ func putChainedAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
 	}
 
 	accountID := uint32ToBytes(account)
-	bucket := scopedBucket.NestedReadWriteBucket(addrBucketName)
+	bucket := scopedBucket.NestedReadWriteBucket(acctBucketName)
 	serializedAccount := bucket.Get(accountID)
 
 	row, err := deserializeAccountRow(accountID, serializedAccount)
@@ -1011,6 +1224,22 @@ func putChainedAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
 	return nil
 }
 
+func putImportedAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
+	addressID []byte, account uint32, status syncStatus,
+	encryptedPubKey, encryptedPrivKey []byte) error {
+
+	rawData := serializeImportedAddress(encryptedPubKey, encryptedPrivKey)
+	addrRow := dbAddressRow{
+		addrType:   adtImport,
+		account:    account,
+		addTime:    uint64(time.Now().Unix()),
+		syncStatus: status,
+		rawData:    rawData,
+	}
+
+	return putAddress(ns, scope, addressID, &addrRow)
+}
+
 func putScriptAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
 	addressID []byte, account uint32, status syncStatus,
 	encryptedHash, encryptedScript []byte) error {
@@ -1031,6 +1260,29 @@ func putScriptAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
 	return nil
 }
 
+func putWitnessScriptAddress(ns walletdb.ReadWriteBucket, scope *KeyScope,
+	addressID []byte, account uint32, status syncStatus,
+	witnessVersion byte, isSecretScript bool,
+	encryptedHash, encryptedScript []byte) error {
+
+	addrType := adtWitnessScript
+	if witnessVersion == witnessVersionV1 {
+		addrType = adtTaprootScript
+	}
+
+	rawData := serializeWitnessScriptAddress(
+		witnessVersion, isSecretScript, encryptedHash, encryptedScript)
+	addrRow := dbAddressRow{
+		addrType:   addrType,
+		account:    account,
+		addTime:    uint64(time.Now().Unix()),
+		syncStatus: status,
+		rawData:    rawData,
+	}
+
+	return putAddress(ns, scope, addressID, &addrRow)
+}
+
 func fetchAddress(ns walletdb.ReadBucket, scope *KeyScope,
 	addressID []byte) (interface{}, error) {
 
@@ -1054,6 +1306,12 @@ func fetchAddressByHash(ns walletdb.ReadBucket, scope *KeyScope,
 		return nil, managerError(ErrAddressNotFound, str, nil)
 	}
 
+	return readAddressRow(serializedRow)
+}
+
+// readAddressRow deserializes an address row into the row type of its
+// address type.
+func readAddressRow(serializedRow []byte) (interface{}, error) {
 	row, err := deserializeAddressRow(serializedRow)
 	if err != nil {
 		return nil, err
@@ -141,29 +141,31 @@ const (
 
 // Map of ErrorCode values back to their constant names for pretty printing.
 var errorCodeStrings = map[ErrorCode]string{
-	ErrDatabase:          "ErrDatabase",
-	ErrUpgrade:           "ErrUpgrade",
-	ErrKeyChain:          "ErrKeyChain",
-	ErrCrypto:            "ErrCrypto",
-	ErrInvalidKeyType:    "ErrInvalidKeyType",
-	ErrNoExist:           "ErrNoExist",
-	ErrAlreadyExists:     "ErrAlreadyExists",
-	ErrCoinTypeTooHigh:   "ErrCoinTypeTooHigh",
-	ErrAccountNumTooHigh: "ErrAccountNumTooHigh",
-	ErrLocked:            "ErrLocked",
-	ErrWatchingOnly:      "ErrWatchingOnly",
-	ErrInvalidAccount:    "ErrInvalidAccount",
-	ErrAddressNotFound:   "ErrAddressNotFound",
-	ErrAccountNotFound:   "ErrAccountNotFound",
-	ErrDuplicateAddress:  "ErrDuplicateAddress",
-	ErrDuplicateAccount:  "ErrDuplicateAccount",
-	ErrTooManyAddresses:  "ErrTooManyAddresses",
-	ErrWrongPassphrase:   "ErrWrongPassphrase",
-	ErrWrongNet:          "ErrWrongNet",
-	ErrCallBackBreak:     "ErrCallBackBreak",
-	ErrEmptyPassphrase:   "ErrEmptyPassphrase",
-	ErrScopeNotFound:     "ErrScopeNotFound",
-	ErrAccountNotCached:  "ErrAccountNotCached",
+	ErrDatabase:            "ErrDatabase",
+	ErrUpgrade:             "ErrUpgrade",
+	ErrKeyChain:            "ErrKeyChain",
+	ErrCrypto:              "ErrCrypto",
+	ErrInvalidKeyType:      "ErrInvalidKeyType",
+	ErrNoExist:             "ErrNoExist",
+	ErrAlreadyExists:       "ErrAlreadyExists",
+	ErrCoinTypeTooHigh:     "ErrCoinTypeTooHigh",
+	ErrAccountNumTooHigh:   "ErrAccountNumTooHigh",
+	ErrLocked:              "ErrLocked",
+	ErrWatchingOnly:        "ErrWatchingOnly",
+	ErrInvalidAccount:      "ErrInvalidAccount",
+	ErrAddressNotFound:     "ErrAddressNotFound",
+	ErrAccountNotFound:     "ErrAccountNotFound",
+	ErrDuplicateAddress:    "ErrDuplicateAddress",
+	ErrDuplicateAccount:    "ErrDuplicateAccount",
+	ErrTooManyAddresses:    "ErrTooManyAddresses",
+	ErrWrongPassphrase:     "ErrWrongPassphrase",
+	ErrWrongNet:            "ErrWrongNet",
+	ErrCallBackBreak:       "ErrCallBackBreak",
+	ErrEmptyPassphrase:     "ErrEmptyPassphrase",
+	ErrScopeNotFound:       "ErrScopeNotFound",
+	ErrBirthdayBlockNotSet: "ErrBirthdayBlockNotSet",
+	ErrBlockNotFound:       "ErrBlockNotFound",
+	ErrAccountNotCached:    "ErrAccountNotCached",
 }
 
 func (e ErrorCode) String() string {
@@ -189,3 +191,10 @@ func (e ManagerError) Error() string {
 func managerError(c ErrorCode, desc string, err error) ManagerError {
 	return ManagerError{ErrorCode: c, Description: desc, Err: err}
 }
+
+// IsError returns whether the error is a ManagerError with a matching error
+// code.
+func IsError(err error, code ErrorCode) bool {
+	merr, ok := err.(ManagerError)
+	return ok && merr.ErrorCode == code
+}
@@ -3,13 +3,17 @@ package waddrmgr
 import (
 	"crypto/rand"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/czh0526/btc-wallet/internal/securemem"
 	"github.com/czh0526/btc-wallet/internal/zero"
 	"github.com/czh0526/btc-wallet/snacl"
 	"github.com/czh0526/btc-wallet/walletdb"
-	"github.com/lightninglabs/neutrino/cache/lru"
 	"sync"
 	"time"
 )
@@ -33,6 +37,19 @@ const (
 	ImportedAddrAccountName = "imported"
 )
 
+// HDVersion is the version prefix of a serialized extended key, identifying
+// its network and, as per SLIP-0132, the type of the addresses derived from
+// it.
+type HDVersion uint32
+
+const (
+	HDVersionMainNetBIP0049 HDVersion = 0x049d7cb2 // ypub
+	HDVersionMainNetBIP0084 HDVersion = 0x04b24746 // zpub
+
+	HDVersionTestNetBIP0049 HDVersion = 0x044a5262 // upub
+	HDVersionTestNetBIP0084 HDVersion = 0x045f1cf6 // vpub
+)
+
 type addrKey string
 
 var (
@@ -51,8 +68,8 @@ var (
 )
 
 func defaultNewSecretKey(passphrase *[]byte,
-	config *ScryptOptions) (*snacl.SecretKey, error) {
-	return snacl.NewSecretKey(passphrase, config.N, config.R, config.P)
+	config KDFOptions) (*snacl.SecretKey, error) {
+	return config.newSecretKey(passphrase)
 }
 
 type Manager struct {
@@ -75,23 +92,71 @@ type Manager struct {
 	cryptoKeyScript          EncryptorDecryptor
 	cryptoKeyScriptEncrypted []byte
 
-	privPassphraseSalt   [saltSize]byte
-	hashedPrivPassphrase [sha512.Size]byte
+	privPassphraseSalt [saltSize]byte
+
+	// hashedPrivPassphrase holds the salted SHA-512 of the private
+	// passphrase while unlocked. It lives in locked memory.
+	hashedPrivPassphrase *securemem.Buffer
+
+	// privKeyPool backs the private key caches of all scoped managers.
+	privKeyPool *securemem.Pool
+
+	syncState syncState
+
+	// birthday is the time before which the wallet can't have any
+	// transactions.
+	birthday time.Time
 
 	locked bool
 	closed bool
 }
 
+// KDFOptions selects the password-based key derivation function, and its
+// cost parameters, used to protect the master keys. It is implemented by
+// *ScryptOptions and *Argon2idOptions.
+type KDFOptions interface {
+	newSecretKey(passphrase *[]byte) (*snacl.SecretKey, error)
+}
+
 type ScryptOptions struct {
 	N, R, P int
 }
 
+func (o *ScryptOptions) newSecretKey(passphrase *[]byte) (*snacl.SecretKey, error) {
+	return snacl.NewSecretKey(passphrase, o.N, o.R, o.P)
+}
+
 var FastScryptOptions = ScryptOptions{
 	N: 16,
 	R: 8,
 	P: 1,
 }
 
+// Argon2idOptions are the Argon2id cost parameters. Memory is in KiB.
+type Argon2idOptions struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+func (o *Argon2idOptions) newSecretKey(passphrase *[]byte) (*snacl.SecretKey, error) {
+	return snacl.NewArgon2idSecretKey(passphrase, o.Time, o.Memory, o.Threads)
+}
+
+var (
+	DefaultArgon2idOptions = Argon2idOptions{
+		Time:    snacl.DefaultArgon2idTime,
+		Memory:  snacl.DefaultArgon2idMemory,
+		Threads: snacl.DefaultArgon2idThreads,
+	}
+
+	FastArgon2idOptions = Argon2idOptions{
+		Time:    1,
+		Memory:  64,
+		Threads: 1,
+	}
+)
+
 type AccountProperties struct {
 	AccountNumber        uint32
 	AccountName          string
@@ -134,7 +199,7 @@ type AccountProperties struct {
 */
 func Create(ns walletdb.ReadWriteBucket, rootKey *hdkeychain.ExtendedKey,
 	pubPassphrase, privPassphrase []byte,
-	chainParams *chaincfg.Params, config *ScryptOptions,
+	chainParams *chaincfg.Params, config KDFOptions,
 	birthday time.Time) error {
 
 	isWatchingOnly := rootKey == nil
@@ -332,7 +397,25 @@ func Open(ns walletdb.ReadBucket, pubPassphrase []byte,
 	return loadManager(ns, pubPassphrase, chainParams)
 }
 
+// Close locks the manager and frees the locked memory backing its private
+// key caches and hashed passphrase. The manager must not be used afterwards.
 func (m *Manager) Close() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	if !m.watchingOnly && !m.locked {
+		m.lock()
+	}
+	for _, manager := range m.scopedManagers {
+		manager.purgePrivKeyCache()
+	}
+	m.privKeyPool.Destroy()
+	m.hashedPrivPassphrase.Destroy()
+
 	m.closed = true
 }
 
@@ -380,14 +463,23 @@ func (m *Manager) lock() {
 				addr.lock()
 			case *scriptAddress:
 				addr.lock()
+			case *witnessScriptAddress:
+				addr.lock()
+			case *taprootScriptAddress:
+				addr.lock()
 			}
 		}
 	}
 
+	for _, manager := range m.scopedManagers {
+		manager.purgePrivKeyCache()
+	}
+	m.privKeyPool.Wipe()
+
 	m.cryptoKeyScript.Zero()
 	m.cryptoKeyPriv.Zero()
 	m.masterKeyPriv.Zero()
-	zero.Bytea64(&m.hashedPrivPassphrase)
+	m.hashedPrivPassphrase.Wipe()
 
 	m.locked = true
 }
@@ -418,7 +510,10 @@ func (m *Manager) Unlock(ns walletdb.ReadBucket, passphrase []byte) error {
 			passphrase...)
 		hashedPassphrase := sha512.Sum512(saltedPassphrase)
 		zero.Bytes(saltedPassphrase)
-		if hashedPassphrase != m.hashedPrivPassphrase {
+		match := subtle.ConstantTimeCompare(
+			hashedPassphrase[:], m.hashedPrivPassphrase.Bytes())
+		zero.Bytea64(&hashedPassphrase)
+		if match != 1 {
 			m.lock()
 			str := "invalid passphrase for master private key"
 			return managerError(ErrWrongPassphrase, str, nil)
@@ -449,6 +544,15 @@ func (m *Manager) Unlock(ns walletdb.ReadBucket, passphrase []byte) error {
 	m.cryptoKeyPriv.CopyBytes(decryptedKey)
 	zero.Bytes(decryptedKey)
 
+	decryptedKey, err = m.masterKeyPriv.Decrypt(m.cryptoKeyScriptEncrypted)
+	if err != nil {
+		m.lock()
+		str := "failed to decrypt crypto script key"
+		return managerError(ErrCrypto, str, err)
+	}
+	m.cryptoKeyScript.CopyBytes(decryptedKey)
+	zero.Bytes(decryptedKey)
+
 	for _, manager := range m.scopedManagers {
 		for account, acctInfo := range manager.acctInfo {
 			fmt.Printf("【Manager】Decrypt `acctKeyPriv` use {cryptoKeyPriv} \n")
@@ -505,11 +609,189 @@ func (m *Manager) Unlock(ns walletdb.ReadBucket, passphrase []byte) error {
 
 	m.locked = false
 	saltedPassphrase := append(m.privPassphraseSalt[:], passphrase...)
-	m.hashedPrivPassphrase = sha512.Sum512(saltedPassphrase)
+	hashedPassphrase := sha512.Sum512(saltedPassphrase)
+	copy(m.hashedPrivPassphrase.Bytes(), hashedPassphrase[:])
+	zero.Bytea64(&hashedPassphrase)
 	zero.Bytes(saltedPassphrase)
 	return nil
 }
 
+// KDFInfo returns the key derivation options currently protecting the public
+// and private master keys. The private options are nil for a watching-only
+// manager.
+func (m *Manager) KDFInfo() (pubOptions, privOptions KDFOptions) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	pubOptions = kdfOptionsFromParams(&m.masterKeyPub.Parameters)
+	if !m.watchingOnly {
+		privOptions = kdfOptionsFromParams(&m.masterKeyPriv.Parameters)
+	}
+	return pubOptions, privOptions
+}
+
+// kdfOptionsFromParams converts the cost parameters stored in a secret key
+// back into the KDFOptions that would recreate them.
+func kdfOptionsFromParams(params *snacl.Parameters) KDFOptions {
+	switch params.KDF {
+	case snacl.KDFArgon2id:
+		return &Argon2idOptions{
+			Time:    params.Time,
+			Memory:  params.Memory,
+			Threads: params.Threads,
+		}
+	default:
+		return &ScryptOptions{
+			N: params.N,
+			R: params.R,
+			P: params.P,
+		}
+	}
+}
+
+// UpgradeKDF re-derives the public and private master keys from the given
+// passphrases using newOptions and re-encrypts the crypto keys with them. All
+// database writes happen within ns, so the upgrade is atomic with respect to
+// the enclosing transaction, and the in-memory keys are only replaced once it
+// commits. The passphrases themselves are unchanged, and the lock state of the
+// manager is preserved.
+func (m *Manager) UpgradeKDF(ns walletdb.ReadWriteBucket, pubPassphrase,
+	privPassphrase []byte, newOptions KDFOptions) error {
+
+	if newOptions == nil {
+		str := "no key derivation options specified"
+		return managerError(ErrCrypto, str, nil)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// Check the public passphrase against a copy of the current master key
+	// so a failure leaves the in-memory key untouched.
+	oldPub := snacl.SecretKey{Parameters: m.masterKeyPub.Parameters}
+	if err := oldPub.DeriveKey(&pubPassphrase); err != nil {
+		if err == snacl.ErrInvalidPassword {
+			str := "invalid passphrase for master public key"
+			return managerError(ErrWrongPassphrase, str, nil)
+		}
+
+		str := "failed to derive master public key"
+		return managerError(ErrCrypto, str, err)
+	}
+	oldPub.Zero()
+
+	newMasterKeyPub, err := newSecretKey(&pubPassphrase, newOptions)
+	if err != nil {
+		str := "failed to create new master public key"
+		return managerError(ErrCrypto, str, err)
+	}
+	cryptoKeyPubEnc, err := newMasterKeyPub.Encrypt(m.cryptoKeyPub.Bytes())
+	if err != nil {
+		newMasterKeyPub.Zero()
+		str := "failed to encrypt crypto public key"
+		return managerError(ErrCrypto, str, err)
+	}
+
+	var (
+		newMasterKeyPriv   *snacl.SecretKey
+		cryptoKeyPrivEnc   []byte
+		cryptoKeyScriptEnc []byte
+		privParams         []byte
+	)
+	if !m.watchingOnly {
+		oldPriv := snacl.SecretKey{Parameters: m.masterKeyPriv.Parameters}
+		if err := oldPriv.DeriveKey(&privPassphrase); err != nil {
+			newMasterKeyPub.Zero()
+			if err == snacl.ErrInvalidPassword {
+				str := "invalid passphrase for master private key"
+				return managerError(ErrWrongPassphrase, str, nil)
+			}
+
+			str := "failed to derive master private key"
+			return managerError(ErrCrypto, str, err)
+		}
+		defer oldPriv.Zero()
+
+		cryptoKeyPriv, err := oldPriv.Decrypt(m.cryptoKeyPrivEncrypted)
+		if err != nil {
+			newMasterKeyPub.Zero()
+			str := "failed to decrypt crypto private key"
+			return managerError(ErrCrypto, str, err)
+		}
+		defer zero.Bytes(cryptoKeyPriv)
+
+		cryptoKeyScript, err := oldPriv.Decrypt(m.cryptoKeyScriptEncrypted)
+		if err != nil {
+			newMasterKeyPub.Zero()
+			str := "failed to decrypt crypto script key"
+			return managerError(ErrCrypto, str, err)
+		}
+		defer zero.Bytes(cryptoKeyScript)
+
+		newMasterKeyPriv, err = newSecretKey(&privPassphrase, newOptions)
+		if err != nil {
+			newMasterKeyPub.Zero()
+			str := "failed to create new master private key"
+			return managerError(ErrCrypto, str, err)
+		}
+
+		cryptoKeyPrivEnc, err = newMasterKeyPriv.Encrypt(cryptoKeyPriv)
+		if err != nil {
+			newMasterKeyPub.Zero()
+			newMasterKeyPriv.Zero()
+			str := "failed to encrypt crypto private key"
+			return managerError(ErrCrypto, str, err)
+		}
+
+		cryptoKeyScriptEnc, err = newMasterKeyPriv.Encrypt(cryptoKeyScript)
+		if err != nil {
+			newMasterKeyPub.Zero()
+			newMasterKeyPriv.Zero()
+			str := "failed to encrypt crypto script key"
+			return managerError(ErrCrypto, str, err)
+		}
+
+		privParams = newMasterKeyPriv.Marshal()
+	}
+
+	err = putMasterKeyParams(ns, newMasterKeyPub.Marshal(), privParams)
+	if err == nil {
+		err = putCryptoKeys(
+			ns, cryptoKeyPubEnc, cryptoKeyPrivEnc, cryptoKeyScriptEnc)
+	}
+	if err != nil {
+		newMasterKeyPub.Zero()
+		if newMasterKeyPriv != nil {
+			newMasterKeyPriv.Zero()
+		}
+		return maybeConvertDbError(err)
+	}
+
+	// Only swap the keys in memory once the new ones are committed, so a
+	// rolled back transaction leaves the manager matching the database.
+	ns.Tx().OnCommit(func() {
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+
+		m.masterKeyPub.Zero()
+		m.masterKeyPub = newMasterKeyPub
+		if !m.watchingOnly {
+			m.masterKeyPriv.Zero()
+			m.masterKeyPriv = newMasterKeyPriv
+			m.cryptoKeyPrivEncrypted = cryptoKeyPrivEnc
+			m.cryptoKeyScriptEncrypted = cryptoKeyScriptEnc
+
+			// Only keep the derived private master key around while
+			// the manager is unlocked.
+			if m.locked {
+				m.masterKeyPriv.Zero()
+			}
+		}
+	})
+
+	return nil
+}
+
 func (m *Manager) NewScopedKeyManager(ns walletdb.ReadWriteBucket,
 	scope KeyScope, addrSchema ScopeAddrSchema) (*ScopedKeyManager, error) {
 
@@ -569,14 +851,12 @@ func (m *Manager) NewScopedKeyManager(ns walletdb.ReadWriteBucket,
 	}
 
 	m.scopedManagers[scope] = &ScopedKeyManager{
-		scope:       scope,
-		addrSchema:  addrSchema,
-		rootManager: m,
-		addrs:       make(map[addrKey]ManagedAddress),
-		acctInfo:    make(map[uint32]*accountInfo),
-		privKeyCache: lru.NewCache[DerivationPath, *cachedKey](
-			defaultPrivKeyCacheSize,
-		),
+		scope:        scope,
+		addrSchema:   addrSchema,
+		rootManager:  m,
+		addrs:        make(map[addrKey]ManagedAddress),
+		acctInfo:     make(map[uint32]*accountInfo),
+		privKeyCache: newPrivKeyCache(defaultPrivKeyCacheSize),
 	}
 
 	m.externalAddrSchemas[addrSchema.ExternalAddrType] = append(
@@ -587,6 +867,105 @@ func (m *Manager) NewScopedKeyManager(ns walletdb.ReadWriteBucket,
 	return m.scopedManagers[scope], nil
 }
 
+// ChainParams returns the chain parameters for this address manager.
+func (m *Manager) ChainParams() *chaincfg.Params {
+	// NOTE: No need for mutex here since the net field does not change
+	// after the manager instance is created.
+	return m.chainParams
+}
+
+// MasterKeyFingerprint returns the BIP-32 fingerprint of the root key the
+// default accounts are derived from, as used in the key origin of PSBT
+// derivation paths. It is not known for watching-only managers, whose
+// accounts record their own fingerprint.
+func (m *Manager) MasterKeyFingerprint(ns walletdb.ReadBucket) (uint32, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	_, masterHDPubEnc := fetchMasterHDKeys(ns)
+	if masterHDPubEnc == nil {
+		return 0, managerError(ErrWatchingOnly, errWatchingOnly, nil)
+	}
+
+	serializedPub, err := m.cryptoKeyPub.Decrypt(masterHDPubEnc)
+	if err != nil {
+		str := "failed to decrypt master HD public key"
+		return 0, managerError(ErrCrypto, str, err)
+	}
+	rootPub, err := hdkeychain.NewKeyFromString(string(serializedPub))
+	if err != nil {
+		str := "failed to parse master HD public key"
+		return 0, managerError(ErrKeyChain, str, err)
+	}
+	pubKey, err := rootPub.ECPubKey()
+	if err != nil {
+		str := "failed to parse master public key"
+		return 0, managerError(ErrKeyChain, str, err)
+	}
+
+	fingerprint := btcutil.Hash160(pubKey.SerializeCompressed())[:4]
+	return binary.LittleEndian.Uint32(fingerprint), nil
+}
+
+// Address returns a managed address given the passed address if it is known
+// to any of the scoped key managers.
+func (m *Manager) Address(ns walletdb.ReadBucket,
+	address btcutil.Address) (ManagedAddress, error) {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, scopedMgr := range m.scopedManagers {
+		addr, err := scopedMgr.Address(ns, address)
+		if err != nil {
+			continue
+		}
+
+		return addr, nil
+	}
+
+	str := fmt.Sprintf("unable to find key for addr %v", address)
+	return nil, managerError(ErrAddressNotFound, str, nil)
+}
+
+// AddrAccount returns the scoped key manager and account that the given
+// address belongs to.
+func (m *Manager) AddrAccount(ns walletdb.ReadBucket,
+	address btcutil.Address) (*ScopedKeyManager, uint32, error) {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, scopedMgr := range m.scopedManagers {
+		addr, err := scopedMgr.Address(ns, address)
+		if err != nil {
+			continue
+		}
+
+		return scopedMgr, addr.InternalAccount(), nil
+	}
+
+	str := fmt.Sprintf("unable to find key for addr %v", address)
+	return nil, 0, managerError(ErrAddressNotFound, str, nil)
+}
+
+// ForEachActiveAddress calls fn with every address known to any of the scoped
+// key managers.
+func (m *Manager) ForEachActiveAddress(ns walletdb.ReadBucket,
+	fn func(addr btcutil.Address) error) error {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	for _, scopedMgr := range m.scopedManagers {
+		if err := scopedMgr.ForEachActiveAddress(ns, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func managerExists(ns walletdb.ReadBucket) bool {
 	if ns == nil {
 		return false
@@ -647,6 +1026,11 @@ func loadManager(ns walletdb.ReadBucket, pubPassphrase []byte,
 		return nil, maybeConvertDbError(err)
 	}
 
+	syncedTo, err := fetchSyncedTo(ns)
+	if err != nil {
+		return nil, maybeConvertDbError(err)
+	}
+
 	var masterKeyPriv snacl.SecretKey
 	if !watchingOnly {
 		err := masterKeyPriv.Unmarshal(masterKeyPrivParams)
@@ -670,7 +1054,7 @@ func loadManager(ns walletdb.ReadBucket, pubPassphrase []byte,
 	}
 	fmt.Println("根据 `pubPassphrase` 恢复 masterKeyPub")
 
-	cryptoKeyPub := &cryptoKey{snacl.CryptoKey{}}
+	cryptoKeyPub := newLockedCryptoKey()
 	cryptoKeyPubCT, err := masterKeyPub.Decrypt(cryptoKeyPubEnc)
 	if err != nil {
 		str := "failed to decrypt crypto public key"
@@ -696,13 +1080,11 @@ func loadManager(ns walletdb.ReadBucket, pubPassphrase []byte,
 		}
 
 		scopedManagers[scope] = &ScopedKeyManager{
-			scope:      scope,
-			addrSchema: *scopeSchema,
-			addrs:      make(map[addrKey]ManagedAddress),
-			acctInfo:   make(map[uint32]*accountInfo),
-			privKeyCache: lru.NewCache[DerivationPath, *cachedKey](
-				defaultPrivKeyCacheSize,
-			),
+			scope:        scope,
+			addrSchema:   *scopeSchema,
+			addrs:        make(map[addrKey]ManagedAddress),
+			acctInfo:     make(map[uint32]*accountInfo),
+			privKeyCache: newPrivKeyCache(defaultPrivKeyCacheSize),
 		}
 		fmt.Printf("构建 ScopedKeyManager 对象 => %v \n", scope)
 
@@ -716,6 +1098,7 @@ func loadManager(ns walletdb.ReadBucket, pubPassphrase []byte,
 		chainParams, &masterKeyPub, &masterKeyPriv,
 		cryptoKeyPub, cryptoKeyPrivEnc, cryptoKeyScriptEnc,
 		birthday, privPassphraseSalt, scopedManagers, watchingOnly)
+	mgr.syncState = *newSyncState(&BlockStamp{}, syncedTo)
 	fmt.Println("构建 Manager 对象")
 
 	for _, scopedManager := range scopedManagers {
@@ -732,19 +1115,23 @@ func newManager(chainParams *chaincfg.Params, masterKeyPub *snacl.SecretKey,
 	scopedKeyManagers map[KeyScope]*ScopedKeyManager, watchingOnly bool) *Manager {
 
 	m := &Manager{
+		chainParams:              chainParams,
 		locked:                   true,
 		masterKeyPub:             masterKeyPub,
 		masterKeyPriv:            masterKeyPriv,
 		cryptoKeyPub:             cryptoKeyPub,
 		cryptoKeyPrivEncrypted:   cryptoKeyPrivEncrypted,
-		cryptoKeyPriv:            &cryptoKey{},
+		cryptoKeyPriv:            newLockedCryptoKey(),
 		cryptoKeyScriptEncrypted: cryptoKeyScriptEncrypted,
-		cryptoKeyScript:          &cryptoKey{},
+		cryptoKeyScript:          newLockedCryptoKey(),
 		privPassphraseSalt:       privPassphraseSalt,
+		hashedPrivPassphrase:     securemem.New(sha512.Size),
+		privKeyPool:              securemem.NewPool(btcec.PrivKeyBytesLen),
 		scopedManagers:           scopedKeyManagers,
 		externalAddrSchemas:      make(map[AddressType][]KeyScope),
 		internalAddrSchemas:      make(map[AddressType][]KeyScope),
 		watchingOnly:             watchingOnly,
+		birthday:                 birthday,
 	}
 
 	for _, sMgr := range m.scopedManagers {
@@ -761,7 +1148,7 @@ func newManager(chainParams *chaincfg.Params, masterKeyPub *snacl.SecretKey,
 	return m
 }
 
-func newSecretKey(passphrase *[]byte, config *ScryptOptions) (*snacl.SecretKey, error) {
+func newSecretKey(passphrase *[]byte, config KDFOptions) (*snacl.SecretKey, error) {
 	secretKeyGenMtx.Lock()
 	defer secretKeyGenMtx.Unlock()
 
@@ -2,11 +2,20 @@ package waddrmgr
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/czh0526/btc-wallet/internal/securemem"
+	"github.com/czh0526/btc-wallet/snacl"
 	"github.com/czh0526/btc-wallet/walletdb"
 	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
+	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
 	"testing"
@@ -299,6 +308,22 @@ func testLocking(tc *testContext) bool {
 		return false
 	}
 
+	// Lock the manager again, as testNewAccount expects the locked manager
+	// testLocking was called with.
+	err = tc.rootManager.Lock()
+	if tc.watchingOnly {
+		if !checkManagerError(tc.t, "Lock", err, ErrWatchingOnly) {
+			return false
+		}
+	} else if err != nil {
+		tc.t.Error("Lock: unexpected error:", err)
+		return false
+	}
+	if !tc.watchingOnly && !tc.rootManager.IsLocked() {
+		tc.t.Error("IsLocked: returned false on locked manager")
+		return false
+	}
+
 	return true
 }
 
@@ -377,3 +402,1011 @@ func testNewAccount(tc *testContext) bool {
 
 	return true
 }
+
+func TestCreateWithArgon2id(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastArgon2idOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+	defer mgr.Close()
+
+	if mgr.masterKeyPub.Parameters.KDF != snacl.KDFArgon2id ||
+		mgr.masterKeyPriv.Parameters.KDF != snacl.KDFArgon2id {
+
+		t.Fatalf("master keys not derived with argon2id")
+	}
+
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		return mgr.Unlock(ns, []byte("wrong"))
+	})
+	if !checkManagerError(t, "Unlock with wrong passphrase", err, ErrWrongPassphrase) {
+		return
+	}
+
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		t.Fatalf("unlock: unexpected error: %v", err)
+	}
+}
+
+func TestUpgradeKDF(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+
+	pubOpts, privOpts := mgr.KDFInfo()
+	assert.Equal(t, &FastScryptOptions, pubOpts)
+	assert.Equal(t, &FastScryptOptions, privOpts)
+
+	// A wrong private passphrase must leave the stored keys untouched.
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		return mgr.UpgradeKDF(ns, pubPassphrase, []byte("wrong"),
+			&FastArgon2idOptions)
+	})
+	if !checkManagerError(t, "UpgradeKDF with wrong passphrase", err,
+		ErrWrongPassphrase) {
+
+		return
+	}
+	_, privOpts = mgr.KDFInfo()
+	assert.Equal(t, &FastScryptOptions, privOpts)
+
+	// An upgrade whose transaction is rolled back must leave the manager
+	// with the keys that are still stored.
+	errRollback := errors.New("rollback")
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		err := mgr.UpgradeKDF(ns, pubPassphrase, privPassphrase,
+			&FastArgon2idOptions)
+		if err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("rolled back UpgradeKDF: unexpected error: %v", err)
+	}
+	pubOpts, privOpts = mgr.KDFInfo()
+	assert.Equal(t, &FastScryptOptions, pubOpts)
+	assert.Equal(t, &FastScryptOptions, privOpts)
+
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		t.Fatalf("unlock after rollback: unexpected error: %v", err)
+	}
+	if err := mgr.Lock(); err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		return mgr.UpgradeKDF(ns, pubPassphrase, privPassphrase,
+			&FastArgon2idOptions)
+	})
+	if err != nil {
+		t.Fatalf("UpgradeKDF: unexpected error: %v", err)
+	}
+
+	pubOpts, privOpts = mgr.KDFInfo()
+	assert.Equal(t, &FastArgon2idOptions, pubOpts)
+	assert.Equal(t, &FastArgon2idOptions, privOpts)
+	mgr.Close()
+
+	// The upgraded keys must be usable after reopening the manager.
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		t.Fatalf("reopen/unlock: unexpected error: %v", err)
+	}
+	defer mgr.Close()
+
+	pubOpts, _ = mgr.KDFInfo()
+	assert.Equal(t, &FastArgon2idOptions, pubOpts)
+}
+
+func TestPrivKeyCacheWipedOnLock(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+	defer mgr.Close()
+
+	scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0084)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+
+	path := DerivationPath{InternalAccount: DefaultAccountNum, Index: 3}
+	var want ManagedPubKeyAddress
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		if err := mgr.Unlock(ns, privPassphrase); err != nil {
+			return err
+		}
+		addr, err := scopedMgr.DeriveFromKeyPath(ns, path)
+		if err != nil {
+			return err
+		}
+		want = addr.(ManagedPubKeyAddress)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		privKey, err := scopedMgr.DeriveFromKeyPathCache(path)
+		if err != nil {
+			t.Fatalf("unable to derive cached key: %v", err)
+		}
+		if !privKey.PubKey().IsEqual(want.PubKey()) {
+			t.Fatalf("cached key does not match derived address")
+		}
+	}
+	if scopedMgr.privKeyCache.Len() != 1 {
+		t.Fatalf("expected one cached key, got %d",
+			scopedMgr.privKeyCache.Len())
+	}
+
+	if err := mgr.Lock(); err != nil {
+		t.Fatalf("unable to lock: %v", err)
+	}
+	if scopedMgr.privKeyCache.Len() != 0 {
+		t.Fatalf("private key cache not purged on lock")
+	}
+	if !bytes.Equal(mgr.hashedPrivPassphrase.Bytes(), make([]byte, 64)) {
+		t.Fatalf("hashed passphrase not wiped on lock")
+	}
+
+	_, err = scopedMgr.DeriveFromKeyPathCache(path)
+	checkManagerError(t, "DeriveFromKeyPathCache when locked", err, ErrLocked)
+}
+
+func TestCloseFreesPrivKeyCache(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+
+	scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0084)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+
+	path := DerivationPath{InternalAccount: DefaultAccountNum, Index: 1}
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		if err := mgr.Unlock(ns, privPassphrase); err != nil {
+			return err
+		}
+		_, err := scopedMgr.DeriveFromKeyPath(ns, path)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+
+	privKey, err := scopedMgr.DeriveFromKeyPathCache(path)
+	if err != nil {
+		t.Fatalf("unable to derive cached key: %v", err)
+	}
+	privKey.Zero()
+
+	slot, ok := scopedMgr.privKeyCache.Get(path)
+	if !ok {
+		t.Fatalf("derived key not cached")
+	}
+
+	// Closing an unlocked manager locks it, drops the cached keys and
+	// unmaps the memory that held them.
+	mgr.Close()
+	if !mgr.IsLocked() {
+		t.Fatalf("manager not locked on close")
+	}
+	if scopedMgr.privKeyCache.Len() != 0 {
+		t.Fatalf("private key cache not purged on close")
+	}
+	if slot.Bytes() != nil {
+		t.Fatalf("cached key slot still readable after close")
+	}
+	if mgr.hashedPrivPassphrase.Bytes() != nil {
+		t.Fatalf("hashed passphrase not freed on close")
+	}
+
+	// Closing twice is harmless.
+	mgr.Close()
+}
+
+func TestPrivKeyCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	pool := securemem.NewPool(btcec.PrivKeyBytesLen)
+	defer pool.Destroy()
+
+	cache := newPrivKeyCache(2)
+	slots := make([]*securemem.Slot, 3)
+	for i := range slots {
+		slots[i] = pool.Get()
+	}
+	cache.Put(DerivationPath{Index: 0}, slots[0])
+	cache.Put(DerivationPath{Index: 1}, slots[1])
+
+	// Using the first key makes the second one the least recently used,
+	// so inserting the third key evicts and releases it.
+	if _, ok := cache.Get(DerivationPath{Index: 0}); !ok {
+		t.Fatalf("first key not cached")
+	}
+	cache.Put(DerivationPath{Index: 2}, slots[2])
+	if _, ok := cache.Get(DerivationPath{Index: 1}); ok {
+		t.Fatalf("least recently used key not evicted")
+	}
+	if slots[0].Bytes() == nil || slots[2].Bytes() == nil {
+		t.Fatalf("cached key released")
+	}
+	if slots[1].Bytes() != nil {
+		t.Fatalf("evicted key not released")
+	}
+
+	cache.Purge()
+	if cache.Len() != 0 || slots[0].Bytes() != nil {
+		t.Fatalf("purged keys not released")
+	}
+}
+
+func TestImportScripts(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+
+	scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0084)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+
+	internalKey, _ := btcec.NewPrivateKey()
+	leafKey, _ := btcec.NewPrivateKey()
+	leafScript, err := txscript.NewScriptBuilder().
+		AddData(schnorr.SerializePubKey(leafKey.PubKey())).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	if err != nil {
+		t.Fatalf("unable to build leaf script: %v", err)
+	}
+	leaf := txscript.NewBaseTapLeaf(leafScript)
+	tree := txscript.AssembleTaprootScriptTree(leaf)
+	controlBlock := tree.LeafMerkleProofs[0].ToControlBlock(
+		internalKey.PubKey())
+	tapscript := &Tapscript{
+		Type:           TapscriptTypePartialReveal,
+		ControlBlock:   &controlBlock,
+		RevealedScript: leafScript,
+	}
+
+	redeemScript := []byte{txscript.OP_TRUE}
+	witnessScript := []byte{txscript.OP_2, txscript.OP_DROP, txscript.OP_TRUE}
+
+	// Redeem scripts are secret and can't be imported while locked.
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		_, err := scopedMgr.ImportScript(ns, redeemScript)
+		return err
+	})
+	if !checkManagerError(t, "ImportScript when locked", err, ErrLocked) {
+		return
+	}
+
+	var (
+		p2shAddr, p2wshAddr btcutil.Address
+		p2trAddr            btcutil.Address
+	)
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		if err := mgr.Unlock(ns, privPassphrase); err != nil {
+			return err
+		}
+
+		ma, err := scopedMgr.ImportScript(ns, redeemScript)
+		if err != nil {
+			return err
+		}
+		p2shAddr = ma.Address()
+
+		ma, err = scopedMgr.ImportWitnessScript(ns, witnessScript, false)
+		if err != nil {
+			return err
+		}
+		p2wshAddr = ma.Address()
+
+		tma, err := scopedMgr.ImportTaprootScript(ns, tapscript, true)
+		if err != nil {
+			return err
+		}
+		p2trAddr = tma.Address()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to import scripts: %v", err)
+	}
+
+	rootHash := tree.RootNode.TapHash()
+	outputKey := txscript.ComputeTaprootOutputKey(
+		internalKey.PubKey(), rootHash[:])
+	assert.Equal(t, schnorr.SerializePubKey(outputKey),
+		p2trAddr.ScriptAddress())
+
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		_, err := scopedMgr.ImportScript(ns, redeemScript)
+		return err
+	})
+	if !checkManagerError(t, "duplicate ImportScript", err,
+		ErrDuplicateAddress) {
+
+		return
+	}
+	mgr.Close()
+
+	// Reopen the manager so the addresses are read back from the
+	// database.
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		if err := mgr.Unlock(ns, privPassphrase); err != nil {
+			return err
+		}
+
+		ma, err := mgr.Address(ns, p2shAddr)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, uint32(ImportedAddrAccount), ma.InternalAccount())
+		script, err := ma.(ManagedScriptAddress).Script()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, redeemScript, script)
+
+		ma, err = mgr.Address(ns, p2wshAddr)
+		if err != nil {
+			return err
+		}
+		script, err = ma.(ManagedScriptAddress).Script()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, witnessScript, script)
+
+		ma, err = mgr.Address(ns, p2trAddr)
+		if err != nil {
+			return err
+		}
+		decoded, err := ma.(ManagedTaprootScriptAddress).TaprootScript()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, tapscript.Type, decoded.Type)
+		assert.Equal(t, leafScript, decoded.RevealedScript)
+		assert.Equal(t, controlBlock.OutputKeyYIsOdd,
+			decoded.ControlBlock.OutputKeyYIsOdd)
+		assert.Equal(t,
+			schnorr.SerializePubKey(internalKey.PubKey()),
+			schnorr.SerializePubKey(decoded.ControlBlock.InternalKey))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to read imported scripts: %v", err)
+	}
+	defer mgr.Close()
+
+	if err := mgr.Lock(); err != nil {
+		t.Fatalf("unable to lock: %v", err)
+	}
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+
+		ma, err := mgr.Address(ns, p2shAddr)
+		if err != nil {
+			return err
+		}
+		_, err = ma.(ManagedScriptAddress).Script()
+		checkManagerError(t, "secret Script when locked", err, ErrLocked)
+
+		// Scripts that aren't secret remain readable.
+		ma, err = mgr.Address(ns, p2wshAddr)
+		if err != nil {
+			return err
+		}
+		script, err := ma.(ManagedScriptAddress).Script()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, witnessScript, script)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to read imported scripts: %v", err)
+	}
+}
+
+func TestImportPrivateKey(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+
+	scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0044)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+
+	privKey, _ := btcec.NewPrivateKey()
+	wif, err := btcutil.NewWIF(privKey, &chaincfg.MainNetParams, true)
+	if err != nil {
+		t.Fatalf("unable to encode key: %v", err)
+	}
+	importKey := func(wif *btcutil.WIF) (ManagedPubKeyAddress, error) {
+		var ma ManagedPubKeyAddress
+		err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+			ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+			var err error
+			ma, err = scopedMgr.ImportPrivateKey(ns, wif)
+			return err
+		})
+		return ma, err
+	}
+
+	// Private keys can't be imported while locked.
+	_, err = importKey(wif)
+	if !checkManagerError(t, "ImportPrivateKey when locked", err,
+		ErrLocked) {
+
+		return
+	}
+
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+
+	testNetWIF, err := btcutil.NewWIF(
+		privKey, &chaincfg.TestNet3Params, true)
+	if err != nil {
+		t.Fatalf("unable to encode key: %v", err)
+	}
+	_, err = importKey(testNetWIF)
+	if !checkManagerError(t, "ImportPrivateKey for another network",
+		err, ErrWrongNet) {
+
+		return
+	}
+
+	ma, err := importKey(wif)
+	if err != nil {
+		t.Fatalf("unable to import private key: %v", err)
+	}
+	addr := ma.Address()
+	assert.True(t, ma.Imported())
+	assert.Equal(t, btcutil.Hash160(privKey.PubKey().SerializeCompressed()),
+		addr.ScriptAddress())
+
+	_, err = importKey(wif)
+	if !checkManagerError(t, "duplicate ImportPrivateKey", err,
+		ErrDuplicateAddress) {
+
+		return
+	}
+	mgr.Close()
+
+	// Reopen the manager so the address is read back from the database.
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		if err := mgr.Unlock(ns, privPassphrase); err != nil {
+			return err
+		}
+
+		ma, err := mgr.Address(ns, addr)
+		if err != nil {
+			return err
+		}
+		assert.True(t, ma.Imported())
+		assert.Equal(t, uint32(ImportedAddrAccount), ma.InternalAccount())
+		imported, err := ma.(ManagedPubKeyAddress).PrivKey()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, privKey.Serialize(), imported.Serialize())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to read imported key: %v", err)
+	}
+	mgr.Close()
+}
+
+func TestMasterKeyFingerprint(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var fingerprint uint32
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err := Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		defer mgr.Close()
+
+		fingerprint, err = mgr.MasterKeyFingerprint(ns)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to fetch fingerprint: %v", err)
+	}
+
+	// PSBTs serialize the fingerprint bytes in little-endian order, while
+	// extended keys report their parent's fingerprint big-endian.
+	child, err := rootKey.Derive(0)
+	if err != nil {
+		t.Fatalf("unable to derive child: %v", err)
+	}
+	var want [4]byte
+	binary.BigEndian.PutUint32(want[:], child.ParentFingerprint())
+	assert.Equal(t, binary.LittleEndian.Uint32(want[:]), fingerprint)
+}
+
+func TestSyncedToBlockHashes(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err := Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		defer mgr.Close()
+
+		for height := int32(10); height <= 12; height++ {
+			err := mgr.SetSyncedTo(ns, &BlockStamp{
+				Height: height,
+				Hash:   [32]byte{byte(height)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		assert.Equal(t, int32(12), mgr.SyncedTo().Height)
+
+		hash, err := mgr.BlockHash(ns, 11)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, byte(11), hash[0])
+
+		_, err = mgr.BlockHash(ns, 9)
+		assert.True(t, IsError(err, ErrBlockNotFound))
+
+		// Every derived address is visited.
+		scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+		addrs, err := scopedMgr.NextExternalAddresses(
+			ns, DefaultAccountNum, 2)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		err = mgr.ForEachActiveAddress(ns, func(addr btcutil.Address) error {
+			seen[addr.EncodeAddress()] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			assert.True(t, seen[addr.Address().EncodeAddress()])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBirthdayBlock(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	birthday := time.Unix(1700000000, 0)
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, birthday)
+		if err != nil {
+			return err
+		}
+
+		mgr, err := Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		defer mgr.Close()
+
+		// The birthday is stored with a margin of two days.
+		assert.Equal(t, birthday.Add(-48*time.Hour), mgr.Birthday())
+
+		_, _, err = mgr.BirthdayBlock(ns)
+		assert.True(t, IsError(err, ErrBirthdayBlockNotSet))
+
+		block := BlockStamp{
+			Height:    7,
+			Hash:      [32]byte{7},
+			Timestamp: birthday,
+		}
+		if err := mgr.SetBirthdayBlock(ns, block, true); err != nil {
+			return err
+		}
+		stored, verified, err := mgr.BirthdayBlock(ns)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, block, stored)
+		assert.True(t, verified)
+
+		if err := mgr.SetBirthdayBlock(ns, block, false); err != nil {
+			return err
+		}
+		_, verified, err = mgr.BirthdayBlock(ns)
+		assert.False(t, verified)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountPropertiesKeyVersion(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err := Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		defer mgr.Close()
+
+		// The account keys of the default scopes are serialized with
+		// the version of their address type.
+		for scope, prefix := range map[KeyScope]string{
+			KeyScopeBIP0044:     "xpub",
+			KeyScopeBIP0049Plus: "ypub",
+			KeyScopeBIP0084:     "zpub",
+			KeyScopeBIP0086:     "xpub",
+		} {
+			scopedMgr, err := mgr.FetchScopedKeyManager(scope)
+			if err != nil {
+				return err
+			}
+			props, err := scopedMgr.AccountProperties(
+				ns, DefaultAccountNum)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, prefix,
+				props.AccountPubKey.String()[:4], "%v", scope)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to fetch account properties: %v", err)
+	}
+}
+
+func TestRenameAccount(t *testing.T) {
+	t.Parallel()
+
+	teardown, db := emptyDB(t)
+	defer teardown()
+
+	var mgr *Manager
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(waddrmgrNamespaceKey)
+		if err != nil {
+			return err
+		}
+
+		err = Create(ns, rootKey, pubPassphrase, privPassphrase,
+			&chaincfg.MainNetParams, &FastScryptOptions, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		mgr, err = Open(ns, pubPassphrase, &chaincfg.MainNetParams)
+		if err != nil {
+			return err
+		}
+		return mgr.Unlock(ns, privPassphrase)
+	})
+	if err != nil {
+		t.Fatalf("create/open: unexpected error: %v", err)
+	}
+	defer mgr.Close()
+
+	scopedMgr, err := mgr.FetchScopedKeyManager(KeyScopeBIP0084)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+	rename := func(account uint32, name string) error {
+		return walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+			ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+			return scopedMgr.RenameAccount(ns, account, name)
+		})
+	}
+
+	var account uint32
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		var err error
+		account, err = scopedMgr.NewAccount(ns, "savings")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to create account: %v", err)
+	}
+
+	if err := rename(account, "spending"); err != nil {
+		t.Fatalf("unable to rename account: %v", err)
+	}
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		ns := tx.ReadBucket(waddrmgrNamespaceKey)
+
+		renamed, err := scopedMgr.LookupAccount(ns, "spending")
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, account, renamed)
+
+		_, err = scopedMgr.LookupAccount(ns, "savings")
+		assert.True(t, IsError(err, ErrAccountNotFound))
+
+		props, err := scopedMgr.AccountProperties(ns, account)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, "spending", props.AccountName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to look up renamed account: %v", err)
+	}
+
+	checkManagerError(t, "rename to a taken name",
+		rename(account, defaultAccountName), ErrDuplicateAccount)
+	checkManagerError(t, "rename the imported account",
+		rename(ImportedAddrAccount, "other"), ErrInvalidAccount)
+	checkManagerError(t, "rename to a reserved name",
+		rename(account, ImportedAddrAccountName), ErrInvalidAccount)
+	checkManagerError(t, "rename an unknown account",
+		rename(account+1, "other"), ErrAccountNotFound)
+}
+
+func TestDeserializeAddressRow(t *testing.T) {
+	row := &dbAddressRow{
+		addrType:   adtChain,
+		account:    1,
+		addTime:    uint64(time.Now().Unix()),
+		syncStatus: ssFull,
+		rawData:    serializeChainedAddress(InternalBranch, 7),
+	}
+	serialized := serializeAddressRow(row)
+
+	got, err := deserializeAddressRow(serialized)
+	if err != nil {
+		t.Fatalf("unable to deserialize address row: %v", err)
+	}
+	assert.Equal(t, row, got)
+
+	// Rows whose raw data is cut short or followed by trailing bytes are
+	// rejected.
+	for _, malformed := range [][]byte{
+		serialized[:17],
+		serialized[:len(serialized)-1],
+		append(serialized, 0x00),
+	} {
+		_, err := deserializeAddressRow(malformed)
+		assert.True(t, IsError(err, ErrDatabase))
+	}
+}
@@ -1,13 +1,18 @@
 package waddrmgr
 
 import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/internal/securemem"
 	"github.com/czh0526/btc-wallet/internal/zero"
 	"github.com/czh0526/btc-wallet/walletdb"
-	"github.com/lightninglabs/neutrino/cache/lru"
 	"sync"
 )
 
@@ -20,6 +25,17 @@ type KeyScope struct {
 	Coin    uint32
 }
 
+// ScopedIndex is a tuple of KeyScope and child Index. This is used to compactly
+// identify a particular child key, when the account and branch can be
+// inferred from context.
+type ScopedIndex struct {
+	// Scope is the BIP44 account' used to derive the child key.
+	Scope KeyScope
+
+	// Index is the BIP44 address_index used to derive the child key.
+	Index uint32
+}
+
 type ScopeAddrSchema struct {
 	ExternalAddrType AddressType
 	InternalAddrType AddressType
@@ -91,12 +107,86 @@ type DerivationPath struct {
 	MasterKeyFingerprint uint32
 }
 
+// cachedKey is a private key held in the manager's locked key pool.
 type cachedKey struct {
-	key btcec.PrivateKey
+	path DerivationPath
+	slot *securemem.Slot
+}
+
+// privKeyCache is a least recently used cache of private keys. The slot of
+// every key it drops, whether replaced, evicted or purged, is released back
+// to the pool right away rather than left to the garbage collector.
+type privKeyCache struct {
+	capacity int
+	keys     map[DerivationPath]*list.Element
+	order    *list.List
+
+	mtx sync.Mutex
+}
+
+// newPrivKeyCache creates a cache holding up to capacity keys.
+func newPrivKeyCache(capacity int) *privKeyCache {
+	return &privKeyCache{
+		capacity: capacity,
+		keys:     make(map[DerivationPath]*list.Element),
+		order:    list.New(),
+	}
 }
 
-func (c *cachedKey) Size() (uint64, error) {
-	return 1, nil
+// Get returns the slot holding the key of the path, marking it as the most
+// recently used.
+func (c *privKeyCache) Get(kp DerivationPath) (*securemem.Slot, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.keys[kp]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedKey).slot, true
+}
+
+// Put caches the slot holding the key of the path, releasing the slot it
+// replaces and the least recently used ones beyond the capacity.
+func (c *privKeyCache) Put(kp DerivationPath, slot *securemem.Slot) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.keys[kp]; ok {
+		c.remove(el)
+	}
+	c.keys[kp] = c.order.PushFront(&cachedKey{path: kp, slot: slot})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops the element and releases its slot. The cache lock must be
+// held.
+func (c *privKeyCache) remove(el *list.Element) {
+	cached := c.order.Remove(el).(*cachedKey)
+	delete(c.keys, cached.path)
+	cached.slot.Release()
+}
+
+// Len returns the number of cached keys.
+func (c *privKeyCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.order.Len()
+}
+
+// Purge drops every cached key, releasing its slot.
+func (c *privKeyCache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
 }
 
 type ScopedKeyManager struct {
@@ -106,7 +196,7 @@ type ScopedKeyManager struct {
 	addrs          map[addrKey]ManagedAddress
 	acctInfo       map[uint32]*accountInfo
 	deriveOnUnlock []*unlockDeriveInfo
-	privKeyCache   *lru.Cache[DerivationPath, *cachedKey]
+	privKeyCache   *privKeyCache
 
 	mtx sync.RWMutex
 }
@@ -372,7 +462,7 @@ func (s *ScopedKeyManager) nextAddresses(ns walletdb.ReadWriteBucket,
 		var nextKey *hdkeychain.ExtendedKey
 		// 尝试构建`ExtendedKey`
 		for {
-			key, err := branchKey.DeriveNonStandard(i)
+			key, err := branchKey.DeriveNonStandard(nextIndex)
 			if err != nil {
 				if err == hdkeychain.ErrInvalidChild {
 					nextIndex++
@@ -453,10 +543,10 @@ func (s *ScopedKeyManager) nextAddresses(ns walletdb.ReadWriteBucket,
 
 		if ma.Address().String() != diskAddr.Address().String() {
 			delete(s.addrs, addrKey(diskAddr.Address().ScriptAddress()))
-		}
 
-		return nil, fmt.Errorf("%w (disk read): expected %v, got %v",
-			ErrAddrMismatch, diskAddr.Address().String(), ma.Address().String())
+			return nil, fmt.Errorf("%w (disk read): expected %v, got %v",
+				ErrAddrMismatch, diskAddr.Address().String(), ma.Address().String())
+		}
 	}
 
 	managedAddresses := make([]ManagedAddress, 0, len(addressInfo))
@@ -497,7 +587,7 @@ func (s *ScopedKeyManager) loadAndCacheAddress(ns walletdb.ReadBucket,
 
 	rowInterface, err := fetchAddress(ns, &s.scope, address.ScriptAddress())
 	if err != nil {
-		if merr, ok := err.(*ManagerError); ok {
+		if merr, ok := err.(ManagerError); ok {
 			desc := fmt.Sprintf("failed to fetch address `%s`: %v",
 				address.ScriptAddress(), merr.Description)
 			merr.Description = desc
@@ -515,6 +605,46 @@ func (s *ScopedKeyManager) loadAndCacheAddress(ns walletdb.ReadBucket,
 	return managedAddr, nil
 }
 
+// Address returns a managed address given the passed address if it is known
+// to the address manager.
+func (s *ScopedKeyManager) Address(ns walletdb.ReadBucket,
+	address btcutil.Address) (ManagedAddress, error) {
+
+	// ScriptAddress will only return a script hash if we're accessing an
+	// address that is either PKH or SH. In the event we're passed a PK
+	// address, convert the PK to PKH address so that we can access it
+	// from the addrs map and database.
+	if pka, ok := address.(*btcutil.AddressPubKey); ok {
+		address = pka.AddressPubKeyHash()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if ma, ok := s.addrs[addrKey(address.ScriptAddress())]; ok {
+		return ma, nil
+	}
+
+	return s.loadAndCacheAddress(ns, address)
+}
+
+// ForEachActiveAddress calls fn with every address of the scope, of every
+// account, that has been derived or imported.
+func (s *ScopedKeyManager) ForEachActiveAddress(ns walletdb.ReadBucket,
+	fn func(addr btcutil.Address) error) error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return forEachActiveAddress(ns, &s.scope, func(row interface{}) error {
+		ma, err := s.rowInterfaceToManaged(ns, row)
+		if err != nil {
+			return err
+		}
+		return fn(ma.Address())
+	})
+}
+
 func (s *ScopedKeyManager) rowInterfaceToManaged(ns walletdb.ReadBucket,
 	rowInterface interface{}) (ManagedAddress, error) {
 
@@ -657,6 +787,23 @@ func (s *ScopedKeyManager) NewAccount(ns walletdb.ReadWriteBucket, name string)
 	return account, nil
 }
 
+// LastAccount returns the last account stored in the manager. If no accounts
+// were created yet, ErrAccountNotFound is returned.
+func (s *ScopedKeyManager) LastAccount(ns walletdb.ReadBucket) (uint32, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	account, err := fetchLastAccount(ns, &s.scope)
+	if err != nil {
+		return 0, err
+	}
+	if account > MaxAccountNum {
+		str := fmt.Sprintf("no accounts in scope %v", s.scope)
+		return 0, managerError(ErrAccountNotFound, str, nil)
+	}
+	return account, nil
+}
+
 func (s *ScopedKeyManager) NewRawAccount(ns walletdb.ReadWriteBucket, number uint32) error {
 	if s.rootManager.WatchOnly() {
 		return managerError(ErrWatchingOnly, errWatchingOnly, nil)
@@ -737,6 +884,72 @@ func (s *ScopedKeyManager) newAccount(ns walletdb.ReadWriteBucket,
 	return putLastAccount(ns, &s.scope, account)
 }
 
+// RenameAccount renames the account. The imported account can't be renamed,
+// and ErrDuplicateAccount is returned if another account of the scope has
+// the name already.
+func (s *ScopedKeyManager) RenameAccount(ns walletdb.ReadWriteBucket,
+	account uint32, name string) error {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if account == ImportedAddrAccount {
+		str := "the imported account cannot be renamed"
+		return managerError(ErrInvalidAccount, str, nil)
+	}
+	if err := ValidateAccountName(name); err != nil {
+		return err
+	}
+	if _, err := s.lookupAccount(ns, name); err == nil {
+		str := fmt.Sprintf("account with the name `%s` already exists",
+			name)
+		return managerError(ErrDuplicateAccount, str, nil)
+	}
+
+	rowInterface, err := fetchAccountInfo(ns, &s.scope, account)
+	if err != nil {
+		return maybeConvertDbError(err)
+	}
+
+	switch row := rowInterface.(type) {
+	case *dbDefaultAccountRow:
+		err = deleteAccountNameIndex(ns, &s.scope, row.name)
+		if err != nil {
+			return err
+		}
+		err = putDefaultAccountInfo(ns, &s.scope, account,
+			row.pubKeyEncrypted, row.privKeyEncrypted,
+			row.nextExternalIndex, row.nextInternalIndex, name)
+
+	case *dbWatchOnlyAccountRow:
+		err = deleteAccountNameIndex(ns, &s.scope, row.name)
+		if err != nil {
+			return err
+		}
+		err = putWatchOnlyAccountInfo(ns, &s.scope, account,
+			row.pubKeyEncrypted, row.masterKeyFingerprint,
+			row.nextExternalIndex, row.nextInternalIndex, name,
+			row.addrSchema)
+
+	default:
+		str := fmt.Sprintf("unsupported account type %T", row)
+		return managerError(ErrDatabase, str, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	ns.Tx().OnCommit(func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		if acctInfo, ok := s.acctInfo[account]; ok {
+			acctInfo.acctName = name
+		}
+	})
+	return nil
+}
+
 func (s *ScopedKeyManager) LookupAccount(ns walletdb.ReadBucket, name string) (uint32, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -776,6 +989,262 @@ func (s *ScopedKeyManager) NextInternalAddresses(ns walletdb.ReadWriteBucket,
 	return s.nextAddresses(ns, account, numAddresses, true)
 }
 
+// ExtendExternalAddresses derives the external addresses of the account up
+// to and including lastIndex. Addresses derived already are left as is.
+func (s *ScopedKeyManager) ExtendExternalAddresses(ns walletdb.ReadWriteBucket,
+	account uint32, lastIndex uint32) error {
+
+	return s.extendAddresses(ns, account, lastIndex, false)
+}
+
+// ExtendInternalAddresses derives the internal addresses of the account up
+// to and including lastIndex. Addresses derived already are left as is.
+func (s *ScopedKeyManager) ExtendInternalAddresses(ns walletdb.ReadWriteBucket,
+	account uint32, lastIndex uint32) error {
+
+	return s.extendAddresses(ns, account, lastIndex, true)
+}
+
+func (s *ScopedKeyManager) extendAddresses(ns walletdb.ReadWriteBucket,
+	account uint32, lastIndex uint32, internal bool) error {
+
+	if account > MaxAccountNum {
+		err := managerError(ErrAccountNumTooHigh, errAcctTooHigh, nil)
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	acctInfo, err := s.loadAccountInfo(ns, account)
+	if err != nil {
+		return err
+	}
+
+	nextIndex := acctInfo.nextExternalIndex
+	if internal {
+		nextIndex = acctInfo.nextInternalIndex
+	}
+	if lastIndex < nextIndex {
+		return nil
+	}
+
+	_, err = s.nextAddresses(ns, account, lastIndex+1-nextIndex, internal)
+	return err
+}
+
+// ImportPrivateKey imports a WIF-encoded private key into the imported
+// account of the scope, as an address of the external address type of the
+// scope. The private key is encrypted with the private crypto key, so the
+// manager must be unlocked.
+func (s *ScopedKeyManager) ImportPrivateKey(ns walletdb.ReadWriteBucket,
+	wif *btcutil.WIF) (ManagedPubKeyAddress, error) {
+
+	if !wif.IsForNet(s.rootManager.chainParams) {
+		str := fmt.Sprintf("private key is not for the same network "+
+			"the address manager is configured for (%s)",
+			s.rootManager.chainParams.Name)
+		return nil, managerError(ErrWrongNet, str, nil)
+	}
+	if s.rootManager.WatchOnly() {
+		return nil, managerError(ErrWatchingOnly, errWatchingOnly, nil)
+	}
+	if s.rootManager.IsLocked() {
+		return nil, managerError(ErrLocked, errLocked, nil)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ma, err := newManagedAddressWithoutPrivKey(
+		s, ImportedDerivationPath, wif.PrivKey.PubKey(),
+		wif.CompressPubKey, s.addrSchema.ExternalAddrType)
+	if err != nil {
+		return nil, err
+	}
+	ma.imported = true
+
+	addressID := ma.Address().ScriptAddress()
+	_, err = fetchAddress(ns, &s.scope, addressID)
+	if err == nil {
+		str := fmt.Sprintf("address for public key %x already exists",
+			wif.SerializePubKey())
+		return nil, managerError(ErrDuplicateAddress, str, nil)
+	}
+	if !IsError(err, ErrAddressNotFound) {
+		return nil, maybeConvertDbError(err)
+	}
+
+	encryptedPubKey, err := s.rootManager.cryptoKeyPub.Encrypt(
+		wif.SerializePubKey())
+	if err != nil {
+		str := fmt.Sprintf("failed to encrypt public key for %x",
+			wif.SerializePubKey())
+		return nil, managerError(ErrCrypto, str, err)
+	}
+	privKeyBytes := wif.PrivKey.Serialize()
+	encryptedPrivKey, err := s.rootManager.cryptoKeyPriv.Encrypt(
+		privKeyBytes)
+	if err != nil {
+		str := fmt.Sprintf("failed to encrypt private key for %x",
+			wif.SerializePubKey())
+		return nil, managerError(ErrCrypto, str, err)
+	}
+
+	err = putImportedAddress(
+		ns, &s.scope, addressID, ImportedAddrAccount, ssNone,
+		encryptedPubKey, encryptedPrivKey)
+	if err != nil {
+		return nil, maybeConvertDbError(err)
+	}
+	ma.privKeyEncrypted = encryptedPrivKey
+	ma.privKeyCT = privKeyBytes
+
+	ns.Tx().OnCommit(func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		s.addrs[addrKey(addressID)] = ma
+	})
+
+	return ma, nil
+}
+
+// ImportScript imports a P2SH redeem script into the imported account of the
+// scope. Redeem scripts are stored encrypted with the script crypto key, so
+// the manager must be unlocked.
+func (s *ScopedKeyManager) ImportScript(ns walletdb.ReadWriteBucket,
+	script []byte) (ManagedScriptAddress, error) {
+
+	scriptHash := btcutil.Hash160(script)
+	return s.importScriptAddress(ns, scriptHash, script, 0, true, false)
+}
+
+// ImportWitnessScript imports a P2WSH witness script into the imported
+// account of the scope. Only secret scripts need the manager to be unlocked;
+// the others are encrypted with the public crypto key.
+func (s *ScopedKeyManager) ImportWitnessScript(ns walletdb.ReadWriteBucket,
+	script []byte, isSecretScript bool) (ManagedScriptAddress, error) {
+
+	scriptHash := sha256.Sum256(script)
+	return s.importScriptAddress(
+		ns, scriptHash[:], script, witnessVersionV0, isSecretScript, true)
+}
+
+// ImportTaprootScript imports the tapscript of a P2TR output into the
+// imported account of the scope. The address is derived from the taproot
+// output key of the tapscript.
+func (s *ScopedKeyManager) ImportTaprootScript(ns walletdb.ReadWriteBucket,
+	tapscript *Tapscript, isSecretScript bool) (
+	ManagedTaprootScriptAddress, error) {
+
+	taprootKey, err := tapscript.TaprootKey()
+	if err != nil {
+		str := "failed to compute taproot output key"
+		return nil, managerError(ErrInvalidKeyType, str, err)
+	}
+
+	script, err := tlvEncodeTaprootScript(tapscript)
+	if err != nil {
+		str := "failed to encode tapscript"
+		return nil, managerError(ErrInvalidKeyType, str, err)
+	}
+
+	ma, err := s.importScriptAddress(
+		ns, schnorr.SerializePubKey(taprootKey), script,
+		witnessVersionV1, isSecretScript, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ma.(ManagedTaprootScriptAddress), nil
+}
+
+// importScriptAddress stores an imported script under scriptIdent, which is
+// the hash of the script for P2SH and P2WSH, and the output key for P2TR.
+func (s *ScopedKeyManager) importScriptAddress(ns walletdb.ReadWriteBucket,
+	scriptIdent, script []byte, witnessVersion byte, isSecretScript,
+	witness bool) (ManagedScriptAddress, error) {
+
+	if isSecretScript {
+		if s.rootManager.WatchOnly() {
+			return nil, managerError(
+				ErrWatchingOnly, errWatchingOnly, nil)
+		}
+		if s.rootManager.IsLocked() {
+			return nil, managerError(ErrLocked, errLocked, nil)
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err := fetchAddress(ns, &s.scope, scriptIdent)
+	if err == nil {
+		str := fmt.Sprintf("address for script hash %x already exists",
+			scriptIdent)
+		return nil, managerError(ErrDuplicateAddress, str, nil)
+	}
+	if !IsError(err, ErrAddressNotFound) {
+		return nil, maybeConvertDbError(err)
+	}
+
+	encryptedHash, err := s.rootManager.cryptoKeyPub.Encrypt(scriptIdent)
+	if err != nil {
+		str := fmt.Sprintf("failed to encrypt script hash %x",
+			scriptIdent)
+		return nil, managerError(ErrCrypto, str, err)
+	}
+
+	cryptoKey := s.rootManager.cryptoKeyScript
+	if !isSecretScript {
+		cryptoKey = s.rootManager.cryptoKeyPub
+	}
+	encryptedScript, err := cryptoKey.Encrypt(script)
+	if err != nil {
+		str := fmt.Sprintf("failed to encrypt script for %x",
+			scriptIdent)
+		return nil, managerError(ErrCrypto, str, err)
+	}
+
+	var ma ManagedScriptAddress
+	if witness {
+		err = putWitnessScriptAddress(
+			ns, &s.scope, scriptIdent, ImportedAddrAccount, ssFull,
+			witnessVersion, isSecretScript, encryptedHash,
+			encryptedScript)
+		if err != nil {
+			return nil, maybeConvertDbError(err)
+		}
+
+		ma, err = newWitnessScriptAddress(
+			s, ImportedAddrAccount, scriptIdent, encryptedScript,
+			witnessVersion, isSecretScript)
+	} else {
+		err = putScriptAddress(
+			ns, &s.scope, scriptIdent, ImportedAddrAccount, ssFull,
+			encryptedHash, encryptedScript)
+		if err != nil {
+			return nil, maybeConvertDbError(err)
+		}
+
+		ma, err = newScriptAddress(
+			s, ImportedAddrAccount, scriptIdent, encryptedScript)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ns.Tx().OnCommit(func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		s.addrs[addrKey(ma.Address().ScriptAddress())] = ma
+	})
+
+	return ma, nil
+}
+
 func (s *ScopedKeyManager) DeriveFromKeyPath(ns walletdb.ReadBucket,
 	kp DerivationPath) (ManagedAddress, error) {
 
@@ -799,6 +1268,81 @@ func (s *ScopedKeyManager) DeriveFromKeyPath(ns walletdb.ReadBucket,
 	return s.keyToManaged(addrKey, kp, acctInfo)
 }
 
+// DeriveFromKeyPathCache returns the private key for the given derivation
+// path, serving it from the private key cache when possible. The account must
+// already be loaded and the manager must be unlocked. Only the account,
+// branch and index of the path are considered.
+//
+// The cache itself lives in locked memory, but the returned key is a copy on
+// the regular heap. Callers must Zero it as soon as they are done signing
+// and must not keep it around.
+func (s *ScopedKeyManager) DeriveFromKeyPathCache(
+	kp DerivationPath) (*btcec.PrivateKey, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	kp = DerivationPath{
+		InternalAccount: kp.InternalAccount,
+		Branch:          kp.Branch,
+		Index:           kp.Index,
+	}
+	if slot, ok := s.privKeyCache.Get(kp); ok {
+		privKey, _ := btcec.PrivKeyFromBytes(slot.Bytes())
+
+		// The pool is wiped when the manager locks, in which case the
+		// entry is stale and the key is derived again below.
+		if !privKey.Key.IsZero() {
+			return privKey, nil
+		}
+	}
+
+	if s.rootManager.WatchOnly() {
+		return nil, managerError(ErrWatchingOnly, errWatchingOnly, nil)
+	}
+	if s.rootManager.IsLocked() {
+		return nil, managerError(ErrLocked, errLocked, nil)
+	}
+
+	acctInfo, ok := s.acctInfo[kp.InternalAccount]
+	if !ok {
+		str := fmt.Sprintf("account %d not loaded", kp.InternalAccount)
+		return nil, managerError(ErrAccountNotFound, str, nil)
+	}
+	if acctInfo.acctKeyPriv == nil {
+		return nil, managerError(ErrLocked, errLocked, nil)
+	}
+
+	addrKey, err := s.deriveKey(acctInfo, kp.Branch, kp.Index, true)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := addrKey.ECPrivKey()
+	addrKey.Zero()
+	if err != nil {
+		str := fmt.Sprintf("failed to derive private key for %v", kp)
+		return nil, managerError(ErrKeyChain, str, err)
+	}
+
+	// The pool may be wiped by a concurrent lock, leaving the new slot
+	// invalid, in which case the key is simply not cached.
+	slot := s.rootManager.privKeyPool.Get()
+	if buf := slot.Bytes(); buf != nil {
+		privKey.Key.PutBytesUnchecked(buf)
+		s.privKeyCache.Put(kp, slot)
+	} else {
+		slot.Release()
+	}
+
+	return privKey, nil
+}
+
+// purgePrivKeyCache drops every cached private key and returns its memory to
+// the pool.
+func (s *ScopedKeyManager) purgePrivKeyCache() {
+	s.privKeyCache.Purge()
+}
+
 func (s *ScopedKeyManager) AccountProperties(ns walletdb.ReadBucket,
 	account uint32) (*AccountProperties, error) {
 
@@ -860,8 +1404,33 @@ func IsDefaultScope(scope KeyScope) bool {
 	return false
 }
 
+// cloneKeyWithVersion returns a copy of the account key whose version
+// identifies the address type of the scope, so wallets importing it derive
+// the same addresses. BIP-0044 and BIP-0086 keys, which have no dedicated
+// SLIP-0132 version, and the keys of networks without any keep their
+// version.
 func (s *ScopedKeyManager) cloneKeyWithVersion(key *hdkeychain.ExtendedKey) (
 	*hdkeychain.ExtendedKey, error) {
 
-	return nil, fmt.Errorf("cloneKeyWithVersion(...) has not be implemented")
+	mainNet := s.rootManager.chainParams.Net == wire.MainNet
+	testNet := s.rootManager.chainParams.Net == wire.TestNet ||
+		s.rootManager.chainParams.Net == wire.TestNet3
+
+	var version HDVersion
+	switch {
+	case s.scope == KeyScopeBIP0049Plus && mainNet:
+		version = HDVersionMainNetBIP0049
+	case s.scope == KeyScopeBIP0049Plus && testNet:
+		version = HDVersionTestNetBIP0049
+	case s.scope == KeyScopeBIP0084 && mainNet:
+		version = HDVersionMainNetBIP0084
+	case s.scope == KeyScopeBIP0084 && testNet:
+		version = HDVersionTestNetBIP0084
+	default:
+		return key, nil
+	}
+
+	var versionBytes [4]byte
+	binary.BigEndian.PutUint32(versionBytes[:], uint32(version))
+	return key.CloneWithVersion(versionBytes[:])
 }
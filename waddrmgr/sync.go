@@ -2,6 +2,7 @@ package waddrmgr
 
 import (
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/czh0526/btc-wallet/walletdb"
 	"time"
 )
 
@@ -22,3 +23,110 @@ func newSyncState(startBlock *BlockStamp, syncedTo *BlockStamp) *syncState {
 		syncedTo:   *syncedTo,
 	}
 }
+
+// SetSyncedTo marks the address manager to be in sync with the recently-seen
+// block described by the blockstamp. When the provided blockstamp is nil, the
+// manager is marked as unsynced.
+//
+// The hash of the block is also recorded by its height, so that BlockHash
+// can later tell whether the blocks the manager synced through are still
+// part of the best chain.
+func (m *Manager) SetSyncedTo(ns walletdb.ReadWriteBucket, bs *BlockStamp) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if bs == nil {
+		bs = &BlockStamp{}
+	} else if err := putBlockHash(ns, bs.Height, &bs.Hash); err != nil {
+		return err
+	}
+
+	if err := putSyncedTo(ns, bs); err != nil {
+		return err
+	}
+
+	m.syncState.syncedTo = *bs
+	return nil
+}
+
+// SyncedTo returns details about the block height and hash that the address
+// manager is synced through at the very least.
+func (m *Manager) SyncedTo() BlockStamp {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.syncState.syncedTo
+}
+
+// BlockHash returns the hash of the block the manager synced through at the
+// given height. ErrBlockNotFound is returned for heights the manager never
+// synced through.
+func (m *Manager) BlockHash(ns walletdb.ReadBucket, height int32) (
+	*chainhash.Hash, error) {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return fetchBlockHash(ns, height)
+}
+
+// Birthday returns the birthday, or earliest time a key could have been used,
+// for the manager.
+func (m *Manager) Birthday() time.Time {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return m.birthday
+}
+
+// BirthdayBlock returns the birthday block of the manager, the first block
+// that may contain transactions of the wallet, and whether it was verified
+// against the chain. ErrBirthdayBlockNotSet is returned if none was set.
+func (m *Manager) BirthdayBlock(ns walletdb.ReadBucket) (BlockStamp, bool,
+	error) {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	bs, err := fetchBirthdayBlock(ns)
+	if err != nil {
+		return BlockStamp{}, false, err
+	}
+	return *bs, fetchBirthdayBlockVerification(ns), nil
+}
+
+// SetBirthdayBlock sets the birthday block of the manager. The verified flag
+// records whether the block was located on the chain, as opposed to only
+// being estimated.
+func (m *Manager) SetBirthdayBlock(ns walletdb.ReadWriteBucket,
+	block BlockStamp, verified bool) error {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := putBirthdayBlock(ns, &block); err != nil {
+		return err
+	}
+	return putBirthdayBlockVerification(ns, verified)
+}
+
+// RecoveryWindow returns the recovery window of the recovery of the manager
+// from its seed that is in progress, or zero if none is.
+func (m *Manager) RecoveryWindow(ns walletdb.ReadBucket) uint32 {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	return fetchRecoveryWindow(ns)
+}
+
+// SetRecoveryWindow records that a recovery of the manager from its seed with
+// the recovery window is in progress, so it can be resumed if interrupted. A
+// zero window marks the recovery finished.
+func (m *Manager) SetRecoveryWindow(ns walletdb.ReadWriteBucket,
+	window uint32) error {
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return putRecoveryWindow(ns, window)
+}
@@ -1,6 +1,8 @@
 package waddrmgr
 
 import (
+	"fmt"
+
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/txscript"
 )
@@ -22,3 +24,55 @@ type Tapscript struct {
 	RootHash       []byte
 	FullOutputKey  *btcec.PublicKey
 }
+
+// TaprootKey calculates the tweaked taproot output key of the tapscript.
+func (t *Tapscript) TaprootKey() (*btcec.PublicKey, error) {
+	if t.Type != TaprootFullKeyOnly &&
+		(t.ControlBlock == nil || t.ControlBlock.InternalKey == nil) {
+
+		return nil, fmt.Errorf("internal key is required for " +
+			"tapscript type")
+	}
+
+	switch t.Type {
+	case TapscriptTypeFullTree:
+		if len(t.Leaves) == 0 {
+			return nil, fmt.Errorf("missing leaves")
+		}
+
+		tree := txscript.AssembleTaprootScriptTree(t.Leaves...)
+		rootHash := tree.RootNode.TapHash()
+		return txscript.ComputeTaprootOutputKey(
+			t.ControlBlock.InternalKey, rootHash[:],
+		), nil
+
+	case TapscriptTypePartialReveal:
+		if len(t.RevealedScript) == 0 {
+			return nil, fmt.Errorf("missing revealed script")
+		}
+
+		rootHash := t.ControlBlock.RootHash(t.RevealedScript)
+		return txscript.ComputeTaprootOutputKey(
+			t.ControlBlock.InternalKey, rootHash,
+		), nil
+
+	case TaprootKeySpendRootHash:
+		if len(t.RootHash) == 0 {
+			return nil, fmt.Errorf("missing root hash")
+		}
+
+		return txscript.ComputeTaprootOutputKey(
+			t.ControlBlock.InternalKey, t.RootHash,
+		), nil
+
+	case TaprootFullKeyOnly:
+		if t.FullOutputKey == nil {
+			return nil, fmt.Errorf("missing full output key")
+		}
+
+		return t.FullOutputKey, nil
+
+	default:
+		return nil, fmt.Errorf("unknown tapscript type %d", t.Type)
+	}
+}
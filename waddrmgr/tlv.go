@@ -1,7 +1,170 @@
 package waddrmgr
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"io"
 
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// The record types of a serialized tapscript. Each record is written as a
+// one byte type followed by a var bytes value, in increasing type order.
+// Records that don't apply to the tapscript type are omitted.
+const (
+	typeTapscriptType       byte = 1
+	typeTapscriptControl    byte = 2
+	typeTapscriptLeaf       byte = 3
+	typeTapscriptRevealed   byte = 4
+	typeTapscriptRootHash   byte = 5
+	typeTapscriptFullOutKey byte = 6
+)
+
+// maxTapscriptRecordSize bounds a single record, which is no larger than a
+// script of the maximum standard size.
+const maxTapscriptRecordSize = txscript.MaxScriptSize
+
+func writeTapscriptRecord(w io.Writer, recordType byte, value []byte) error {
+	if _, err := w.Write([]byte{recordType}); err != nil {
+		return err
+	}
+	return wire.WriteVarBytes(w, 0, value)
+}
+
+// tlvEncodeTaprootScript serializes a tapscript for storage as the script of
+// a taproot script address.
+func tlvEncodeTaprootScript(s *Tapscript) ([]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("cannot encode nil tapscript")
+	}
+
+	var b bytes.Buffer
+	err := writeTapscriptRecord(&b, typeTapscriptType, []byte{byte(s.Type)})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.ControlBlock != nil {
+		controlBlock, err := s.ControlBlock.ToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("error encoding control block: %w",
+				err)
+		}
+		err = writeTapscriptRecord(&b, typeTapscriptControl, controlBlock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each leaf is stored as its own record, with the leaf version in
+	// front of the script.
+	for _, leaf := range s.Leaves {
+		value := make([]byte, 0, 1+len(leaf.Script))
+		value = append(value, byte(leaf.LeafVersion))
+		value = append(value, leaf.Script...)
+		err := writeTapscriptRecord(&b, typeTapscriptLeaf, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.RevealedScript) > 0 {
+		err := writeTapscriptRecord(
+			&b, typeTapscriptRevealed, s.RevealedScript)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.RootHash) > 0 {
+		err := writeTapscriptRecord(&b, typeTapscriptRootHash, s.RootHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.FullOutputKey != nil {
+		err := writeTapscriptRecord(
+			&b, typeTapscriptFullOutKey,
+			schnorr.SerializePubKey(s.FullOutputKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// tlvDecodeTaprootTaprootScript deserializes a tapscript written by
+// tlvEncodeTaprootScript.
 func tlvDecodeTaprootTaprootScript(tlvData []byte) (*Tapscript, error) {
-	return nil, fmt.Errorf("tlvDecodeTaprootTaprootScript(...) has not be implemented")
+	var (
+		s       Tapscript
+		hasType bool
+		r       = bytes.NewReader(tlvData)
+	)
+	for r.Len() > 0 {
+		recordType, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := wire.ReadVarBytes(
+			r, 0, maxTapscriptRecordSize, "tapscript record")
+		if err != nil {
+			return nil, fmt.Errorf("error reading tapscript record "+
+				"%d: %w", recordType, err)
+		}
+
+		switch recordType {
+		case typeTapscriptType:
+			if len(value) != 1 {
+				return nil, fmt.Errorf("invalid tapscript type " +
+					"length")
+			}
+			s.Type = TapscriptType(value[0])
+			hasType = true
+
+		case typeTapscriptControl:
+			s.ControlBlock, err = txscript.ParseControlBlock(value)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding control "+
+					"block: %w", err)
+			}
+
+		case typeTapscriptLeaf:
+			if len(value) == 0 {
+				return nil, fmt.Errorf("empty tapscript leaf")
+			}
+			s.Leaves = append(s.Leaves, txscript.TapLeaf{
+				LeafVersion: txscript.TapscriptLeafVersion(
+					value[0]),
+				Script: value[1:],
+			})
+
+		case typeTapscriptRevealed:
+			s.RevealedScript = value
+
+		case typeTapscriptRootHash:
+			s.RootHash = value
+
+		case typeTapscriptFullOutKey:
+			s.FullOutputKey, err = schnorr.ParsePubKey(value)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding full "+
+					"output key: %w", err)
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown tapscript record type %d",
+				recordType)
+		}
+	}
+
+	if !hasType {
+		return nil, fmt.Errorf("tapscript type is missing")
+	}
+
+	return &s, nil
 }
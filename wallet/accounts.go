@@ -0,0 +1,270 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// AccountResult holds the properties of an account along with the total of
+// its unspent outputs.
+type AccountResult struct {
+	waddrmgr.AccountProperties
+	TotalBalance btcutil.Amount
+}
+
+// AccountsResult holds the accounts of a scope, and the block their balances
+// were calculated at.
+type AccountsResult struct {
+	Accounts           []AccountResult
+	CurrentBlockHash   chainhash.Hash
+	CurrentBlockHeight int32
+}
+
+// NewAddress derives the next external address of the account, which the
+// chain backend, if attached, is asked to watch. A backend failing to watch
+// it is logged rather than returned.
+func (w *Wallet) NewAddress(account uint32,
+	scope waddrmgr.KeyScope) (btcutil.Address, error) {
+
+	return w.newAddress(account, scope, false)
+}
+
+// NewChangeAddress derives the next internal address of the account, which
+// the chain backend, if attached, is asked to watch.
+func (w *Wallet) NewChangeAddress(account uint32,
+	scope waddrmgr.KeyScope) (btcutil.Address, error) {
+
+	return w.newAddress(account, scope, true)
+}
+
+// newAddress derives the next address of a branch of the account.
+func (w *Wallet) newAddress(account uint32, scope waddrmgr.KeyScope,
+	internal bool) (btcutil.Address, error) {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr btcutil.Address
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		next := scopedMgr.NextExternalAddresses
+		if internal {
+			next = scopedMgr.NextInternalAddresses
+		}
+		addrs, err := next(addrmgrNs, account, 1)
+		if err != nil {
+			return err
+		}
+		addr = addrs[0].Address()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a backend, the address is watched once one is attached.
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		return addr, nil
+	}
+
+	// The address is already stored, so failing here would only hide it
+	// from the caller while its next call derives another one. Its mined
+	// transactions are still found in the blocks the wallet processes.
+	err = chainClient.NotifyReceived([]btcutil.Address{addr})
+	if err != nil {
+		fmt.Printf("Unable to watch address %v: %v \n", addr, err)
+	}
+	return addr, nil
+}
+
+// Accounts returns the accounts of the scope, the imported one last, with
+// the total of their unspent outputs.
+func (w *Wallet) Accounts(scope waddrmgr.KeyScope) (*AccountsResult, error) {
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []AccountResult
+	syncBlock := w.Manager.SyncedTo()
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		lastAccount, err := scopedMgr.LastAccount(addrmgrNs)
+		if err != nil {
+			return err
+		}
+
+		// The indexes of the accounts are kept to sum their balances.
+		indexes := make(map[uint32]int)
+		numbers := make([]uint32, 0, lastAccount+2)
+		for account := uint32(0); account <= lastAccount; account++ {
+			numbers = append(numbers, account)
+		}
+		numbers = append(numbers, waddrmgr.ImportedAddrAccount)
+		for _, account := range numbers {
+			props, err := scopedMgr.AccountProperties(
+				addrmgrNs, account)
+			if err != nil {
+				return err
+			}
+			indexes[account] = len(accounts)
+			accounts = append(accounts, AccountResult{
+				AccountProperties: *props,
+			})
+		}
+
+		unspent, err := w.TxStore.UnspentOutputs(txmgrNs)
+		if err != nil {
+			return err
+		}
+		for _, output := range unspent {
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+				output.PkScript, w.chainParams)
+			if err != nil || len(addrs) == 0 {
+				continue
+			}
+			outputMgr, account, err := w.Manager.AddrAccount(
+				addrmgrNs, addrs[0])
+			if err != nil || outputMgr.Scope() != scope {
+				continue
+			}
+			if i, ok := indexes[account]; ok {
+				accounts[i].TotalBalance += output.Amount
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountsResult{
+		Accounts:           accounts,
+		CurrentBlockHash:   syncBlock.Hash,
+		CurrentBlockHeight: syncBlock.Height,
+	}, nil
+}
+
+// NextAccount creates the account following the last one of the scope,
+// returning its number. The wallet must be unlocked to derive its keys.
+func (w *Wallet) NextAccount(scope waddrmgr.KeyScope,
+	name string) (uint32, error) {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return 0, err
+	}
+
+	var account uint32
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		var err error
+		account, err = scopedMgr.NewAccount(addrmgrNs, name)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return account, nil
+}
+
+// RenameAccount renames the account of the scope.
+func (w *Wallet) RenameAccount(scope waddrmgr.KeyScope, account uint32,
+	name string) error {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return err
+	}
+
+	return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		return scopedMgr.RenameAccount(addrmgrNs, account, name)
+	})
+}
+
+// AccountNumber returns the number of the account of the scope with the
+// name.
+func (w *Wallet) AccountNumber(scope waddrmgr.KeyScope,
+	name string) (uint32, error) {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return 0, err
+	}
+
+	var account uint32
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		var err error
+		account, err = scopedMgr.LookupAccount(addrmgrNs, name)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return account, nil
+}
+
+// AccountProperties returns the properties of the account of the scope.
+func (w *Wallet) AccountProperties(scope waddrmgr.KeyScope,
+	account uint32) (*waddrmgr.AccountProperties, error) {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var props *waddrmgr.AccountProperties
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		var err error
+		props, err = scopedMgr.AccountProperties(addrmgrNs, account)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// AddressInfo returns the managed address of a wallet address and the scope
+// of its account, or an ErrAddressNotFound error if the address is not the
+// wallet's.
+func (w *Wallet) AddressInfo(addr btcutil.Address) (waddrmgr.ManagedAddress,
+	waddrmgr.KeyScope, error) {
+
+	var (
+		managed waddrmgr.ManagedAddress
+		scope   waddrmgr.KeyScope
+	)
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		scopedMgr, _, err := w.Manager.AddrAccount(addrmgrNs, addr)
+		if err != nil {
+			return err
+		}
+		scope = scopedMgr.Scope()
+		managed, err = scopedMgr.Address(addrmgrNs, addr)
+		return err
+	})
+	if err != nil {
+		return nil, waddrmgr.KeyScope{}, err
+	}
+	return managed, scope, nil
+}
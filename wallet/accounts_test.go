@@ -0,0 +1,131 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccounts(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	scope := waddrmgr.KeyScopeBIP0084
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	account, err := w.NextAccount(scope, "savings")
+	if err != nil {
+		t.Fatalf("unable to create account: %v", err)
+	}
+	assert.Equal(t, uint32(1), account)
+	w.Lock()
+	if !w.Locked() {
+		t.Fatalf("wallet not locked")
+	}
+
+	// Addresses are derived in order, and known to belong to their
+	// account and branch.
+	first, err := w.NewAddress(account, scope)
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+	second, err := w.NewAddress(account, scope)
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+	assert.NotEqual(t, first.String(), second.String())
+
+	change, err := w.NewChangeAddress(account, scope)
+	if err != nil {
+		t.Fatalf("unable to derive change address: %v", err)
+	}
+	managed, addrScope, err := w.AddressInfo(change)
+	if err != nil {
+		t.Fatalf("unable to look up address: %v", err)
+	}
+	assert.Equal(t, scope, addrScope)
+	assert.Equal(t, account, managed.InternalAccount())
+	assert.True(t, managed.Internal())
+
+	// Balances are summed per account.
+	pay := func(addr btcutil.Address, amount int64) *wire.MsgTx {
+		pkScript, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: chainhash.Hash{byte(amount)}}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(amount, pkScript))
+		return tx
+	}
+	block := testBlock(nil, 0, pay(first, 1000), pay(change, 500))
+	meta := blockMeta(block, 1)
+	if err := w.processBlock(block, &meta); err != nil {
+		t.Fatalf("unable to process block: %v", err)
+	}
+
+	result, err := w.Accounts(scope)
+	if err != nil {
+		t.Fatalf("unable to list accounts: %v", err)
+	}
+	assert.Equal(t, block.BlockHash(), result.CurrentBlockHash)
+	assert.Equal(t, int32(1), result.CurrentBlockHeight)
+	if assert.Len(t, result.Accounts, 3) {
+		assert.Equal(t, "default", result.Accounts[0].AccountName)
+		assert.Zero(t, result.Accounts[0].TotalBalance)
+
+		assert.Equal(t, "savings", result.Accounts[1].AccountName)
+		assert.Equal(t, btcutil.Amount(1500),
+			result.Accounts[1].TotalBalance)
+		assert.Equal(t, uint32(2), result.Accounts[1].ExternalKeyCount)
+		assert.Equal(t, uint32(1), result.Accounts[1].InternalKeyCount)
+
+		assert.Equal(t, waddrmgr.ImportedAddrAccountName,
+			result.Accounts[2].AccountName)
+	}
+
+	// Renamed accounts are looked up by their new name.
+	if err := w.RenameAccount(scope, account, "spending"); err != nil {
+		t.Fatalf("unable to rename account: %v", err)
+	}
+	renamed, err := w.AccountNumber(scope, "spending")
+	if err != nil {
+		t.Fatalf("unable to look up account: %v", err)
+	}
+	assert.Equal(t, account, renamed)
+	props, err := w.AccountProperties(scope, account)
+	if err != nil {
+		t.Fatalf("unable to fetch account properties: %v", err)
+	}
+	assert.Equal(t, "spending", props.AccountName)
+}
+
+func TestNewAddressWatchFailure(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	// The derived address is returned even though the backend fails to
+	// watch it, so no derived address goes unused.
+	w.chainClient = &mockChainClient{notifyErr: errors.New("disconnected")}
+	addr, err := w.NewAddress(waddrmgr.DefaultAccountNum,
+		waddrmgr.KeyScopeBIP0084)
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+	assert.NotNil(t, addr)
+
+	props, err := w.AccountProperties(waddrmgr.KeyScopeBIP0084,
+		waddrmgr.DefaultAccountNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(1), props.ExternalKeyCount)
+}
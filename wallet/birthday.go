@@ -0,0 +1,136 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// birthdayBlockDelta is the safety margin applied to the birthday of the
+// wallet when locating its birthday block. Block timestamps are only loosely
+// ordered, and a block may be timestamped up to two hours in the future.
+const birthdayBlockDelta = 2 * time.Hour
+
+// errBackendBehind is returned when the chain backend is still syncing the
+// blocks below the birthday block of the wallet.
+var errBackendBehind = errors.New("chain backend is behind the birthday " +
+	"block")
+
+// locateBirthdayBlock returns the first block of the best chain of the
+// backend whose timestamp is within birthdayBlockDelta of the birthday or
+// later. The tip is returned if no block is that recent.
+func locateBirthdayBlock(chainClient chain.Interface, birthday time.Time,
+	bestHeight int32) (*waddrmgr.BlockStamp, error) {
+
+	cutoff := birthday.Add(-birthdayBlockDelta)
+
+	low, high := int32(0), bestHeight
+	for low < high {
+		mid := low + (high-low)/2
+		bs, err := blockStamp(chainClient, mid)
+		if err != nil {
+			return nil, err
+		}
+		if bs.Timestamp.Before(cutoff) {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+
+	return blockStamp(chainClient, low)
+}
+
+// blockStamp returns the block of the best chain of the backend at the given
+// height. Negative heights refer to the genesis block.
+func blockStamp(chainClient chain.Interface,
+	height int32) (*waddrmgr.BlockStamp, error) {
+
+	if height < 0 {
+		height = 0
+	}
+	hash, err := chainClient.GetBlockHash(int64(height))
+	if err != nil {
+		return nil, err
+	}
+	header, err := chainClient.GetBlockHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &waddrmgr.BlockStamp{
+		Height:    height,
+		Hash:      *hash,
+		Timestamp: header.Timestamp,
+	}, nil
+}
+
+// verifyBirthdayBlock returns the birthday block of the wallet, checking
+// that the stored one is still part of the best chain of the backend. A
+// birthday block is located and stored if none was verified yet, or if a
+// reorg replaced the stored one, in which case the returned flag tells the
+// blocks following it must be scanned again. errBackendBehind is returned
+// while the backend hasn't reached the stored birthday block yet.
+func (w *Wallet) verifyBirthdayBlock(chainClient chain.Interface,
+	bestHeight int32) (*waddrmgr.BlockStamp, bool, error) {
+
+	var (
+		birthdayBlock waddrmgr.BlockStamp
+		verified      bool
+		stored        bool
+	)
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		var err error
+		birthdayBlock, verified, err = w.Manager.BirthdayBlock(addrmgrNs)
+		if waddrmgr.IsError(err, waddrmgr.ErrBirthdayBlockNotSet) {
+			return nil
+		}
+		stored = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if stored && verified && birthdayBlock.Height > bestHeight {
+		return nil, false, fmt.Errorf("%w: birthday block at height "+
+			"%d, backend at height %d", errBackendBehind,
+			birthdayBlock.Height, bestHeight)
+	}
+	if stored && verified {
+		hash, err := chainClient.GetBlockHash(int64(birthdayBlock.Height))
+		if err != nil {
+			return nil, false, err
+		}
+		if *hash == birthdayBlock.Hash {
+			return &birthdayBlock, false, nil
+		}
+	}
+	if stored {
+		fmt.Printf("Birthday block %v (height %d) is not part of the "+
+			"best chain, locating it again \n", birthdayBlock.Hash,
+			birthdayBlock.Height)
+	}
+
+	located, err := locateBirthdayBlock(
+		chainClient, w.Manager.Birthday(), bestHeight)
+	if err != nil {
+		return nil, false, err
+	}
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		return w.Manager.SetBirthdayBlock(addrmgrNs, *located, true)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	fmt.Printf("Birthday block set to %v (height %d) \n", located.Hash,
+		located.Height)
+
+	return located, stored, nil
+}
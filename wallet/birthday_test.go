@@ -0,0 +1,201 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocateBirthdayBlock(t *testing.T) {
+	blocks := []*wire.MsgBlock{testBlock(nil, 0)}
+	for len(blocks) < 100 {
+		blocks = append(blocks, testBlock(blocks[len(blocks)-1], 0))
+	}
+	chainClient := &mockChainClient{blocks: blocks}
+
+	tests := []struct {
+		name     string
+		birthday time.Time
+		height   int32
+	}{
+		{
+			name:     "before the genesis block",
+			birthday: time.Unix(1600000000, 0),
+			height:   0,
+		},
+		{
+			// Blocks are ten minutes apart, so the safety margin
+			// reaches back twelve blocks.
+			name:     "within the chain",
+			birthday: blocks[50].Header.Timestamp,
+			height:   38,
+		},
+		{
+			name:     "between two blocks",
+			birthday: blocks[50].Header.Timestamp.Add(time.Minute),
+			height:   39,
+		},
+		{
+			name:     "after the tip",
+			birthday: time.Now(),
+			height:   99,
+		},
+	}
+	for _, test := range tests {
+		bs, err := locateBirthdayBlock(chainClient, test.birthday, 99)
+		if err != nil {
+			t.Fatalf("%s: unable to locate birthday block: %v",
+				test.name, err)
+		}
+		assert.Equal(t, test.height, bs.Height, test.name)
+		assert.Equal(t, blocks[test.height].BlockHash(), bs.Hash, test.name)
+	}
+}
+
+func TestBirthdayBlockReorg(t *testing.T) {
+	// The margin of two days applied to the birthday when creating the
+	// wallet, and the margin of the locator, make block 3 the birthday
+	// block.
+	genesis := testBlock(nil, 0)
+	b1 := testBlock(genesis, 0)
+	b2 := testBlock(b1, 0)
+	b3 := testBlock(b2, 0)
+	b4 := testBlock(b3, 0)
+	birthday := b3.Header.Timestamp.Add(48*time.Hour + birthdayBlockDelta)
+
+	w, cleanUp := testWalletFromKey(t, nil, birthday, 0)
+	defer cleanUp()
+
+	chainClient := &mockChainClient{
+		blocks: []*wire.MsgBlock{genesis, b1, b2, b3, b4},
+	}
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b4, 4)
+
+	birthdayBlock := func() waddrmgr.BlockStamp {
+		var (
+			bs       waddrmgr.BlockStamp
+			verified bool
+		)
+		err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+			addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+			var err error
+			bs, verified, err = w.Manager.BirthdayBlock(addrmgrNs)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, verified)
+		return bs
+	}
+	assert.Equal(t, int32(3), birthdayBlock().Height)
+	assert.Equal(t, b3.BlockHash(), birthdayBlock().Hash)
+
+	var addr waddrmgr.ManagedAddress
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		scopedMgr, err := w.Manager.FetchScopedKeyManager(
+			waddrmgr.KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+		addrs, err := scopedMgr.NextExternalAddresses(
+			addrmgrNs, waddrmgr.DefaultAccountNum, 1)
+		if err != nil {
+			return err
+		}
+		addr = addrs[0]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := wire.NewMsgTx(wire.TxVersion)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x04}}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(50000, pkScript))
+
+	// The blocks of the competing chain are timestamped late enough for
+	// its first block to become the birthday block. Its payment lies
+	// below the blocks the wallet synced through, so only the birthday
+	// block check finds it.
+	reorged := []*wire.MsgBlock{genesis}
+	for height := 1; height <= 4; height++ {
+		var txs []*wire.MsgTx
+		if height == 1 {
+			txs = append(txs, payment)
+		}
+		block := testBlock(reorged[height-1], 1, txs...)
+		block.Header.Timestamp = block.Header.Timestamp.Add(
+			20 * time.Minute)
+		reorged = append(reorged, block)
+	}
+	b1r, b4r := reorged[1], reorged[4]
+	chainClient.setBlocks(reorged)
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b4r, 4)
+
+	assert.Equal(t, int32(1), birthdayBlock().Height)
+	assert.Equal(t, b1r.BlockHash(), birthdayBlock().Hash)
+	assert.Equal(t, int32(1), txHeight(t, w, payment.TxHash()))
+}
+
+func TestBirthdayBlockBackendBehind(t *testing.T) {
+	genesis := testBlock(nil, 0)
+	b1 := testBlock(genesis, 0)
+	b2 := testBlock(b1, 0)
+	b3 := testBlock(b2, 0)
+	b4 := testBlock(b3, 0)
+	birthday := b3.Header.Timestamp.Add(48*time.Hour + birthdayBlockDelta)
+
+	w, cleanUp := testWalletFromKey(t, nil, birthday, 0)
+	defer cleanUp()
+
+	blocks := []*wire.MsgBlock{genesis, b1, b2, b3, b4}
+	chainClient := &mockChainClient{blocks: blocks}
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b4, 4)
+
+	// A backend syncing from scratch again is behind the birthday block,
+	// which is kept rather than located again.
+	chainClient.setBlocks(blocks[:3])
+	err := w.syncWithChain(chainClient)
+	assert.ErrorIs(t, err, errBackendBehind)
+
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		bs, verified, err := w.Manager.BirthdayBlock(addrmgrNs)
+		assert.True(t, verified)
+		assert.Equal(t, b3.BlockHash(), bs.Hash)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, b4.BlockHash(), w.Manager.SyncedTo().Hash)
+
+	// Once it caught up, the wallet syncs again.
+	chainClient.setBlocks(blocks)
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b4, 4)
+}
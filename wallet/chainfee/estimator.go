@@ -0,0 +1,228 @@
+// Package chainfee provides fee rate estimators for newly created
+// transactions. All fee rates are expressed in satoshis per kilo-virtual-byte,
+// the unit used by txauthor.
+package chainfee
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+const (
+	// FeePerKBFloor is the lowest fee rate any estimator returns. It is the
+	// default minimum relay fee of bitcoind and btcd.
+	FeePerKBFloor btcutil.Amount = 1000
+
+	// MaxBlockVSize is the virtual size of a full block, used to convert
+	// a confirmation target into a mempool depth.
+	MaxBlockVSize = 1000000
+)
+
+var (
+	// ErrNoEstimate is returned when the backend has too little data to
+	// estimate a fee rate and no fallback rate was configured.
+	ErrNoEstimate = errors.New("fee estimate unavailable")
+)
+
+// Estimator provides the fee rate a transaction should pay to confirm within
+// a number of blocks.
+type Estimator interface {
+	// EstimateFeePerKB returns the fee rate, in sat/kvB, expected to get a
+	// transaction confirmed within numBlocks blocks.
+	EstimateFeePerKB(numBlocks uint32) (btcutil.Amount, error)
+
+	// RelayFeePerKB returns the minimum fee rate, in sat/kvB, required
+	// for transactions to be relayed.
+	RelayFeePerKB() btcutil.Amount
+}
+
+// StaticEstimator returns the same fee rate for every confirmation target.
+// It is useful on regtest and in tests.
+type StaticEstimator struct {
+	feePerKB btcutil.Amount
+	relayFee btcutil.Amount
+}
+
+// NewStaticEstimator returns an estimator that always returns feePerKB. A
+// relay fee of zero selects FeePerKBFloor.
+func NewStaticEstimator(feePerKB, relayFee btcutil.Amount) *StaticEstimator {
+	if relayFee == 0 {
+		relayFee = FeePerKBFloor
+	}
+	return &StaticEstimator{
+		feePerKB: feePerKB,
+		relayFee: relayFee,
+	}
+}
+
+// EstimateFeePerKB implements the Estimator interface.
+func (e *StaticEstimator) EstimateFeePerKB(uint32) (btcutil.Amount, error) {
+	return clampFee(e.feePerKB, e.relayFee), nil
+}
+
+// RelayFeePerKB implements the Estimator interface.
+func (e *StaticEstimator) RelayFeePerKB() btcutil.Amount {
+	return e.relayFee
+}
+
+// SmartFeeSource is a chain backend answering estimatesmartfee queries.
+// *rpcclient.Client, and therefore chain.RPCClient, satisfy it.
+type SmartFeeSource interface {
+	EstimateSmartFee(confTarget int64,
+		mode *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult,
+		error)
+}
+
+var _ SmartFeeSource = (*rpcclient.Client)(nil)
+
+// SmartFeeEstimator asks the chain backend for fee rates with
+// estimatesmartfee.
+type SmartFeeEstimator struct {
+	source   SmartFeeSource
+	mode     btcjson.EstimateSmartFeeMode
+	fallback btcutil.Amount
+	relayFee btcutil.Amount
+}
+
+// NewSmartFeeEstimator returns an estimator backed by source, using the
+// conservative estimate mode. fallback is returned when the backend has no
+// estimate yet, which is common right after startup or on regtest; a zero
+// fallback makes that case an error instead.
+func NewSmartFeeEstimator(source SmartFeeSource, fallback,
+	relayFee btcutil.Amount) *SmartFeeEstimator {
+
+	if relayFee == 0 {
+		relayFee = FeePerKBFloor
+	}
+	return &SmartFeeEstimator{
+		source:   source,
+		mode:     btcjson.EstimateModeConservative,
+		fallback: fallback,
+		relayFee: relayFee,
+	}
+}
+
+// EstimateFeePerKB implements the Estimator interface.
+func (e *SmartFeeEstimator) EstimateFeePerKB(numBlocks uint32) (btcutil.Amount,
+	error) {
+
+	// Confirmation targets below two blocks are treated as two blocks by
+	// the backend anyway.
+	if numBlocks < 2 {
+		numBlocks = 2
+	}
+
+	mode := e.mode
+	res, err := e.source.EstimateSmartFee(int64(numBlocks), &mode)
+	if err != nil {
+		return 0, err
+	}
+	if res.FeeRate == nil || *res.FeeRate <= 0 {
+		if e.fallback == 0 {
+			return 0, fmt.Errorf("%w: %v", ErrNoEstimate, res.Errors)
+		}
+		return clampFee(e.fallback, e.relayFee), nil
+	}
+
+	// The backend reports BTC/kvB.
+	feePerKB, err := btcutil.NewAmount(*res.FeeRate)
+	if err != nil {
+		return 0, err
+	}
+	return clampFee(feePerKB, e.relayFee), nil
+}
+
+// RelayFeePerKB implements the Estimator interface.
+func (e *SmartFeeEstimator) RelayFeePerKB() btcutil.Amount {
+	return e.relayFee
+}
+
+// FeeHistogramBin is one entry of a mempool fee histogram: VSize virtual bytes
+// of transactions pay at least FeeRate sat/vB, but less than the rate of the
+// next higher bin.
+type FeeHistogramBin struct {
+	FeeRate float64
+	VSize   int64
+}
+
+// HistogramSource provides a snapshot of the mempool as a fee histogram,
+// such as the result of Electrum's mempool.get_fee_histogram.
+type HistogramSource interface {
+	FeeHistogram() ([]FeeHistogramBin, error)
+}
+
+// MempoolEstimator estimates fee rates from the mempool fee histogram. A
+// transaction targeting n blocks must pay at least the rate of the
+// transaction found n full blocks deep in the mempool.
+type MempoolEstimator struct {
+	source   HistogramSource
+	relayFee btcutil.Amount
+}
+
+// NewMempoolEstimator returns an estimator using histograms from source.
+func NewMempoolEstimator(source HistogramSource,
+	relayFee btcutil.Amount) *MempoolEstimator {
+
+	if relayFee == 0 {
+		relayFee = FeePerKBFloor
+	}
+	return &MempoolEstimator{
+		source:   source,
+		relayFee: relayFee,
+	}
+}
+
+// EstimateFeePerKB implements the Estimator interface.
+func (e *MempoolEstimator) EstimateFeePerKB(numBlocks uint32) (btcutil.Amount,
+	error) {
+
+	if numBlocks == 0 {
+		numBlocks = 1
+	}
+
+	histogram, err := e.source.FeeHistogram()
+	if err != nil {
+		return 0, err
+	}
+	bins := append([]FeeHistogramBin(nil), histogram...)
+	sort.SliceStable(bins, func(i, j int) bool {
+		return bins[i].FeeRate > bins[j].FeeRate
+	})
+
+	// Walk down from the highest paying transactions until the target
+	// number of blocks is filled. If the mempool doesn't even fill that
+	// many blocks, the relay fee is enough.
+	depth := int64(numBlocks) * MaxBlockVSize
+	var cumulative int64
+	for _, bin := range bins {
+		cumulative += bin.VSize
+		if cumulative < depth {
+			continue
+		}
+
+		// Pay one sat/vB more than the transactions at the boundary
+		// so the transaction is placed above them.
+		satPerVByte := math.Ceil(bin.FeeRate) + 1
+		return clampFee(btcutil.Amount(satPerVByte*1000), e.relayFee), nil
+	}
+	return e.relayFee, nil
+}
+
+// RelayFeePerKB implements the Estimator interface.
+func (e *MempoolEstimator) RelayFeePerKB() btcutil.Amount {
+	return e.relayFee
+}
+
+// clampFee raises a fee rate to the relay fee.
+func clampFee(feePerKB, relayFee btcutil.Amount) btcutil.Amount {
+	if feePerKB < relayFee {
+		return relayFee
+	}
+	return feePerKB
+}
@@ -0,0 +1,114 @@
+package chainfee
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+type mockSmartFeeSource struct {
+	rates      map[int64]float64
+	lastTarget int64
+}
+
+func (m *mockSmartFeeSource) EstimateSmartFee(confTarget int64,
+	_ *btcjson.EstimateSmartFeeMode) (*btcjson.EstimateSmartFeeResult, error) {
+
+	m.lastTarget = confTarget
+	res := &btcjson.EstimateSmartFeeResult{Blocks: confTarget}
+	if rate, ok := m.rates[confTarget]; ok {
+		res.FeeRate = &rate
+	} else {
+		res.Errors = []string{"Insufficient data or no feerate found"}
+	}
+	return res, nil
+}
+
+type mockHistogram []FeeHistogramBin
+
+func (m mockHistogram) FeeHistogram() ([]FeeHistogramBin, error) {
+	return m, nil
+}
+
+func TestStaticEstimator(t *testing.T) {
+	e := NewStaticEstimator(5000, 0)
+	fee, err := e.EstimateFeePerKB(6)
+	if err != nil || fee != 5000 {
+		t.Fatalf("expected 5000, got %v (%v)", fee, err)
+	}
+
+	e = NewStaticEstimator(500, 0)
+	fee, _ = e.EstimateFeePerKB(6)
+	if fee != FeePerKBFloor {
+		t.Fatalf("expected fee clamped to %v, got %v", FeePerKBFloor, fee)
+	}
+}
+
+func TestSmartFeeEstimator(t *testing.T) {
+	src := &mockSmartFeeSource{rates: map[int64]float64{
+		2: 0.00025,
+		6: 0.00000500,
+	}}
+
+	e := NewSmartFeeEstimator(src, 0, 0)
+	fee, err := e.EstimateFeePerKB(1)
+	if err != nil {
+		t.Fatalf("unable to estimate fee: %v", err)
+	}
+	if src.lastTarget != 2 {
+		t.Fatalf("expected target raised to 2, got %d", src.lastTarget)
+	}
+	if fee != 25000 {
+		t.Fatalf("expected 25000 sat/kvB, got %v", fee)
+	}
+
+	// Estimates below the relay fee are raised to it.
+	fee, err = e.EstimateFeePerKB(6)
+	if err != nil || fee != FeePerKBFloor {
+		t.Fatalf("expected %v, got %v (%v)", FeePerKBFloor, fee, err)
+	}
+
+	// Without data, the fallback is used if there is one.
+	_, err = e.EstimateFeePerKB(144)
+	if !errors.Is(err, ErrNoEstimate) {
+		t.Fatalf("expected ErrNoEstimate, got %v", err)
+	}
+	e = NewSmartFeeEstimator(src, 20000, 0)
+	fee, err = e.EstimateFeePerKB(144)
+	if err != nil || fee != 20000 {
+		t.Fatalf("expected fallback 20000, got %v (%v)", fee, err)
+	}
+}
+
+func TestMempoolEstimator(t *testing.T) {
+	hist := mockHistogram{
+		{FeeRate: 5, VSize: 600000},
+		{FeeRate: 50, VSize: 400000},
+		{FeeRate: 20.5, VSize: 500000},
+		{FeeRate: 2, VSize: 900000},
+	}
+	e := NewMempoolEstimator(hist, 0)
+
+	tests := []struct {
+		blocks uint32
+		fee    btcutil.Amount
+	}{
+		// 400k at 50 and 500k at 20.5 sat/vB don't fill a block,
+		// so the first block ends in the 5 sat/vB bin.
+		{blocks: 1, fee: 6000},
+		{blocks: 2, fee: 3000},
+		{blocks: 3, fee: FeePerKBFloor},
+	}
+	for _, test := range tests {
+		fee, err := e.EstimateFeePerKB(test.blocks)
+		if err != nil {
+			t.Fatalf("unable to estimate fee: %v", err)
+		}
+		if fee != test.fee {
+			t.Fatalf("%d blocks: expected %v, got %v", test.blocks,
+				test.fee, fee)
+		}
+	}
+}
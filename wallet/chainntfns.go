@@ -0,0 +1,418 @@
+package wallet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// handleChainNotifications keeps the wallet in sync with the chain backend.
+// It catches up from the block the wallet synced through to the tip of the
+// backend, then processes the notifications of the backend until it shuts
+// down or the wallet is stopped. It must be run as a goroutine.
+func (w *Wallet) handleChainNotifications() {
+	defer w.wg.Done()
+
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		fmt.Printf("handleChainNotifications called without RPC "+
+			"client: %v \n", err)
+		return
+	}
+
+	if err := w.watchActiveAddresses(chainClient); err != nil {
+		fmt.Printf("Unable to watch wallet addresses: %v \n", err)
+	}
+	if err := w.syncWithChain(chainClient); err != nil {
+		fmt.Printf("Unable to synchronize wallet to chain: %v \n", err)
+	}
+
+	notifications := chainClient.Notifications()
+	quit := w.quitChan()
+	for {
+		select {
+		case n, ok := <-notifications:
+			if !ok {
+				return
+			}
+
+			var notificationName string
+			switch n := n.(type) {
+			case chain.ClientConnected:
+				// Blocks may have been missed while the client
+				// was disconnected.
+				notificationName = "client connected"
+				err = w.syncWithChain(chainClient)
+
+			case chain.BlockConnected:
+				notificationName = "block connected"
+				err = w.connectBlock(
+					chainClient, wtxmgr.BlockMeta(n))
+
+			case chain.BlockDisconnected:
+				notificationName = "block disconnected"
+				err = w.disconnectBlock(
+					chainClient, wtxmgr.BlockMeta(n))
+
+			case chain.RelevantTx:
+				notificationName = "relevant transaction"
+				err = walletdb.Update(w.db, func(
+					dbTx walletdb.ReadWriteTx) error {
+
+					return w.addRelevantTx(
+						dbTx, n.TxRecord, n.Block)
+				})
+
+			default:
+				continue
+			}
+			if err != nil {
+				fmt.Printf("Unable to process chain backend %v "+
+					"notification: %v \n", notificationName, err)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
+
+// watchActiveAddresses requests notifications from the chain backend for
+// unmined transactions paying to any wallet address.
+func (w *Wallet) watchActiveAddresses(chainClient chain.Interface) error {
+	if err := chainClient.NotifyBlocks(); err != nil {
+		return err
+	}
+
+	var addrs []btcutil.Address
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		return w.Manager.ForEachActiveAddress(addrmgrNs,
+			func(addr btcutil.Address) error {
+				addrs = append(addrs, addr)
+				return nil
+			})
+	})
+	if err != nil {
+		return err
+	}
+	return chainClient.NotifyReceived(addrs)
+}
+
+// syncWithChain brings the wallet in sync with the best chain of the backend.
+// Blocks the wallet synced through that are no longer part of the best chain
+// are rolled back first, then every block up to the tip is scanned for
+// wallet transactions.
+//
+// A wallet that never synced starts scanning at its birthday block, and
+// recovers its funds from there when it was opened with a recovery window.
+// A recovery that was interrupted is resumed from the block the wallet synced
+// through. The blocks following the birthday block are scanned again if a
+// reorg replaced it. Syncing fails while the backend is still behind the
+// birthday block, and is retried as the backend connects blocks.
+func (w *Wallet) syncWithChain(chainClient chain.Interface) error {
+	_, bestHeight, err := chainClient.GetBestBlock()
+	if err != nil {
+		return err
+	}
+
+	birthdayBlock, rescan, err := w.verifyBirthdayBlock(
+		chainClient, bestHeight)
+	if err != nil {
+		return err
+	}
+
+	syncedTo := w.Manager.SyncedTo()
+	neverSynced := syncedTo.Hash == (chainhash.Hash{})
+	if neverSynced || (rescan && syncedTo.Height >= birthdayBlock.Height) {
+		bs, err := blockStamp(chainClient, birthdayBlock.Height-1)
+		if err != nil {
+			return err
+		}
+		if err := w.rollback(bs); err != nil {
+			return err
+		}
+	}
+
+	var recoveryWindow uint32
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		recoveryWindow = w.Manager.RecoveryWindow(addrmgrNs)
+		if recoveryWindow > 0 || !neverSynced || w.recoveryWindow == 0 ||
+			w.Manager.WatchOnly() {
+
+			return nil
+		}
+
+		// The recovery is recorded before it starts, so it's resumed
+		// if the wallet stops before it finishes.
+		recoveryWindow = w.recoveryWindow
+		return w.Manager.SetRecoveryWindow(addrmgrNs, recoveryWindow)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.rollbackToChain(chainClient, bestHeight); err != nil {
+		return err
+	}
+	if recoveryWindow > 0 {
+		return w.recover(chainClient, bestHeight, recoveryWindow)
+	}
+
+	for height := w.Manager.SyncedTo().Height + 1; height <= bestHeight; height++ {
+		hash, err := chainClient.GetBlockHash(int64(height))
+		if err != nil {
+			return err
+		}
+		block, err := chainClient.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		err = w.processBlock(block, &wtxmgr.BlockMeta{
+			Block: wtxmgr.Block{Hash: *hash, Height: height},
+			Time:  block.Header.Timestamp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollbackToChain rolls the wallet back to the most recent block it synced
+// through that is still part of the best chain of the backend.
+func (w *Wallet) rollbackToChain(chainClient chain.Interface,
+	bestHeight int32) error {
+
+	syncedTo := w.Manager.SyncedTo()
+	height := syncedTo.Height
+	if height > bestHeight {
+		height = bestHeight
+	}
+
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		for ; height > 0; height-- {
+			hash, err := w.Manager.BlockHash(addrmgrNs, height)
+			if waddrmgr.IsError(err, waddrmgr.ErrBlockNotFound) {
+				// Blocks below the first block the wallet
+				// synced through are trusted.
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			chainHash, err := chainClient.GetBlockHash(int64(height))
+			if err != nil {
+				return err
+			}
+			if *hash == *chainHash {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if height == syncedTo.Height {
+		return nil
+	}
+
+	bs, err := blockStamp(chainClient, height)
+	if err != nil {
+		return err
+	}
+	return w.rollback(bs)
+}
+
+// rollback removes the blocks above bs from the wallet, moving their
+// transactions back to the unconfirmed pool, and marks the wallet synced to
+// bs.
+func (w *Wallet) rollback(bs *waddrmgr.BlockStamp) error {
+	return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		if err := w.TxStore.Rollback(txmgrNs, bs.Height+1); err != nil {
+			return err
+		}
+		return w.Manager.SetSyncedTo(addrmgrNs, bs)
+	})
+}
+
+// connectBlock processes a block attached to the best chain. A block that
+// doesn't extend the block the wallet synced through, e.g. because earlier
+// notifications were missed, brings the wallet in sync with the backend
+// instead.
+func (w *Wallet) connectBlock(chainClient chain.Interface,
+	b wtxmgr.BlockMeta) error {
+
+	syncedTo := w.Manager.SyncedTo()
+	if b.Height <= syncedTo.Height {
+		var hash *chainhash.Hash
+		err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+			addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+			var err error
+			hash, err = w.Manager.BlockHash(addrmgrNs, b.Height)
+			return err
+		})
+		if err == nil && *hash == b.Hash {
+			return nil
+		}
+		return w.syncWithChain(chainClient)
+	}
+	if b.Height != syncedTo.Height+1 {
+		return w.syncWithChain(chainClient)
+	}
+
+	block, err := chainClient.GetBlock(&b.Hash)
+	if err != nil {
+		return err
+	}
+	if block.Header.PrevBlock != syncedTo.Hash {
+		return w.syncWithChain(chainClient)
+	}
+	return w.processBlock(block, &b)
+}
+
+// disconnectBlock rolls back a block reorganized out of the best chain, if
+// the wallet synced through it.
+func (w *Wallet) disconnectBlock(chainClient chain.Interface,
+	b wtxmgr.BlockMeta) error {
+
+	if b.Height > w.Manager.SyncedTo().Height || b.Height == 0 {
+		return nil
+	}
+
+	var hash, prevHash *chainhash.Hash
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		var err error
+		hash, err = w.Manager.BlockHash(addrmgrNs, b.Height)
+		if err != nil {
+			return err
+		}
+		prevHash, err = w.Manager.BlockHash(addrmgrNs, b.Height-1)
+		return err
+	})
+	switch {
+	case waddrmgr.IsError(err, waddrmgr.ErrBlockNotFound):
+		// The wallet can't roll back below the first block it synced
+		// through, so sync with the backend instead.
+		return w.syncWithChain(chainClient)
+	case err != nil:
+		return err
+	case *hash != b.Hash:
+		return nil
+	}
+
+	header, err := chainClient.GetBlockHeader(prevHash)
+	if err != nil {
+		return err
+	}
+	return w.rollback(&waddrmgr.BlockStamp{
+		Height:    b.Height - 1,
+		Hash:      *prevHash,
+		Timestamp: header.Timestamp,
+	})
+}
+
+// processBlock records the wallet transactions of a block attached to the
+// block the wallet synced through, and marks the wallet synced to it. A nil
+// block, known to hold no wallet transaction, only marks the wallet synced.
+func (w *Wallet) processBlock(block *wire.MsgBlock,
+	b *wtxmgr.BlockMeta) error {
+
+	return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		if block != nil {
+			if err := w.recordBlockTxs(dbTx, block, b); err != nil {
+				return err
+			}
+		}
+
+		return w.Manager.SetSyncedTo(addrmgrNs, &waddrmgr.BlockStamp{
+			Height:    b.Height,
+			Hash:      b.Hash,
+			Timestamp: b.Time,
+		})
+	})
+}
+
+// recordBlockTxs records the wallet transactions of a block.
+func (w *Wallet) recordBlockTxs(dbTx walletdb.ReadWriteTx,
+	block *wire.MsgBlock, b *wtxmgr.BlockMeta) error {
+
+	addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+	txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+	for _, tx := range block.Transactions {
+		relevant, err := w.isRelevantTx(txmgrNs, addrmgrNs, tx)
+		if err != nil {
+			return err
+		}
+		if !relevant {
+			continue
+		}
+
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+		if err != nil {
+			return err
+		}
+		if err := w.addRelevantTx(dbTx, rec, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRelevantTx returns whether a transaction spends a wallet output or pays
+// to a wallet address.
+func (w *Wallet) isRelevantTx(txmgrNs, addrmgrNs walletdb.ReadBucket,
+	tx *wire.MsgTx) (bool, error) {
+
+	for _, txIn := range tx.TxIn {
+		credit, err := w.TxStore.IsCredit(txmgrNs, txIn.PreviousOutPoint)
+		if err != nil {
+			return false, err
+		}
+		if credit {
+			return true, nil
+		}
+	}
+
+	for _, txOut := range tx.TxOut {
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+			txOut.PkScript, w.chainParams)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			_, err := w.Manager.Address(addrmgrNs, addr)
+			if err == nil {
+				return true, nil
+			}
+			if !waddrmgr.IsError(err, waddrmgr.ErrAddressNotFound) {
+				return false, err
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,276 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/chain/simchain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBlock returns a block extending prev with the given transactions. The
+// nonce distinguishes blocks of competing chains.
+func testBlock(prev *wire.MsgBlock, nonce uint32,
+	txs ...*wire.MsgTx) *wire.MsgBlock {
+
+	var (
+		prevHash chainhash.Hash
+		height   int64
+	)
+	if prev != nil {
+		prevHash = prev.BlockHash()
+		height = int64(prev.Header.Nonce>>16) + 1
+	}
+	return &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			PrevBlock: prevHash,
+			Timestamp: time.Unix(1700000000+height*600, 0),
+			Nonce:     uint32(height)<<16 | nonce,
+		},
+		Transactions: txs,
+	}
+}
+
+// blockMeta returns the metadata of a block at the given height.
+func blockMeta(block *wire.MsgBlock, height int32) wtxmgr.BlockMeta {
+	return wtxmgr.BlockMeta{
+		Block: wtxmgr.Block{Hash: block.BlockHash(), Height: height},
+		Time:  block.Header.Timestamp,
+	}
+}
+
+// txHeight returns the height of the block a wallet transaction is mined in,
+// or -1 if unmined.
+func txHeight(t *testing.T, w *Wallet, txHash chainhash.Hash) int32 {
+	t.Helper()
+
+	var height int32
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		details, err := w.TxStore.TxDetails(txmgrNs, &txHash)
+		if err != nil {
+			return err
+		}
+		if details == nil {
+			t.Fatalf("transaction %v not found", txHash)
+		}
+		height = details.Block.Height
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return height
+}
+
+// waitSyncedTo waits for the wallet to sync to a block.
+func waitSyncedTo(t *testing.T, w *Wallet, block *wire.MsgBlock,
+	height int32) {
+
+	t.Helper()
+
+	want := waddrmgr.BlockStamp{
+		Height:    height,
+		Hash:      block.BlockHash(),
+		Timestamp: block.Header.Timestamp,
+	}
+	deadline := time.After(5 * time.Second)
+	for w.Manager.SyncedTo() != want {
+		select {
+		case <-deadline:
+			t.Fatalf("wallet synced to %v, want %v",
+				w.Manager.SyncedTo(), want)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestSyncWithChain(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	var addr waddrmgr.ManagedAddress
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		scopedMgr, err := w.Manager.FetchScopedKeyManager(
+			waddrmgr.KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+		addrs, err := scopedMgr.NextExternalAddresses(
+			addrmgrNs, waddrmgr.DefaultAccountNum, 1)
+		if err != nil {
+			return err
+		}
+		addr = addrs[0]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := wire.NewMsgTx(wire.TxVersion)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x02}}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(50000, pkScript))
+	paymentHash := payment.TxHash()
+
+	unrelated := wire.NewMsgTx(wire.TxVersion)
+	unrelated.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x03}}, nil, nil))
+	unrelated.AddTxOut(wire.NewTxOut(50000, []byte{0x51}))
+
+	genesis := testBlock(nil, 0)
+	chainClient := &mockChainClient{
+		blocks: []*wire.MsgBlock{genesis},
+		ntfns:  make(chan interface{}, 1),
+	}
+
+	// A wallet that never synced starts at the tip.
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, genesis, 0)
+
+	// Catching up records the wallet transactions of the new blocks.
+	b1 := testBlock(genesis, 0, unrelated, payment)
+	b2 := testBlock(b1, 0)
+	chainClient.setBlocks([]*wire.MsgBlock{genesis, b1, b2})
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b2, 2)
+	assert.Equal(t, int32(1), txHeight(t, w, paymentHash))
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		assert.True(t, addr.Used(addrmgrNs))
+		unrelatedHash := unrelated.TxHash()
+		details, err := w.TxStore.TxDetails(txmgrNs, &unrelatedHash)
+		if err != nil {
+			return err
+		}
+		assert.Nil(t, details)
+		details, err = w.TxStore.TxDetails(txmgrNs, &paymentHash)
+		assert.Len(t, details.Credits, 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reorg the wallet missed is rolled back when catching up.
+	b1r := testBlock(genesis, 1)
+	b2r := testBlock(b1r, 1)
+	b3r := testBlock(b2r, 1)
+	chainClient.setBlocks([]*wire.MsgBlock{genesis, b1r, b2r, b3r})
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to sync: %v", err)
+	}
+	waitSyncedTo(t, w, b3r, 3)
+	assert.Equal(t, int32(-1), txHeight(t, w, paymentHash))
+
+	// Block notifications are processed once the wallet synchronizes
+	// with the backend.
+	w.SynchronizeRPC(chainClient)
+
+	b4r := testBlock(b3r, 1, payment)
+	chainClient.setBlocks([]*wire.MsgBlock{genesis, b1r, b2r, b3r, b4r})
+	chainClient.ntfns <- chain.BlockConnected(blockMeta(b4r, 4))
+	waitSyncedTo(t, w, b4r, 4)
+	assert.Equal(t, int32(4), txHeight(t, w, paymentHash))
+
+	chainClient.setBlocks([]*wire.MsgBlock{genesis, b1r, b2r, b3r})
+	chainClient.ntfns <- chain.BlockDisconnected(blockMeta(b4r, 4))
+	waitSyncedTo(t, w, b3r, 3)
+	assert.Equal(t, int32(-1), txHeight(t, w, paymentHash))
+
+	// A block connected after a missed one catches up with the backend.
+	b4 := testBlock(b3r, 2)
+	b5 := testBlock(b4, 2, payment)
+	chainClient.setBlocks([]*wire.MsgBlock{genesis, b1r, b2r, b3r, b4, b5})
+	chainClient.ntfns <- chain.BlockConnected(blockMeta(b5, 5))
+	waitSyncedTo(t, w, b5, 5)
+	assert.Equal(t, int32(5), txHeight(t, w, paymentHash))
+}
+
+func TestSyncWithSimChain(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	var addr waddrmgr.ManagedAddress
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		scopedMgr, err := w.Manager.FetchScopedKeyManager(
+			waddrmgr.KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+		addrs, err := scopedMgr.NextExternalAddresses(
+			addrmgrNs, waddrmgr.DefaultAccountNum, 1)
+		if err != nil {
+			return err
+		}
+		addr = addrs[0]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := simchain.New(&chaincfg.RegressionNetParams)
+	genesis, _ := sim.Tip()
+	client := sim.NewClient()
+	client.SetNotificationDelay(time.Millisecond)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		client.Stop()
+		client.WaitForShutdown()
+	}()
+	w.SynchronizeRPC(client)
+	waitSyncedTo(t, w, genesis, 0)
+
+	// A payment is recorded unmined once broadcast, then mined.
+	payment := wire.NewMsgTx(wire.TxVersion)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x01}}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(50000, pkScript))
+	paymentHash := payment.TxHash()
+	if _, err := client.SendRawTransaction(payment, false); err != nil {
+		t.Fatal(err)
+	}
+	b1 := sim.Mine()
+	waitSyncedTo(t, w, b1, 1)
+	assert.Equal(t, int32(1), txHeight(t, w, paymentHash))
+
+	// A reorg returns the payment to the mempool until it is mined in
+	// the new chain.
+	reorged, err := sim.Reorg(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSyncedTo(t, w, reorged[1], 2)
+	assert.Equal(t, int32(-1), txHeight(t, w, paymentHash))
+
+	b3 := sim.Mine()
+	waitSyncedTo(t, w, b3, 3)
+	assert.Equal(t, int32(3), txHeight(t, w, paymentHash))
+}
@@ -0,0 +1,185 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/wallet/txauthor"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// CPFP bumps the fee of an unconfirmed transaction by spending one of its
+// wallet outputs in a child paying enough fee for the parent and child
+// together to reach targetPackageFeeRate, in sat/kvB. It works for incoming
+// transactions and transactions that don't signal replaceability, which
+// BumpFee can't replace.
+//
+// The fee of the parent is determined from the outputs it spends, which are
+// fetched from the chain backend when the transaction store doesn't hold
+// them, as for incoming transactions. The child pays back to a change
+// address of the account of the output, adding confirmed coins of the
+// account when the output alone can't pay for the fee.
+func (w *Wallet) CPFP(outpoint wire.OutPoint,
+	targetPackageFeeRate btcutil.Amount) (*wire.MsgTx, error) {
+
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var parent *wtxmgr.TxDetails
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		var err error
+		parent, err = w.TxStore.TxDetails(txmgrNs, &outpoint.Hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return nil, fmt.Errorf("transaction %v not found", outpoint.Hash)
+	}
+	if parent.Block.Height != -1 {
+		return nil, fmt.Errorf("transaction %v is already mined",
+			outpoint.Hash)
+	}
+
+	parentFee, err := w.txFee(chainClient, &parent.MsgTx)
+	if err != nil {
+		return nil, err
+	}
+	parentVSize := txVSize(&parent.MsgTx)
+	packageFee := txauthor.FeeForWeight(targetPackageFeeRate,
+		parentVSize*blockchain.WitnessScaleFactor) - parentFee
+	if packageFee <= 0 {
+		return nil, fmt.Errorf("transaction %v already pays %d sat/kvB",
+			outpoint.Hash, parentFee*1000/btcutil.Amount(parentVSize))
+	}
+
+	req := createTxRequest{
+		inputs:      []wire.OutPoint{outpoint},
+		minconf:     1,
+		feeSatPerKB: targetPackageFeeRate,
+		packageFee:  packageFee,
+	}
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		coin, spent, err := w.walletCoin(txmgrNs, addrmgrNs, outpoint)
+		if err != nil {
+			return err
+		}
+		if spent {
+			return fmt.Errorf("output %v is already spent", outpoint)
+		}
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+			coin.PkScript, w.chainParams)
+		if err != nil || len(addrs) != 1 {
+			return fmt.Errorf("unsupported script for output %v",
+				outpoint)
+		}
+		scopedMgr, account, err := w.Manager.AddrAccount(
+			addrmgrNs, addrs[0])
+		if err != nil {
+			return err
+		}
+		scope := scopedMgr.Scope()
+		req.keyScope = &scope
+		req.account = account
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := w.createTx(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, txIn := range tx.Tx.TxIn {
+			w.UnlockOutpoint(txIn.PreviousOutPoint)
+		}
+	}()
+
+	if err := w.publishTransaction(chainClient, tx.Tx, ""); err != nil {
+		return nil, err
+	}
+	return tx.Tx, nil
+}
+
+// txFee returns the fee of a transaction. The outputs it spends are looked
+// up in the transaction store, and those it doesn't hold are fetched from
+// the chain backend, which must serve transactions.
+func (w *Wallet) txFee(chainClient chain.Interface,
+	tx *wire.MsgTx) (btcutil.Amount, error) {
+
+	var (
+		fee     btcutil.Amount
+		missing []wire.OutPoint
+	)
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		for _, txIn := range tx.TxIn {
+			op := txIn.PreviousOutPoint
+			prev, err := w.TxStore.TxDetails(txmgrNs, &op.Hash)
+			if err != nil {
+				return err
+			}
+			if prev == nil {
+				missing = append(missing, op)
+				continue
+			}
+			if int(op.Index) >= len(prev.MsgTx.TxOut) {
+				return fmt.Errorf("spent output %v of %v does "+
+					"not exist", op, tx.TxHash())
+			}
+			fee += btcutil.Amount(prev.MsgTx.TxOut[op.Index].Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(missing) > 0 {
+		txSource, ok := chainClient.(chain.TxSource)
+		if !ok {
+			return 0, fmt.Errorf("unable to determine the fee of "+
+				"%v: spent output %v is not recorded and the "+
+				"backend doesn't serve transactions",
+				tx.TxHash(), missing[0])
+		}
+		for _, op := range missing {
+			prev, err := txSource.GetRawTransaction(&op.Hash)
+			if err != nil {
+				return 0, fmt.Errorf("unable to fetch spent "+
+					"output %v of %v: %w", op, tx.TxHash(),
+					err)
+			}
+			prevTx := prev.MsgTx()
+			if prevTx.TxHash() != op.Hash ||
+				int(op.Index) >= len(prevTx.TxOut) {
+
+				return 0, fmt.Errorf("backend returned an "+
+					"invalid transaction for spent output "+
+					"%v of %v", op, tx.TxHash())
+			}
+			fee += btcutil.Amount(prevTx.TxOut[op.Index].Value)
+		}
+	}
+
+	for _, txOut := range tx.TxOut {
+		fee -= btcutil.Amount(txOut.Value)
+	}
+	return fee, nil
+}
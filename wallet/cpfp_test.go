@@ -0,0 +1,119 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPFP(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	addTestCredits(t, w, 100000, 200000)
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	chainClient := &mockChainClient{}
+	w.chainClient = chainClient
+
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	parent, err := w.SendOutputs(
+		[]*wire.TxOut{wire.NewTxOut(150000, pkScript)}, nil,
+		waddrmgr.DefaultAccountNum, 1, 1000, CoinSelectionLargest, "")
+	if err != nil {
+		t.Fatalf("unable to send outputs: %v", err)
+	}
+	parentHash := parent.TxHash()
+	parentFee := txFee(t, w, parentHash)
+
+	change := wire.OutPoint{Hash: parentHash}
+	if parent.TxOut[0].Value == 150000 {
+		change.Index = 1
+	}
+
+	// The parent already pays the target.
+	_, err = w.CPFP(change, 1000)
+	assert.Error(t, err)
+
+	// The child spends the change of the parent, and together they pay
+	// the target rate.
+	child, err := w.CPFP(change, 20000)
+	if err != nil {
+		t.Fatalf("unable to create child: %v", err)
+	}
+	assert.Equal(t, change, child.TxIn[0].PreviousOutPoint)
+	assert.Len(t, child.TxOut, 1)
+	assert.Equal(t, child, chainClient.published[1])
+
+	packageFee := parentFee + txFee(t, w, child.TxHash())
+	packageVSize := txVSize(parent) + txVSize(child)
+	rate := int64(packageFee) * 1000 / packageVSize
+	if rate < 20000 || rate > 21000 {
+		t.Fatalf("package fee rate %d sat/kvB not within 1 sat/vB of "+
+			"20000", rate)
+	}
+	assert.Empty(t, w.LockedOutpoints())
+
+	// The fee of an incoming transaction is determined from the outputs
+	// it spends, which only the backend holds.
+	funding := wire.NewMsgTx(wire.TxVersion)
+	funding.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x05}}, nil, nil))
+	funding.AddTxOut(wire.NewTxOut(int64(btcutil.SatoshiPerBitcoin)+200,
+		pkScript))
+	var incoming *wire.MsgTx
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		addr := nextPubKey(t, addrmgrNs, w, waddrmgr.KeyScopeBIP0084)
+		pkScript, err := txscript.PayToAddrScript(addr.Address())
+		if err != nil {
+			return err
+		}
+		incoming = wire.NewMsgTx(wire.TxVersion)
+		incoming.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: funding.TxHash()}, nil, nil))
+		incoming.AddTxOut(wire.NewTxOut(
+			int64(btcutil.SatoshiPerBitcoin), pkScript))
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(incoming, time.Now())
+		if err != nil {
+			return err
+		}
+		return w.addRelevantTx(dbTx, rec, nil)
+	})
+	if err != nil {
+		t.Fatalf("unable to add incoming tx: %v", err)
+	}
+	incomingOut := wire.OutPoint{Hash: incoming.TxHash()}
+
+	// The fee can't be determined until the backend serves the output.
+	_, err = w.CPFP(incomingOut, 20000)
+	assert.ErrorContains(t, err, "unable to fetch spent output")
+
+	chainClient.txs = map[chainhash.Hash]*wire.MsgTx{
+		funding.TxHash(): funding,
+	}
+	child, err = w.CPFP(incomingOut, 20000)
+	if err != nil {
+		t.Fatalf("unable to create child of incoming tx: %v", err)
+	}
+	assert.Equal(t, incomingOut, child.TxIn[0].PreviousOutPoint)
+
+	packageFee = 200 + txFee(t, w, child.TxHash())
+	packageVSize = txVSize(incoming) + txVSize(child)
+	rate = int64(packageFee) * 1000 / packageVSize
+	if rate < 20000 || rate > 21000 {
+		t.Fatalf("package fee rate %d sat/kvB not within 1 sat/vB of "+
+			"20000", rate)
+	}
+}
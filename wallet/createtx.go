@@ -0,0 +1,642 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txauthor"
+	"github.com/czh0526/btc-wallet/wallet/txsizes"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// CoinSelectionStrategy selects the algorithm used to pick the inputs of a
+// new transaction.
+type CoinSelectionStrategy int
+
+const (
+	// CoinSelectionLargest always picks the largest available coins
+	// first.
+	CoinSelectionLargest CoinSelectionStrategy = iota
+
+	// CoinSelectionRandomImprove picks coins at random, then improves the
+	// selection so that change is close to the payment amount, keeping
+	// the least wasteful of several attempts.
+	CoinSelectionRandomImprove
+
+	// CoinSelectionBnB searches for a changeless selection with
+	// Branch-and-Bound, falling back to random-improve when none exists.
+	CoinSelectionBnB
+)
+
+// String returns the name of the strategy.
+func (s CoinSelectionStrategy) String() string {
+	switch s {
+	case CoinSelectionLargest:
+		return "largest"
+	case CoinSelectionRandomImprove:
+		return "random-improve"
+	case CoinSelectionBnB:
+		return "bnb"
+	}
+	return fmt.Sprintf("CoinSelectionStrategy(%d)", int(s))
+}
+
+func (s CoinSelectionStrategy) selector() (txauthor.CoinSelector, error) {
+	switch s {
+	case CoinSelectionLargest:
+		return txauthor.LargestFirst{}, nil
+	case CoinSelectionRandomImprove:
+		return txauthor.RandomImprove{}, nil
+	case CoinSelectionBnB:
+		return txauthor.BranchAndBound{
+			Fallback: txauthor.RandomImprove{},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown coin selection strategy %v", s)
+}
+
+type (
+	createTxRequest struct {
+		keyScope    *waddrmgr.KeyScope
+		account     uint32
+		outputs     []*wire.TxOut
+		minconf     int32
+		feeSatPerKB btcutil.Amount
+		strategy    CoinSelectionStrategy
+		dryRun      bool
+
+		// inputs, if set, are the only coins spent by the
+		// transaction instead of those picked by the strategy.
+		inputs []wire.OutPoint
+
+		// lease, if set, leases the inputs in the transaction store
+		// instead of locking them in memory, and leaves the
+		// transaction unsigned.
+		lease *outputLease
+
+		// replaces, if set, is the unmined transaction the new one
+		// replaces under BIP-125. Its inputs, which must be passed as
+		// inputs, are spent along with coins of the account added
+		// only when they can't pay for the fee.
+		replaces *replacedTx
+
+		// packageFee, if set, is paid on top of the fee of the
+		// transaction, for the unconfirmed parent of its inputs. Coins
+		// of the account are added to the inputs only when they can't
+		// pay for it.
+		packageFee btcutil.Amount
+
+		resp chan createTxResponse
+	}
+
+	// outputLease identifies the lease taken on the inputs of a funded
+	// transaction.
+	outputLease struct {
+		id       wtxmgr.LockID
+		duration time.Duration
+	}
+	createTxResponse struct {
+		tx  *txauthor.AuthoredTx
+		err error
+	}
+)
+
+// CreateSimpleTx creates a new signed transaction spending unspent outputs
+// with at least minconf confirmations from the given account to the passed
+// outputs. If keyScope is nil, coins of every scope are eligible and change
+// goes to the BIP0084 scope.
+//
+// Requests are serialized through the wallet's txCreator goroutine, and the
+// inputs of a non dry-run transaction are locked until released with
+// UnlockOutpoint, so concurrent callers never select the same coins. A dry
+// run neither derives a change address nor locks any outputs.
+func (w *Wallet) CreateSimpleTx(keyScope *waddrmgr.KeyScope, account uint32,
+	outputs []*wire.TxOut, minconf int32, satPerKb btcutil.Amount,
+	strategy CoinSelectionStrategy, dryRun bool) (*txauthor.AuthoredTx, error) {
+
+	return w.createTx(createTxRequest{
+		keyScope:    keyScope,
+		account:     account,
+		outputs:     outputs,
+		minconf:     minconf,
+		feeSatPerKB: satPerKb,
+		strategy:    strategy,
+		dryRun:      dryRun,
+	})
+}
+
+// createTx sends a request to the txCreator goroutine and waits for the
+// response.
+func (w *Wallet) createTx(req createTxRequest) (*txauthor.AuthoredTx, error) {
+	req.resp = make(chan createTxResponse)
+
+	select {
+	case w.createTxRequests <- req:
+	case <-w.quitChan():
+		return nil, ErrWalletShuttingDown
+	}
+
+	resp := <-req.resp
+	return resp.tx, resp.err
+}
+
+// txToOutputs creates a transaction paying to the given outputs. It is
+// signed unless the request is a dry run or leases its inputs. It must only
+// be called from the txCreator goroutine.
+func (w *Wallet) txToOutputs(req *createTxRequest) (*txauthor.AuthoredTx, error) {
+	var selector txauthor.CoinSelector = txauthor.SpendAll{}
+	if len(req.inputs) == 0 {
+		var err error
+		selector, err = req.strategy.selector()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changeScope := waddrmgr.KeyScopeBIP0084
+	if req.keyScope != nil {
+		changeScope = *req.keyScope
+	}
+	changeMgr, err := w.Manager.FetchScopedKeyManager(changeScope)
+	if err != nil {
+		return nil, err
+	}
+	changeType := changeMgr.AddrSchema().InternalAddrType
+	changeScriptSize, err := changeScriptSize(changeType)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *txauthor.AuthoredTx
+	err = walletdb.Update(w.db, func(dbtx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbtx.ReadWriteBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbtx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		var coins []txauthor.Coin
+		switch {
+		case req.replaces != nil:
+			coins, err = w.replacedCoins(
+				txmgrNs, addrmgrNs, req.replaces, req.inputs)
+		case len(req.inputs) > 0:
+			coins, err = w.lookupCoins(txmgrNs, addrmgrNs, req.inputs)
+		default:
+			coins, err = w.findEligibleOutputs(
+				txmgrNs, addrmgrNs, req.keyScope, req.account,
+				req.minconf)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Replacements and CPFP children spend their inputs along
+		// with other coins of the account if needed.
+		if req.replaces != nil || req.packageFee > 0 {
+			selector = txauthor.SpendRequired{
+				Required: coins,
+				ExtraFee: req.packageFee,
+			}
+			coins, err = w.findEligibleOutputs(
+				txmgrNs, addrmgrNs, req.keyScope, req.account,
+				req.minconf)
+			if err != nil {
+				return err
+			}
+		}
+
+		changeSource := &txauthor.ChangeSource{
+			ScriptSize: changeScriptSize,
+			AddrType:   changeType,
+			NewScript: func() ([]byte, error) {
+				if req.dryRun {
+					return make([]byte, changeScriptSize), nil
+				}
+				if req.replaces != nil &&
+					req.replaces.changeScript != nil {
+
+					return req.replaces.changeScript, nil
+				}
+				addrs, err := changeMgr.NextInternalAddresses(
+					addrmgrNs, req.account, 1)
+				if err != nil {
+					return nil, err
+				}
+				return txscript.PayToAddrScript(addrs[0].Address())
+			},
+		}
+
+		tx, err = txauthor.NewUnsignedTransaction(
+			req.outputs, req.feeSatPerKB, coins, selector, changeSource)
+		if err != nil || req.dryRun {
+			return err
+		}
+
+		if req.lease != nil {
+			for _, txIn := range tx.Tx.TxIn {
+				_, err := w.TxStore.LockOutput(
+					txmgrNs, req.lease.id,
+					txIn.PreviousOutPoint, req.lease.duration)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		err = tx.AddAllInputScripts(
+			secretSource{w.Manager, addrmgrNs})
+		if err != nil {
+			return err
+		}
+		err = validateMsgTx(tx.Tx, tx.PrevScripts, tx.PrevInputValues)
+		if err != nil || req.replaces == nil {
+			return err
+		}
+		return req.replaces.checkFee(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.dryRun && req.lease == nil {
+		for _, txIn := range tx.Tx.TxIn {
+			w.LockOutpoint(txIn.PreviousOutPoint)
+		}
+	}
+	return tx, nil
+}
+
+// lookupCoins returns the coins for outpoints chosen by the caller. Each must
+// be an unspent output of the wallet that is neither locked nor leased.
+func (w *Wallet) lookupCoins(txmgrNs walletdb.ReadBucket,
+	addrmgrNs walletdb.ReadBucket, outpoints []wire.OutPoint) (
+	[]txauthor.Coin, error) {
+
+	leases, err := w.TxStore.ListLockedOutputs(txmgrNs)
+	if err != nil {
+		return nil, err
+	}
+	leased := make(map[wire.OutPoint]struct{}, len(leases))
+	for _, lease := range leases {
+		leased[lease.Outpoint] = struct{}{}
+	}
+
+	coins := make([]txauthor.Coin, 0, len(outpoints))
+	for _, op := range outpoints {
+		if _, ok := leased[op]; ok || w.LockedOutpoint(op) {
+			return nil, fmt.Errorf("output %v is locked", op)
+		}
+
+		coin, spent, err := w.walletCoin(txmgrNs, addrmgrNs, op)
+		if err != nil {
+			return nil, err
+		}
+		if spent {
+			return nil, fmt.Errorf("output %v is not an unspent "+
+				"wallet output", op)
+		}
+		coins = append(coins, *coin)
+	}
+
+	return coins, nil
+}
+
+// walletCoin returns the coin of a wallet output, and whether it is spent by
+// a known transaction.
+func (w *Wallet) walletCoin(txmgrNs walletdb.ReadBucket,
+	addrmgrNs walletdb.ReadBucket, op wire.OutPoint) (*txauthor.Coin,
+	bool, error) {
+
+	details, err := w.TxStore.TxDetails(txmgrNs, &op.Hash)
+	if err != nil {
+		return nil, false, err
+	}
+	var credit *wtxmgr.CreditRecord
+	if details != nil {
+		for i := range details.Credits {
+			if details.Credits[i].Index == op.Index {
+				credit = &details.Credits[i]
+				break
+			}
+		}
+	}
+	if credit == nil {
+		return nil, false, fmt.Errorf("output %v is not a wallet "+
+			"output", op)
+	}
+
+	txOut := details.MsgTx.TxOut[op.Index]
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		txOut.PkScript, w.chainParams)
+	if err != nil || len(addrs) != 1 {
+		return nil, false, fmt.Errorf("unsupported script for "+
+			"output %v", op)
+	}
+	addr, err := w.Manager.Address(addrmgrNs, addrs[0])
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &txauthor.Coin{
+		OutPoint: op,
+		TxOut:    *txOut,
+		AddrType: addr.AddrType(),
+	}, credit.Spent, nil
+}
+
+// secretSource looks up the private keys and scripts of wallet addresses for
+// signing.
+type secretSource struct {
+	*waddrmgr.Manager
+	addrmgrNs walletdb.ReadBucket
+}
+
+// GetKey implements the txscript.KeyDB interface.
+func (s secretSource) GetKey(addr btcutil.Address) (*btcec.PrivateKey, bool,
+	error) {
+
+	ma, err := s.Address(s.addrmgrNs, addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mpka, ok := ma.(waddrmgr.ManagedPubKeyAddress)
+	if !ok {
+		e := fmt.Errorf("managed address type for %v is `%T` but "+
+			"want waddrmgr.ManagedPubKeyAddress", addr, ma)
+		return nil, false, e
+	}
+	privKey, err := s.privKey(mpka)
+	if err != nil {
+		return nil, false, err
+	}
+	return privKey, ma.Compressed(), nil
+}
+
+// privKey returns the private key of the address. Keys derived from an
+// account are served from the private key cache of their scoped manager,
+// sparing a derivation for every input signed with the same key.
+func (s secretSource) privKey(
+	mpka waddrmgr.ManagedPubKeyAddress) (*btcec.PrivateKey, error) {
+
+	scope, path, ok := mpka.DerivationInfo()
+	if !ok {
+		return mpka.PrivKey()
+	}
+	scopedMgr, err := s.FetchScopedKeyManager(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey, err := scopedMgr.DeriveFromKeyPathCache(path)
+	if waddrmgr.IsError(err, waddrmgr.ErrAccountNotFound) {
+		return mpka.PrivKey()
+	}
+	return privKey, err
+}
+
+// GetScript implements the txscript.ScriptDB interface.
+func (s secretSource) GetScript(addr btcutil.Address) ([]byte, error) {
+	ma, err := s.Address(s.addrmgrNs, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	msa, ok := ma.(waddrmgr.ManagedScriptAddress)
+	if !ok {
+		e := fmt.Errorf("managed address type for %v is `%T` but "+
+			"want waddrmgr.ManagedScriptAddress", addr, ma)
+		return nil, e
+	}
+	return msa.Script()
+}
+
+// validateMsgTx verifies transaction input scripts for tx. All previous
+// output scripts from outputs redeemed by the transaction, in the same order
+// they are spent, must be passed in the prevScripts slice.
+func validateMsgTx(tx *wire.MsgTx, prevScripts [][]byte,
+	inputValues []btcutil.Amount) error {
+
+	inputFetcher, err := txauthor.TXPrevOutFetcher(
+		tx, prevScripts, inputValues)
+	if err != nil {
+		return err
+	}
+
+	hashCache := txscript.NewTxSigHashes(tx, inputFetcher)
+	for i, prevScript := range prevScripts {
+		vm, err := txscript.NewEngine(
+			prevScript, tx, i, txscript.StandardVerifyFlags, nil,
+			hashCache, int64(inputValues[i]), inputFetcher)
+		if err != nil {
+			return fmt.Errorf("cannot create script engine: %w", err)
+		}
+		err = vm.Execute()
+		if err != nil {
+			return fmt.Errorf("cannot validate transaction: %w", err)
+		}
+	}
+	return nil
+}
+
+// changeScriptSize returns the size of an output script paying to an address
+// of the given type.
+func changeScriptSize(addrType waddrmgr.AddressType) (int, error) {
+	switch addrType {
+	case waddrmgr.PubKeyHash:
+		return txsizes.P2PKHPkScriptSize, nil
+	case waddrmgr.NestedWitnessPubKey:
+		return txsizes.P2SHPkScriptSize, nil
+	case waddrmgr.WitnessPubKey:
+		return txsizes.P2WPKHPkScriptSize, nil
+	case waddrmgr.TaprootPubKey:
+		return txsizes.P2TRPkScriptSize, nil
+	}
+	return 0, fmt.Errorf("unsupported change address type %v", addrType)
+}
+
+// findEligibleOutputs returns the unspent outputs of the given account that
+// have at least minconf confirmations and are not locked.
+func (w *Wallet) findEligibleOutputs(txmgrNs walletdb.ReadBucket,
+	addrmgrNs walletdb.ReadBucket, keyScope *waddrmgr.KeyScope,
+	account uint32, minconf int32) ([]txauthor.Coin, error) {
+
+	unspent, err := w.TxStore.UnspentOutputs(txmgrNs)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := w.Manager.SyncedTo()
+	eligible := make([]txauthor.Coin, 0, len(unspent))
+	for i := range unspent {
+		output := &unspent[i]
+
+		// Only include this output if it meets the required number of
+		// confirmations. Coinbase transactions must have reached
+		// maturity before their outputs may be spent.
+		if !confirmed(minconf, output.Height, bs.Height) {
+			continue
+		}
+		if output.FromCoinBase {
+			maturity := int32(w.chainParams.CoinbaseMaturity)
+			if !confirmed(maturity, output.Height, bs.Height) {
+				continue
+			}
+		}
+
+		// Locked unspent outputs are skipped.
+		if w.LockedOutpoint(output.OutPoint) {
+			continue
+		}
+
+		// Only include the output if it is associated with the passed
+		// account.
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+			output.PkScript, w.chainParams)
+		if err != nil || len(addrs) != 1 {
+			continue
+		}
+		scopedMgr, addrAcct, err := w.Manager.AddrAccount(addrmgrNs, addrs[0])
+		if err != nil {
+			continue
+		}
+		if keyScope != nil && scopedMgr.Scope() != *keyScope {
+			continue
+		}
+		if addrAcct != account {
+			continue
+		}
+		addr, err := scopedMgr.Address(addrmgrNs, addrs[0])
+		if err != nil {
+			continue
+		}
+
+		eligible = append(eligible, txauthor.Coin{
+			OutPoint: output.OutPoint,
+			TxOut: wire.TxOut{
+				Value:    int64(output.Amount),
+				PkScript: output.PkScript,
+			},
+			AddrType: addr.AddrType(),
+		})
+	}
+
+	return eligible, nil
+}
+
+// confirmed checks whether a transaction at height txHeight has met minconf
+// confirmations for a blockchain at height curHeight.
+func confirmed(minconf, txHeight, curHeight int32) bool {
+	return confirms(txHeight, curHeight) >= minconf
+}
+
+// confirms returns the number of confirmations for a transaction in a block
+// at height txHeight (or -1 for an unconfirmed tx) given the chain height
+// curHeight.
+func confirms(txHeight, curHeight int32) int32 {
+	switch {
+	case txHeight == -1, txHeight > curHeight:
+		return 0
+	default:
+		return curHeight - txHeight + 1
+	}
+}
+
+// LockOutpoint marks an outpoint as locked, that is, it should not be used
+// as an input for newly created transactions.
+func (w *Wallet) LockOutpoint(op wire.OutPoint) {
+	w.lockedOutpointsMtx.Lock()
+	defer w.lockedOutpointsMtx.Unlock()
+
+	w.lockedOutpoints[op] = struct{}{}
+}
+
+// UnlockOutpoint marks an outpoint as unlocked, that is, it may be used as an
+// input for newly created transactions.
+func (w *Wallet) UnlockOutpoint(op wire.OutPoint) {
+	w.lockedOutpointsMtx.Lock()
+	defer w.lockedOutpointsMtx.Unlock()
+
+	delete(w.lockedOutpoints, op)
+}
+
+// LockedOutpoint returns whether an outpoint has been marked as locked and
+// should not be used as an input for created transactions.
+func (w *Wallet) LockedOutpoint(op wire.OutPoint) bool {
+	w.lockedOutpointsMtx.Lock()
+	defer w.lockedOutpointsMtx.Unlock()
+
+	_, locked := w.lockedOutpoints[op]
+	return locked
+}
+
+// ResetLockedOutpoints resets the set of locked outpoints so all may be used
+// as inputs for new transactions.
+func (w *Wallet) ResetLockedOutpoints() {
+	w.lockedOutpointsMtx.Lock()
+	defer w.lockedOutpointsMtx.Unlock()
+
+	w.lockedOutpoints = make(map[wire.OutPoint]struct{})
+}
+
+// LockedOutpoints returns the currently locked outpoints.
+func (w *Wallet) LockedOutpoints() []wire.OutPoint {
+	w.lockedOutpointsMtx.Lock()
+	defer w.lockedOutpointsMtx.Unlock()
+
+	locked := make([]wire.OutPoint, 0, len(w.lockedOutpoints))
+	for op := range w.lockedOutpoints {
+		locked = append(locked, op)
+	}
+	return locked
+}
+
+// LeaseOutput locks an output to the given ID in the transaction store,
+// preventing it from being selected for new transactions until the lease
+// expires or is released. The lease of an output already leased to the same
+// ID is extended. The expiry of the lease is returned.
+func (w *Wallet) LeaseOutput(id wtxmgr.LockID, op wire.OutPoint,
+	duration time.Duration) (time.Time, error) {
+
+	var expiry time.Time
+	err := walletdb.Update(w.db, func(tx walletdb.ReadWriteTx) error {
+		txmgrNs := tx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		var err error
+		expiry, err = w.TxStore.LockOutput(txmgrNs, id, op, duration)
+		return err
+	})
+	return expiry, err
+}
+
+// ReleaseOutput releases the lease of an output. The ID must match the one
+// the output was leased to.
+func (w *Wallet) ReleaseOutput(id wtxmgr.LockID, op wire.OutPoint) error {
+	return walletdb.Update(w.db, func(tx walletdb.ReadWriteTx) error {
+		txmgrNs := tx.ReadWriteBucket(wtxmgrNamespaceKey)
+		return w.TxStore.UnlockOutput(txmgrNs, id, op)
+	})
+}
+
+// ListLeasedOutputs returns the outputs whose lease hasn't expired.
+func (w *Wallet) ListLeasedOutputs() ([]*wtxmgr.LockedOutput, error) {
+	var outputs []*wtxmgr.LockedOutput
+	err := walletdb.View(w.db, func(tx walletdb.ReadTx) error {
+		txmgrNs := tx.ReadBucket(wtxmgrNamespaceKey)
+
+		var err error
+		outputs, err = w.TxStore.ListLockedOutputs(txmgrNs)
+		return err
+	})
+	return outputs, err
+}
+
+// ErrWalletShuttingDown is returned for requests made while the wallet is
+// stopping.
+var ErrWalletShuttingDown = errors.New("wallet shutting down")
@@ -0,0 +1,144 @@
+package wallet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// addTestCredits credits the wallet with one confirmed output of each value,
+// paying to fresh BIP0084 addresses of the default account.
+func addTestCredits(t *testing.T, w *Wallet, values ...int64) {
+	t.Helper()
+
+	err := walletdb.Update(w.db, func(tx walletdb.ReadWriteTx) error {
+		addrmgrNs := tx.ReadWriteBucket(waddrmgrNamespaceKey)
+		txmgrNs := tx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		scopedMgr, err := w.Manager.FetchScopedKeyManager(
+			waddrmgr.KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+		addrs, err := scopedMgr.NextExternalAddresses(
+			addrmgrNs, waddrmgr.DefaultAccountNum, uint32(len(values)))
+		if err != nil {
+			return err
+		}
+
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		msgTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: chainhash.Hash{0x01}}, nil, nil))
+		for i, v := range values {
+			pkScript, err := txscript.PayToAddrScript(
+				addrs[i].Address())
+			if err != nil {
+				return err
+			}
+			msgTx.AddTxOut(wire.NewTxOut(v, pkScript))
+		}
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(msgTx, time.Now())
+		if err != nil {
+			return err
+		}
+		block := &wtxmgr.BlockMeta{Block: wtxmgr.Block{Height: 100}}
+		for i := range values {
+			err := w.TxStore.AddCredit(
+				txmgrNs, rec, block, uint32(i), false)
+			if err != nil {
+				return err
+			}
+		}
+
+		return w.Manager.SetSyncedTo(addrmgrNs, &waddrmgr.BlockStamp{
+			Height: 105,
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to add credits: %v", err)
+	}
+}
+
+func TestCreateSimpleTxSerializesSelection(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	addTestCredits(t, w, 100000, 100000, 100000, 100000)
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	outputs := []*wire.TxOut{wire.NewTxOut(150000, pkScript)}
+
+	// Each request needs two of the four coins, so concurrent requests
+	// only both succeed if they never pick the same coins.
+	var (
+		wg  sync.WaitGroup
+		txs [2]*wire.MsgTx
+		err [2]error
+	)
+	for i := range txs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx, e := w.CreateSimpleTx(nil, waddrmgr.DefaultAccountNum,
+				outputs, 1, 1000, CoinSelectionLargest, false)
+			err[i] = e
+			if e == nil {
+				txs[i] = tx.Tx
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[wire.OutPoint]bool)
+	for i := range txs {
+		if err[i] != nil {
+			t.Fatalf("unable to create tx: %v", err[i])
+		}
+		for _, txIn := range txs[i].TxIn {
+			if seen[txIn.PreviousOutPoint] {
+				t.Fatalf("outpoint %v selected twice",
+					txIn.PreviousOutPoint)
+			}
+			seen[txIn.PreviousOutPoint] = true
+		}
+	}
+	if len(w.LockedOutpoints()) != 4 {
+		t.Fatalf("expected 4 locked outpoints, got %d",
+			len(w.LockedOutpoints()))
+	}
+
+	// With every coin locked, a dry run has nothing left to spend.
+	_, e := w.CreateSimpleTx(nil, waddrmgr.DefaultAccountNum, outputs, 1,
+		1000, CoinSelectionBnB, true)
+	if e == nil {
+		t.Fatalf("expected insufficient funds with all coins locked")
+	}
+
+	// Unlocked coins can be selected again, and a dry run does not lock
+	// them.
+	w.ResetLockedOutpoints()
+	tx, e := w.CreateSimpleTx(nil, waddrmgr.DefaultAccountNum, outputs, 1,
+		1000, CoinSelectionRandomImprove, true)
+	if e != nil {
+		t.Fatalf("unable to create tx: %v", e)
+	}
+	if tx.TotalInput < btcutil.Amount(150000)+tx.Fee {
+		t.Fatalf("inputs %v do not cover outputs and fee %v",
+			tx.TotalInput, tx.Fee)
+	}
+	if len(w.LockedOutpoints()) != 0 {
+		t.Fatalf("dry run locked outpoints")
+	}
+}
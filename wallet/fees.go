@@ -0,0 +1,48 @@
+package wallet
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+)
+
+const (
+	// DefaultFeeTarget is the confirmation target, in blocks, of the fee
+	// rate estimated when the caller doesn't specify one.
+	DefaultFeeTarget = 6
+
+	// FallbackFeePerKB is the fee rate, in sat/kvB, used when the chain
+	// backend can't estimate fees.
+	FallbackFeePerKB btcutil.Amount = 10000
+)
+
+// FeeEstimator returns a fee estimator backed by the chain backend of the
+// wallet.
+func (w *Wallet) FeeEstimator() (chainfee.Estimator, error) {
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		return nil, err
+	}
+	return feeEstimator(chainClient), nil
+}
+
+// feeEstimator picks the estimator suited to the chain backend. bitcoind
+// answers estimatesmartfee, and Electrum and Esplora servers expose the fee
+// histogram of their mempool. Other backends, like btcd, which doesn't
+// implement estimatesmartfee, and neutrino, which has no mempool, get the
+// fallback rate.
+func feeEstimator(chainClient chain.Interface) chainfee.Estimator {
+	relayFee := txrules.DefaultRelayFeePerKb
+
+	switch c := chainClient.(type) {
+	case *chain.BitcoindClient:
+		return chainfee.NewSmartFeeEstimator(c, FallbackFeePerKB, relayFee)
+
+	case chainfee.HistogramSource:
+		return chainfee.NewMempoolEstimator(c, relayFee)
+
+	default:
+		return chainfee.NewStaticEstimator(FallbackFeePerKB, relayFee)
+	}
+}
@@ -0,0 +1,62 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/czh0526/btc-wallet/wallet/chainfee"
+	"github.com/stretchr/testify/assert"
+)
+
+// histogramChainClient is a chain backend serving the fee histogram of its
+// mempool.
+type histogramChainClient struct {
+	mockChainClient
+	histogram []chainfee.FeeHistogramBin
+}
+
+func (c *histogramChainClient) FeeHistogram() ([]chainfee.FeeHistogramBin,
+	error) {
+
+	return c.histogram, nil
+}
+
+func TestFeeEstimator(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	if _, err := w.FeeEstimator(); err == nil {
+		t.Fatalf("expected error without a chain backend")
+	}
+
+	// Backends without fee estimates get the fallback rate.
+	w.chainClient = &mockChainClient{}
+	estimator, err := w.FeeEstimator()
+	if err != nil {
+		t.Fatalf("unable to get fee estimator: %v", err)
+	}
+	feeRate, err := estimator.EstimateFeePerKB(DefaultFeeTarget)
+	if err != nil {
+		t.Fatalf("unable to estimate fee rate: %v", err)
+	}
+	assert.Equal(t, FallbackFeePerKB, feeRate)
+
+	// Backends exposing their mempool are estimated from its histogram.
+	// Six blocks deep, the 20 sat/vB bin is reached.
+	w.chainClient = &histogramChainClient{
+		histogram: []chainfee.FeeHistogramBin{
+			{FeeRate: 50, VSize: 2000000},
+			{FeeRate: 20, VSize: 5000000},
+			{FeeRate: 5, VSize: 10000000},
+		},
+	}
+	estimator, err = w.FeeEstimator()
+	if err != nil {
+		t.Fatalf("unable to get fee estimator: %v", err)
+	}
+	feeRate, err = estimator.EstimateFeePerKB(DefaultFeeTarget)
+	if err != nil {
+		t.Fatalf("unable to estimate fee rate: %v", err)
+	}
+	assert.Equal(t, btcutil.Amount(21000), feeRate)
+}
@@ -0,0 +1,114 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// ImportPrivateKey imports a WIF-encoded private key into the imported
+// account of the scope, returning the encoded address of the key. If rescan
+// is set, the blocks the wallet synced through are scanned for the
+// transactions of the address from height rescanFrom, or from the birthday
+// block of the wallet if rescanFrom is 0, which requires a chain backend.
+func (w *Wallet) ImportPrivateKey(scope waddrmgr.KeyScope, wif *btcutil.WIF,
+	rescanFrom int32, rescan bool) (string, error) {
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		return "", err
+	}
+
+	// Rescanning is checked to be possible before importing, so a failed
+	// call leaves the wallet as is.
+	chainClient, err := w.requireChainClient()
+	if err != nil && rescan {
+		return "", err
+	}
+
+	var addr btcutil.Address
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+		ma, err := scopedMgr.ImportPrivateKey(addrmgrNs, wif)
+		if err != nil {
+			return err
+		}
+		addr = ma.Address()
+
+		if rescanFrom != 0 {
+			return nil
+		}
+		birthdayBlock, _, err := w.Manager.BirthdayBlock(addrmgrNs)
+		switch {
+		case waddrmgr.IsError(err, waddrmgr.ErrBirthdayBlockNotSet):
+			return nil
+		case err != nil:
+			return err
+		}
+		rescanFrom = birthdayBlock.Height
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Imported payment address %s \n", addr)
+
+	// Without a backend, the address is watched once one is attached.
+	if chainClient == nil {
+		return addr.EncodeAddress(), nil
+	}
+
+	// The transactions of the address following the blocks the wallet
+	// synced through are reported by the backend from now on.
+	err = chainClient.NotifyReceived([]btcutil.Address{addr})
+	if err != nil {
+		return "", err
+	}
+	if rescan {
+		err := w.rescan(
+			chainClient, rescanFrom, []btcutil.Address{addr})
+		if err != nil {
+			return "", err
+		}
+	}
+	return addr.EncodeAddress(), nil
+}
+
+// rescan records the wallet transactions of the blocks from startHeight
+// through the block the wallet synced through that are relevant to the
+// addresses. Only the blocks whose compact filters match are downloaded when
+// the backend serves them.
+func (w *Wallet) rescan(chainClient chain.Interface, startHeight int32,
+	addrs []btcutil.Address) error {
+
+	endHeight := w.Manager.SyncedTo().Height
+	fmt.Printf("Rescanning blocks %d-%d for %d addresses \n", startHeight,
+		endHeight, len(addrs))
+
+	scanner := chain.NewFilterScanner(chainClient)
+	if err := scanner.WatchAddrs(addrs); err != nil {
+		return err
+	}
+	err := scanner.Scan(startHeight, endHeight, func(meta wtxmgr.BlockMeta,
+		block *wire.MsgBlock) error {
+
+		if block == nil {
+			return nil
+		}
+		return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+			return w.recordBlockTxs(dbTx, block, &meta)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished rescan through height %d \n", endHeight)
+	return nil
+}
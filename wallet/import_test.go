@@ -0,0 +1,160 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain/simchain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportPrivateKey(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	privKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF(privKey, &chaincfg.RegressionNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(wif.SerializePubKey()),
+		&chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := func(b byte, pkScript []byte) *wire.MsgTx {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: chainhash.Hash{b}}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(50000, pkScript))
+		return tx
+	}
+
+	otherKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherWIF, err := btcutil.NewWIF(
+		otherKey, &chaincfg.RegressionNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAddr, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(otherWIF.SerializePubKey()),
+		&chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherScript, err := txscript.PayToAddrScript(otherAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both keys were paid to before the wallet was created, and so before
+	// its birthday block.
+	sim := simchain.New(&chaincfg.RegressionNetParams)
+	client := sim.NewClient()
+	earlier := payment(0x01, pkScript)
+	otherEarlier := payment(0x03, otherScript)
+	for _, tx := range []*wire.MsgTx{earlier, otherEarlier} {
+		if _, err := client.SendRawTransaction(tx, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sim.Mine()
+	tip := sim.MineEmpty(2)[1]
+
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		client.Stop()
+		client.WaitForShutdown()
+	}()
+	w.SynchronizeRPC(client)
+	waitSyncedTo(t, w, tip, 3)
+
+	// Importing requires the private key to be encrypted.
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif, 0, true)
+	assert.True(t, waddrmgr.IsError(err, waddrmgr.ErrLocked))
+
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	// By default, the rescan starts at the birthday block, missing the
+	// payment preceding it.
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, otherWIF, 0, true)
+	if err != nil {
+		t.Fatalf("unable to import private key: %v", err)
+	}
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		otherHash := otherEarlier.TxHash()
+		details, err := w.TxStore.TxDetails(txmgrNs, &otherHash)
+		assert.Nil(t, details)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key known to be older is rescanned from the requested height.
+	encoded, err := w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif, 1, true)
+	if err != nil {
+		t.Fatalf("unable to import private key: %v", err)
+	}
+	assert.Equal(t, addr.EncodeAddress(), encoded)
+	assert.Equal(t, int32(1), txHeight(t, w, earlier.TxHash()))
+
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif, 0, false)
+	assert.True(t, waddrmgr.IsError(err, waddrmgr.ErrDuplicateAddress))
+
+	// Payments following the import are reported by the backend.
+	later := payment(0x02, pkScript)
+	if _, err := client.SendRawTransaction(later, false); err != nil {
+		t.Fatal(err)
+	}
+	b4 := sim.Mine()
+	waitSyncedTo(t, w, b4, 4)
+	assert.Equal(t, int32(4), txHeight(t, w, later.TxHash()))
+}
+
+func TestRescanWithoutBackend(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	privKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wif, err := btcutil.NewWIF(privKey, &chaincfg.RegressionNetParams, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	// Rescanning without a backend fails without importing the key,
+	// which is imported once no rescan is requested.
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif, 0, true)
+	assert.Error(t, err)
+	_, err = w.ImportPrivateKey(waddrmgr.KeyScopeBIP0044, wif, 0, false)
+	assert.NoError(t, err)
+}
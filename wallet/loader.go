@@ -175,6 +175,7 @@ func (l *Loader) createNewWallet(pubPassphrase, privPassphrase []byte, rootKey *
 	}
 	w.Start()
 
+	l.onLoaded(w)
 	return w, nil
 }
 
@@ -219,14 +220,19 @@ func (l *Loader) OpenExistingWallet(pubPassphrase []byte,
 	return w, nil
 }
 
+// onLoaded runs the callbacks registered with RunAfterLoad for the wallet
+// just created or opened. The callbacks are kept, so they run again for any
+// wallet loaded after this one is unloaded.
 func (l *Loader) onLoaded(w *Wallet) {
 	for _, fn := range l.callbacks {
 		fn(w)
 	}
 	l.wallet = w
-	l.callbacks = nil
 }
 
+// UnloadWallet stops the loaded wallet, along with its chain client, and
+// closes its database.
+
 func (l *Loader) UnloadWallet() error {
 	defer l.mu.Unlock()
 	l.mu.Lock()
@@ -251,15 +257,25 @@ func (l *Loader) UnloadWallet() error {
 	return nil
 }
 
+// LoadedWallet returns the loaded wallet, if any, and whether one is loaded.
+func (l *Loader) LoadedWallet() (*Wallet, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.wallet, l.wallet != nil
+}
+
+// RunAfterLoad registers a function to run each time the loader creates or
+// opens a wallet. If a wallet is loaded already, the function also runs for it
+// right away.
 func (l *Loader) RunAfterLoad(fn func(*Wallet)) {
 	l.mu.Lock()
-	if l.wallet != nil {
-		w := l.wallet
-		l.mu.Unlock()
+	l.callbacks = append(l.callbacks, fn)
+	w := l.wallet
+	l.mu.Unlock()
+
+	if w != nil {
 		fn(w)
-	} else {
-		l.callbacks = append(l.callbacks, fn)
-		l.mu.Unlock()
 	}
 }
 
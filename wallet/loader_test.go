@@ -0,0 +1,79 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoaderCreateAndOpen(t *testing.T) {
+	dir, err := os.MkdirTemp("", "loadertest")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loader := NewLoader(&chaincfg.RegressionNetParams, dir, true,
+		10*time.Second, 0)
+	exists, err := loader.WalletExists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, exists)
+
+	var loaded *Wallet
+	loader.RunAfterLoad(func(w *Wallet) {
+		loaded = w
+	})
+
+	// A created wallet is loaded, running the callbacks.
+	w, err := loader.CreateNewWallet(testPubPass, testPrivPass, seed,
+		time.Now())
+	if err != nil {
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	assert.Equal(t, w, loaded)
+
+	_, err = loader.CreateNewWallet(testPubPass, testPrivPass, seed,
+		time.Now())
+	assert.True(t, errors.Is(err, ErrLoaded))
+	_, err = loader.OpenExistingWallet(testPubPass, false)
+	assert.True(t, errors.Is(err, ErrLoaded))
+
+	if err := loader.UnloadWallet(); err != nil {
+		t.Fatalf("unable to unload wallet: %v", err)
+	}
+
+	// Once unloaded, the wallet exists and can be opened again.
+	_, err = loader.CreateNewWallet(testPubPass, testPrivPass, seed,
+		time.Now())
+	assert.True(t, errors.Is(err, ErrExists))
+
+	// The callbacks run again for the reopened wallet, and callbacks
+	// registered while it is loaded run right away.
+	w, err = loader.OpenExistingWallet(testPubPass, false)
+	if err != nil {
+		t.Fatalf("unable to open wallet: %v", err)
+	}
+	assert.Equal(t, w, loaded)
+
+	var late *Wallet
+	loader.RunAfterLoad(func(w *Wallet) {
+		late = w
+	})
+	assert.Equal(t, w, late)
+
+	if err := loader.UnloadWallet(); err != nil {
+		t.Fatalf("unable to unload wallet: %v", err)
+	}
+}
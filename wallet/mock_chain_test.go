@@ -0,0 +1,143 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+)
+
+var errNotImplemented = errors.New("not implemented")
+
+// mockChainClient is a chain backend recording published transactions. Its
+// best chain is blocks, indexed by height, and notifications are delivered
+// through ntfns. It serves the transactions of txs.
+type mockChainClient struct {
+	published []*wire.MsgTx
+	err       error
+	notifyErr error
+	txs       map[chainhash.Hash]*wire.MsgTx
+
+	mu     sync.Mutex
+	blocks []*wire.MsgBlock
+	ntfns  chan interface{}
+}
+
+// setBlocks replaces the best chain of the backend.
+func (m *mockChainClient) setBlocks(blocks []*wire.MsgBlock) {
+	m.mu.Lock()
+	m.blocks = blocks
+	m.mu.Unlock()
+}
+
+// block returns the block of the best chain with the given hash.
+func (m *mockChainClient) block(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, block := range m.blocks {
+		if block.BlockHash() == *hash {
+			return block, nil
+		}
+	}
+	return nil, fmt.Errorf("block %v not found", hash)
+}
+
+var _ chain.Interface = (*mockChainClient)(nil)
+
+var _ chain.TxSource = (*mockChainClient)(nil)
+
+func (m *mockChainClient) Start() error {
+	return nil
+}
+
+func (m *mockChainClient) Stop() {}
+
+func (m *mockChainClient) WaitForShutdown() {}
+
+func (m *mockChainClient) GetBestBlock() (*chainhash.Hash, int32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.blocks) == 0 {
+		return nil, 0, errNotImplemented
+	}
+	hash := m.blocks[len(m.blocks)-1].BlockHash()
+	return &hash, int32(len(m.blocks) - 1), nil
+}
+
+func (m *mockChainClient) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock,
+	error) {
+
+	return m.block(hash)
+}
+
+func (m *mockChainClient) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if height < 0 || height >= int64(len(m.blocks)) {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	hash := m.blocks[height].BlockHash()
+	return &hash, nil
+}
+
+func (m *mockChainClient) GetBlockHeader(hash *chainhash.Hash) (
+	*wire.BlockHeader, error) {
+
+	block, err := m.block(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &block.Header, nil
+}
+
+func (m *mockChainClient) FilterBlocks(*chain.FilterBlocksRequest) (
+	*chain.FilterBlocksResponse, error) {
+
+	return nil, nil
+}
+
+func (m *mockChainClient) SendRawTransaction(tx *wire.MsgTx,
+	_ bool) (*chainhash.Hash, error) {
+
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.published = append(m.published, tx)
+	txHash := tx.TxHash()
+	return &txHash, nil
+}
+
+func (m *mockChainClient) GetRawTransaction(
+	txHash *chainhash.Hash) (*btcutil.Tx, error) {
+
+	tx, ok := m.txs[*txHash]
+	if !ok {
+		return nil, fmt.Errorf("transaction %v not found", txHash)
+	}
+	return btcutil.NewTx(tx), nil
+}
+
+func (m *mockChainClient) Rescan(*chainhash.Hash, []btcutil.Address,
+	map[wire.OutPoint]btcutil.Address) error {
+
+	return nil
+}
+
+func (m *mockChainClient) NotifyReceived([]btcutil.Address) error {
+	return m.notifyErr
+}
+
+func (m *mockChainClient) NotifyBlocks() error {
+	return nil
+}
+
+func (m *mockChainClient) Notifications() <-chan interface{} {
+	return m.ntfns
+}
@@ -0,0 +1,75 @@
+package wallet
+
+import "sync"
+
+// NotificationServer is a server that interested clients may hook into to
+// receive notifications of changes in a wallet.
+type NotificationServer struct {
+	mu         sync.Mutex
+	lockStates []chan bool
+}
+
+func newNotificationServer() *NotificationServer {
+	return &NotificationServer{}
+}
+
+// LockStateNotificationsClient receives the new lock state of the wallet
+// each time it changes. A true value means the wallet was locked.
+type LockStateNotificationsClient struct {
+	C      <-chan bool
+	server *NotificationServer
+}
+
+// LockStateNotifications returns a client for receiving lock state changes.
+// The client's Done method must be called once notifications are no longer
+// needed.
+func (s *NotificationServer) LockStateNotifications() LockStateNotificationsClient {
+	// Buffered so a slow client doesn't stall the wallet locker. Should
+	// the buffer fill up, notifications are dropped for that client.
+	c := make(chan bool, 8)
+
+	s.mu.Lock()
+	s.lockStates = append(s.lockStates, c)
+	s.mu.Unlock()
+
+	return LockStateNotificationsClient{
+		C:      c,
+		server: s,
+	}
+}
+
+// Done deregisters the client from the server and drains any remaining
+// messages. It must be called exactly once when the client is finished
+// receiving notifications.
+func (c *LockStateNotificationsClient) Done() {
+	go func() {
+		for range c.C {
+		}
+	}()
+	go func() {
+		s := c.server
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, ch := range s.lockStates {
+			if ch == c.C {
+				s.lockStates[i] = s.lockStates[len(s.lockStates)-1]
+				s.lockStates = s.lockStates[:len(s.lockStates)-1]
+				close(ch)
+				break
+			}
+		}
+	}()
+}
+
+func (s *NotificationServer) notifyLockStateChange(locked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.lockStates {
+		select {
+		case c <- locked:
+		default:
+		}
+	}
+}
@@ -0,0 +1,709 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// DefaultLockDuration is how long the inputs selected by FundPsbt stay
+// leased, giving the signers time to complete the transaction.
+const DefaultLockDuration = 10 * time.Minute
+
+// PsbtLockID is the ID the inputs selected by FundPsbt are leased to.
+var PsbtLockID = wtxmgr.LockID(chainhash.HashH([]byte("btc-wallet/psbt")))
+
+// FundPsbt adds inputs and, if needed, a change output to the transaction of
+// a PSBT paying to its outputs. If the PSBT has no inputs, coins with at
+// least minConfs confirmations are selected from the account using the given
+// strategy. Otherwise its inputs must be unspent wallet outputs and are all
+// spent. If keyScope is nil, coins of every scope are eligible and change
+// goes to the BIP0084 scope.
+//
+// The inputs are leased to PsbtLockID for DefaultLockDuration. The funded
+// packet replaces the passed one, with the previous outputs and BIP-32
+// derivations of the inputs and change output filled in so that external
+// signers can sign it. The index of the change output is returned, or -1 if
+// there is none.
+//
+// Only version 0 packets (BIP-174) are supported, as the psbt package only
+// models those. The RPC server rejects version 2 packets (BIP-370) as
+// unimplemented.
+func (w *Wallet) FundPsbt(packet *psbt.Packet, keyScope *waddrmgr.KeyScope,
+	minConfs int32, account uint32, feeSatPerKB btcutil.Amount,
+	strategy CoinSelectionStrategy) (int32, error) {
+
+	txOuts := packet.UnsignedTx.TxOut
+	if len(txOuts) == 0 {
+		return -1, fmt.Errorf("PSBT has no outputs")
+	}
+	for _, output := range txOuts {
+		err := txrules.CheckOutput(output, txrules.DefaultRelayFeePerKb)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	inputs := make([]wire.OutPoint, 0, len(packet.UnsignedTx.TxIn))
+	sequences := make(map[wire.OutPoint]uint32)
+	for _, txIn := range packet.UnsignedTx.TxIn {
+		inputs = append(inputs, txIn.PreviousOutPoint)
+		sequences[txIn.PreviousOutPoint] = txIn.Sequence
+	}
+
+	tx, err := w.createTx(createTxRequest{
+		keyScope:    keyScope,
+		account:     account,
+		outputs:     txOuts,
+		minconf:     minConfs,
+		feeSatPerKB: feeSatPerKB,
+		strategy:    strategy,
+		inputs:      inputs,
+		lease: &outputLease{
+			id:       PsbtLockID,
+			duration: DefaultLockDuration,
+		},
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	// The leases are only kept if the packet is returned.
+	funded, err := w.decoratePsbt(packet, tx.Tx, sequences)
+	if err != nil {
+		for _, txIn := range tx.Tx.TxIn {
+			_ = w.ReleaseOutput(PsbtLockID, txIn.PreviousOutPoint)
+		}
+		return -1, err
+	}
+
+	*packet = *funded
+	return int32(tx.ChangeIndex), nil
+}
+
+// decoratePsbt creates the packet of a funded transaction. The version, lock
+// time and input sequences are kept from the template packet, along with the
+// fields of its outputs.
+func (w *Wallet) decoratePsbt(template *psbt.Packet, tx *wire.MsgTx,
+	sequences map[wire.OutPoint]uint32) (*psbt.Packet, error) {
+
+	tx.Version = template.UnsignedTx.Version
+	tx.LockTime = template.UnsignedTx.LockTime
+	for _, txIn := range tx.TxIn {
+		if sequence, ok := sequences[txIn.PreviousOutPoint]; ok {
+			txIn.Sequence = sequence
+		}
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The funded transaction holds the template outputs themselves, with
+	// the change output at a random position.
+	templateOuts := make(map[*wire.TxOut]int)
+	for i, txOut := range template.UnsignedTx.TxOut {
+		if i < len(template.Outputs) {
+			templateOuts[txOut] = i
+		}
+	}
+
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		fingerprint, err := w.Manager.MasterKeyFingerprint(addrmgrNs)
+		if err != nil && !waddrmgr.IsError(err, waddrmgr.ErrWatchingOnly) {
+			return err
+		}
+
+		for i, txIn := range tx.TxIn {
+			op := txIn.PreviousOutPoint
+			details, err := w.TxStore.TxDetails(txmgrNs, &op.Hash)
+			if err != nil {
+				return err
+			}
+			if details == nil {
+				return fmt.Errorf("unknown input %v", op)
+			}
+
+			err = w.decorateInput(
+				addrmgrNs, fingerprint, &packet.Inputs[i],
+				&details.MsgTx, op.Index)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, txOut := range tx.TxOut {
+			if j, ok := templateOuts[txOut]; ok {
+				packet.Outputs[i] = template.Outputs[j]
+				continue
+			}
+
+			err := w.decorateOutput(
+				addrmgrNs, fingerprint, &packet.Outputs[i], txOut)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// bip32Path returns the key origin of a wallet key. The fingerprint of the
+// root key is used for accounts that don't record their own.
+func bip32Path(addr waddrmgr.ManagedPubKeyAddress,
+	rootFingerprint uint32) (uint32, []uint32, bool) {
+
+	scope, path, ok := addr.DerivationInfo()
+	if !ok {
+		return 0, nil, false
+	}
+
+	fingerprint := path.MasterKeyFingerprint
+	if fingerprint == 0 {
+		fingerprint = rootFingerprint
+	}
+	return fingerprint, []uint32{
+		scope.Purpose + hdkeychain.HardenedKeyStart,
+		scope.Coin + hdkeychain.HardenedKeyStart,
+		path.Account,
+		path.Branch,
+		path.Index,
+	}, true
+}
+
+// decorateInput adds the previous output and the key origin of the wallet
+// key spending it to a PSBT input.
+func (w *Wallet) decorateInput(addrmgrNs walletdb.ReadBucket,
+	rootFingerprint uint32, pInput *psbt.PInput, prevTx *wire.MsgTx,
+	index uint32) error {
+
+	prevOut := prevTx.TxOut[index]
+	addr, err := w.pubKeyAddress(addrmgrNs, prevOut.PkScript)
+	if err != nil {
+		return err
+	}
+
+	pubKey := addr.PubKey()
+	switch addr.AddrType() {
+	case waddrmgr.PubKeyHash:
+		pInput.NonWitnessUtxo = prevTx
+
+	case waddrmgr.NestedWitnessPubKey:
+		witnessProgram, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).
+			AddData(btcutil.Hash160(pubKey.SerializeCompressed())).
+			Script()
+		if err != nil {
+			return err
+		}
+		pInput.WitnessUtxo = prevOut
+		pInput.RedeemScript = witnessProgram
+
+	case waddrmgr.WitnessPubKey:
+		pInput.WitnessUtxo = prevOut
+
+	case waddrmgr.TaprootPubKey:
+		pInput.WitnessUtxo = prevOut
+		pInput.TaprootInternalKey = schnorr.SerializePubKey(pubKey)
+
+	default:
+		return fmt.Errorf("unsupported address type %v for input",
+			addr.AddrType())
+	}
+
+	fingerprint, path, ok := bip32Path(addr, rootFingerprint)
+	if !ok {
+		return nil
+	}
+	if addr.AddrType() == waddrmgr.TaprootPubKey {
+		pInput.TaprootBip32Derivation = []*psbt.TaprootBip32Derivation{{
+			XOnlyPubKey:          schnorr.SerializePubKey(pubKey),
+			MasterKeyFingerprint: fingerprint,
+			Bip32Path:            path,
+		}}
+		return nil
+	}
+	pInput.Bip32Derivation = []*psbt.Bip32Derivation{{
+		PubKey:               pubKey.SerializeCompressed(),
+		MasterKeyFingerprint: fingerprint,
+		Bip32Path:            path,
+	}}
+	return nil
+}
+
+// decorateOutput adds the key origin of the wallet key an output pays to.
+func (w *Wallet) decorateOutput(addrmgrNs walletdb.ReadBucket,
+	rootFingerprint uint32, pOutput *psbt.POutput, txOut *wire.TxOut) error {
+
+	addr, err := w.pubKeyAddress(addrmgrNs, txOut.PkScript)
+	if err != nil {
+		return err
+	}
+	fingerprint, path, ok := bip32Path(addr, rootFingerprint)
+	if !ok {
+		return nil
+	}
+
+	pubKey := addr.PubKey()
+	if addr.AddrType() == waddrmgr.TaprootPubKey {
+		pOutput.TaprootInternalKey = schnorr.SerializePubKey(pubKey)
+		pOutput.TaprootBip32Derivation = []*psbt.TaprootBip32Derivation{{
+			XOnlyPubKey:          schnorr.SerializePubKey(pubKey),
+			MasterKeyFingerprint: fingerprint,
+			Bip32Path:            path,
+		}}
+		return nil
+	}
+	pOutput.Bip32Derivation = []*psbt.Bip32Derivation{{
+		PubKey:               pubKey.SerializeCompressed(),
+		MasterKeyFingerprint: fingerprint,
+		Bip32Path:            path,
+	}}
+	return nil
+}
+
+// pubKeyAddress returns the wallet key an output script pays to.
+func (w *Wallet) pubKeyAddress(addrmgrNs walletdb.ReadBucket,
+	pkScript []byte) (waddrmgr.ManagedPubKeyAddress, error) {
+
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		pkScript, w.chainParams)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != 1 {
+		return nil, fmt.Errorf("script pays to %d addresses", len(addrs))
+	}
+	ma, err := w.Manager.Address(addrmgrNs, addrs[0])
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := ma.(waddrmgr.ManagedPubKeyAddress)
+	if !ok {
+		return nil, fmt.Errorf("address %v is not a key address",
+			addrs[0])
+	}
+	return addr, nil
+}
+
+// SignPsbt adds the signatures of wallet keys to the inputs of a PSBT. Keys
+// are derived from the BIP-32 derivations of an input whose master key
+// fingerprint is the wallet's. Partial signatures are added for P2PKH,
+// P2SH, P2WPKH and P2WSH inputs, using the redeem and witness scripts of the
+// input. For taproot inputs, a key spend signature is added when the key is
+// the internal key, and a script spend signature for each leaf the
+// derivation lists.
+//
+// Finalized inputs are skipped. The indexes of the inputs signed are
+// returned.
+func (w *Wallet) SignPsbt(packet *psbt.Packet) ([]uint32, error) {
+	tx := packet.UnsignedTx
+	if len(packet.Inputs) != len(tx.TxIn) {
+		return nil, fmt.Errorf("PSBT has %d inputs for %d transaction "+
+			"inputs", len(packet.Inputs), len(tx.TxIn))
+	}
+
+	fetcher, allKnown, err := psbtPrevOutFetcher(packet)
+	if err != nil {
+		return nil, err
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+
+	var signed []uint32
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+		fingerprint, err := w.Manager.MasterKeyFingerprint(addrmgrNs)
+		if err != nil && !waddrmgr.IsError(err, waddrmgr.ErrWatchingOnly) {
+			return err
+		}
+
+		for i := range packet.Inputs {
+			pInput := &packet.Inputs[i]
+			if pInput.FinalScriptSig != nil ||
+				pInput.FinalScriptWitness != nil {
+
+				continue
+			}
+
+			prevOut := fetcher.FetchPrevOutput(
+				tx.TxIn[i].PreviousOutPoint)
+			if prevOut.PkScript == nil {
+				continue
+			}
+
+			s := &psbtSigner{
+				w:           w,
+				addrmgrNs:   addrmgrNs,
+				fingerprint: fingerprint,
+				tx:          tx,
+				sigHashes:   sigHashes,
+				idx:         i,
+				pInput:      pInput,
+				prevOut:     prevOut,
+			}
+
+			var added bool
+			if txscript.IsPayToTaproot(prevOut.PkScript) {
+				// Taproot signatures commit to every
+				// output spent.
+				if !allKnown {
+					continue
+				}
+				added, err = s.signTaproot()
+			} else {
+				added, err = s.signECDSA()
+			}
+			s.keys.zero()
+			if err != nil {
+				return err
+			}
+			if added {
+				signed = append(signed, uint32(i))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return signed, nil
+}
+
+// psbtPrevOutFetcher returns the outputs spent by the inputs of a PSBT.
+// Inputs without previous output information are fetched as empty outputs,
+// in which case false is returned as well.
+func psbtPrevOutFetcher(packet *psbt.Packet) (*txscript.MultiPrevOutFetcher,
+	bool, error) {
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	allKnown := true
+	for i, txIn := range packet.UnsignedTx.TxIn {
+		op := txIn.PreviousOutPoint
+		pInput := packet.Inputs[i]
+
+		switch {
+		case pInput.WitnessUtxo != nil:
+			fetcher.AddPrevOut(op, pInput.WitnessUtxo)
+
+		case pInput.NonWitnessUtxo != nil:
+			if pInput.NonWitnessUtxo.TxHash() != op.Hash ||
+				int(op.Index) >= len(pInput.NonWitnessUtxo.TxOut) {
+
+				return nil, false, fmt.Errorf("non-witness UTXO "+
+					"of input %d does not match outpoint %v",
+					i, op)
+			}
+			fetcher.AddPrevOut(
+				op, pInput.NonWitnessUtxo.TxOut[op.Index])
+
+		default:
+			allKnown = false
+			fetcher.AddPrevOut(op, &wire.TxOut{})
+		}
+	}
+
+	return fetcher, allKnown, nil
+}
+
+// psbtSigner signs a single input of a PSBT.
+type psbtSigner struct {
+	w           *Wallet
+	addrmgrNs   walletdb.ReadBucket
+	fingerprint uint32
+	tx          *wire.MsgTx
+	sigHashes   *txscript.TxSigHashes
+	idx         int
+	pInput      *psbt.PInput
+	prevOut     *wire.TxOut
+	keys        signingKeys
+}
+
+// deriveKey returns the private key of a wallet key derived along a BIP-32
+// path of the form m/purpose'/coin'/account'/branch/index. The key must
+// match pubKey, which is compared in x-only form for taproot keys.
+func (s *psbtSigner) deriveKey(fingerprint uint32, path []uint32,
+	pubKey []byte) (*btcec.PrivateKey, error) {
+
+	if fingerprint != s.fingerprint {
+		return nil, nil
+	}
+
+	const h = hdkeychain.HardenedKeyStart
+	if len(path) != 5 || path[0] < h || path[1] < h || path[2] < h {
+		return nil, nil
+	}
+
+	scopedMgr, err := s.w.Manager.FetchScopedKeyManager(waddrmgr.KeyScope{
+		Purpose: path[0] - h,
+		Coin:    path[1] - h,
+	})
+	if err != nil {
+		return nil, nil
+	}
+	keyPath := waddrmgr.DerivationPath{
+		InternalAccount: path[2] - h,
+		Account:         path[2],
+		Branch:          path[3],
+		Index:           path[4],
+	}
+	ma, err := scopedMgr.DeriveFromKeyPath(s.addrmgrNs, keyPath)
+	if waddrmgr.IsError(err, waddrmgr.ErrAccountNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addr := ma.(waddrmgr.ManagedPubKeyAddress)
+	derived := addr.PubKey().SerializeCompressed()
+	if len(pubKey) == schnorr.PubKeyBytesLen {
+		derived = derived[1:]
+	}
+	if !bytes.Equal(derived, pubKey) {
+		return nil, fmt.Errorf("derived key %x does not match %x",
+			derived, pubKey)
+	}
+
+	// DeriveFromKeyPath loaded the account, so the key can be served from
+	// the cache. The copy is zeroed once the input is signed.
+	key, err := scopedMgr.DeriveFromKeyPathCache(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	s.keys.add(key)
+	return key, nil
+}
+
+// signECDSA adds partial signatures for the wallet keys of a non-taproot
+// input.
+func (s *psbtSigner) signECDSA() (bool, error) {
+	hashType := s.pInput.SighashType
+	if hashType == 0 {
+		hashType = txscript.SigHashAll
+	}
+
+	pkScript := s.prevOut.PkScript
+	witness := true
+	var script []byte
+	switch {
+	case txscript.IsPayToWitnessPubKeyHash(pkScript):
+		script = pkScript
+
+	case txscript.IsPayToWitnessScriptHash(pkScript):
+		script = s.pInput.WitnessScript
+
+	case txscript.IsPayToScriptHash(pkScript):
+		switch {
+		case txscript.IsPayToWitnessPubKeyHash(s.pInput.RedeemScript):
+			script = s.pInput.RedeemScript
+		case txscript.IsPayToWitnessScriptHash(s.pInput.RedeemScript):
+			script = s.pInput.WitnessScript
+		default:
+			script = s.pInput.RedeemScript
+			witness = false
+		}
+
+	default:
+		script = pkScript
+		witness = false
+	}
+	if len(script) == 0 {
+		return false, fmt.Errorf("missing script to sign")
+	}
+
+	var added bool
+	for _, derivation := range s.pInput.Bip32Derivation {
+		if s.hasPartialSig(derivation.PubKey) {
+			continue
+		}
+		key, err := s.deriveKey(derivation.MasterKeyFingerprint,
+			derivation.Bip32Path, derivation.PubKey)
+		if err != nil {
+			return false, err
+		}
+		if key == nil {
+			continue
+		}
+
+		var sig []byte
+		if witness {
+			sig, err = txscript.RawTxInWitnessSignature(
+				s.tx, s.sigHashes, s.idx, s.prevOut.Value,
+				script, hashType, key)
+		} else {
+			sig, err = txscript.RawTxInSignature(
+				s.tx, s.idx, script, hashType, key)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		s.pInput.PartialSigs = append(s.pInput.PartialSigs,
+			&psbt.PartialSig{
+				PubKey:    derivation.PubKey,
+				Signature: sig,
+			})
+		added = true
+	}
+
+	return added, nil
+}
+
+func (s *psbtSigner) hasPartialSig(pubKey []byte) bool {
+	for _, sig := range s.pInput.PartialSigs {
+		if bytes.Equal(sig.PubKey, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// signTaproot adds the key spend signature or script spend signatures of the
+// wallet keys of a taproot input.
+func (s *psbtSigner) signTaproot() (bool, error) {
+	hashType := s.pInput.SighashType
+	if hashType == 0 {
+		hashType = txscript.SigHashDefault
+	}
+
+	var added bool
+	for _, derivation := range s.pInput.TaprootBip32Derivation {
+		key, err := s.deriveKey(derivation.MasterKeyFingerprint,
+			derivation.Bip32Path, derivation.XOnlyPubKey)
+		if err != nil {
+			return false, err
+		}
+		if key == nil {
+			continue
+		}
+
+		// Without leaf hashes, the key is the internal key of a key
+		// spend.
+		if len(derivation.LeafHashes) == 0 {
+			if len(s.pInput.TaprootKeySpendSig) > 0 ||
+				!bytes.Equal(s.pInput.TaprootInternalKey,
+					derivation.XOnlyPubKey) {
+
+				continue
+			}
+
+			sig, err := txscript.RawTxInTaprootSignature(
+				s.tx, s.sigHashes, s.idx, s.prevOut.Value,
+				s.prevOut.PkScript, s.pInput.TaprootMerkleRoot,
+				hashType, key)
+			if err != nil {
+				return false, err
+			}
+			s.pInput.TaprootKeySpendSig = sig
+			added = true
+			continue
+		}
+
+		for _, leafHash := range derivation.LeafHashes {
+			if s.hasScriptSpendSig(derivation.XOnlyPubKey, leafHash) {
+				continue
+			}
+			leafScript, err := psbt.FindLeafScript(s.pInput, leafHash)
+			if err != nil {
+				continue
+			}
+
+			leaf := txscript.NewTapLeaf(
+				leafScript.LeafVersion, leafScript.Script)
+			sig, err := txscript.RawTxInTapscriptSignature(
+				s.tx, s.sigHashes, s.idx, s.prevOut.Value,
+				s.prevOut.PkScript, leaf, hashType, key)
+			if err != nil {
+				return false, err
+			}
+
+			s.pInput.TaprootScriptSpendSig = append(
+				s.pInput.TaprootScriptSpendSig,
+				&psbt.TaprootScriptSpendSig{
+					XOnlyPubKey: derivation.XOnlyPubKey,
+					LeafHash:    leafHash,
+					Signature:   sig[:schnorr.SignatureSize],
+					SigHash:     hashType,
+				})
+			added = true
+		}
+	}
+
+	return added, nil
+}
+
+func (s *psbtSigner) hasScriptSpendSig(xOnlyPubKey, leafHash []byte) bool {
+	for _, sig := range s.pInput.TaprootScriptSpendSig {
+		if bytes.Equal(sig.XOnlyPubKey, xOnlyPubKey) &&
+			bytes.Equal(sig.LeafHash, leafHash) {
+
+			return true
+		}
+	}
+	return false
+}
+
+// FinalizePsbt finalizes every input of a fully signed PSBT and extracts the
+// transaction. The scripts of the extracted transaction are verified against
+// the previous outputs of the inputs.
+func (w *Wallet) FinalizePsbt(packet *psbt.Packet) (*wire.MsgTx, error) {
+	if err := psbt.MaybeFinalizeAll(packet); err != nil {
+		return nil, fmt.Errorf("unable to finalize PSBT: %w", err)
+	}
+
+	fetcher, allKnown, err := psbtPrevOutFetcher(packet)
+	if err != nil {
+		return nil, err
+	}
+	if !allKnown {
+		return nil, fmt.Errorf("PSBT is missing previous outputs")
+	}
+
+	tx, err := psbt.Extract(packet)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract transaction: %w", err)
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i, txIn := range tx.TxIn {
+		prevOut := fetcher.FetchPrevOutput(txIn.PreviousOutPoint)
+		vm, err := txscript.NewEngine(
+			prevOut.PkScript, tx, i, txscript.StandardVerifyFlags,
+			nil, sigHashes, prevOut.Value, fetcher)
+		if err != nil {
+			return nil, err
+		}
+		if err := vm.Execute(); err != nil {
+			return nil, fmt.Errorf("input %d does not validate: %w",
+				i, err)
+		}
+	}
+
+	return tx, nil
+}
@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPsbtWorkflow(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	// Credit the wallet with a confirmed output of each key scope.
+	scopes := []waddrmgr.KeyScope{
+		waddrmgr.KeyScopeBIP0044,
+		waddrmgr.KeyScopeBIP0049Plus,
+		waddrmgr.KeyScopeBIP0084,
+		waddrmgr.KeyScopeBIP0086,
+	}
+	var fundingHash chainhash.Hash
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		ns := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		fundingTx := wire.NewMsgTx(wire.TxVersion)
+		fundingTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: chainhash.Hash{0x01}}, nil, nil))
+		for _, scope := range scopes {
+			addr := nextPubKey(t, ns, w, scope).Address()
+			pkScript, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				return err
+			}
+			fundingTx.AddTxOut(wire.NewTxOut(100000, pkScript))
+		}
+		fundingHash = fundingTx.TxHash()
+
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(fundingTx, time.Now())
+		if err != nil {
+			return err
+		}
+		block := &wtxmgr.BlockMeta{Block: wtxmgr.Block{Height: 100}}
+		for i := range scopes {
+			err := w.TxStore.AddCredit(
+				txmgrNs, rec, block, uint32(i), false)
+			if err != nil {
+				return err
+			}
+		}
+		return w.Manager.SetSyncedTo(ns, &waddrmgr.BlockStamp{
+			Height: 105,
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to fund wallet: %v", err)
+	}
+
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	template := func(inputs ...wire.OutPoint) *psbt.Packet {
+		tx := wire.NewMsgTx(2)
+		for i := range inputs {
+			tx.AddTxIn(wire.NewTxIn(&inputs[i], nil, nil))
+		}
+		tx.AddTxOut(wire.NewTxOut(50000, pkScript))
+		packet, err := psbt.NewFromUnsignedTx(tx)
+		if err != nil {
+			t.Fatalf("unable to create PSBT: %v", err)
+		}
+		return packet
+	}
+
+	// All inputs given in the template are spent.
+	spendAll := []wire.OutPoint{
+		{Hash: fundingHash, Index: 0},
+		{Hash: fundingHash, Index: 1},
+		{Hash: fundingHash, Index: 2},
+		{Hash: fundingHash, Index: 3},
+	}
+	packet := template(spendAll...)
+	changeIdx, err := w.FundPsbt(packet, nil, 1,
+		waddrmgr.DefaultAccountNum, 1000, CoinSelectionLargest)
+	if err != nil {
+		t.Fatalf("unable to fund PSBT: %v", err)
+	}
+	if changeIdx < 0 {
+		t.Fatalf("expected a change output")
+	}
+	assert.Len(t, packet.UnsignedTx.TxIn, len(spendAll))
+	assert.Equal(t, int32(2), packet.UnsignedTx.Version)
+	assert.Len(t, packet.Outputs[changeIdx].Bip32Derivation, 1)
+
+	leases, err := w.ListLeasedOutputs()
+	if err != nil {
+		t.Fatalf("unable to list leases: %v", err)
+	}
+	assert.Len(t, leases, len(spendAll))
+	for _, lease := range leases {
+		assert.Equal(t, PsbtLockID, lease.LockID)
+	}
+
+	// Leased outputs can't be funded again until they are released.
+	_, err = w.FundPsbt(template(spendAll[0]), nil, 1,
+		waddrmgr.DefaultAccountNum, 1000, CoinSelectionLargest)
+	assert.Error(t, err)
+
+	// The wallet signs every input once unlocked, and the signed packet
+	// finalizes to a valid transaction.
+	w.Lock()
+	if !w.Locked() {
+		t.Fatalf("wallet not locked")
+	}
+	_, err = w.SignPsbt(packet)
+	assert.True(t, waddrmgr.IsError(err, waddrmgr.ErrLocked))
+
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	signed, err := w.SignPsbt(packet)
+	if err != nil {
+		t.Fatalf("unable to sign PSBT: %v", err)
+	}
+	assert.Equal(t, []uint32{0, 1, 2, 3}, signed)
+
+	tx, err := w.FinalizePsbt(packet)
+	if err != nil {
+		t.Fatalf("unable to finalize PSBT: %v", err)
+	}
+	assert.Len(t, tx.TxIn, len(spendAll))
+
+	// Signing again adds nothing.
+	signed, err = w.SignPsbt(packet)
+	if err != nil {
+		t.Fatalf("unable to sign PSBT: %v", err)
+	}
+	assert.Empty(t, signed)
+
+	// Coins are selected when the template has no inputs.
+	for _, op := range spendAll {
+		if err := w.ReleaseOutput(PsbtLockID, op); err != nil {
+			t.Fatalf("unable to release output: %v", err)
+		}
+	}
+	packet = template()
+	_, err = w.FundPsbt(packet, &waddrmgr.KeyScopeBIP0084, 1,
+		waddrmgr.DefaultAccountNum, 1000, CoinSelectionLargest)
+	if err != nil {
+		t.Fatalf("unable to fund PSBT: %v", err)
+	}
+	assert.Equal(t, []wire.OutPoint{spendAll[2]}, []wire.OutPoint{
+		packet.UnsignedTx.TxIn[0].PreviousOutPoint})
+	assert.NotNil(t, packet.Inputs[0].WitnessUtxo)
+}
@@ -0,0 +1,274 @@
+package wallet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/wallet/txauthor"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// replacedTx describes the unmined transaction a fee bump replaces.
+type replacedTx struct {
+	hash  chainhash.Hash
+	fee   btcutil.Amount
+	vsize int64
+
+	// changeScript is the script of the change output of the replaced
+	// transaction, reused by the replacement. It is nil if the replaced
+	// transaction has no change.
+	changeScript []byte
+}
+
+// checkFee checks that a signed replacement pays enough to replace the
+// transaction under BIP-125.
+func (r *replacedTx) checkFee(tx *txauthor.AuthoredTx) error {
+	vsize := txVSize(tx.Tx)
+	err := txrules.CheckReplacementFee(
+		r.fee, r.vsize, tx.Fee, vsize, txrules.DefaultRelayFeePerKb)
+	if err != nil {
+		return fmt.Errorf("%w: replacing %v requires a fee of at least "+
+			"%v", err, r.hash, r.minFee(vsize))
+	}
+	return nil
+}
+
+// minFee returns the smallest fee a replacement of the given virtual size
+// pays under BIP-125.
+func (r *replacedTx) minFee(vsize int64) btcutil.Amount {
+	minFee := r.fee + txrules.DefaultRelayFeePerKb*
+		btcutil.Amount(vsize)/1000
+	if rateFee := r.fee*btcutil.Amount(vsize)/
+		btcutil.Amount(r.vsize) + 1; rateFee > minFee {
+
+		minFee = rateFee
+	}
+	return minFee
+}
+
+// txVSize returns the virtual size of a transaction.
+func txVSize(tx *wire.MsgTx) int64 {
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	return (weight + blockchain.WitnessScaleFactor - 1) /
+		blockchain.WitnessScaleFactor
+}
+
+// BumpFee replaces an unmined wallet transaction signaling replaceability
+// with one paying newFeeRate, in sat/kvB, as allowed by BIP-125. The
+// replacement spends the same inputs and pays the same outputs, lowering the
+// change to pay for the fee. Confirmed coins of the account the change went
+// to are added as inputs when the inputs alone can't pay for it.
+//
+// Every input of the transaction must be a wallet output, and none of its
+// outputs may be spent yet, since descendants would be evicted along with
+// it. Once the chain backend accepts the replacement, it is recorded in the
+// transaction store and the original is marked replaced by it.
+func (w *Wallet) BumpFee(txid chainhash.Hash,
+	newFeeRate btcutil.Amount) (*wire.MsgTx, error) {
+
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		replaced *replacedTx
+		req      createTxRequest
+	)
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		details, err := w.TxStore.TxDetails(txmgrNs, &txid)
+		if err != nil {
+			return err
+		}
+		replaced, req, err = w.replacementRequest(
+			txmgrNs, addrmgrNs, details, txid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Checking the fee rate first spares deriving keys and signing for a
+	// replacement that can never be accepted.
+	if newFeeRate*btcutil.Amount(replaced.vsize) <= replaced.fee*1000 {
+		return nil, fmt.Errorf("%w: fee rate must exceed %d sat/kvB",
+			txrules.ErrReplacementFeeTooLow,
+			replaced.fee*1000/btcutil.Amount(replaced.vsize))
+	}
+
+	req.feeSatPerKB = newFeeRate
+	req.minconf = 1
+	req.replaces = replaced
+	tx, err := w.createTx(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, txIn := range tx.Tx.TxIn {
+			w.UnlockOutpoint(txIn.PreviousOutPoint)
+		}
+	}()
+
+	if err := w.publishReplacement(chainClient, txid, tx.Tx); err != nil {
+		return nil, err
+	}
+	return tx.Tx, nil
+}
+
+// replacementRequest checks that a wallet transaction can be replaced, and
+// returns the request creating its replacement.
+func (w *Wallet) replacementRequest(txmgrNs, addrmgrNs walletdb.ReadBucket,
+	details *wtxmgr.TxDetails, txid chainhash.Hash) (*replacedTx,
+	createTxRequest, error) {
+
+	var req createTxRequest
+	switch {
+	case details == nil:
+		return nil, req, fmt.Errorf("transaction %v not found", txid)
+	case details.Block.Height != -1:
+		return nil, req, fmt.Errorf("transaction %v is already mined",
+			txid)
+	case !txrules.SignalsReplacement(&details.MsgTx):
+		return nil, req, fmt.Errorf("transaction %v does not signal "+
+			"replaceability", txid)
+	case len(details.Debits) != len(details.MsgTx.TxIn):
+		return nil, req, fmt.Errorf("transaction %v spends inputs "+
+			"the wallet does not own", txid)
+	}
+
+	var fee btcutil.Amount
+	for _, debit := range details.Debits {
+		fee += debit.Amount
+	}
+	for _, txOut := range details.MsgTx.TxOut {
+		fee -= btcutil.Amount(txOut.Value)
+	}
+	replaced := &replacedTx{
+		hash:  txid,
+		fee:   fee,
+		vsize: txVSize(&details.MsgTx),
+	}
+
+	change := -1
+	for _, credit := range details.Credits {
+		if credit.Spent {
+			return nil, req, fmt.Errorf("output %d of transaction "+
+				"%v is already spent", credit.Index, txid)
+		}
+		if credit.Change && change == -1 {
+			change = int(credit.Index)
+		}
+	}
+
+	for i, txOut := range details.MsgTx.TxOut {
+		if i == change {
+			replaced.changeScript = txOut.PkScript
+			continue
+		}
+		req.outputs = append(req.outputs, wire.NewTxOut(
+			txOut.Value, txOut.PkScript))
+	}
+	for _, txIn := range details.MsgTx.TxIn {
+		req.inputs = append(req.inputs, txIn.PreviousOutPoint)
+	}
+
+	// Coins are added from the account, and change is sent to the scope,
+	// of the change output, or of the first input without change.
+	accountScript := replaced.changeScript
+	if accountScript == nil {
+		coin, _, err := w.walletCoin(
+			txmgrNs, addrmgrNs, details.MsgTx.TxIn[0].PreviousOutPoint)
+		if err != nil {
+			return nil, req, err
+		}
+		accountScript = coin.PkScript
+	}
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		accountScript, w.chainParams)
+	if err != nil || len(addrs) != 1 {
+		return nil, req, fmt.Errorf("unsupported script %x",
+			accountScript)
+	}
+	scopedMgr, account, err := w.Manager.AddrAccount(addrmgrNs, addrs[0])
+	if err != nil {
+		return nil, req, err
+	}
+	scope := scopedMgr.Scope()
+	req.keyScope = &scope
+	req.account = account
+
+	return replaced, req, nil
+}
+
+// replacedCoins returns the coins spent by a transaction being replaced,
+// checking it is still unmined. It must only be called from the txCreator
+// goroutine.
+func (w *Wallet) replacedCoins(txmgrNs walletdb.ReadBucket,
+	addrmgrNs walletdb.ReadBucket, replaced *replacedTx,
+	inputs []wire.OutPoint) ([]txauthor.Coin, error) {
+
+	details, err := w.TxStore.TxDetails(txmgrNs, &replaced.hash)
+	if err != nil {
+		return nil, err
+	}
+	if details == nil || details.Block.Height != -1 {
+		return nil, fmt.Errorf("transaction %v is no longer "+
+			"replaceable", replaced.hash)
+	}
+
+	// The inputs are spent by the replaced transaction, which is the only
+	// transaction allowed to spend them.
+	coins := make([]txauthor.Coin, 0, len(inputs))
+	for _, op := range inputs {
+		coin, _, err := w.walletCoin(txmgrNs, addrmgrNs, op)
+		if err != nil {
+			return nil, err
+		}
+		coins = append(coins, *coin)
+	}
+	return coins, nil
+}
+
+// publishReplacement sends a replacement to the chain backend, and records it
+// once accepted. Until then the replaced transaction stays recorded, as a
+// rejected replacement must leave it untouched.
+func (w *Wallet) publishReplacement(chainClient chain.Interface,
+	replaced chainhash.Hash, tx *wire.MsgTx) error {
+
+	_, err := chainClient.SendRawTransaction(tx, false)
+	if err != nil && !isAlreadyKnownError(err) {
+		return fmt.Errorf("unable to publish replacement of %v: %w",
+			replaced, err)
+	}
+
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+	if err != nil {
+		return err
+	}
+	return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		label := w.TxStore.FetchTxLabel(txmgrNs, replaced)
+		if err := w.TxStore.ReplaceTx(txmgrNs, replaced, rec); err != nil {
+			return err
+		}
+		if err := w.addRelevantTx(dbTx, rec, nil); err != nil {
+			return err
+		}
+		if label == "" {
+			return nil
+		}
+		return w.TxStore.PutTxLabel(txmgrNs, rec.Hash, label)
+	})
+}
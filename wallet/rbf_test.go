@@ -0,0 +1,147 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// txFee returns the fee of a wallet transaction spending only wallet
+// outputs.
+func txFee(t *testing.T, w *Wallet, txHash chainhash.Hash) btcutil.Amount {
+	t.Helper()
+
+	var fee btcutil.Amount
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		details, err := w.TxStore.TxDetails(txmgrNs, &txHash)
+		if err != nil {
+			return err
+		}
+		for _, debit := range details.Debits {
+			fee += debit.Amount
+		}
+		for _, txOut := range details.MsgTx.TxOut {
+			fee -= btcutil.Amount(txOut.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to compute fee: %v", err)
+	}
+	return fee
+}
+
+func TestBumpFee(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	addTestCredits(t, w, 100000, 200000)
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	chainClient := &mockChainClient{}
+	w.chainClient = chainClient
+
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	payment := wire.NewTxOut(150000, pkScript)
+	original, err := w.SendOutputs([]*wire.TxOut{payment}, nil,
+		waddrmgr.DefaultAccountNum, 1, 1000, CoinSelectionLargest,
+		"withdrawal")
+	if err != nil {
+		t.Fatalf("unable to send outputs: %v", err)
+	}
+	if !txrules.SignalsReplacement(original) {
+		t.Fatalf("wallet transaction does not signal replaceability")
+	}
+	originalHash := original.TxHash()
+	originalFee := txFee(t, w, originalHash)
+
+	// A replacement must pay a higher fee rate.
+	_, err = w.BumpFee(originalHash, 1000)
+	if !errors.Is(err, txrules.ErrReplacementFeeTooLow) {
+		t.Fatalf("expected ErrReplacementFeeTooLow, got %v", err)
+	}
+
+	// The change pays for a moderate bump.
+	bumped, err := w.BumpFee(originalHash, 5000)
+	if err != nil {
+		t.Fatalf("unable to bump fee: %v", err)
+	}
+	assert.Equal(t, original.TxIn[0].PreviousOutPoint,
+		bumped.TxIn[0].PreviousOutPoint)
+	assert.Len(t, bumped.TxIn, 1)
+	assert.Len(t, bumped.TxOut, 2)
+	assert.Contains(t, bumped.TxOut, payment)
+	assert.Equal(t, bumped, chainClient.published[1])
+
+	bumpedHash := bumped.TxHash()
+	assert.Greater(t, int64(txFee(t, w, bumpedHash)),
+		int64(originalFee)+
+			txVSize(bumped)*int64(txrules.DefaultRelayFeePerKb)/1000)
+
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		details, err := w.TxStore.TxDetails(txmgrNs, &originalHash)
+		if err != nil {
+			return err
+		}
+		assert.Nil(t, details)
+		replacedBy, err := w.TxStore.ReplacedBy(txmgrNs, originalHash)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, &bumpedHash, replacedBy)
+
+		details, err = w.TxStore.TxDetails(txmgrNs, &bumpedHash)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, details.Credits, 1)
+		assert.True(t, details.Credits[0].Change)
+		assert.Equal(t, "withdrawal",
+			w.TxStore.FetchTxLabel(txmgrNs, bumpedHash))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replaced transaction can't be bumped again.
+	_, err = w.BumpFee(originalHash, 10000)
+	assert.Error(t, err)
+
+	// A bump the change can't pay for adds another input.
+	bumped, err = w.BumpFee(bumpedHash, 500000)
+	if err != nil {
+		t.Fatalf("unable to bump fee: %v", err)
+	}
+	assert.Len(t, bumped.TxIn, 2)
+	assert.Contains(t, bumped.TxOut, payment)
+	assert.Empty(t, w.LockedOutpoints())
+
+	// A rejected replacement leaves the transaction untouched.
+	chainClient.err = chain.ErrTxRejected
+	bumpedHash = bumped.TxHash()
+	_, err = w.BumpFee(bumpedHash, 600000)
+	assert.Error(t, err)
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		details, err := w.TxStore.TxDetails(txmgrNs, &bumpedHash)
+		assert.NotNil(t, details)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
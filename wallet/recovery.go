@@ -0,0 +1,451 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// errWalletShuttingDown is returned when the wallet stops while waiting to
+// be unlocked.
+var errWalletShuttingDown = errors.New("wallet shutting down")
+
+// branchRecoveryState tracks the addresses of one branch of an account that
+// are watched while recovering, and the horizon up to which they are
+// derived.
+type branchRecoveryState struct {
+	recoveryWindow uint32
+
+	// horizon is the index of the first address not derived yet.
+	horizon uint32
+
+	// nextUnfound is the index following the highest address found used
+	// on chain.
+	nextUnfound uint32
+
+	addrs map[uint32]btcutil.Address
+}
+
+func newBranchRecoveryState(recoveryWindow uint32) *branchRecoveryState {
+	return &branchRecoveryState{
+		recoveryWindow: recoveryWindow,
+		addrs:          make(map[uint32]btcutil.Address),
+	}
+}
+
+// extendHorizon returns the range of indexes to derive so that the
+// recovery window of addresses following the last found one is watched.
+func (b *branchRecoveryState) extendHorizon() (uint32, uint32) {
+	target := b.nextUnfound + b.recoveryWindow
+	if target <= b.horizon {
+		return b.horizon, 0
+	}
+
+	start, count := b.horizon, target-b.horizon
+	b.horizon = target
+	return start, count
+}
+
+// reportFound records that the address at index was found used on chain.
+func (b *branchRecoveryState) reportFound(index uint32) {
+	if index >= b.nextUnfound {
+		b.nextUnfound = index + 1
+	}
+}
+
+// accountRecoveryState holds the recovery state of both branches of an
+// account.
+type accountRecoveryState struct {
+	external *branchRecoveryState
+	internal *branchRecoveryState
+}
+
+// branch returns the state of the internal or external branch.
+func (a *accountRecoveryState) branch(internal bool) *branchRecoveryState {
+	if internal {
+		return a.internal
+	}
+	return a.external
+}
+
+// addrLocation identifies a watched address by its derivation.
+type addrLocation struct {
+	scope    waddrmgr.KeyScope
+	account  uint32
+	internal bool
+	index    uint32
+}
+
+// recoveryState tracks the addresses of every account of the wallet watched
+// while recovering it from its seed. Accounts are tracked from the first one
+// on, and an account following the last tracked one of a scope is tracked as
+// soon as any address of that one is found used, as BIP-44 account
+// discovery requires.
+type recoveryState struct {
+	recoveryWindow uint32
+
+	accounts map[waddrmgr.KeyScope][]*accountRecoveryState
+
+	// watched maps the encoding of every watched address to its
+	// derivation.
+	watched map[string]addrLocation
+}
+
+func newRecoveryState(recoveryWindow uint32) *recoveryState {
+	return &recoveryState{
+		recoveryWindow: recoveryWindow,
+		accounts:       make(map[waddrmgr.KeyScope][]*accountRecoveryState),
+		watched:        make(map[string]addrLocation),
+	}
+}
+
+// trackAccount starts watching the addresses of the next account of the
+// scope.
+func (r *recoveryState) trackAccount(scope waddrmgr.KeyScope) {
+	r.accounts[scope] = append(r.accounts[scope], &accountRecoveryState{
+		external: newBranchRecoveryState(r.recoveryWindow),
+		internal: newBranchRecoveryState(r.recoveryWindow),
+	})
+}
+
+// resume tracks the accounts of every default scope of the manager, taking
+// the addresses derived so far as found. The account following the last one
+// of a scope is tracked too once any of its addresses is, as it would have
+// been had these addresses been found on chain.
+func (r *recoveryState) resume(addrmgrNs walletdb.ReadBucket,
+	mgr *waddrmgr.Manager) error {
+
+	for _, scope := range waddrmgr.DefaultKeyScopes {
+		scopedMgr, err := mgr.FetchScopedKeyManager(scope)
+		if waddrmgr.IsError(err, waddrmgr.ErrScopeNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lastAccount, err := scopedMgr.LastAccount(addrmgrNs)
+		if err != nil {
+			return err
+		}
+
+		var props *waddrmgr.AccountProperties
+		for account := uint32(0); account <= lastAccount; account++ {
+			props, err = scopedMgr.AccountProperties(
+				addrmgrNs, account)
+			if err != nil {
+				return err
+			}
+
+			r.trackAccount(scope)
+			state := r.accounts[scope][account]
+			state.external.nextUnfound = props.ExternalKeyCount
+			state.internal.nextUnfound = props.InternalKeyCount
+		}
+		if props.ExternalKeyCount > 0 || props.InternalKeyCount > 0 {
+			r.trackAccount(scope)
+		}
+	}
+	return nil
+}
+
+// pendingAccounts returns whether an account must be created before the
+// addresses of every tracked account can be derived.
+func (r *recoveryState) pendingAccounts(addrmgrNs walletdb.ReadBucket,
+	mgr *waddrmgr.Manager) (bool, error) {
+
+	for scope, accounts := range r.accounts {
+		scopedMgr, err := mgr.FetchScopedKeyManager(scope)
+		if err != nil {
+			return false, err
+		}
+		lastAccount, err := scopedMgr.LastAccount(addrmgrNs)
+		if err != nil {
+			return false, err
+		}
+		if uint32(len(accounts)-1) > lastAccount {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expandHorizons derives the addresses up to the horizon of every tracked
+// branch, creating the accounts discovered since.
+func (r *recoveryState) expandHorizons(addrmgrNs walletdb.ReadWriteBucket,
+	mgr *waddrmgr.Manager) error {
+
+	for scope, accounts := range r.accounts {
+		scopedMgr, err := mgr.FetchScopedKeyManager(scope)
+		if err != nil {
+			return err
+		}
+		lastAccount, err := scopedMgr.LastAccount(addrmgrNs)
+		if err != nil {
+			return err
+		}
+
+		for account, state := range accounts {
+			account := uint32(account)
+			if account > lastAccount {
+				err := scopedMgr.NewRawAccount(addrmgrNs, account)
+				if err != nil {
+					return err
+				}
+				lastAccount = account
+			}
+
+			for _, internal := range []bool{false, true} {
+				branch := state.branch(internal)
+				start, count := branch.extendHorizon()
+				for index := start; index < start+count; index++ {
+					addr, err := scopedMgr.DeriveFromKeyPath(
+						addrmgrNs, waddrmgr.DerivationPath{
+							InternalAccount: account,
+							Account:         account,
+							Branch:          branchNumber(internal),
+							Index:           index,
+						})
+					if err != nil {
+						return err
+					}
+
+					branch.addrs[index] = addr.Address()
+					r.watched[addr.Address().EncodeAddress()] =
+						addrLocation{
+							scope:    scope,
+							account:  account,
+							internal: internal,
+							index:    index,
+						}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// branchNumber returns the BIP-44 branch number of the internal or external
+// branch.
+func branchNumber(internal bool) uint32 {
+	if internal {
+		return waddrmgr.InternalBranch
+	}
+	return waddrmgr.ExternalBranch
+}
+
+// addrs returns every watched address.
+func (r *recoveryState) addrs() []btcutil.Address {
+	addrs := make([]btcutil.Address, 0, len(r.watched))
+	for _, accounts := range r.accounts {
+		for _, account := range accounts {
+			for _, internal := range []bool{false, true} {
+				for _, addr := range account.branch(internal).addrs {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// findAddrs returns the watched addresses a block pays to that lie beyond
+// the addresses found so far. A nil block pays to none.
+func (r *recoveryState) findAddrs(block *wire.MsgBlock,
+	params *chaincfg.Params) []addrLocation {
+
+	if block == nil {
+		return nil
+	}
+
+	var found []addrLocation
+	for _, tx := range block.Transactions {
+		for _, txOut := range tx.TxOut {
+			_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+				txOut.PkScript, params)
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				loc, ok := r.watched[addr.EncodeAddress()]
+				if !ok {
+					continue
+				}
+				accounts := r.accounts[loc.scope]
+				branch := accounts[loc.account].branch(loc.internal)
+				if loc.index >= branch.nextUnfound {
+					found = append(found, loc)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// reportFound records the addresses found used on chain, deriving them in
+// the address manager so the transactions paying to them are recorded. An
+// account following the last tracked one of its scope is tracked as soon
+// as one of its addresses is found.
+func (r *recoveryState) reportFound(addrmgrNs walletdb.ReadWriteBucket,
+	mgr *waddrmgr.Manager, found []addrLocation) error {
+
+	for _, loc := range found {
+		scopedMgr, err := mgr.FetchScopedKeyManager(loc.scope)
+		if err != nil {
+			return err
+		}
+		extend := scopedMgr.ExtendExternalAddresses
+		if loc.internal {
+			extend = scopedMgr.ExtendInternalAddresses
+		}
+		if err := extend(addrmgrNs, loc.account, loc.index); err != nil {
+			return err
+		}
+
+		accounts := r.accounts[loc.scope]
+		accounts[loc.account].branch(loc.internal).reportFound(loc.index)
+		if int(loc.account) == len(accounts)-1 {
+			r.trackAccount(loc.scope)
+		}
+	}
+	return nil
+}
+
+// recover scans the chain from the block following the one the wallet synced
+// through to the tip of the backend for transactions paying to addresses
+// derived from its seed. Only the blocks whose compact filters match a
+// watched address are downloaded when the backend serves them. For every
+// branch of every account, the addresses of the recovery window that follow
+// the last one found are watched, and the window moves forward as addresses
+// are found. Accounts are discovered one after the other, which requires the
+// wallet to be unlocked, so recovery waits for an unlock before creating an
+// account.
+//
+// The addresses derived before are taken as found, so an interrupted
+// recovery resumes where it stopped. Once the tip is reached, the recovery is
+// marked finished.
+func (w *Wallet) recover(chainClient chain.Interface, bestHeight int32,
+	recoveryWindow uint32) error {
+
+	startHeight := w.Manager.SyncedTo().Height + 1
+	fmt.Printf("Recovering wallet from height %d with a recovery "+
+		"window of %d addresses \n", startHeight, recoveryWindow)
+
+	state := newRecoveryState(recoveryWindow)
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		return state.resume(addrmgrNs, w.Manager)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The addresses of the initial recovery windows are derived before
+	// scanning, and those derived from the blocks found are watched from
+	// the following block on.
+	if err := w.recoverBlock(state, nil); err != nil {
+		return err
+	}
+	scanner := chain.NewFilterScanner(chainClient)
+	if err := scanner.WatchAddrs(state.addrs()); err != nil {
+		return err
+	}
+
+	err = scanner.Scan(startHeight, bestHeight, func(meta wtxmgr.BlockMeta,
+		block *wire.MsgBlock) error {
+
+		if block != nil {
+			if err := w.recoverBlock(state, block); err != nil {
+				return err
+			}
+			if err := scanner.WatchAddrs(state.addrs()); err != nil {
+				return err
+			}
+		}
+		return w.processBlock(block, &meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Finished recovering wallet through height %d \n",
+		bestHeight)
+	return walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		return w.Manager.SetRecoveryWindow(addrmgrNs, 0)
+	})
+}
+
+// recoverBlock derives the addresses of a block found used on chain, until
+// the block pays to no watched address beyond them. A nil block only derives
+// the addresses of the recovery windows not derived yet.
+func (w *Wallet) recoverBlock(state *recoveryState,
+	block *wire.MsgBlock) error {
+
+	for {
+		var pending bool
+		err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+			addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+
+			var err error
+			pending, err = state.pendingAccounts(addrmgrNs, w.Manager)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if pending {
+			if err := w.waitUnlocked(); err != nil {
+				return err
+			}
+		}
+
+		var found []addrLocation
+		err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+			addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+
+			err := state.expandHorizons(addrmgrNs, w.Manager)
+			if err != nil {
+				return err
+			}
+			found = state.findAddrs(block, w.chainParams)
+			return state.reportFound(addrmgrNs, w.Manager, found)
+		})
+		if waddrmgr.IsError(err, waddrmgr.ErrLocked) {
+			// The wallet locked again before the account was
+			// created.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(found) == 0 {
+			return nil
+		}
+	}
+}
+
+// waitUnlocked blocks until the wallet is unlocked or stopped.
+func (w *Wallet) waitUnlocked() error {
+	client := w.NtfnServer.LockStateNotifications()
+	defer client.Done()
+
+	quit := w.quitChan()
+	for w.Manager.IsLocked() {
+		fmt.Println("Waiting for the wallet to be unlocked to " +
+			"discover accounts")
+		select {
+		case <-client.C:
+		case <-quit:
+			return errWalletShuttingDown
+		}
+	}
+	return nil
+}
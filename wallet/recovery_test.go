@@ -0,0 +1,332 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain/simchain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// bip84Address returns the address of the BIP-84 scope of the root key at
+// the given derivation, derived the way the address manager does.
+func bip84Address(t *testing.T, rootKey *hdkeychain.ExtendedKey,
+	account, branch, index uint32) btcutil.Address {
+
+	t.Helper()
+
+	params := &chaincfg.RegressionNetParams
+	scope := waddrmgr.KeyScopeBIP0084
+	key := rootKey
+	for _, child := range []uint32{
+		scope.Purpose + hdkeychain.HardenedKeyStart,
+		scope.Coin + hdkeychain.HardenedKeyStart,
+		account + hdkeychain.HardenedKeyStart,
+		branch,
+		index,
+	} {
+		var err error
+		key, err = key.DeriveNonStandard(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(
+		btcutil.Hash160(pubKey.SerializeCompressed()), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// bip84Payment returns a transaction paying to the address of the BIP-84
+// scope of the root key at the given derivation.
+func bip84Payment(t *testing.T, rootKey *hdkeychain.ExtendedKey,
+	account, branch, index uint32) *wire.MsgTx {
+
+	t.Helper()
+
+	addr := bip84Address(t, rootKey, account, branch, index)
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{byte(account), byte(branch), byte(index)},
+	}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(10000, pkScript))
+	return tx
+}
+
+func TestBranchRecoveryState(t *testing.T) {
+	b := newBranchRecoveryState(5)
+
+	start, count := b.extendHorizon()
+	assert.Equal(t, uint32(0), start)
+	assert.Equal(t, uint32(5), count)
+
+	// Nothing to derive until an address is found.
+	_, count = b.extendHorizon()
+	assert.Equal(t, uint32(0), count)
+
+	b.reportFound(3)
+	start, count = b.extendHorizon()
+	assert.Equal(t, uint32(5), start)
+	assert.Equal(t, uint32(4), count)
+
+	// Finding an address below the last found one moves nothing.
+	b.reportFound(1)
+	_, count = b.extendHorizon()
+	assert.Equal(t, uint32(0), count)
+}
+
+func TestRecover(t *testing.T) {
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootKey, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, cleanUp := testWalletFromKey(t, rootKey, time.Unix(1600000000, 0), 5)
+	defer cleanUp()
+
+	var (
+		ext3  = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 3)
+		int2  = bip84Payment(t, rootKey, 0, waddrmgr.InternalBranch, 2)
+		ext7  = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 7)
+		ext12 = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 12)
+		acct1 = bip84Payment(t, rootKey, 1, waddrmgr.ExternalBranch, 0)
+		ext20 = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 20)
+	)
+
+	// Index 7 lies beyond the initial window, and index 12 is only
+	// watched once index 7 of the same block is found.
+	genesis := testBlock(nil, 0)
+	b1 := testBlock(genesis, 0, ext3, int2)
+	b2 := testBlock(b1, 0, ext12, ext7)
+	b3 := testBlock(b2, 0, acct1)
+	b4 := testBlock(b3, 0, ext20)
+	chainClient := &mockChainClient{
+		blocks: []*wire.MsgBlock{genesis, b1, b2, b3, b4},
+		ntfns:  make(chan interface{}, 1),
+	}
+
+	// Discovering account 1 waits for the wallet to be unlocked.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- w.syncWithChain(chainClient)
+	}()
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("unable to recover wallet: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("recovery did not finish")
+	}
+	waitSyncedTo(t, w, b4, 4)
+
+	assert.Equal(t, int32(1), txHeight(t, w, ext3.TxHash()))
+	assert.Equal(t, int32(1), txHeight(t, w, int2.TxHash()))
+	assert.Equal(t, int32(2), txHeight(t, w, ext7.TxHash()))
+	assert.Equal(t, int32(2), txHeight(t, w, ext12.TxHash()))
+	assert.Equal(t, int32(3), txHeight(t, w, acct1.TxHash()))
+
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		// Index 20 lies beyond the recovery window.
+		ext20Hash := ext20.TxHash()
+		details, err := w.TxStore.TxDetails(txmgrNs, &ext20Hash)
+		if err != nil {
+			return err
+		}
+		assert.Nil(t, details)
+
+		// The addresses up to the last ones found are derived.
+		for _, derived := range []struct {
+			account, branch, index uint32
+			known                  bool
+		}{
+			{0, waddrmgr.ExternalBranch, 12, true},
+			{0, waddrmgr.ExternalBranch, 13, false},
+			{0, waddrmgr.InternalBranch, 2, true},
+			{0, waddrmgr.InternalBranch, 3, false},
+			{1, waddrmgr.ExternalBranch, 0, true},
+			{1, waddrmgr.ExternalBranch, 1, false},
+		} {
+			addr := bip84Address(t, rootKey, derived.account,
+				derived.branch, derived.index)
+			_, err := w.Manager.Address(addrmgrNs, addr)
+			if derived.known {
+				assert.NoError(t, err, "%+v", derived)
+			} else {
+				assert.True(t, waddrmgr.IsError(
+					err, waddrmgr.ErrAddressNotFound), "%+v", derived)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingChainClient counts the blocks downloaded from a simulated chain.
+type countingChainClient struct {
+	*simchain.Client
+	blockRequests int
+}
+
+func (c *countingChainClient) GetBlock(
+	hash *chainhash.Hash) (*wire.MsgBlock, error) {
+
+	c.blockRequests++
+	return c.Client.GetBlock(hash)
+}
+
+func TestRecoverWithCompactFilters(t *testing.T) {
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootKey, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The simulated chain starts at the genesis block of the network.
+	birthday := chaincfg.RegressionNetParams.GenesisBlock.Header.Timestamp
+	w, cleanUp := testWalletFromKey(t, rootKey, birthday, 5)
+	defer cleanUp()
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	var (
+		ext3 = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 3)
+		ext7 = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 7)
+	)
+
+	// Index 7 is only watched once index 3 is found, blocks later.
+	sim := simchain.New(&chaincfg.RegressionNetParams)
+	chainClient := &countingChainClient{Client: sim.NewClient()}
+	for _, tx := range []*wire.MsgTx{ext3, ext7} {
+		if _, err := chainClient.SendRawTransaction(tx, false); err != nil {
+			t.Fatal(err)
+		}
+		sim.Mine()
+		sim.MineEmpty(2)
+	}
+	tip, height := sim.Tip()
+
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to recover wallet: %v", err)
+	}
+	waitSyncedTo(t, w, tip, height)
+
+	assert.Equal(t, int32(1), txHeight(t, w, ext3.TxHash()))
+	assert.Equal(t, int32(4), txHeight(t, w, ext7.TxHash()))
+
+	// Only the blocks paying to the wallet were downloaded.
+	assert.Equal(t, 2, chainClient.blockRequests)
+}
+
+func TestResumeRecovery(t *testing.T) {
+	seed, err := hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootKey, err := hdkeychain.NewMaster(seed, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, cleanUp := testWalletFromKey(t, rootKey, time.Unix(1600000000, 0), 5)
+	defer cleanUp()
+
+	var (
+		ext3  = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 3)
+		ext7  = bip84Payment(t, rootKey, 0, waddrmgr.ExternalBranch, 7)
+		acct1 = bip84Payment(t, rootKey, 1, waddrmgr.ExternalBranch, 0)
+	)
+	genesis := testBlock(nil, 0)
+	b1 := testBlock(genesis, 0, ext3)
+	b2 := testBlock(b1, 0, ext7)
+	b3 := testBlock(b2, 0, acct1)
+	chainClient := &mockChainClient{
+		blocks: []*wire.MsgBlock{genesis, b1, b2, b3},
+		ntfns:  make(chan interface{}, 1),
+	}
+
+	// Finding index 3 makes recovery wait for an unlock to discover
+	// account 1, and the wallet stops meanwhile.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- w.syncWithChain(chainClient)
+	}()
+	ext3Addr := bip84Address(t, rootKey, 0, waddrmgr.ExternalBranch, 3)
+	assert.Eventually(t, func() bool {
+		err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+			addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+			_, err := w.Manager.Address(addrmgrNs, ext3Addr)
+			return err
+		})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	w.Stop()
+	select {
+	case err := <-errChan:
+		assert.Equal(t, errWalletShuttingDown, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("recovery did not stop")
+	}
+	w.WaitForShutdown()
+
+	// The wallet is restarted without a recovery window, and the
+	// recovery resumes from the block it synced through.
+	w.recoveryWindow = 0
+	w.Start()
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+	if err := w.syncWithChain(chainClient); err != nil {
+		t.Fatalf("unable to resume recovery: %v", err)
+	}
+	waitSyncedTo(t, w, b3, 3)
+
+	assert.Equal(t, int32(1), txHeight(t, w, ext3.TxHash()))
+	assert.Equal(t, int32(2), txHeight(t, w, ext7.TxHash()))
+	assert.Equal(t, int32(3), txHeight(t, w, acct1.TxHash()))
+
+	// Once finished, the recovery isn't run again.
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		assert.Zero(t, w.Manager.RecoveryWindow(addrmgrNs))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
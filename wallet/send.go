@@ -0,0 +1,191 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+)
+
+// SendOutputs funds, signs and publishes a transaction paying to the passed
+// outputs. Coins with at least minconf confirmations are selected from the
+// account using the given strategy, and change is sent to a new internal
+// address of the account. If keyScope is nil, coins of every scope are
+// eligible and change goes to the BIP0084 scope.
+//
+// The signed transaction is recorded as unmined, along with its label if it
+// isn't empty, before it is published through the chain backend. If the
+// backend rejects it, the record is removed again so its inputs may be
+// spent by another transaction. Errors that leave unknown whether the
+// backend accepted it, such as timeouts, keep it recorded, as it may have
+// been relayed.
+func (w *Wallet) SendOutputs(outputs []*wire.TxOut, keyScope *waddrmgr.KeyScope,
+	account uint32, minconf int32, satPerKb btcutil.Amount,
+	strategy CoinSelectionStrategy, label string) (*wire.MsgTx, error) {
+
+	// Ensure the outputs to be created adhere to the network's consensus
+	// rules and are not dust.
+	for _, output := range outputs {
+		err := txrules.CheckOutput(output, txrules.DefaultRelayFeePerKb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(label) > wtxmgr.TxLabelLimit {
+		return nil, fmt.Errorf("transaction label of %d bytes exceeds "+
+			"limit of %d", len(label), wtxmgr.TxLabelLimit)
+	}
+
+	chainClient, err := w.requireChainClient()
+	if err != nil {
+		return nil, err
+	}
+
+	createdTx, err := w.CreateSimpleTx(
+		keyScope, account, outputs, minconf, satPerKb, strategy, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once the transaction is recorded, the store tracks its inputs as
+	// spent and the in-memory locks are no longer needed. If it couldn't
+	// be published, the inputs are free to be spent again.
+	defer func() {
+		for _, txIn := range createdTx.Tx.TxIn {
+			w.UnlockOutpoint(txIn.PreviousOutPoint)
+		}
+	}()
+
+	err = w.publishTransaction(chainClient, createdTx.Tx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return createdTx.Tx, nil
+}
+
+// publishTransaction records tx as unmined and sends it to the chain
+// backend.
+func (w *Wallet) publishTransaction(chainClient chain.Interface, tx *wire.MsgTx,
+	label string) error {
+
+	rec, err := wtxmgr.NewTxRecordFromMsgTx(tx, time.Now())
+	if err != nil {
+		return err
+	}
+	err = walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		if err := w.addRelevantTx(dbTx, rec, nil); err != nil {
+			return err
+		}
+		if label == "" {
+			return nil
+		}
+
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+		return w.TxStore.PutTxLabel(txmgrNs, rec.Hash, label)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = chainClient.SendRawTransaction(tx, false)
+	if err == nil || isAlreadyKnownError(err) {
+		return nil
+	}
+	if !errors.Is(err, chain.ErrTxRejected) {
+		// The transaction may have been relayed before the error,
+		// so its inputs stay spent.
+		return fmt.Errorf("unable to publish transaction %v: %w",
+			rec.Hash, err)
+	}
+
+	// The backend rejected the transaction, so it will never confirm.
+	// Remove it so its inputs are spendable again.
+	dbErr := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+		return w.TxStore.RemoveUnminedTx(txmgrNs, rec)
+	})
+	if dbErr != nil {
+		fmt.Printf("Unable to remove invalid transaction %v: %v \n",
+			rec.Hash, dbErr)
+	}
+
+	return fmt.Errorf("unable to publish transaction %v: %w", rec.Hash, err)
+}
+
+// isAlreadyKnownError returns whether a backend error means the transaction
+// was already accepted to the mempool or mined.
+func isAlreadyKnownError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, known := range []string{
+		"already have transaction",
+		"txn-already-known",
+		"txn-already-in-mempool",
+		"transaction already in block chain",
+	} {
+		if strings.Contains(msg, known) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRelevantTx records a transaction in the store, along with a credit for
+// each output paying to a wallet address. Those addresses are marked used.
+func (w *Wallet) addRelevantTx(dbTx walletdb.ReadWriteTx, rec *wtxmgr.TxRecord,
+	block *wtxmgr.BlockMeta) error {
+
+	addrmgrNs := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+	txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+	if err := w.TxStore.InsertTx(txmgrNs, rec, block); err != nil {
+		return err
+	}
+
+	for i, output := range rec.MsgTx.TxOut {
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+			output.PkScript, w.chainParams)
+		if err != nil {
+			// Non-standard outputs are skipped.
+			continue
+		}
+
+		for _, addr := range addrs {
+			scopedMgr, _, err := w.Manager.AddrAccount(addrmgrNs, addr)
+			if waddrmgr.IsError(err, waddrmgr.ErrAddressNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ma, err := scopedMgr.Address(addrmgrNs, addr)
+			if err != nil {
+				return err
+			}
+
+			err = w.TxStore.AddCredit(
+				txmgrNs, rec, block, uint32(i), ma.Internal())
+			if err != nil {
+				return err
+			}
+			if err := scopedMgr.MarkUsed(addrmgrNs, addr); err != nil {
+				return err
+			}
+
+			// An output is credited once, even if it pays to
+			// several wallet addresses.
+			break
+		}
+	}
+
+	return nil
+}
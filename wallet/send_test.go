@@ -0,0 +1,161 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendOutputs(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	addTestCredits(t, w, 100000, 200000)
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	outputs := []*wire.TxOut{wire.NewTxOut(150000, pkScript)}
+
+	// Without a chain backend nothing can be published.
+	_, err := w.SendOutputs(outputs, nil, waddrmgr.DefaultAccountNum, 1,
+		1000, CoinSelectionLargest, "")
+	if err == nil {
+		t.Fatalf("expected error without chain client")
+	}
+
+	// A rejected transaction is removed from the store again.
+	chainClient := &mockChainClient{err: chain.ErrTxRejected}
+	w.chainClient = chainClient
+	_, err = w.SendOutputs(outputs, nil, waddrmgr.DefaultAccountNum, 1,
+		1000, CoinSelectionLargest, "")
+	if err == nil {
+		t.Fatalf("expected error for rejected transaction")
+	}
+	if len(w.LockedOutpoints()) != 0 {
+		t.Fatalf("rejected transaction left outpoints locked")
+	}
+
+	chainClient.err = nil
+	tx, err := w.SendOutputs(outputs, nil, waddrmgr.DefaultAccountNum, 1,
+		5000, CoinSelectionLargest, "withdrawal")
+	if err != nil {
+		t.Fatalf("unable to send outputs: %v", err)
+	}
+	if len(chainClient.published) != 1 ||
+		chainClient.published[0].TxHash() != tx.TxHash() {
+
+		t.Fatalf("transaction was not published")
+	}
+
+	txHash := tx.TxHash()
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		details, err := w.TxStore.TxDetails(txmgrNs, &txHash)
+		if err != nil {
+			return err
+		}
+		if details == nil {
+			t.Fatalf("transaction not recorded")
+		}
+		if details.Block.Height != -1 {
+			t.Fatalf("expected unmined transaction, got height %d",
+				details.Block.Height)
+		}
+
+		var totalIn btcutil.Amount
+		for _, debit := range details.Debits {
+			totalIn += debit.Amount
+		}
+		var totalOut btcutil.Amount
+		for _, txOut := range tx.TxOut {
+			totalOut += btcutil.Amount(txOut.Value)
+		}
+		fee := totalIn - totalOut
+		weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+		vsize := (weight + 3) / 4
+		if rate := int64(fee) * 1000 / vsize; rate < 5000 || rate > 6000 {
+			t.Fatalf("fee rate %d sat/kvB not within 1 sat/vB of "+
+				"5000", rate)
+		}
+
+		// The change output is credited and its address marked used.
+		if len(details.Credits) != 1 || !details.Credits[0].Change {
+			t.Fatalf("expected one change credit, got %v",
+				details.Credits)
+		}
+		changeOut := tx.TxOut[details.Credits[0].Index]
+		_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+			changeOut.PkScript, w.chainParams)
+		if err != nil {
+			return err
+		}
+		ma, err := w.Manager.Address(addrmgrNs, addrs[0])
+		if err != nil {
+			return err
+		}
+		if !ma.Internal() || !ma.Used(addrmgrNs) {
+			t.Fatalf("change address should be internal and used")
+		}
+
+		if label := w.TxStore.FetchTxLabel(txmgrNs, txHash); label !=
+			"withdrawal" {
+
+			t.Fatalf("unexpected label %q", label)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The spent coins are no longer available.
+	_, err = w.SendOutputs(outputs, nil, waddrmgr.DefaultAccountNum, 1,
+		1000, CoinSelectionLargest, "")
+	if err == nil {
+		t.Fatalf("expected insufficient funds after spending")
+	}
+}
+
+func TestSendOutputsUnknownOutcome(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	addTestCredits(t, w, 100000)
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	// A transaction that may have been relayed before the backend failed
+	// stays recorded, spending its inputs.
+	w.chainClient = &mockChainClient{err: errors.New("connection reset")}
+	pkScript := make([]byte, 22)
+	pkScript[1] = 0x14
+	outputs := []*wire.TxOut{wire.NewTxOut(50000, pkScript)}
+	_, err := w.SendOutputs(outputs, nil, waddrmgr.DefaultAccountNum, 1,
+		1000, CoinSelectionLargest, "")
+	assert.ErrorContains(t, err, "connection reset")
+
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		unmined, err := w.TxStore.UnminedTxs(txmgrNs)
+		assert.Len(t, unmined, 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, w.LockedOutpoints())
+}
@@ -0,0 +1,533 @@
+package wallet
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// SignTransaction signs the inputs of tx at the given indexes, or all of its
+// inputs if inputIndexes is empty. The outputs spent by the inputs are looked
+// up in the transaction store, and the keys and scripts able to spend them in
+// the address manager.
+//
+// The indexes of the inputs that couldn't be fully signed are returned. An
+// input is left untouched if its previous output is unknown, doesn't pay to a
+// wallet address or uses an unsupported script. A multisig input is kept
+// with the signatures the wallet could add. Taproot inputs can only be signed
+// if every output spent by tx is known, since they all commit to the
+// signature hash.
+func (w *Wallet) SignTransaction(tx *wire.MsgTx,
+	inputIndexes []uint32) ([]uint32, error) {
+
+	if len(inputIndexes) == 0 {
+		inputIndexes = make([]uint32, len(tx.TxIn))
+		for i := range tx.TxIn {
+			inputIndexes[i] = uint32(i)
+		}
+	}
+	for _, idx := range inputIndexes {
+		if int(idx) >= len(tx.TxIn) {
+			return nil, fmt.Errorf("input index %d out of range for "+
+				"transaction with %d inputs", idx, len(tx.TxIn))
+		}
+	}
+
+	var unsigned []uint32
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+
+		// Unknown outputs are added to the fetcher as empty outputs,
+		// so the signature hashes of the other inputs can still be
+		// computed.
+		prevOuts := make(map[wire.OutPoint]*wire.TxOut, len(tx.TxIn))
+		fetcher := txscript.NewMultiPrevOutFetcher(nil)
+		allKnown := true
+		for _, txIn := range tx.TxIn {
+			op := txIn.PreviousOutPoint
+			details, err := w.TxStore.TxDetails(txmgrNs, &op.Hash)
+			if err != nil {
+				return err
+			}
+			if details == nil ||
+				int(op.Index) >= len(details.MsgTx.TxOut) {
+
+				allKnown = false
+				fetcher.AddPrevOut(op, &wire.TxOut{})
+				continue
+			}
+
+			prevOut := details.MsgTx.TxOut[op.Index]
+			prevOuts[op] = prevOut
+			fetcher.AddPrevOut(op, prevOut)
+		}
+
+		signer := &inputSigner{
+			Manager:   w.Manager,
+			addrmgrNs: addrmgrNs,
+			tx:        tx,
+			sigHashes: txscript.NewTxSigHashes(tx, fetcher),
+		}
+		defer signer.keys.zero()
+
+		for _, idx := range inputIndexes {
+			txIn := tx.TxIn[idx]
+			prevOut, ok := prevOuts[txIn.PreviousOutPoint]
+			if !ok || (!allKnown &&
+				txscript.IsPayToTaproot(prevOut.PkScript)) {
+
+				unsigned = append(unsigned, idx)
+				continue
+			}
+
+			sigScript, witness := txIn.SignatureScript, txIn.Witness
+			err := signer.signInput(int(idx), prevOut)
+			if waddrmgr.IsError(err, waddrmgr.ErrLocked) {
+				return err
+			}
+			if err != nil {
+				fmt.Printf("Unable to sign input %d of %v: %v \n",
+					idx, tx.TxHash(), err)
+				txIn.SignatureScript, txIn.Witness = sigScript, witness
+				unsigned = append(unsigned, idx)
+				continue
+			}
+
+			// The signatures added may not satisfy the script yet,
+			// e.g. for a multisig script we hold only some of the
+			// keys of.
+			vm, err := txscript.NewEngine(
+				prevOut.PkScript, tx, int(idx),
+				txscript.StandardVerifyFlags, nil,
+				signer.sigHashes, prevOut.Value, fetcher)
+			if err == nil {
+				err = vm.Execute()
+			}
+			if err != nil {
+				unsigned = append(unsigned, idx)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return unsigned, nil
+}
+
+// inputSigner adds signatures to the inputs of a transaction using the keys
+// and scripts of the address manager.
+type inputSigner struct {
+	*waddrmgr.Manager
+	addrmgrNs walletdb.ReadBucket
+	tx        *wire.MsgTx
+	sigHashes *txscript.TxSigHashes
+	keys      signingKeys
+}
+
+// signingKeys holds the private keys handed out for signing. They are copies
+// of the keys of the address manager, zeroed once the signatures are made.
+type signingKeys []*btcec.PrivateKey
+
+// add remembers the key to be zeroed.
+func (k *signingKeys) add(key *btcec.PrivateKey) {
+	if key != nil {
+		*k = append(*k, key)
+	}
+}
+
+// zero zeroes every key handed out.
+func (k *signingKeys) zero() {
+	for _, key := range *k {
+		key.Zero()
+	}
+	*k = nil
+}
+
+// GetKey implements the txscript.KeyDB interface. The key is zeroed along
+// with the signer's other keys.
+func (s *inputSigner) GetKey(addr btcutil.Address) (*btcec.PrivateKey, bool,
+	error) {
+
+	key, compressed, err := secretSource{s.Manager, s.addrmgrNs}.GetKey(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	s.keys.add(key)
+	return key, compressed, nil
+}
+
+// GetScript implements the txscript.ScriptDB interface.
+func (s *inputSigner) GetScript(addr btcutil.Address) ([]byte, error) {
+	return secretSource{s.Manager, s.addrmgrNs}.GetScript(addr)
+}
+
+// address returns the wallet address the output script pays to.
+func (s *inputSigner) address(pkScript []byte) (waddrmgr.ManagedAddress,
+	error) {
+
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(
+		pkScript, s.ChainParams())
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) != 1 {
+		return nil, fmt.Errorf("script pays to %d addresses", len(addrs))
+	}
+
+	return s.Address(s.addrmgrNs, addrs[0])
+}
+
+// signInput sets the signature script and witness of the input at idx,
+// which spends prevOut.
+func (s *inputSigner) signInput(idx int, prevOut *wire.TxOut) error {
+	txIn := s.tx.TxIn[idx]
+	pkScript := prevOut.PkScript
+
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.WitnessV0PubKeyHashTy:
+		ma, err := s.address(pkScript)
+		if err != nil {
+			return err
+		}
+		key, _, err := s.GetKey(ma.Address())
+		if err != nil {
+			return err
+		}
+		witness, err := txscript.WitnessSignature(
+			s.tx, s.sigHashes, idx, prevOut.Value, pkScript,
+			txscript.SigHashAll, key, true)
+		if err != nil {
+			return err
+		}
+		txIn.SignatureScript = nil
+		txIn.Witness = witness
+		return nil
+
+	case txscript.ScriptHashTy:
+		ma, err := s.address(pkScript)
+		if err != nil {
+			return err
+		}
+		if ma.AddrType() == waddrmgr.NestedWitnessPubKey {
+			return s.signNestedWitnessKeyHash(idx, prevOut, ma)
+		}
+
+		// Redeem scripts are looked up through the ScriptDB.
+		sigScript, err := txscript.SignTxOutput(
+			s.ChainParams(), s.tx, idx, pkScript,
+			txscript.SigHashAll, s, s, txIn.SignatureScript)
+		if err != nil {
+			return err
+		}
+		txIn.SignatureScript = sigScript
+		return nil
+
+	case txscript.WitnessV0ScriptHashTy:
+		return s.signWitnessScript(idx, prevOut)
+
+	case txscript.WitnessV1TaprootTy:
+		ma, err := s.address(pkScript)
+		if err != nil {
+			return err
+		}
+		if tma, ok := ma.(waddrmgr.ManagedTaprootScriptAddress); ok {
+			return s.signTapscript(idx, prevOut, tma)
+		}
+
+		key, _, err := s.GetKey(ma.Address())
+		if err != nil {
+			return err
+		}
+		witness, err := txscript.TaprootWitnessSignature(
+			s.tx, s.sigHashes, idx, prevOut.Value, pkScript,
+			txscript.SigHashDefault, key)
+		if err != nil {
+			return err
+		}
+		txIn.SignatureScript = nil
+		txIn.Witness = witness
+		return nil
+
+	default:
+		sigScript, err := txscript.SignTxOutput(
+			s.ChainParams(), s.tx, idx, pkScript,
+			txscript.SigHashAll, s, s, txIn.SignatureScript)
+		if err != nil {
+			return err
+		}
+		txIn.SignatureScript = sigScript
+		return nil
+	}
+}
+
+// signNestedWitnessKeyHash signs a P2WPKH output nested in P2SH. The
+// signature script pushes the witness program, and the witness holds the
+// signature and public key.
+func (s *inputSigner) signNestedWitnessKeyHash(idx int, prevOut *wire.TxOut,
+	ma waddrmgr.ManagedAddress) error {
+
+	key, _, err := s.GetKey(ma.Address())
+	if err != nil {
+		return err
+	}
+
+	pubKeyHash := btcutil.Hash160(key.PubKey().SerializeCompressed())
+	witnessProgram, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(pubKeyHash).
+		Script()
+	if err != nil {
+		return err
+	}
+	sigScript, err := txscript.NewScriptBuilder().
+		AddData(witnessProgram).
+		Script()
+	if err != nil {
+		return err
+	}
+
+	witness, err := txscript.WitnessSignature(
+		s.tx, s.sigHashes, idx, prevOut.Value, witnessProgram,
+		txscript.SigHashAll, key, true)
+	if err != nil {
+		return err
+	}
+
+	txIn := s.tx.TxIn[idx]
+	txIn.SignatureScript = sigScript
+	txIn.Witness = witness
+	return nil
+}
+
+// signWitnessScript signs a P2WSH output whose witness script was imported.
+// Pay-to-pubkey, pay-to-pubkey-hash and multisig witness scripts are
+// supported.
+func (s *inputSigner) signWitnessScript(idx int, prevOut *wire.TxOut) error {
+	ma, err := s.address(prevOut.PkScript)
+	if err != nil {
+		return err
+	}
+	msa, ok := ma.(waddrmgr.ManagedScriptAddress)
+	if !ok {
+		return fmt.Errorf("address %v has no witness script",
+			ma.Address())
+	}
+	witnessScript, err := msa.Script()
+	if err != nil {
+		return err
+	}
+
+	class, addrs, nRequired, err := txscript.ExtractPkScriptAddrs(
+		witnessScript, s.ChainParams())
+	if err != nil {
+		return err
+	}
+
+	sign := func(key *btcec.PrivateKey) ([]byte, error) {
+		return txscript.RawTxInWitnessSignature(
+			s.tx, s.sigHashes, idx, prevOut.Value, witnessScript,
+			txscript.SigHashAll, key)
+	}
+
+	var witness wire.TxWitness
+	switch class {
+	case txscript.PubKeyTy, txscript.PubKeyHashTy:
+		key, compressed, err := s.GetKey(addrs[0])
+		if err != nil {
+			return err
+		}
+		sig, err := sign(key)
+		if err != nil {
+			return err
+		}
+
+		witness = wire.TxWitness{sig}
+		if class == txscript.PubKeyHashTy {
+			pubKey := key.PubKey().SerializeUncompressed()
+			if compressed {
+				pubKey = key.PubKey().SerializeCompressed()
+			}
+			witness = append(witness, pubKey)
+		}
+
+	case txscript.MultiSigTy:
+		// The leading empty item is consumed by the off-by-one bug
+		// of OP_CHECKMULTISIG.
+		witness = wire.TxWitness{nil}
+		for _, addr := range addrs {
+			if len(witness)-1 == nRequired {
+				break
+			}
+
+			key, _, err := s.GetKey(addr)
+			if waddrmgr.IsError(err, waddrmgr.ErrLocked) {
+				return err
+			}
+			if err != nil {
+				continue
+			}
+			sig, err := sign(key)
+			if err != nil {
+				return err
+			}
+			witness = append(witness, sig)
+		}
+		if len(witness) == 1 {
+			return fmt.Errorf("no keys for multisig witness script")
+		}
+
+	default:
+		return fmt.Errorf("unsupported witness script class %v", class)
+	}
+
+	txIn := s.tx.TxIn[idx]
+	txIn.SignatureScript = nil
+	txIn.Witness = append(witness, witnessScript)
+	return nil
+}
+
+// signTapscript spends a P2TR output whose tapscript was imported through
+// its script path. The first leaf of the form <key> OP_CHECKSIG whose key
+// belongs to the wallet is used.
+func (s *inputSigner) signTapscript(idx int, prevOut *wire.TxOut,
+	tma waddrmgr.ManagedTaprootScriptAddress) error {
+
+	tapscript, err := tma.TaprootScript()
+	if err != nil {
+		return err
+	}
+
+	var (
+		leaves        []txscript.TapLeaf
+		controlBlocks []txscript.ControlBlock
+	)
+	switch tapscript.Type {
+	case waddrmgr.TapscriptTypePartialReveal:
+		controlBlock := *tapscript.ControlBlock
+		leaves = append(leaves, txscript.NewTapLeaf(
+			controlBlock.LeafVersion, tapscript.RevealedScript))
+		controlBlocks = append(controlBlocks, controlBlock)
+
+	case waddrmgr.TapscriptTypeFullTree:
+		internalKey := tapscript.ControlBlock.InternalKey
+		tree := txscript.AssembleTaprootScriptTree(tapscript.Leaves...)
+		for _, proof := range tree.LeafMerkleProofs {
+			leaves = append(leaves, proof.TapLeaf)
+			controlBlocks = append(
+				controlBlocks, proof.ToControlBlock(internalKey))
+		}
+
+	default:
+		return fmt.Errorf("tapscript of type %d has no script path",
+			tapscript.Type)
+	}
+
+	for i, leaf := range leaves {
+		key, err := s.tapLeafKey(leaf.Script)
+		if waddrmgr.IsError(err, waddrmgr.ErrLocked) {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+
+		sig, err := txscript.RawTxInTapscriptSignature(
+			s.tx, s.sigHashes, idx, prevOut.Value, prevOut.PkScript,
+			leaf, txscript.SigHashDefault, key)
+		if err != nil {
+			return err
+		}
+		controlBlock, err := controlBlocks[i].ToBytes()
+		if err != nil {
+			return err
+		}
+
+		txIn := s.tx.TxIn[idx]
+		txIn.SignatureScript = nil
+		txIn.Witness = wire.TxWitness{sig, leaf.Script, controlBlock}
+		return nil
+	}
+
+	return fmt.Errorf("no wallet key for any leaf of tapscript %v",
+		tma.Address())
+}
+
+// tapLeafKey returns the private key of a leaf script of the form
+// <key> OP_CHECKSIG. The x-only key is looked up as a compressed key of
+// either parity, among the addresses of every type the key may back.
+func (s *inputSigner) tapLeafKey(script []byte) (*btcec.PrivateKey, error) {
+	if len(script) != 34 || script[0] != txscript.OP_DATA_32 ||
+		script[33] != txscript.OP_CHECKSIG {
+
+		return nil, fmt.Errorf("unsupported tapscript leaf")
+	}
+
+	for _, prefix := range []byte{0x02, 0x03} {
+		pubKey, err := btcec.ParsePubKey(
+			append([]byte{prefix}, script[1:33]...))
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := pubKeyAddrs(pubKey, s.ChainParams())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			key, _, err := s.GetKey(addr)
+			if waddrmgr.IsError(err, waddrmgr.ErrAddressNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("leaf key is not a wallet key")
+}
+
+// pubKeyAddrs returns the addresses the wallet may hold the public key
+// under: P2PKH, which shares its key hash with P2WPKH, nested P2WPKH, and
+// BIP-0086 P2TR.
+func pubKeyAddrs(pubKey *btcec.PublicKey,
+	params *chaincfg.Params) ([]btcutil.Address, error) {
+
+	keyHash := btcutil.Hash160(pubKey.SerializeCompressed())
+	p2pkh, err := btcutil.NewAddressPubKeyHash(keyHash, params)
+	if err != nil {
+		return nil, err
+	}
+
+	p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(keyHash, params)
+	if err != nil {
+		return nil, err
+	}
+	witnessProgram, err := txscript.PayToAddrScript(p2wpkh)
+	if err != nil {
+		return nil, err
+	}
+	np2wpkh, err := btcutil.NewAddressScriptHash(witnessProgram, params)
+	if err != nil {
+		return nil, err
+	}
+
+	p2tr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(
+		txscript.ComputeTaprootKeyNoScript(pubKey)), params)
+	if err != nil {
+		return nil, err
+	}
+
+	return []btcutil.Address{p2pkh, np2wpkh, p2tr}, nil
+}
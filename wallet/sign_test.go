@@ -0,0 +1,298 @@
+package wallet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	"github.com/czh0526/btc-wallet/wtxmgr"
+	"github.com/stretchr/testify/assert"
+)
+
+// nextPubKey returns the public key of a fresh external address of the
+// default account in scope.
+func nextPubKey(t *testing.T, ns walletdb.ReadWriteBucket, w *Wallet,
+	scope waddrmgr.KeyScope) waddrmgr.ManagedPubKeyAddress {
+
+	t.Helper()
+
+	scopedMgr, err := w.Manager.FetchScopedKeyManager(scope)
+	if err != nil {
+		t.Fatalf("unable to fetch scope: %v", err)
+	}
+	addrs, err := scopedMgr.NextExternalAddresses(
+		ns, waddrmgr.DefaultAccountNum, 1)
+	if err != nil {
+		t.Fatalf("unable to derive address: %v", err)
+	}
+	return addrs[0].(waddrmgr.ManagedPubKeyAddress)
+}
+
+func TestSignTransaction(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	foreignKey, _ := btcec.NewPrivateKey()
+	foreignPubKey, _ := btcutil.NewAddressPubKey(
+		foreignKey.PubKey().SerializeCompressed(), w.chainParams)
+
+	// The funding transaction pays to one output of each script type
+	// the wallet can sign, and to a 2-of-2 multisig script the wallet
+	// holds a single key of.
+	var pkScripts [][]byte
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		ns := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		txmgrNs := dbTx.ReadWriteBucket(wtxmgrNamespaceKey)
+
+		for _, scope := range []waddrmgr.KeyScope{
+			waddrmgr.KeyScopeBIP0044,
+			waddrmgr.KeyScopeBIP0049Plus,
+			waddrmgr.KeyScopeBIP0084,
+			waddrmgr.KeyScopeBIP0086,
+		} {
+			addr := nextPubKey(t, ns, w, scope).Address()
+			pkScript, err := txscript.PayToAddrScript(addr)
+			if err != nil {
+				return err
+			}
+			pkScripts = append(pkScripts, pkScript)
+		}
+
+		importMgr, err := w.Manager.FetchScopedKeyManager(
+			waddrmgr.KeyScopeBIP0084)
+		if err != nil {
+			return err
+		}
+
+		walletKey := nextPubKey(t, ns, w, waddrmgr.KeyScopeBIP0084)
+		walletPubKey, err := btcutil.NewAddressPubKey(
+			walletKey.PubKey().SerializeCompressed(), w.chainParams)
+		if err != nil {
+			return err
+		}
+
+		// P2SH 1-of-2 multisig.
+		redeemScript, err := txscript.MultiSigScript(
+			[]*btcutil.AddressPubKey{walletPubKey, foreignPubKey}, 1)
+		if err != nil {
+			return err
+		}
+		ma, err := importMgr.ImportScript(ns, redeemScript)
+		if err != nil {
+			return err
+		}
+		pkScript, err := txscript.PayToAddrScript(ma.Address())
+		if err != nil {
+			return err
+		}
+		pkScripts = append(pkScripts, pkScript)
+
+		// P2WSH 1-of-2 and 2-of-2 multisig.
+		for _, nRequired := range []int{1, 2} {
+			witnessScript, err := txscript.MultiSigScript(
+				[]*btcutil.AddressPubKey{
+					foreignPubKey, walletPubKey,
+				}, nRequired)
+			if err != nil {
+				return err
+			}
+			ma, err := importMgr.ImportWitnessScript(
+				ns, witnessScript, false)
+			if err != nil {
+				return err
+			}
+			pkScript, err := txscript.PayToAddrScript(ma.Address())
+			if err != nil {
+				return err
+			}
+			pkScripts = append(pkScripts, pkScript)
+		}
+
+		// P2TR with a single leaf spendable by a wallet key, and a
+		// foreign internal key.
+		leafScript, err := txscript.NewScriptBuilder().
+			AddData(schnorr.SerializePubKey(walletKey.PubKey())).
+			AddOp(txscript.OP_CHECKSIG).
+			Script()
+		if err != nil {
+			return err
+		}
+		tree := txscript.AssembleTaprootScriptTree(
+			txscript.NewBaseTapLeaf(leafScript))
+		controlBlock := tree.LeafMerkleProofs[0].ToControlBlock(
+			foreignKey.PubKey())
+		tma, err := importMgr.ImportTaprootScript(ns, &waddrmgr.Tapscript{
+			Type:           waddrmgr.TapscriptTypePartialReveal,
+			ControlBlock:   &controlBlock,
+			RevealedScript: leafScript,
+		}, true)
+		if err != nil {
+			return err
+		}
+		pkScript, err = txscript.PayToAddrScript(tma.Address())
+		if err != nil {
+			return err
+		}
+		pkScripts = append(pkScripts, pkScript)
+
+		fundingTx := wire.NewMsgTx(wire.TxVersion)
+		fundingTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+			Hash: chainhash.Hash{0x01}}, nil, nil))
+		for _, pkScript := range pkScripts {
+			fundingTx.AddTxOut(wire.NewTxOut(100000, pkScript))
+		}
+		rec, err := wtxmgr.NewTxRecordFromMsgTx(fundingTx, time.Now())
+		if err != nil {
+			return err
+		}
+		return w.TxStore.InsertTx(txmgrNs, rec, nil)
+	})
+	if err != nil {
+		t.Fatalf("unable to fund wallet: %v", err)
+	}
+
+	var fundingHash chainhash.Hash
+	err = walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		txmgrNs := dbTx.ReadBucket(wtxmgrNamespaceKey)
+		txs, err := w.TxStore.UnminedTxs(txmgrNs)
+		if err != nil {
+			return err
+		}
+		fundingHash = txs[0].TxHash()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to fetch funding tx: %v", err)
+	}
+
+	spendTx := func(unknown bool) *wire.MsgTx {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		for i := range pkScripts {
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+				Hash: fundingHash, Index: uint32(i)}, nil, nil))
+		}
+		if unknown {
+			tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+				Hash: chainhash.Hash{0x02}}, nil, nil))
+		}
+		tx.AddTxOut(wire.NewTxOut(100000, pkScripts[0]))
+		return tx
+	}
+
+	// Only the 2-of-2 multisig input stays unsigned, holding the
+	// signature of the wallet key.
+	const partialIdx = 6
+	tx := spendTx(false)
+	unsigned, err := w.SignTransaction(tx, nil)
+	if err != nil {
+		t.Fatalf("unable to sign transaction: %v", err)
+	}
+	assert.Equal(t, []uint32{partialIdx}, unsigned)
+	assert.Len(t, tx.TxIn[partialIdx].Witness, 3)
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for i, pkScript := range pkScripts {
+		fetcher.AddPrevOut(tx.TxIn[i].PreviousOutPoint,
+			wire.NewTxOut(100000, pkScript))
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	for i, pkScript := range pkScripts {
+		if i == partialIdx {
+			continue
+		}
+		vm, err := txscript.NewEngine(pkScript, tx, i,
+			txscript.StandardVerifyFlags, nil, sigHashes, 100000,
+			fetcher)
+		if err != nil {
+			t.Fatalf("unable to create engine: %v", err)
+		}
+		if err := vm.Execute(); err != nil {
+			t.Fatalf("input %d does not validate: %v", i, err)
+		}
+	}
+
+	// An unknown previous output can't be signed, and prevents signing
+	// the taproot inputs, whose signature commits to every output
+	// spent.
+	tx = spendTx(true)
+	unsigned, err = w.SignTransaction(tx, []uint32{2, 3, 7, 8})
+	if err != nil {
+		t.Fatalf("unable to sign transaction: %v", err)
+	}
+	assert.Equal(t, []uint32{3, 7, 8}, unsigned)
+	assert.NotEmpty(t, tx.TxIn[2].Witness)
+	assert.Empty(t, tx.TxIn[3].Witness)
+
+	_, err = w.SignTransaction(tx, []uint32{9})
+	assert.Error(t, err)
+
+	w.Lock()
+	if !w.Locked() {
+		t.Fatalf("wallet not locked")
+	}
+	_, err = w.SignTransaction(spendTx(false), nil)
+	assert.True(t, waddrmgr.IsError(err, waddrmgr.ErrLocked))
+}
+
+func TestTapLeafKey(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock wallet: %v", err)
+	}
+
+	// The key of a leaf is found whichever address type it backs.
+	err := walletdb.Update(w.db, func(dbTx walletdb.ReadWriteTx) error {
+		ns := dbTx.ReadWriteBucket(waddrmgrNamespaceKey)
+		signer := &inputSigner{Manager: w.Manager, addrmgrNs: ns}
+
+		for _, scope := range []waddrmgr.KeyScope{
+			waddrmgr.KeyScopeBIP0044,
+			waddrmgr.KeyScopeBIP0049Plus,
+			waddrmgr.KeyScopeBIP0084,
+			waddrmgr.KeyScopeBIP0086,
+		} {
+			pubKey := nextPubKey(t, ns, w, scope).PubKey()
+			leafScript, err := txscript.NewScriptBuilder().
+				AddData(schnorr.SerializePubKey(pubKey)).
+				AddOp(txscript.OP_CHECKSIG).
+				Script()
+			if err != nil {
+				return err
+			}
+
+			key, err := signer.tapLeafKey(leafScript)
+			if assert.NoError(t, err, "scope %v", scope) {
+				assert.Equal(t, schnorr.SerializePubKey(pubKey),
+					schnorr.SerializePubKey(key.PubKey()))
+			}
+		}
+
+		foreignKey, _ := btcec.NewPrivateKey()
+		leafScript, err := txscript.NewScriptBuilder().
+			AddData(schnorr.SerializePubKey(foreignKey.PubKey())).
+			AddOp(txscript.OP_CHECKSIG).
+			Script()
+		if err != nil {
+			return err
+		}
+		_, err = signer.tapLeafKey(leafScript)
+		assert.ErrorContains(t, err, "not a wallet key")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
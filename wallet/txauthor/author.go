@@ -0,0 +1,474 @@
+// Package txauthor provides transaction creation code for wallets.
+package txauthor
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txrules"
+	"github.com/czh0526/btc-wallet/wallet/txsizes"
+)
+
+// DefaultRelayFeePerKb is the default minimum relay fee policy for a mempool.
+const DefaultRelayFeePerKb btcutil.Amount = txrules.DefaultRelayFeePerKb
+
+// AuthoredTx holds the state of a newly-created transaction and the change
+// output (if one was added).
+type AuthoredTx struct {
+	Tx              *wire.MsgTx
+	PrevScripts     [][]byte
+	PrevInputValues []btcutil.Amount
+	TotalInput      btcutil.Amount
+	ChangeIndex     int // negative if no change
+	Fee             btcutil.Amount
+}
+
+// ChangeSource provides change output scripts for transaction creation.
+type ChangeSource struct {
+	// NewScript is a closure that produces unique change output scripts
+	// per invocation.
+	NewScript func() ([]byte, error)
+
+	// ScriptSize is the size in bytes of scripts produced by `NewScript`.
+	ScriptSize int
+
+	// AddrType is the address type of the change output, used to
+	// estimate the cost of spending it later.
+	AddrType waddrmgr.AddressType
+}
+
+// NewUnsignedTransaction creates an unsigned transaction paying to one or
+// more non-change outputs, funded by coins chosen by the selector from the
+// passed coins. An appropriate transaction fee is included based on the
+// transaction size.
+//
+// If change is needed, and the change amount is not considered too small to
+// be spent later, a change output is added at a random position.
+//
+// Every input signals replaceability under BIP-125, so that the fee of the
+// transaction can be bumped later.
+//
+// If the coins cannot fund the outputs and fee, ErrInsufficientFunds is
+// returned.
+func NewUnsignedTransaction(outputs []*wire.TxOut, feeRatePerKb btcutil.Amount,
+	coins []Coin, selector CoinSelector,
+	changeSource *ChangeSource) (*AuthoredTx, error) {
+
+	if changeSource == nil {
+		return nil, errors.New("no change source")
+	}
+
+	params, err := selectionParams(outputs, feeRatePerKb, changeSource)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, err := selector.SelectCoins(coins, *params)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &wire.MsgTx{
+		Version:  wire.TxVersion,
+		TxOut:    append([]*wire.TxOut(nil), outputs...),
+		LockTime: 0,
+	}
+	authored := &AuthoredTx{
+		Tx:          tx,
+		ChangeIndex: -1,
+		Fee:         sel.Fee,
+	}
+	for _, c := range sel.Coins {
+		txIn := wire.NewTxIn(&c.OutPoint, nil, nil)
+		txIn.Sequence = txrules.MaxRBFSequence
+		tx.TxIn = append(tx.TxIn, txIn)
+		authored.PrevScripts = append(authored.PrevScripts, c.PkScript)
+		authored.PrevInputValues = append(authored.PrevInputValues,
+			btcutil.Amount(c.Value))
+		authored.TotalInput += btcutil.Amount(c.Value)
+	}
+
+	if sel.Change > 0 {
+		changeScript, err := changeSource.NewScript()
+		if err != nil {
+			return nil, err
+		}
+		if len(changeScript) > changeSource.ScriptSize {
+			return nil, errors.New("fee estimation requires change " +
+				"scripts no larger than the declared script size")
+		}
+		tx.TxOut = append(tx.TxOut, wire.NewTxOut(
+			int64(sel.Change), changeScript))
+		authored.ChangeIndex = len(tx.TxOut) - 1
+		authored.RandomizeChangePosition()
+	}
+	if len(tx.TxOut) == 0 {
+		return nil, errors.New("coins leave no change for a " +
+			"transaction without outputs")
+	}
+
+	return authored, nil
+}
+
+// selectionParams describes the funded transaction to the coin selector.
+func selectionParams(outputs []*wire.TxOut, feeRatePerKb btcutil.Amount,
+	changeSource *ChangeSource) (*SelectionParams, error) {
+
+	var target btcutil.Amount
+	outputsSize := int64(0)
+	for _, out := range outputs {
+		if out.Value <= 0 {
+			return nil, errors.New("transaction output amount must " +
+				"be positive")
+		}
+		target += btcutil.Amount(out.Value)
+		outputsSize += int64(out.SerializeSize())
+	}
+
+	// Version, lock time, one byte input count and the output count.
+	baseSize := 4 + 4 + 1 +
+		int64(wire.VarIntSerializeSize(uint64(len(outputs)))) + outputsSize
+
+	changeOutputSize := txsizes.OutputSize(changeSource.ScriptSize) +
+		int64(wire.VarIntSerializeSize(uint64(len(outputs)+1))-
+			wire.VarIntSerializeSize(uint64(len(outputs))))
+
+	changeSpendWeight, err := txsizes.InputWeight(changeSource.AddrType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SelectionParams{
+		Target:            target,
+		FeeRate:           feeRatePerKb,
+		BaseWeight:        baseSize * blockchain.WitnessScaleFactor,
+		ChangeOutputSize:  changeOutputSize,
+		ChangeSpendWeight: changeSpendWeight,
+		DustLimit: dustLimit(
+			changeSource.ScriptSize, changeSpendWeight),
+	}, nil
+}
+
+// dustLimit returns the smallest output value that is not dust under the
+// default relay policy: an output is dust when spending it costs more than
+// a third of its value.
+func dustLimit(scriptSize int, spendWeight int64) btcutil.Amount {
+	size := txsizes.OutputSize(scriptSize) +
+		(spendWeight+blockchain.WitnessScaleFactor-1)/
+			blockchain.WitnessScaleFactor
+	return 3 * DefaultRelayFeePerKb * btcutil.Amount(size) / 1000
+}
+
+// RandomizeChangePosition randomizes the position of an authored
+// transaction's change output. This should be done before signing.
+func (tx *AuthoredTx) RandomizeChangePosition() {
+	if tx.ChangeIndex < 0 {
+		return
+	}
+
+	r := rand.Intn(len(tx.Tx.TxOut))
+	outs := tx.Tx.TxOut
+	outs[tx.ChangeIndex], outs[r] = outs[r], outs[tx.ChangeIndex]
+	tx.ChangeIndex = r
+}
+
+// SecretsSource provides private keys and redeem scripts necessary for
+// constructing transaction input signatures. Secrets are looked up by the
+// corresponding Address for the previous output script. Addresses for lookup
+// are created using the source's blockchain parameters and means a single
+// SecretsSource can only manage secrets for a single chain.
+type SecretsSource interface {
+	txscript.KeyDB
+	txscript.ScriptDB
+	ChainParams() *chaincfg.Params
+}
+
+// TXPrevOutFetcher creates a txscript.PrevOutFetcher from a given slice of
+// previous pk scripts and input values.
+func TXPrevOutFetcher(tx *wire.MsgTx, prevPkScripts [][]byte,
+	inputValues []btcutil.Amount) (*txscript.MultiPrevOutFetcher, error) {
+
+	if len(tx.TxIn) != len(prevPkScripts) {
+		return nil, errors.New("tx.TxIn and prevPkScripts slices " +
+			"must have equal length")
+	}
+	if len(tx.TxIn) != len(inputValues) {
+		return nil, errors.New("tx.TxIn and inputValues slices " +
+			"must have equal length")
+	}
+
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for idx, txin := range tx.TxIn {
+		fetcher.AddPrevOut(txin.PreviousOutPoint, &wire.TxOut{
+			Value:    int64(inputValues[idx]),
+			PkScript: prevPkScripts[idx],
+		})
+	}
+
+	return fetcher, nil
+}
+
+// signingSecrets remembers the keys handed out by a SecretsSource, so that
+// they can be zeroed once the inputs are signed.
+type signingSecrets struct {
+	SecretsSource
+	keys []*btcec.PrivateKey
+}
+
+// GetKey implements the txscript.KeyDB interface.
+func (s *signingSecrets) GetKey(addr btcutil.Address) (*btcec.PrivateKey,
+	bool, error) {
+
+	key, compressed, err := s.SecretsSource.GetKey(addr)
+	if err == nil {
+		s.keys = append(s.keys, key)
+	}
+	return key, compressed, err
+}
+
+// zero zeroes every key handed out.
+func (s *signingSecrets) zero() {
+	for _, key := range s.keys {
+		key.Zero()
+	}
+	s.keys = nil
+}
+
+// AddAllInputScripts modifies a transaction by adding input scripts for each
+// input. Previous output scripts being redeemed by each input are passed in
+// prevPkScripts and the slice length must match the number of inputs. Private keys and redeem scripts are looked up using a
+// SecretsSource based on the previous output script. The private keys are
+// zeroed once the inputs are signed, so the source must hand out copies.
+func AddAllInputScripts(tx *wire.MsgTx, prevPkScripts [][]byte,
+	inputValues []btcutil.Amount, secrets SecretsSource) error {
+
+	signing := &signingSecrets{SecretsSource: secrets}
+	defer signing.zero()
+	secrets = signing
+
+	inputFetcher, err := TXPrevOutFetcher(tx, prevPkScripts, inputValues)
+	if err != nil {
+		return err
+	}
+
+	inputs := tx.TxIn
+	hashCache := txscript.NewTxSigHashes(tx, inputFetcher)
+	chainParams := secrets.ChainParams()
+
+	for i := range inputs {
+		pkScript := prevPkScripts[i]
+
+		switch {
+		// If this is a p2tr output, then we'll spend it with the key
+		// path of the output key.
+		case txscript.IsPayToTaproot(pkScript):
+			err := spendTaprootKey(
+				inputs[i], pkScript, int64(inputValues[i]),
+				chainParams, secrets, tx, hashCache, i)
+			if err != nil {
+				return err
+			}
+
+		// If this is a p2sh output, who's script hash pre-image is a
+		// witness program, then we'll need to use a modified signing
+		// function which generates both the sigScript, and the
+		// witness script.
+		case txscript.IsPayToScriptHash(pkScript):
+			err := spendNestedWitnessPubKeyHash(
+				inputs[i], pkScript, int64(inputValues[i]),
+				chainParams, secrets, tx, hashCache, i)
+			if err != nil {
+				return err
+			}
+
+		case txscript.IsPayToWitnessPubKeyHash(pkScript):
+			err := spendWitnessKeyHash(
+				inputs[i], pkScript, int64(inputValues[i]),
+				chainParams, secrets, tx, hashCache, i)
+			if err != nil {
+				return err
+			}
+
+		default:
+			sigScript := inputs[i].SignatureScript
+			script, err := txscript.SignTxOutput(chainParams, tx, i,
+				pkScript, txscript.SigHashAll, secrets, secrets,
+				sigScript)
+			if err != nil {
+				return err
+			}
+			inputs[i].SignatureScript = script
+		}
+	}
+
+	return nil
+}
+
+// spendWitnessKeyHash generates, and sets a valid witness for spending the
+// passed pkScript with the specified input amount. The input amount *must*
+// correspond to the output value of the previous pkScript, or else
+// verification will fail since the new sighash digest algorithm defined in
+// BIP0143 includes the input value in the sighash.
+func spendWitnessKeyHash(txIn *wire.TxIn, pkScript []byte,
+	inputValue int64, chainParams *chaincfg.Params, secrets SecretsSource,
+	tx *wire.MsgTx, hashCache *txscript.TxSigHashes, idx int) error {
+
+	// First obtain the key pair associated with this p2wkh address.
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript,
+		chainParams)
+	if err != nil {
+		return err
+	}
+	privKey, compressed, err := secrets.GetKey(addrs[0])
+	if err != nil {
+		return err
+	}
+	pubKey := privKey.PubKey()
+
+	// Once we have the key pair, generate a p2wkh address type, respecting
+	// the compression type of the generated key.
+	var pubKeyHash []byte
+	if compressed {
+		pubKeyHash = btcutil.Hash160(pubKey.SerializeCompressed())
+	} else {
+		pubKeyHash = btcutil.Hash160(pubKey.SerializeUncompressed())
+	}
+	p2wkhAddr, err := btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, chainParams)
+	if err != nil {
+		return err
+	}
+
+	// With the concrete address type, we can now generate the
+	// corresponding witness program to be used to generate a valid witness
+	// which will allow us to spend this output.
+	witnessProgram, err := txscript.PayToAddrScript(p2wkhAddr)
+	if err != nil {
+		return err
+	}
+	witnessScript, err := txscript.WitnessSignature(tx, hashCache, idx,
+		inputValue, witnessProgram, txscript.SigHashAll, privKey, true)
+	if err != nil {
+		return err
+	}
+
+	txIn.Witness = witnessScript
+
+	return nil
+}
+
+// spendTaprootKey generates, and sets a valid witness for spending the passed
+// pkScript with the specified input amount. The input amount *must*
+// correspond to the output value of the previous pkScript, or else
+// verification will fail since the new sighash digest algorithm defined in
+// BIP0341 includes the input value in the sighash.
+func spendTaprootKey(txIn *wire.TxIn, pkScript []byte,
+	inputValue int64, chainParams *chaincfg.Params, secrets SecretsSource,
+	tx *wire.MsgTx, hashCache *txscript.TxSigHashes, idx int) error {
+
+	// First obtain the key pair associated with this p2tr address. If the
+	// pkScript is incorrect or derived from a different internal key or
+	// with a script root, we simply won't find a corresponding private key
+	// here.
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, chainParams)
+	if err != nil {
+		return err
+	}
+	privKey, _, err := secrets.GetKey(addrs[0])
+	if err != nil {
+		return err
+	}
+
+	// We can now generate a valid witness which will allow us to spend
+	// this output.
+	witnessScript, err := txscript.TaprootWitnessSignature(
+		tx, hashCache, idx, inputValue, pkScript,
+		txscript.SigHashDefault, privKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	txIn.Witness = witnessScript
+
+	return nil
+}
+
+// spendNestedWitnessPubKeyHash generates both a sigScript, and valid witness
+// for spending the passed pkScript with the specified input amount. The
+// generated sigScript is the version 0 p2wkh witness program corresponding
+// to the queried key. The witness stack is identical to that generated by
+// spendWitnessKeyHash. The input amount *must* correspond to the output value
+// of the previous pkScript, or else verification will fail since the new
+// sighash digest algorithm defined in BIP0143 includes the input value in the
+// sighash.
+func spendNestedWitnessPubKeyHash(txIn *wire.TxIn, pkScript []byte,
+	inputValue int64, chainParams *chaincfg.Params, secrets SecretsSource,
+	tx *wire.MsgTx, hashCache *txscript.TxSigHashes, idx int) error {
+
+	// First we need to obtain the key pair related to this p2sh output.
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript,
+		chainParams)
+	if err != nil {
+		return err
+	}
+	privKey, compressed, err := secrets.GetKey(addrs[0])
+	if err != nil {
+		return err
+	}
+	pubKey := privKey.PubKey()
+
+	var pubKeyHash []byte
+	if compressed {
+		pubKeyHash = btcutil.Hash160(pubKey.SerializeCompressed())
+	} else {
+		pubKeyHash = btcutil.Hash160(pubKey.SerializeUncompressed())
+	}
+
+	// Next, we'll generate a valid sigScript that'll allow us to spend
+	// the p2sh output. The sigScript will contain only a single push of
+	// the p2wkh witness program corresponding to the matching public key
+	// of this address.
+	p2wkhAddr, err := btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, chainParams)
+	if err != nil {
+		return err
+	}
+	witnessProgram, err := txscript.PayToAddrScript(p2wkhAddr)
+	if err != nil {
+		return err
+	}
+	bldr := txscript.NewScriptBuilder()
+	bldr.AddData(witnessProgram)
+	sigScript, err := bldr.Script()
+	if err != nil {
+		return err
+	}
+	txIn.SignatureScript = sigScript
+
+	// With the sigScript in place, we'll next generate the proper witness
+	// that'll allow us to spend the p2wkh output.
+	witnessScript, err := txscript.WitnessSignature(tx, hashCache, idx,
+		inputValue, witnessProgram, txscript.SigHashAll, privKey, compressed)
+	if err != nil {
+		return err
+	}
+
+	txIn.Witness = witnessScript
+
+	return nil
+}
+
+// AddAllInputScripts modifies an authored transaction by adding inputs scripts
+// for each input of an authored transaction. Private keys and redeem scripts
+// are looked up using a SecretsSource based on the previous output script.
+func (tx *AuthoredTx) AddAllInputScripts(secrets SecretsSource) error {
+	return AddAllInputScripts(
+		tx.Tx, tx.PrevScripts, tx.PrevInputValues, secrets,
+	)
+}
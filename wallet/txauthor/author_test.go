@@ -0,0 +1,248 @@
+package txauthor
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txsizes"
+)
+
+// signingCoin is a coin along with the key able to spend it.
+type signingCoin struct {
+	Coin
+	key *btcec.PrivateKey
+}
+
+func newSigningCoin(t *testing.T, addrType waddrmgr.AddressType,
+	index uint32, value int64) *signingCoin {
+
+	t.Helper()
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyHash := btcutil.Hash160(key.PubKey().SerializeCompressed())
+	params := &chaincfg.RegressionNetParams
+
+	var addr btcutil.Address
+	switch addrType {
+	case waddrmgr.PubKeyHash:
+		addr, err = btcutil.NewAddressPubKeyHash(pubKeyHash, params)
+	case waddrmgr.NestedWitnessPubKey:
+		var witnessAddr btcutil.Address
+		witnessAddr, err = btcutil.NewAddressWitnessPubKeyHash(
+			pubKeyHash, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var redeemScript []byte
+		redeemScript, err = txscript.PayToAddrScript(witnessAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err = btcutil.NewAddressScriptHash(redeemScript, params)
+	case waddrmgr.WitnessPubKey:
+		addr, err = btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, params)
+	case waddrmgr.TaprootPubKey:
+		outputKey := txscript.ComputeTaprootKeyNoScript(key.PubKey())
+		addr, err = btcutil.NewAddressTaproot(
+			schnorr.SerializePubKey(outputKey), params)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &signingCoin{
+		Coin: Coin{
+			OutPoint: wire.OutPoint{Index: index},
+			TxOut:    wire.TxOut{Value: value, PkScript: pkScript},
+			AddrType: addrType,
+		},
+		key: key,
+	}
+}
+
+// signAuthoredTx signs every input of tx with the key of the matching coin.
+func signAuthoredTx(t *testing.T, tx *AuthoredTx, coins []*signingCoin) {
+	t.Helper()
+
+	byOutPoint := make(map[wire.OutPoint]*signingCoin)
+	fetcher := txscript.NewMultiPrevOutFetcher(nil)
+	for _, c := range coins {
+		byOutPoint[c.OutPoint] = c
+		fetcher.AddPrevOut(c.OutPoint, &c.TxOut)
+	}
+	sigHashes := txscript.NewTxSigHashes(tx.Tx, fetcher)
+
+	for i, txIn := range tx.Tx.TxIn {
+		c := byOutPoint[txIn.PreviousOutPoint]
+		var err error
+		switch c.AddrType {
+		case waddrmgr.PubKeyHash:
+			txIn.SignatureScript, err = txscript.SignatureScript(
+				tx.Tx, i, c.PkScript, txscript.SigHashAll, c.key,
+				true)
+
+		case waddrmgr.NestedWitnessPubKey, waddrmgr.WitnessPubKey:
+			pubKeyHash := btcutil.Hash160(
+				c.key.PubKey().SerializeCompressed())
+			witnessProgram, _ := txscript.NewScriptBuilder().
+				AddOp(txscript.OP_0).AddData(pubKeyHash).Script()
+			txIn.Witness, err = txscript.WitnessSignature(
+				tx.Tx, sigHashes, i, c.Value, witnessProgram,
+				txscript.SigHashAll, c.key, true)
+			if err == nil && c.AddrType == waddrmgr.NestedWitnessPubKey {
+				txIn.SignatureScript, err = txscript.
+					NewScriptBuilder().AddData(witnessProgram).
+					Script()
+			}
+
+		case waddrmgr.TaprootPubKey:
+			txIn.Witness, err = txscript.TaprootWitnessSignature(
+				tx.Tx, sigHashes, i, c.Value, c.PkScript,
+				txscript.SigHashDefault, c.key)
+		}
+		if err != nil {
+			t.Fatalf("unable to sign input %d: %v", i, err)
+		}
+	}
+}
+
+// TestFeeRateAccuracy checks that signed transactions pay within one sat/vB
+// of the requested fee rate, for every script type and a mix of them.
+func TestFeeRateAccuracy(t *testing.T) {
+	tests := []struct {
+		name   string
+		inputs []waddrmgr.AddressType
+		change waddrmgr.AddressType
+	}{
+		{
+			name: "p2pkh",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.PubKeyHash, waddrmgr.PubKeyHash,
+			},
+			change: waddrmgr.PubKeyHash,
+		},
+		{
+			name: "np2wpkh",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.NestedWitnessPubKey,
+				waddrmgr.NestedWitnessPubKey,
+			},
+			change: waddrmgr.NestedWitnessPubKey,
+		},
+		{
+			name: "p2wpkh",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.WitnessPubKey, waddrmgr.WitnessPubKey,
+			},
+			change: waddrmgr.WitnessPubKey,
+		},
+		{
+			name: "p2tr",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.TaprootPubKey, waddrmgr.TaprootPubKey,
+			},
+			change: waddrmgr.TaprootPubKey,
+		},
+		{
+			name: "mixed",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.PubKeyHash,
+				waddrmgr.NestedWitnessPubKey,
+				waddrmgr.WitnessPubKey,
+				waddrmgr.TaprootPubKey,
+			},
+			change: waddrmgr.WitnessPubKey,
+		},
+	}
+
+	changeScripts := map[waddrmgr.AddressType]int{
+		waddrmgr.PubKeyHash:          txsizes.P2PKHPkScriptSize,
+		waddrmgr.NestedWitnessPubKey: txsizes.P2SHPkScriptSize,
+		waddrmgr.WitnessPubKey:       txsizes.P2WPKHPkScriptSize,
+		waddrmgr.TaprootPubKey:       txsizes.P2TRPkScriptSize,
+	}
+
+	for _, test := range tests {
+		for _, satPerVByte := range []int64{1, 10, 50} {
+			feeRate := btcutil.Amount(satPerVByte * 1000)
+
+			var coins []*signingCoin
+			var selectable []Coin
+			for i, addrType := range test.inputs {
+				c := newSigningCoin(t, addrType, uint32(i), 100000)
+				coins = append(coins, c)
+				selectable = append(selectable, c.Coin)
+			}
+
+			// Spend all coins, leaving some change.
+			target := int64(len(coins))*100000 - 30000
+			outputs := []*wire.TxOut{wire.NewTxOut(
+				target, make([]byte, txsizes.P2WSHPkScriptSize))}
+			scriptSize := changeScripts[test.change]
+			changeSource := &ChangeSource{
+				NewScript: func() ([]byte, error) {
+					return make([]byte, scriptSize), nil
+				},
+				ScriptSize: scriptSize,
+				AddrType:   test.change,
+			}
+
+			tx, err := NewUnsignedTransaction(outputs, feeRate,
+				selectable, LargestFirst{}, changeSource)
+			if err != nil {
+				t.Fatalf("%s: unable to author tx: %v", test.name, err)
+			}
+			if tx.ChangeIndex < 0 {
+				t.Fatalf("%s: expected change output", test.name)
+			}
+			if len(tx.Tx.TxIn) != len(coins) {
+				t.Fatalf("%s: expected %d inputs, got %d", test.name,
+					len(coins), len(tx.Tx.TxIn))
+			}
+
+			// The estimate must match what the author charged for.
+			estimate, err := txsizes.EstimateVirtualSize(
+				test.inputs, outputs, scriptSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := FeeForWeight(feeRate, estimate*4); tx.Fee != want {
+				t.Fatalf("%s: fee %v does not match estimated "+
+					"vsize %d (%v)", test.name, tx.Fee, estimate,
+					want)
+			}
+
+			signAuthoredTx(t, tx, coins)
+			weight := blockchain.GetTransactionWeight(
+				btcutil.NewTx(tx.Tx))
+			vsize := (weight + 3) / 4
+			if vsize > estimate {
+				t.Fatalf("%s: actual vsize %d exceeds estimate %d",
+					test.name, vsize, estimate)
+			}
+
+			actual := float64(tx.Fee) / float64(vsize)
+			if actual < float64(satPerVByte) ||
+				actual > float64(satPerVByte)+1 {
+
+				t.Fatalf("%s: fee rate %.3f sat/vB not within one "+
+					"sat/vB of %d (fee %v, vsize %d)", test.name,
+					actual, satPerVByte, tx.Fee, vsize)
+			}
+		}
+	}
+}
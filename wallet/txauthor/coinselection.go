@@ -0,0 +1,576 @@
+package txauthor
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txsizes"
+)
+
+const (
+	// DefaultLongTermFeeRate is the fee rate, in sat/kvB, assumed for
+	// spending coins at some later time when computing the waste of a
+	// selection.
+	DefaultLongTermFeeRate btcutil.Amount = 10000
+
+	// DefaultBnBMaxTries is the number of branches Branch-and-Bound
+	// explores before giving up.
+	DefaultBnBMaxTries = 100000
+
+	// DefaultRandomImproveRounds is the number of random selections
+	// random-improve builds before picking the least wasteful one.
+	DefaultRandomImproveRounds = 20
+)
+
+var (
+	// ErrInsufficientFunds is returned when the eligible coins cannot pay
+	// for the target and the fee.
+	ErrInsufficientFunds = errors.New("insufficient funds available to " +
+		"construct transaction")
+
+	// ErrNoChangelessSolution is returned by Branch-and-Bound when no
+	// selection matches the target closely enough to avoid change.
+	ErrNoChangelessSolution = errors.New("no changeless coin selection " +
+		"found")
+)
+
+// Coin is an unspent output that may be selected to fund a transaction. The
+// address type determines the weight of the input spending it.
+type Coin struct {
+	wire.OutPoint
+	wire.TxOut
+	AddrType waddrmgr.AddressType
+}
+
+// SelectionParams describes the transaction being funded.
+type SelectionParams struct {
+	// Target is the total value of the non-change outputs.
+	Target btcutil.Amount
+
+	// FeeRate is the fee rate, in sat/kvB, the transaction pays.
+	FeeRate btcutil.Amount
+
+	// LongTermFeeRate is the fee rate, in sat/kvB, at which the coins are
+	// assumed to be spent otherwise. DefaultLongTermFeeRate is used when
+	// zero.
+	LongTermFeeRate btcutil.Amount
+
+	// BaseWeight is the weight of the transaction without any inputs or
+	// change output, including the input count varint for one input.
+	BaseWeight int64
+
+	// ChangeOutputSize is the serialize size a change output adds.
+	ChangeOutputSize int64
+
+	// ChangeSpendWeight is the weight of the input that will eventually
+	// spend the change output.
+	ChangeSpendWeight int64
+
+	// DustLimit is the smallest change worth creating. Any smaller
+	// remainder is added to the fee.
+	DustLimit btcutil.Amount
+
+	// ExtraFee is paid on top of the fee for the transaction's own
+	// weight, such as the fee missing from an unconfirmed parent bumped
+	// through CPFP.
+	ExtraFee btcutil.Amount
+}
+
+// Selection is the result of coin selection.
+type Selection struct {
+	// Coins are the selected inputs.
+	Coins []Coin
+
+	// Fee is the fee paid by the transaction.
+	Fee btcutil.Amount
+
+	// Change is the value of the change output, zero for a changeless
+	// transaction.
+	Change btcutil.Amount
+
+	// Waste measures the cost of this selection compared to spending the
+	// same coins at the long term fee rate. Lower is better.
+	Waste btcutil.Amount
+}
+
+// CoinSelector picks the coins funding a transaction.
+type CoinSelector interface {
+	SelectCoins(coins []Coin, params SelectionParams) (*Selection, error)
+}
+
+// FeeForWeight returns the fee, rounded up, for a transaction of the given
+// weight at a fee rate in sat/kvB.
+func FeeForWeight(feeRate btcutil.Amount, weight int64) btcutil.Amount {
+	const scale = blockchain.WitnessScaleFactor
+	vsize := (weight + scale - 1) / scale
+	return (feeRate*btcutil.Amount(vsize) + 999) / 1000
+}
+
+// candidate is a coin along with its input weight.
+type candidate struct {
+	coin   Coin
+	weight int64
+}
+
+// candidates drops coins the wallet cannot estimate the input weight of.
+func candidates(coins []Coin) []candidate {
+	cs := make([]candidate, 0, len(coins))
+	for _, c := range coins {
+		w, err := txsizes.InputWeight(c.AddrType)
+		if err != nil {
+			continue
+		}
+		cs = append(cs, candidate{coin: c, weight: w})
+	}
+	return cs
+}
+
+// selectionWeight returns the weight of a transaction spending cs, with or
+// without a change output.
+func (p *SelectionParams) selectionWeight(cs []candidate, change bool) int64 {
+	weight := p.BaseWeight
+	witness := false
+	addrTypes := make([]waddrmgr.AddressType, 0, len(cs))
+	for _, c := range cs {
+		weight += c.weight
+		witness = witness || txsizes.IsWitness(c.coin.AddrType)
+		addrTypes = append(addrTypes, c.coin.AddrType)
+	}
+
+	// The base weight accounts for a one byte input count.
+	weight += int64(wire.VarIntSerializeSize(uint64(len(cs)))-1) *
+		blockchain.WitnessScaleFactor
+	if witness {
+		weight += txsizes.WitnessOverhead(addrTypes)
+	}
+	if change {
+		weight += p.ChangeOutputSize * blockchain.WitnessScaleFactor
+	}
+	return weight
+}
+
+func (p *SelectionParams) longTermFeeRate() btcutil.Amount {
+	if p.LongTermFeeRate == 0 {
+		return DefaultLongTermFeeRate
+	}
+	return p.LongTermFeeRate
+}
+
+// costOfChange is the fee for creating the change output now plus the fee
+// for spending it later.
+func (p *SelectionParams) costOfChange() btcutil.Amount {
+	return FeeForWeight(p.FeeRate,
+		p.ChangeOutputSize*blockchain.WitnessScaleFactor) +
+		FeeForWeight(p.longTermFeeRate(), p.ChangeSpendWeight)
+}
+
+// finalize computes the fee, change and waste of spending cs. A changeless
+// transaction is forced when allowChange is false.
+func (p *SelectionParams) finalize(cs []candidate,
+	allowChange bool) (*Selection, error) {
+
+	var total btcutil.Amount
+	var inputWaste btcutil.Amount
+	coins := make([]Coin, 0, len(cs))
+	for _, c := range cs {
+		total += btcutil.Amount(c.coin.Value)
+		inputWaste += FeeForWeight(p.FeeRate, c.weight) -
+			FeeForWeight(p.longTermFeeRate(), c.weight)
+		coins = append(coins, c.coin)
+	}
+
+	feeWithChange := FeeForWeight(p.FeeRate, p.selectionWeight(cs, true)) +
+		p.ExtraFee
+	change := total - p.Target - feeWithChange
+	if allowChange && change >= p.DustLimit && change > 0 {
+		return &Selection{
+			Coins:  coins,
+			Fee:    feeWithChange,
+			Change: change,
+			Waste:  inputWaste + p.costOfChange(),
+		}, nil
+	}
+
+	fee := FeeForWeight(p.FeeRate, p.selectionWeight(cs, false)) +
+		p.ExtraFee
+	excess := total - p.Target - fee
+	if excess < 0 {
+		return nil, ErrInsufficientFunds
+	}
+	return &Selection{
+		Coins: coins,
+		Fee:   fee + excess,
+		Waste: inputWaste + excess,
+	}, nil
+}
+
+// effectiveValue is the value of a coin minus the fee for spending it.
+func (p *SelectionParams) effectiveValue(c candidate) btcutil.Amount {
+	return btcutil.Amount(c.coin.Value) - FeeForWeight(p.FeeRate, c.weight)
+}
+
+// LargestFirst selects the largest coins until the target and fee are
+// covered.
+type LargestFirst struct{}
+
+// SelectCoins implements the CoinSelector interface.
+func (LargestFirst) SelectCoins(coins []Coin,
+	params SelectionParams) (*Selection, error) {
+
+	cs := candidates(coins)
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].coin.Value > cs[j].coin.Value
+	})
+
+	for i := range cs {
+		sel, err := params.finalize(cs[:i+1], true)
+		if err == nil {
+			return sel, nil
+		}
+	}
+	return nil, ErrInsufficientFunds
+}
+
+// SpendAll selects every coin passed, for transactions whose inputs were
+// chosen by the caller. Change is added if the remainder is worth it.
+type SpendAll struct{}
+
+// SelectCoins implements the CoinSelector interface.
+func (SpendAll) SelectCoins(coins []Coin,
+	params SelectionParams) (*Selection, error) {
+
+	cs := candidates(coins)
+	if len(cs) != len(coins) {
+		return nil, errors.New("unable to estimate the weight of " +
+			"every input")
+	}
+	return params.finalize(cs, true)
+}
+
+// SpendRequired selects every required coin, adding the largest of the coins
+// passed only while the required ones can't pay for the target and fee. It
+// funds replacement transactions, which must keep spending the inputs of the
+// transaction they replace, and CPFP children, which must spend an output of
+// their parent.
+type SpendRequired struct {
+	Required []Coin
+
+	// ExtraFee is added to the ExtraFee of the selection params.
+	ExtraFee btcutil.Amount
+}
+
+// SelectCoins implements the CoinSelector interface.
+func (s SpendRequired) SelectCoins(coins []Coin,
+	params SelectionParams) (*Selection, error) {
+
+	params.ExtraFee += s.ExtraFee
+
+	required := candidates(s.Required)
+	if len(required) != len(s.Required) {
+		return nil, errors.New("unable to estimate the weight of " +
+			"every required input")
+	}
+	isRequired := make(map[wire.OutPoint]struct{}, len(required))
+	for _, c := range required {
+		isRequired[c.coin.OutPoint] = struct{}{}
+	}
+
+	var extra []candidate
+	for _, c := range candidates(coins) {
+		if _, ok := isRequired[c.coin.OutPoint]; !ok {
+			extra = append(extra, c)
+		}
+	}
+	sort.SliceStable(extra, func(i, j int) bool {
+		return extra[i].coin.Value > extra[j].coin.Value
+	})
+
+	cs := required
+	for i := 0; ; i++ {
+		sel, err := params.finalize(cs, true)
+		if err == nil {
+			return sel, nil
+		}
+		if i == len(extra) {
+			return nil, err
+		}
+		cs = append(cs, extra[i])
+	}
+}
+
+// BranchAndBound searches for a set of coins whose effective value matches
+// the target closely enough that no change output is needed, preferring the
+// selection with the least waste. If none exists and Fallback is set, the
+// fallback selector is used instead.
+type BranchAndBound struct {
+	// MaxTries bounds the search. DefaultBnBMaxTries is used when zero.
+	MaxTries int
+
+	// Fallback is used when no changeless solution exists.
+	Fallback CoinSelector
+}
+
+// SelectCoins implements the CoinSelector interface.
+func (b BranchAndBound) SelectCoins(coins []Coin,
+	params SelectionParams) (*Selection, error) {
+
+	sel := b.search(coins, &params)
+	if sel != nil {
+		return sel, nil
+	}
+	if b.Fallback != nil {
+		return b.Fallback.SelectCoins(coins, params)
+	}
+	return nil, ErrNoChangelessSolution
+}
+
+func (b BranchAndBound) search(coins []Coin, params *SelectionParams) *Selection {
+	maxTries := b.MaxTries
+	if maxTries == 0 {
+		maxTries = DefaultBnBMaxTries
+	}
+
+	// Only coins that add value after paying for themselves are useful.
+	var (
+		pool      []candidate
+		effValues []btcutil.Amount
+		waste     []btcutil.Amount
+		isWitness []bool
+		available btcutil.Amount
+	)
+	all := candidates(coins)
+	sort.SliceStable(all, func(i, j int) bool {
+		return params.effectiveValue(all[i]) > params.effectiveValue(all[j])
+	})
+	for _, c := range all {
+		ev := params.effectiveValue(c)
+		if ev <= 0 {
+			continue
+		}
+		pool = append(pool, c)
+		effValues = append(effValues, ev)
+		isWitness = append(isWitness, txsizes.IsWitness(c.coin.AddrType))
+		waste = append(waste, FeeForWeight(params.FeeRate, c.weight)-
+			FeeForWeight(params.longTermFeeRate(), c.weight))
+		available += ev
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+
+	// The witness overhead depends on the coins selected, so it is left
+	// out of the candidate weights. Only a selection spending a witness
+	// coin pays for the segwit marker and flag, and for an empty witness
+	// per non-witness input, as in WitnessOverhead.
+	selTarget := func(witness, nonWitness int) btcutil.Amount {
+		weight := params.BaseWeight
+		if witness > 0 {
+			weight += txsizes.WitnessHeaderWeight +
+				int64(nonWitness)*txsizes.EmptyWitnessWeight
+		}
+		return params.Target + params.ExtraFee +
+			FeeForWeight(params.FeeRate, weight)
+	}
+	costOfChange := params.costOfChange()
+	if available < selTarget(0, 0) {
+		return nil
+	}
+
+	var (
+		currValue      btcutil.Amount
+		currWaste      btcutil.Amount
+		currWitness    int
+		currNonWitness int
+		currSel        []int
+		best           []int
+		bestWaste      btcutil.Amount = -1
+	)
+	for try, idx := 0, 0; try < maxTries; try, idx = try+1, idx+1 {
+		target := selTarget(currWitness, currNonWitness)
+
+		backtrack := false
+		switch {
+		case currValue+available < selTarget(0, 0),
+			currValue > target+costOfChange,
+			bestWaste >= 0 && currWaste > bestWaste && waste[0] > 0:
+
+			backtrack = true
+
+		case currValue >= target:
+			excessWaste := currWaste + currValue - target
+			if bestWaste < 0 || excessWaste <= bestWaste {
+				best = append(best[:0], currSel...)
+				bestWaste = excessWaste
+			}
+			backtrack = true
+		}
+
+		if backtrack {
+			if len(currSel) == 0 {
+				break
+			}
+
+			// Add omitted coins back before traversing the
+			// omission branch of the last included coin.
+			for idx--; idx > currSel[len(currSel)-1]; idx-- {
+				available += effValues[idx]
+			}
+			last := currSel[len(currSel)-1]
+			currValue -= effValues[last]
+			currWaste -= waste[last]
+			if isWitness[last] {
+				currWitness--
+			} else {
+				currNonWitness--
+			}
+			currSel = currSel[:len(currSel)-1]
+			continue
+		}
+
+		available -= effValues[idx]
+
+		// Skip the inclusion branch if the previous coin is equivalent
+		// and was excluded, as it would only repeat that search.
+		if len(currSel) == 0 || idx-1 == currSel[len(currSel)-1] ||
+			effValues[idx] != effValues[idx-1] ||
+			waste[idx] != waste[idx-1] ||
+			isWitness[idx] != isWitness[idx-1] {
+
+			currSel = append(currSel, idx)
+			currValue += effValues[idx]
+			currWaste += waste[idx]
+			if isWitness[idx] {
+				currWitness++
+			} else {
+				currNonWitness++
+			}
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	selected := make([]candidate, 0, len(best))
+	for _, i := range best {
+		selected = append(selected, pool[i])
+	}
+	sel, err := params.finalize(selected, false)
+	if err != nil {
+		return nil
+	}
+	return sel
+}
+
+// RandomImprove implements the random-improve algorithm. Coins are picked
+// at random until the target is met, then further random coins are added
+// while they bring the selected value closer to twice the target without
+// exceeding three times the target, which leaves change useful for future
+// payments. Several rounds are run and the least wasteful result is used.
+type RandomImprove struct {
+	// Rand is the source of randomness. A time seeded source is used when
+	// nil.
+	Rand *rand.Rand
+
+	// Rounds is the number of selections to compare.
+	// DefaultRandomImproveRounds is used when zero.
+	Rounds int
+}
+
+// SelectCoins implements the CoinSelector interface.
+func (r RandomImprove) SelectCoins(coins []Coin,
+	params SelectionParams) (*Selection, error) {
+
+	rng := r.Rand
+	if rng == nil {
+		rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	rounds := r.Rounds
+	if rounds == 0 {
+		rounds = DefaultRandomImproveRounds
+	}
+
+	cs := candidates(coins)
+	var best *Selection
+	for i := 0; i < rounds; i++ {
+		sel := randomImproveRound(rng, cs, &params)
+		if sel == nil {
+			// If a random order cannot fund the target, no order
+			// can.
+			break
+		}
+		if best == nil || sel.Waste < best.Waste {
+			best = sel
+		}
+	}
+	if best == nil {
+		return nil, ErrInsufficientFunds
+	}
+	return best, nil
+}
+
+func randomImproveRound(rng *rand.Rand, cs []candidate,
+	params *SelectionParams) *Selection {
+
+	order := rng.Perm(len(cs))
+
+	// Random phase: select until the target and fee are paid.
+	var (
+		selected []candidate
+		value    btcutil.Amount
+		sel      *Selection
+		next     int
+	)
+	for ; next < len(order); next++ {
+		c := cs[order[next]]
+		selected = append(selected, c)
+		value += params.effectiveValue(c)
+		if value < params.Target {
+			continue
+		}
+		var err error
+		sel, err = params.finalize(selected, true)
+		if err == nil {
+			next++
+			break
+		}
+	}
+	if sel == nil {
+		return nil
+	}
+
+	// Improve phase: move towards the ideal of twice the target.
+	ideal := 2 * params.Target
+	upper := 3 * params.Target
+	for ; next < len(order); next++ {
+		c := cs[order[next]]
+		ev := params.effectiveValue(c)
+		if ev <= 0 {
+			continue
+		}
+		newValue := value + ev
+		if newValue > upper || absAmount(ideal-newValue) >= absAmount(ideal-value) {
+			continue
+		}
+		candidateSel, err := params.finalize(append(selected, c), true)
+		if err != nil {
+			continue
+		}
+		selected = append(selected, c)
+		value = newValue
+		sel = candidateSel
+	}
+	return sel
+}
+
+func absAmount(a btcutil.Amount) btcutil.Amount {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,362 @@
+package txauthor
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/wallet/txsizes"
+)
+
+func p2wpkhCoins(values ...btcutil.Amount) []Coin {
+	coins := make([]Coin, len(values))
+	for i, v := range values {
+		coins[i] = Coin{
+			OutPoint: wire.OutPoint{Index: uint32(i)},
+			TxOut: wire.TxOut{
+				Value:    int64(v),
+				PkScript: make([]byte, txsizes.P2WPKHPkScriptSize),
+			},
+			AddrType: waddrmgr.WitnessPubKey,
+		}
+	}
+	return coins
+}
+
+func testChangeSource() *ChangeSource {
+	return &ChangeSource{
+		NewScript: func() ([]byte, error) {
+			return make([]byte, txsizes.P2WPKHPkScriptSize), nil
+		},
+		ScriptSize: txsizes.P2WPKHPkScriptSize,
+		AddrType:   waddrmgr.WitnessPubKey,
+	}
+}
+
+func testParams(t *testing.T, target, feeRate btcutil.Amount) SelectionParams {
+	out := wire.NewTxOut(int64(target), make([]byte, txsizes.P2WPKHPkScriptSize))
+	params, err := selectionParams(
+		[]*wire.TxOut{out}, feeRate, testChangeSource())
+	if err != nil {
+		t.Fatalf("unable to build selection params: %v", err)
+	}
+	return *params
+}
+
+func sumCoins(coins []Coin) btcutil.Amount {
+	var total btcutil.Amount
+	for _, c := range coins {
+		total += btcutil.Amount(c.Value)
+	}
+	return total
+}
+
+// checkBalanced asserts that the selection pays exactly target, fee and
+// change.
+func checkBalanced(t *testing.T, sel *Selection, target btcutil.Amount) {
+	t.Helper()
+
+	if got := sumCoins(sel.Coins); got != target+sel.Fee+sel.Change {
+		t.Fatalf("inputs %v do not equal target %v + fee %v + "+
+			"change %v", got, target, sel.Fee, sel.Change)
+	}
+}
+
+func TestBranchAndBoundChangeless(t *testing.T) {
+	const feeRate = 1000
+	params := testParams(t, 50000, feeRate)
+
+	// Build a coin whose effective value, together with the base fee,
+	// exactly pays the target, hidden among coins that would all need
+	// change.
+	exact := Coin{AddrType: waddrmgr.WitnessPubKey}
+	exact.PkScript = make([]byte, txsizes.P2WPKHPkScriptSize)
+	exactWeight, _ := txsizes.InputWeight(waddrmgr.WitnessPubKey)
+	baseWeight := params.BaseWeight + txsizes.WitnessHeaderWeight
+	exact.Value = int64(params.Target +
+		FeeForWeight(feeRate, baseWeight) +
+		FeeForWeight(feeRate, exactWeight))
+	coins := append(p2wpkhCoins(120000, 90000, 30000, 25000), exact)
+	coins[len(coins)-1].Index = 99
+
+	sel, err := BranchAndBound{}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if sel.Change != 0 {
+		t.Fatalf("expected changeless selection, got change %v",
+			sel.Change)
+	}
+	if len(sel.Coins) != 1 || sel.Coins[0].Index != 99 {
+		t.Fatalf("expected the exact match coin, got %v", sel.Coins)
+	}
+	checkBalanced(t, sel, params.Target)
+}
+
+func TestBranchAndBoundMixedWitness(t *testing.T) {
+	const feeRate = 1000
+	params := testParams(t, 50000, feeRate)
+	legacyWeight, _ := txsizes.InputWeight(waddrmgr.PubKeyHash)
+	witnessWeight, _ := txsizes.InputWeight(waddrmgr.WitnessPubKey)
+
+	legacyCoin := func(value btcutil.Amount, index uint32) Coin {
+		return Coin{
+			OutPoint: wire.OutPoint{Index: index},
+			TxOut: wire.TxOut{
+				Value:    int64(value),
+				PkScript: make([]byte, txsizes.P2PKHPkScriptSize),
+			},
+			AddrType: waddrmgr.PubKeyHash,
+		}
+	}
+
+	// A selection of legacy coins only carries no witness, so it pays for
+	// neither the segwit marker and flag nor empty witnesses, even though
+	// the pool holds witness coins.
+	legacyFee := FeeForWeight(feeRate, params.BaseWeight) +
+		FeeForWeight(feeRate, legacyWeight)
+	coins := append(p2wpkhCoins(120000, 90000),
+		legacyCoin(params.Target+legacyFee, 99))
+
+	sel, err := BranchAndBound{}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 1 || sel.Coins[0].Index != 99 {
+		t.Fatalf("expected the legacy coin, got %v", sel.Coins)
+	}
+	if sel.Change != 0 || sel.Fee != legacyFee {
+		t.Fatalf("expected fee %v without change, got fee %v and "+
+			"change %v", legacyFee, sel.Fee, sel.Change)
+	}
+	checkBalanced(t, sel, params.Target)
+
+	// Spending a legacy and a witness coin together pays for the marker
+	// and flag and a single empty witness.
+	overhead := int64(txsizes.WitnessHeaderWeight +
+		txsizes.EmptyWitnessWeight)
+	mixedFee := FeeForWeight(feeRate, params.BaseWeight+overhead) +
+		FeeForWeight(feeRate, legacyWeight) +
+		FeeForWeight(feeRate, witnessWeight)
+	witnessCoin := p2wpkhCoins(params.Target + mixedFee - 30000)[0]
+	witnessCoin.Index = 98
+	coins = []Coin{
+		p2wpkhCoins(120000)[0], legacyCoin(30000, 97), witnessCoin,
+	}
+
+	sel, err = BranchAndBound{}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 2 {
+		t.Fatalf("expected the legacy and witness coins, got %v",
+			sel.Coins)
+	}
+	if sel.Change != 0 || sel.Fee != mixedFee {
+		t.Fatalf("expected fee %v without change, got fee %v and "+
+			"change %v", mixedFee, sel.Fee, sel.Change)
+	}
+	checkBalanced(t, sel, params.Target)
+}
+
+func TestBranchAndBoundFallback(t *testing.T) {
+	params := testParams(t, 50000, 1000)
+	coins := p2wpkhCoins(200000, 300000)
+
+	_, err := BranchAndBound{}.SelectCoins(coins, params)
+	if !errors.Is(err, ErrNoChangelessSolution) {
+		t.Fatalf("expected ErrNoChangelessSolution, got %v", err)
+	}
+
+	sel, err := BranchAndBound{Fallback: LargestFirst{}}.SelectCoins(
+		coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins with fallback: %v", err)
+	}
+	if sel.Change == 0 {
+		t.Fatalf("expected fallback selection with change")
+	}
+	checkBalanced(t, sel, params.Target)
+}
+
+func TestLargestFirst(t *testing.T) {
+	params := testParams(t, 150000, 2000)
+	coins := p2wpkhCoins(10000, 100000, 20000, 80000)
+
+	sel, err := LargestFirst{}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 2 || sel.Coins[0].Value != 100000 ||
+		sel.Coins[1].Value != 80000 {
+
+		t.Fatalf("expected the two largest coins, got %v", sel.Coins)
+	}
+	checkBalanced(t, sel, params.Target)
+}
+
+func TestSpendAll(t *testing.T) {
+	params := testParams(t, 50000, 2000)
+	coins := p2wpkhCoins(10000, 100000, 20000)
+
+	sel, err := SpendAll{}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != len(coins) {
+		t.Fatalf("expected all %d coins, got %d", len(coins),
+			len(sel.Coins))
+	}
+	if sel.Change == 0 {
+		t.Fatalf("expected change")
+	}
+	checkBalanced(t, sel, params.Target)
+
+	_, err = SpendAll{}.SelectCoins(coins[:1], params)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+}
+
+func TestSpendRequired(t *testing.T) {
+	params := testParams(t, 50000, 2000)
+	coins := p2wpkhCoins(10000, 100000, 60000, 20000)
+
+	// The required coin is spent alone while it covers the target.
+	sel, err := SpendRequired{Required: coins[2:3]}.SelectCoins(
+		coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 1 || sel.Coins[0].OutPoint != coins[2].OutPoint {
+		t.Fatalf("expected only the required coin, got %v", sel.Coins)
+	}
+	checkBalanced(t, sel, params.Target)
+
+	// Otherwise the largest other coins are added.
+	sel, err = SpendRequired{Required: coins[3:]}.SelectCoins(
+		coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 2 || sel.Coins[0].OutPoint != coins[3].OutPoint ||
+		sel.Coins[1].OutPoint != coins[1].OutPoint {
+
+		t.Fatalf("expected the required and largest coin, got %v",
+			sel.Coins)
+	}
+	checkBalanced(t, sel, params.Target)
+
+	// An extra fee is paid on top of the fee for the weight, adding
+	// another coin.
+	plain, err := SpendRequired{Required: coins[2:3]}.SelectCoins(
+		coins[2:3], params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	sel, err = SpendRequired{Required: coins[2:3], ExtraFee: 20000}.
+		SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if len(sel.Coins) != 2 || sel.Fee < plain.Fee+20000 {
+		t.Fatalf("expected two coins paying the extra fee, got %v "+
+			"with fee %v", sel.Coins, sel.Fee)
+	}
+	checkBalanced(t, sel, params.Target)
+
+	_, err = SpendRequired{Required: coins[:1]}.SelectCoins(
+		coins[:1], params)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+}
+
+func TestRandomImproveWaste(t *testing.T) {
+	params := testParams(t, 40000, 1000)
+	coins := p2wpkhCoins(5000, 10000, 15000, 20000, 25000, 30000, 35000,
+		40000, 45000, 50000)
+
+	sel, err := RandomImprove{
+		Rand: rand.New(rand.NewSource(1)),
+	}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	checkBalanced(t, sel, params.Target)
+
+	// The improve phase never lets the effective value exceed three
+	// times the target.
+	if sumCoins(sel.Coins) > 3*params.Target+sel.Fee {
+		t.Fatalf("selection %v exceeds the improve cap",
+			sumCoins(sel.Coins))
+	}
+
+	// Every round is a valid selection, so the best round can't waste
+	// more than a single one.
+	single, err := RandomImprove{
+		Rand:   rand.New(rand.NewSource(1)),
+		Rounds: 1,
+	}.SelectCoins(coins, params)
+	if err != nil {
+		t.Fatalf("unable to select coins: %v", err)
+	}
+	if sel.Waste > single.Waste {
+		t.Fatalf("waste %v of best round exceeds waste %v of first "+
+			"round", sel.Waste, single.Waste)
+	}
+}
+
+func TestInsufficientFunds(t *testing.T) {
+	params := testParams(t, 100000, 1000)
+	coins := p2wpkhCoins(30000, 40000, 30000)
+
+	selectors := []CoinSelector{
+		LargestFirst{},
+		RandomImprove{Rand: rand.New(rand.NewSource(1))},
+		BranchAndBound{Fallback: LargestFirst{}},
+	}
+	for _, s := range selectors {
+		_, err := s.SelectCoins(coins, params)
+		if !errors.Is(err, ErrInsufficientFunds) {
+			t.Fatalf("%T: expected ErrInsufficientFunds, got %v",
+				s, err)
+		}
+	}
+}
+
+func TestInputWeightByAddressType(t *testing.T) {
+	// Spending the same value from each script type must charge the
+	// input weight of that type.
+	types := []waddrmgr.AddressType{
+		waddrmgr.PubKeyHash,
+		waddrmgr.NestedWitnessPubKey,
+		waddrmgr.WitnessPubKey,
+		waddrmgr.TaprootPubKey,
+	}
+	params := testParams(t, 10000, 10000)
+	for _, addrType := range types {
+		coin := p2wpkhCoins(100000)
+		coin[0].AddrType = addrType
+
+		sel, err := LargestFirst{}.SelectCoins(coin, params)
+		if err != nil {
+			t.Fatalf("%v: unable to select coins: %v", addrType, err)
+		}
+
+		weight, err := txsizes.InputWeight(addrType)
+		if err != nil {
+			t.Fatalf("%v: %v", addrType, err)
+		}
+		cand := candidates(coin)
+		wantFee := FeeForWeight(params.FeeRate,
+			params.selectionWeight(cand, sel.Change > 0))
+		if sel.Fee != wantFee {
+			t.Fatalf("%v: fee %v, want %v for input weight %d",
+				addrType, sel.Fee, wantFee, weight)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package txrules provides transaction rules that should be followed by
+// transaction authors for wide mempool acceptance and quick mining.
+package txrules
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// DefaultRelayFeePerKb is the default minimum relay fee policy for a mempool.
+const DefaultRelayFeePerKb btcutil.Amount = 1e3
+
+// GetDustThreshold is used to define the amount below which output will be
+// determined as dust. Threshold is determined as 3 times the relay fee.
+func GetDustThreshold(scriptSize int, relayFeePerKb btcutil.Amount) btcutil.Amount {
+	// Calculate the total (estimated) cost to the network. This is
+	// calculated using the serialize size of the output plus the serial
+	// size of a transaction input which redeems it. The output is assumed
+	// to be compressed P2PKH as this is the most common script type. Use
+	// the average size of a compressed P2PKH redeem input (148) rather
+	// than the largest possible (txsizes.RedeemP2PKHInputSize).
+	totalSize := 8 + wire.VarIntSerializeSize(uint64(scriptSize)) +
+		scriptSize + 148
+
+	byteFee := relayFeePerKb / 1000
+	relayFee := btcutil.Amount(totalSize) * byteFee
+	return 3 * relayFee
+}
+
+// IsDustAmount determines whether a transaction output value and script
+// length would cause the output to be considered dust. Transactions with dust
+// outputs are not standard and are rejected by mempools with default
+// policies.
+func IsDustAmount(amount btcutil.Amount, scriptSize int,
+	relayFeePerKb btcutil.Amount) bool {
+
+	return amount < GetDustThreshold(scriptSize, relayFeePerKb)
+}
+
+// IsDustOutput determines whether a transaction output is considered dust.
+// Transactions with dust outputs are not standard and are rejected by
+// mempools with default policies.
+func IsDustOutput(output *wire.TxOut, relayFeePerKb btcutil.Amount) bool {
+	// Unspendable outputs which solely carry data are not checked for
+	// dust.
+	if txscript.GetScriptClass(output.PkScript) == txscript.NullDataTy {
+		return false
+	}
+
+	// All other unspendable outputs are considered dust.
+	if txscript.IsUnspendable(output.PkScript) {
+		return true
+	}
+
+	return IsDustAmount(btcutil.Amount(output.Value), len(output.PkScript),
+		relayFeePerKb)
+}
+
+// Transaction rule violations
+var (
+	ErrAmountNegative   = errors.New("transaction output amount is negative")
+	ErrAmountExceedsMax = errors.New("transaction output amount exceeds maximum value")
+	ErrOutputIsDust     = errors.New("transaction output is dust")
+)
+
+// CheckOutput performs simple consensus and policy tests on a transaction
+// output.
+func CheckOutput(output *wire.TxOut, relayFeePerKb btcutil.Amount) error {
+	if output.Value < 0 {
+		return ErrAmountNegative
+	}
+	if output.Value > btcutil.MaxSatoshi {
+		return ErrAmountExceedsMax
+	}
+	if IsDustOutput(output, relayFeePerKb) {
+		return ErrOutputIsDust
+	}
+	return nil
+}
+
+// MaxRBFSequence is the largest input sequence number that signals, as per
+// BIP-125, that a transaction may be replaced by one paying a higher fee.
+const MaxRBFSequence = wire.MaxTxInSequenceNum - 2
+
+// SignalsReplacement returns whether a transaction opts in to replacement
+// under BIP-125, which any input with a sequence number of at most
+// MaxRBFSequence does.
+func SignalsReplacement(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence <= MaxRBFSequence {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrReplacementFeeTooLow is returned when a replacement transaction does not
+// pay enough to replace the original under BIP-125.
+var ErrReplacementFeeTooLow = errors.New("replacement transaction fee is " +
+	"too low")
+
+// CheckReplacementFee checks the fee of a transaction replacing another one
+// against the BIP-125 rules: the replacement must pay a higher fee rate and
+// at least the fee of the original, plus the incremental relay fee for its
+// own virtual size.
+func CheckReplacementFee(origFee btcutil.Amount, origVSize int64,
+	fee btcutil.Amount, vsize int64, incrementalFeePerKb btcutil.Amount) error {
+
+	if fee*btcutil.Amount(origVSize) <= origFee*btcutil.Amount(vsize) {
+		return ErrReplacementFeeTooLow
+	}
+	if fee-origFee < incrementalFeePerKb*btcutil.Amount(vsize)/1000 {
+		return ErrReplacementFeeTooLow
+	}
+	return nil
+}
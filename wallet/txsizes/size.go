@@ -0,0 +1,217 @@
+// Package txsizes provides worst-case size and weight estimates for
+// transactions spending the script types the wallet manages.
+package txsizes
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+)
+
+// Worst case script and input/output size estimates.
+const (
+	// RedeemP2PKHSigScriptSize is the worst case (largest) serialize size
+	// of a transaction input script that redeems a compressed P2PKH output.
+	// It is calculated as:
+	//
+	//   - OP_DATA_73
+	//   - 72 bytes DER signature + 1 byte sighash
+	//   - OP_DATA_33
+	//   - 33 bytes serialized compressed pubkey
+	RedeemP2PKHSigScriptSize = 1 + 73 + 1 + 33
+
+	// P2PKHPkScriptSize is the size of a transaction output script that
+	// pays to a compressed pubkey hash.
+	P2PKHPkScriptSize = 1 + 1 + 1 + 20 + 1 + 1
+
+	// P2SHPkScriptSize is the size of a transaction output script that
+	// pays to a script hash.
+	P2SHPkScriptSize = 1 + 1 + 20 + 1
+
+	// P2WPKHPkScriptSize is the size of a transaction output script that
+	// pays to a witness pubkey hash.
+	P2WPKHPkScriptSize = 1 + 1 + 20
+
+	// P2WSHPkScriptSize is the size of a transaction output script that
+	// pays to a witness script hash.
+	P2WSHPkScriptSize = 1 + 1 + 32
+
+	// P2TRPkScriptSize is the size of a transaction output script that
+	// pays to a taproot output key.
+	P2TRPkScriptSize = 1 + 1 + 32
+
+	// RedeemP2PKHInputSize is the worst case (largest) serialize size of a
+	// transaction input redeeming a compressed P2PKH output.
+	RedeemP2PKHInputSize = 32 + 4 + 1 + RedeemP2PKHSigScriptSize + 4
+
+	// RedeemP2WPKHInputSize is the worst case size of a transaction input
+	// redeeming a P2WPKH output. The script is empty; the signature and
+	// pubkey are in the witness.
+	RedeemP2WPKHInputSize = 32 + 4 + 1 + 4
+
+	// RedeemNestedP2WPKHScriptSize is the worst case size of a transaction
+	// input script that redeems a pay-to-witness-key hash nested in P2SH
+	// (P2SH-P2WPKH). It is calculated as:
+	//
+	//   - 1 byte compact int encoding value 22
+	//   - OP_0
+	//   - 1 byte compact int encoding value 20
+	//   - 20 byte key hash
+	RedeemNestedP2WPKHScriptSize = 1 + 1 + 1 + 20
+
+	// RedeemNestedP2WPKHInputSize is the worst case size of a transaction
+	// input redeeming a P2SH-P2WPKH output.
+	RedeemNestedP2WPKHInputSize = 32 + 4 + 1 + RedeemNestedP2WPKHScriptSize + 4
+
+	// RedeemP2WPKHInputWitnessWeight is the worst case weight of a witness
+	// for spending P2WPKH and nested P2WPKH outputs. It is calculated as:
+	//
+	//   - 1 wu compact int encoding value 2 (number of items)
+	//   - 1 wu compact int encoding value 73
+	//   - 72 wu DER signature + 1 wu sighash
+	//   - 1 wu compact int encoding value 33
+	//   - 33 wu serialized compressed pubkey
+	RedeemP2WPKHInputWitnessWeight = 1 + 1 + 73 + 1 + 33
+
+	// RedeemP2TRInputSize is the size of a transaction input redeeming a
+	// taproot output by key path. The script is empty.
+	RedeemP2TRInputSize = 32 + 4 + 1 + 4
+
+	// TaprootKeyPathWitnessWeight is the weight of a key path spend
+	// witness using the default sighash type. It is calculated as:
+	//
+	//   - 1 wu compact int encoding value 1 (number of items)
+	//   - 1 wu compact int encoding value 64
+	//   - 64 wu schnorr signature
+	TaprootKeyPathWitnessWeight = 1 + 1 + 64
+
+	// TaprootKeyPathCustomSighashWitnessWeight is the weight of a key path
+	// spend witness that carries an explicit sighash byte.
+	TaprootKeyPathCustomSighashWitnessWeight = TaprootKeyPathWitnessWeight + 1
+
+	// WitnessHeaderWeight is the weight of the segwit marker and flag
+	// bytes of a transaction with a witness.
+	WitnessHeaderWeight = 1 + 1
+
+	// EmptyWitnessWeight is the weight of the empty witness of an input
+	// that doesn't need one, in a transaction with a witness: a compact
+	// int encoding value 0.
+	EmptyWitnessWeight = 1
+)
+
+// InputWeight returns the worst case weight of a transaction input spending
+// an output of the given address type, witness included. Only address types
+// the wallet can sign for without extra script information are supported.
+func InputWeight(addrType waddrmgr.AddressType) (int64, error) {
+	const scale = blockchain.WitnessScaleFactor
+
+	switch addrType {
+	case waddrmgr.PubKeyHash:
+		return RedeemP2PKHInputSize * scale, nil
+
+	case waddrmgr.NestedWitnessPubKey:
+		return RedeemNestedP2WPKHInputSize*scale +
+			RedeemP2WPKHInputWitnessWeight, nil
+
+	case waddrmgr.WitnessPubKey:
+		return RedeemP2WPKHInputSize*scale +
+			RedeemP2WPKHInputWitnessWeight, nil
+
+	case waddrmgr.TaprootPubKey:
+		return RedeemP2TRInputSize*scale +
+			TaprootKeyPathWitnessWeight, nil
+	}
+
+	return 0, fmt.Errorf("unsupported input address type %v", addrType)
+}
+
+// IsWitness returns whether spending an output of the given address type
+// requires a witness.
+func IsWitness(addrType waddrmgr.AddressType) bool {
+	switch addrType {
+	case waddrmgr.NestedWitnessPubKey, waddrmgr.WitnessPubKey,
+		waddrmgr.WitnessScript, waddrmgr.TaprootPubKey,
+		waddrmgr.TaprootScript:
+
+		return true
+	}
+	return false
+}
+
+// OutputSize returns the serialize size of a transaction output paying to
+// a script of scriptSize bytes.
+func OutputSize(scriptSize int) int64 {
+	return 8 + int64(wire.VarIntSerializeSize(uint64(scriptSize))) +
+		int64(scriptSize)
+}
+
+// EstimateWeight returns the worst case weight of a transaction spending
+// inputs of the given address types and paying to txOuts. If changeScriptSize
+// is non-zero, a change output paying to a script of that size is included.
+func EstimateWeight(inputs []waddrmgr.AddressType, txOuts []*wire.TxOut,
+	changeScriptSize int) (int64, error) {
+
+	const scale = blockchain.WitnessScaleFactor
+
+	numOutputs := len(txOuts)
+	outputsSize := int64(0)
+	for _, txOut := range txOuts {
+		outputsSize += int64(txOut.SerializeSize())
+	}
+	if changeScriptSize > 0 {
+		numOutputs++
+		outputsSize += OutputSize(changeScriptSize)
+	}
+
+	// Version, lock time, input and output counts and the outputs.
+	baseSize := 4 + 4 +
+		int64(wire.VarIntSerializeSize(uint64(len(inputs)))) +
+		int64(wire.VarIntSerializeSize(uint64(numOutputs))) +
+		outputsSize
+	weight := baseSize * scale
+
+	witness := false
+	for _, addrType := range inputs {
+		inputWeight, err := InputWeight(addrType)
+		if err != nil {
+			return 0, err
+		}
+		weight += inputWeight
+		witness = witness || IsWitness(addrType)
+	}
+	if witness {
+		weight += WitnessOverhead(inputs)
+	}
+
+	return weight, nil
+}
+
+// WitnessOverhead returns the weight a transaction spending inputs of the
+// given address types carries beyond the weight of each input when it has a
+// witness: the segwit marker and flag, plus an empty witness for every input
+// that doesn't need one.
+func WitnessOverhead(inputs []waddrmgr.AddressType) int64 {
+	overhead := int64(WitnessHeaderWeight)
+	for _, addrType := range inputs {
+		if !IsWitness(addrType) {
+			overhead += EmptyWitnessWeight
+		}
+	}
+	return overhead
+}
+
+// EstimateVirtualSize returns the worst case virtual size of a transaction
+// spending inputs of the given address types and paying to txOuts, with a
+// change output if changeScriptSize is non-zero.
+func EstimateVirtualSize(inputs []waddrmgr.AddressType, txOuts []*wire.TxOut,
+	changeScriptSize int) (int64, error) {
+
+	weight, err := EstimateWeight(inputs, txOuts, changeScriptSize)
+	if err != nil {
+		return 0, err
+	}
+	return (weight + blockchain.WitnessScaleFactor - 1) /
+		blockchain.WitnessScaleFactor, nil
+}
@@ -0,0 +1,75 @@
+package txsizes
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+)
+
+func TestEstimateVirtualSize(t *testing.T) {
+	p2wpkhOut := wire.NewTxOut(1000, make([]byte, P2WPKHPkScriptSize))
+	p2pkhOut := wire.NewTxOut(1000, make([]byte, P2PKHPkScriptSize))
+
+	tests := []struct {
+		name       string
+		inputs     []waddrmgr.AddressType
+		outputs    []*wire.TxOut
+		changeSize int
+		vsize      int64
+	}{
+		{
+			// 4 + 1 + 41 + 1 + 2*31 + 4 = 113 bytes, plus the
+			// 109 wu witness and 2 wu marker: 563 wu.
+			name:       "p2wpkh 1 in 2 out",
+			inputs:     []waddrmgr.AddressType{waddrmgr.WitnessPubKey},
+			outputs:    []*wire.TxOut{p2wpkhOut},
+			changeSize: P2WPKHPkScriptSize,
+			vsize:      141,
+		},
+		{
+			// 4 + 1 + 149 + 1 + 34 + 4 = 193 bytes, no witness.
+			name:    "p2pkh 1 in 1 out",
+			inputs:  []waddrmgr.AddressType{waddrmgr.PubKeyHash},
+			outputs: []*wire.TxOut{p2pkhOut},
+			vsize:   193,
+		},
+		{
+			// 4 + 1 + 41 + 1 + 31 + 4 = 82 bytes, plus the 66 wu
+			// witness and 2 wu marker: 396 wu.
+			name:    "p2tr 1 in 1 out",
+			inputs:  []waddrmgr.AddressType{waddrmgr.TaprootPubKey},
+			outputs: []*wire.TxOut{p2wpkhOut},
+			vsize:   99,
+		},
+		{
+			// 4 + 1 + 149 + 64 + 1 + 31 + 4 = 254 bytes, plus the
+			// 109 wu witness, 2 wu marker and an empty witness for
+			// the P2PKH input: 1128 wu.
+			name: "p2pkh and np2wpkh",
+			inputs: []waddrmgr.AddressType{
+				waddrmgr.PubKeyHash, waddrmgr.NestedWitnessPubKey,
+			},
+			outputs: []*wire.TxOut{p2wpkhOut},
+			vsize:   282,
+		},
+	}
+
+	for _, test := range tests {
+		vsize, err := EstimateVirtualSize(
+			test.inputs, test.outputs, test.changeSize)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if vsize != test.vsize {
+			t.Fatalf("%s: expected vsize %d, got %d", test.name,
+				test.vsize, vsize)
+		}
+	}
+
+	_, err := EstimateVirtualSize(
+		[]waddrmgr.AddressType{waddrmgr.WitnessScript}, nil, 0)
+	if err == nil {
+		t.Fatalf("expected error for unsupported input type")
+	}
+}
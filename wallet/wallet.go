@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"github.com/btcsuite/btcd/btcutil/hdkeychain"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/chain"
 	"github.com/czh0526/btc-wallet/waddrmgr"
 	"github.com/czh0526/btc-wallet/walletdb"
 	"github.com/czh0526/btc-wallet/wtxmgr"
@@ -13,6 +16,10 @@ import (
 )
 
 const (
+	// InsecurePubPassphrase is the public passphrase used for wallets
+	// created without one.
+	InsecurePubPassphrase = "public"
+
 	defaultSyncRetryInterval = 5 * time.Second
 )
 
@@ -26,8 +33,24 @@ type Wallet struct {
 	Manager *waddrmgr.Manager
 	TxStore *wtxmgr.Store
 
-	unlockRequests chan unlockRequest
-	lockRequests   chan struct{}
+	chainParams *chaincfg.Params
+
+	chainClient     chain.Interface
+	chainClientLock sync.Mutex
+
+	recoveryWindow uint32
+
+	lockedOutpoints    map[wire.OutPoint]struct{}
+	lockedOutpointsMtx sync.Mutex
+
+	NtfnServer *NotificationServer
+
+	createTxRequests chan createTxRequest
+	unlockRequests   chan unlockRequest
+	holdRequests     chan unlockRequest
+	releaseRequests  chan struct{}
+	lockRequests     chan chan struct{}
+	lockState        chan bool
 
 	started bool
 	quit    chan struct{}
@@ -58,6 +81,55 @@ func (w *Wallet) Start() {
 	go w.walletLocker()
 }
 
+// SynchronizeRPC associates the wallet with the chain backend, through which
+// transactions are published, and starts keeping the wallet in sync with the
+// chain of the backend. Any backend implementing chain.Interface may be
+// used. The wallet must not be associated with another client already. The
+// client is stopped along with the wallet, or right away if the wallet was
+// already stopped.
+func (w *Wallet) SynchronizeRPC(chainClient chain.Interface) {
+	select {
+	case <-w.quitChan():
+		chainClient.Stop()
+		return
+	default:
+	}
+
+	w.chainClientLock.Lock()
+	if w.chainClient != nil {
+		w.chainClientLock.Unlock()
+		return
+	}
+	w.chainClient = chainClient
+	w.chainClientLock.Unlock()
+
+	w.wg.Add(1)
+	go w.handleChainNotifications()
+}
+
+// requireChainClient returns the chain client if one is attached, or an
+// error otherwise.
+func (w *Wallet) requireChainClient() (chain.Interface, error) {
+	w.chainClientLock.Lock()
+	defer w.chainClientLock.Unlock()
+
+	if w.chainClient == nil {
+		return nil, errors.New("blockchain RPC is inactive")
+	}
+	return w.chainClient, nil
+}
+
+// ChainClient returns the chain backend the wallet is associated with, or nil
+// if there is none.
+func (w *Wallet) ChainClient() chain.Interface {
+	w.chainClientLock.Lock()
+	defer w.chainClientLock.Unlock()
+
+	return w.chainClient
+}
+
+// Stop signals all wallet goroutines to shut down, stopping the chain client
+// associated with the wallet as well.
 func (w *Wallet) Stop() {
 	quit := w.quitChan()
 
@@ -67,6 +139,12 @@ func (w *Wallet) Stop() {
 		fmt.Printf("Wallet::Stop() send quit signal to chan \n")
 		close(quit)
 	}
+
+	w.chainClientLock.Lock()
+	if w.chainClient != nil {
+		w.chainClient.Stop()
+	}
+	w.chainClientLock.Unlock()
 }
 
 type (
@@ -77,6 +155,15 @@ type (
 	}
 )
 
+// Unlock unlocks the wallet's address manager and relocks it after timeout
+// has expired. If the wallet is already unlocked and the new passphrase is
+// correct, the current timeout is replaced with the new one. The wallet will
+// be locked if the passphrase is incorrect or any other error occurs during
+// the unlock.
+//
+// A nil lock channel keeps the wallet unlocked until Lock is called. Sending
+// on, or closing, the channel locks the wallet immediately, which lets a
+// caller unlock only for the duration of a single operation.
 func (w *Wallet) Unlock(passphrase []byte, lock <-chan time.Time) error {
 	err := make(chan error, 1)
 	w.unlockRequests <- unlockRequest{
@@ -87,16 +174,86 @@ func (w *Wallet) Unlock(passphrase []byte, lock <-chan time.Time) error {
 	return <-err
 }
 
+// UnlockForRequest unlocks the wallet for a single operation, until the
+// returned function is called. Concurrent operations share the unlock: the
+// wallet is only relocked once the last of them is done, and only if it was
+// locked when the first one started or its relock timeout expired meanwhile.
+// An Unlock call made meanwhile keeps the wallet unlocked past them, until
+// its own timeout. As with Unlock, an incorrect passphrase locks the wallet.
+func (w *Wallet) UnlockForRequest(passphrase []byte) (func(), error) {
+	err := make(chan error, 1)
+	w.holdRequests <- unlockRequest{
+		passphrase: passphrase,
+		err:        err,
+	}
+	if err := <-err; err != nil {
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			select {
+			case w.releaseRequests <- struct{}{}:
+			case <-w.quitChan():
+			}
+		})
+	}, nil
+}
+
+// Lock locks the wallet's address manager and cancels any pending relock
+// timeout. It returns once the manager is locked, or the wallet is stopping.
+func (w *Wallet) Lock() {
+	done := make(chan struct{})
+	select {
+	case w.lockRequests <- done:
+		<-done
+	case <-w.quitChan():
+	}
+}
+
+// Locked returns whether the account manager for a wallet is locked.
+func (w *Wallet) Locked() bool {
+	return <-w.lockState
+}
+
+// WaitForShutdown blocks until all wallet goroutines and the chain client
+// have finished, and detaches the client from the wallet.
 func (w *Wallet) WaitForShutdown() {
+	w.chainClientLock.Lock()
+	chainClient := w.chainClient
+	w.chainClientLock.Unlock()
+
+	if chainClient != nil {
+		chainClient.WaitForShutdown()
+	}
 	w.wg.Wait()
+
+	w.chainClientLock.Lock()
+	w.chainClient = nil
+	w.chainClientLock.Unlock()
 }
 
+// txCreator is responsible for the input selection and creation of
+// transactions. These functions are the responsibility of this method
+// (designed to be run as its own goroutine) since input selection must be
+// serialized, or else it is possible to create double spends by choosing the
+// same inputs for multiple transactions. Along with input selection, this
+// method is also responsible for the signing of transactions, since we don't
+// want to end up in a situation where we run out of inputs as multiple
+// transactions are being created. In this situation, it would then be
+// possible for both requests, rather than just one, to fail due to not enough
+// available inputs.
 func (w *Wallet) txCreator() {
 	fmt.Printf("Wallet::txCreator() was running ... \n")
 	quit := w.quitChan()
 out:
 	for {
 		select {
+		case txr := <-w.createTxRequests:
+			tx, err := w.txToOutputs(&txr)
+			txr.resp <- createTxResponse{tx, err}
+
 		case <-quit:
 			break out
 		}
@@ -105,23 +262,57 @@ out:
 	fmt.Println("txCreator finished")
 }
 
+// walletLocker manages the locked/unlocked state of a wallet. Unlocking,
+// locking and the relock timeout are all serialized through this goroutine.
 func (w *Wallet) walletLocker() {
-	fmt.Printf("Wallet::txCreator() was running ... \n")
-	var timeout <-chan time.Time
+	fmt.Printf("Wallet::walletLocker() was running ... \n")
+	var (
+		timeout <-chan time.Time
+
+		// holds counts the operations the wallet is unlocked for with
+		// UnlockForRequest, and relock records whether it's locked
+		// once the last of them is done.
+		holds  int
+		relock bool
+	)
+
+	// unlock unlocks the manager, returning whether it was locked.
+	unlock := func(passphrase []byte) (bool, error) {
+		wasLocked := w.Manager.IsLocked()
+		err := walletdb.View(w.db, func(tx walletdb.ReadTx) error {
+			addrmgrNs := tx.ReadBucket(waddrmgrNamespaceKey)
+			return w.Manager.Unlock(addrmgrNs, passphrase)
+		})
+		if err != nil {
+			// A wrong passphrase relocks an unlocked manager,
+			// so any running timeout is now moot.
+			if !wasLocked && w.Manager.IsLocked() {
+				timeout = nil
+				relock = false
+				w.NtfnServer.notifyLockStateChange(true)
+			}
+			return wasLocked, err
+		}
+		if wasLocked {
+			w.NtfnServer.notifyLockStateChange(false)
+		}
+		return wasLocked, nil
+	}
+
 	quit := w.quitChan()
 out:
 	for {
+		// lockDone is closed once an explicit lock request is served.
+		var lockDone chan struct{}
+
 		select {
 		case req := <-w.unlockRequests:
-			err := walletdb.View(w.db, func(tx walletdb.ReadTx) error {
-				addrmgrNs := tx.ReadBucket(waddrmgrNamespaceKey)
-				return w.Manager.Unlock(addrmgrNs, req.passphrase)
-			})
-			if err != nil {
+			if _, err := unlock(req.passphrase); err != nil {
 				req.err <- err
 				continue
 			}
 			timeout = req.lockAfter
+			relock = false
 			if timeout == nil {
 				fmt.Println("The wallet has been unlocked without a time limit")
 			} else {
@@ -130,15 +321,81 @@ out:
 			req.err <- nil
 			continue
 
+		case req := <-w.holdRequests:
+			wasLocked, err := unlock(req.passphrase)
+			if err != nil {
+				req.err <- err
+				continue
+			}
+			holds++
+			if wasLocked {
+				relock = true
+			}
+			req.err <- nil
+			continue
+
+		case <-w.releaseRequests:
+			holds--
+			if holds > 0 || !relock {
+				continue
+			}
+
+		case w.lockState <- w.Manager.IsLocked():
+			continue
+
 		case <-quit:
 			break out
+
+		case lockDone = <-w.lockRequests:
 		case <-timeout:
+			// The wallet is relocked once the operations it's
+			// unlocked for are done.
+			if holds > 0 {
+				timeout = nil
+				relock = true
+				continue
+			}
+		}
+
+		// Select statement fell through by an explicit lock, the
+		// timer expiring or the last operation being done. Lock the
+		// manager here.
+		timeout = nil
+		relock = false
+		err := w.Manager.Lock()
+		if err != nil && !waddrmgr.IsError(err, waddrmgr.ErrLocked) {
+			fmt.Printf("Could not lock wallet: %v \n", err)
+		} else if err == nil {
+			fmt.Println("The wallet has been locked")
+			w.NtfnServer.notifyLockStateChange(true)
+		}
+		if lockDone != nil {
+			close(lockDone)
 		}
 	}
 	w.wg.Done()
 	fmt.Println("walletLocker finished")
 }
 
+// ChainParams returns the network parameters for the blockchain the wallet
+// belongs to.
+func (w *Wallet) ChainParams() *chaincfg.Params {
+	return w.chainParams
+}
+
+// BlockHash returns the hash of the block the wallet synced through at the
+// height, failing with waddrmgr.ErrBlockNotFound if it did not.
+func (w *Wallet) BlockHash(height int32) (*chainhash.Hash, error) {
+	var hash *chainhash.Hash
+	err := walletdb.View(w.db, func(dbTx walletdb.ReadTx) error {
+		addrmgrNs := dbTx.ReadBucket(waddrmgrNamespaceKey)
+		var err error
+		hash, err = w.Manager.BlockHash(addrmgrNs, height)
+		return err
+	})
+	return hash, err
+}
+
 func (w *Wallet) quitChan() chan struct{} {
 	w.quitMu.Lock()
 	c := w.quit
@@ -255,11 +512,21 @@ func OpenWithRetry(db walletdb.DB, pubPass []byte,
 	}
 
 	w := &Wallet{
-		db:      db,
-		Manager: addrMgr,
-		TxStore: txMgr,
-		quit:    make(chan struct{}),
+		db:               db,
+		Manager:          addrMgr,
+		TxStore:          txMgr,
+		chainParams:      params,
+		recoveryWindow:   recoveryWindow,
+		lockedOutpoints:  make(map[wire.OutPoint]struct{}),
+		createTxRequests: make(chan createTxRequest),
+		unlockRequests:   make(chan unlockRequest),
+		holdRequests:     make(chan unlockRequest),
+		releaseRequests:  make(chan struct{}),
+		lockRequests:     make(chan chan struct{}),
+		lockState:        make(chan bool),
+		quit:             make(chan struct{}),
 	}
+	w.NtfnServer = newNotificationServer()
 
 	return w, nil
 }
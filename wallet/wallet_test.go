@@ -0,0 +1,201 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/czh0526/btc-wallet/waddrmgr"
+	"github.com/czh0526/btc-wallet/walletdb"
+	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testPubPass  = []byte("public")
+	testPrivPass = []byte("private")
+)
+
+// testWallet creates and starts a wallet backed by a temporary database.
+func testWallet(t *testing.T) (*Wallet, func()) {
+	t.Helper()
+
+	return testWalletFromKey(t, nil, time.Now(), 0)
+}
+
+// testWalletFromKey creates and starts a wallet from the given root key, or
+// a random seed if nil, opened with the given recovery window.
+func testWalletFromKey(t *testing.T, rootKey *hdkeychain.ExtendedKey,
+	birthday time.Time, recoveryWindow uint32) (*Wallet, func()) {
+
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "wallettest")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	db, err := walletdb.Create(
+		"bdb", filepath.Join(dir, "wallet.db"), true, 10*time.Second)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("unable to create db: %v", err)
+	}
+	cleanUp := func() {
+		db.Close()
+		_ = os.RemoveAll(dir)
+	}
+
+	err = create(db, testPubPass, testPrivPass, rootKey,
+		&chaincfg.RegressionNetParams, birthday, false, nil)
+	if err != nil {
+		cleanUp()
+		t.Fatalf("unable to create wallet: %v", err)
+	}
+	w, err := OpenWithRetry(db, testPubPass,
+		&chaincfg.RegressionNetParams, recoveryWindow,
+		defaultSyncRetryInterval)
+	if err != nil {
+		cleanUp()
+		t.Fatalf("unable to open wallet: %v", err)
+	}
+	w.Start()
+
+	return w, func() {
+		w.Stop()
+		w.WaitForShutdown()
+		cleanUp()
+	}
+}
+
+func expectLockState(t *testing.T, c <-chan bool, locked bool) {
+	t.Helper()
+
+	select {
+	case got := <-c:
+		if got != locked {
+			t.Fatalf("expected lock state %v, got %v", locked, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for lock state %v", locked)
+	}
+}
+
+func TestWalletLocker(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	ntfns := w.NtfnServer.LockStateNotifications()
+	defer ntfns.Done()
+
+	if !w.Locked() {
+		t.Fatalf("new wallet should start locked")
+	}
+
+	err := w.Unlock([]byte("wrong"), nil)
+	if !waddrmgr.IsError(err, waddrmgr.ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	// A timed unlock relocks once the timer fires.
+	if err := w.Unlock(testPrivPass, time.After(100*time.Millisecond)); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	expectLockState(t, ntfns.C, false)
+	expectLockState(t, ntfns.C, true)
+	if !w.Locked() {
+		t.Fatalf("wallet should be relocked after timeout")
+	}
+
+	// An explicit lock cancels a pending timeout.
+	if err := w.Unlock(testPrivPass, time.After(time.Hour)); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	expectLockState(t, ntfns.C, false)
+	if w.Locked() {
+		t.Fatalf("wallet should be unlocked")
+	}
+	w.Lock()
+	if !w.Manager.IsLocked() {
+		t.Fatalf("manager should be locked once Lock returns")
+	}
+	expectLockState(t, ntfns.C, true)
+
+	// Signalling the lock channel locks the wallet immediately.
+	lock := make(chan time.Time, 1)
+	if err := w.Unlock(testPrivPass, lock); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	expectLockState(t, ntfns.C, false)
+	lock <- time.Time{}
+	expectLockState(t, ntfns.C, true)
+	if !w.Locked() {
+		t.Fatalf("wallet should be locked")
+	}
+
+	// Lock doesn't block once the wallet is stopped.
+	w.Stop()
+	w.WaitForShutdown()
+	done := make(chan struct{})
+	go func() {
+		w.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lock blocked on a stopped wallet")
+	}
+}
+
+func TestUnlockForRequest(t *testing.T) {
+	w, cleanUp := testWallet(t)
+	defer cleanUp()
+
+	_, err := w.UnlockForRequest([]byte("wrong"))
+	assert.True(t, waddrmgr.IsError(err, waddrmgr.ErrWrongPassphrase))
+
+	// The wallet stays unlocked until the last request is done.
+	release1, err := w.UnlockForRequest(testPrivPass)
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	release2, err := w.UnlockForRequest(testPrivPass)
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	release1()
+	release1()
+	assert.False(t, w.Locked())
+	release2()
+	assert.True(t, w.Locked())
+
+	// A request doesn't end an unlock made beyond it.
+	if err := w.Unlock(testPrivPass, nil); err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	release, err := w.UnlockForRequest(testPrivPass)
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	release()
+	assert.False(t, w.Locked())
+	w.Lock()
+
+	// A timeout expiring during a request relocks the wallet once the
+	// request is done.
+	err = w.Unlock(testPrivPass, time.After(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	release, err = w.UnlockForRequest(testPrivPass)
+	if err != nil {
+		t.Fatalf("unable to unlock: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, w.Locked())
+	release()
+	assert.True(t, w.Locked())
+}
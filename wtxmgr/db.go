@@ -0,0 +1,439 @@
+package wtxmgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+/*
+	Bucket layout, all buckets are top-level within the wtxmgr namespace:
+
+	   bucket    |  key                     |  value
+	-------------+--------------------------+----------------------------------
+	   meta      |  "ver"                   |  uint32 version
+	   txrecords |  tx hash                 |  received, block meta, raw tx
+	   credits   |  outpoint                |  amount, flags
+	   spends    |  outpoint                |  spending tx hash, input index
+	   locks     |  outpoint                |  lock id, expiry
+	   txlabels  |  tx hash                 |  label
+	   replaced  |  replaced tx hash        |  replacement tx hash
+*/
+
+const (
+	// latestVersion is the most recent store version.
+	latestVersion = 3
+
+	// outpointSize is the size of a serialized outpoint key.
+	outpointSize = 36
+
+	// txRecordHeaderSize is the size of the fixed fields that precede the
+	// serialized transaction in a tx record.
+	txRecordHeaderSize = 8 + 4 + 32 + 8
+
+	// creditValueSize is the size of a serialized credit.
+	creditValueSize = 9
+
+	// spendValueSize is the size of a serialized spend.
+	spendValueSize = 36
+
+	// lockValueSize is the size of a serialized output lock.
+	lockValueSize = 32 + 8
+
+	// flagChange marks a credit as a change output.
+	flagChange byte = 1 << 0
+)
+
+var (
+	bucketMeta      = []byte("meta")
+	bucketTxRecords = []byte("txrecords")
+	bucketCredits   = []byte("credits")
+	bucketSpends    = []byte("spends")
+	bucketLocks     = []byte("locks")
+	bucketTxLabels  = []byte("txlabels")
+	bucketReplaced  = []byte("replaced")
+
+	versionKey = []byte("ver")
+)
+
+func createBuckets(ns walletdb.ReadWriteBucket) error {
+	for _, name := range [][]byte{bucketMeta, bucketTxRecords,
+		bucketCredits, bucketSpends, bucketLocks, bucketTxLabels,
+		bucketReplaced} {
+
+		if _, err := ns.CreateBucket(name); err != nil {
+			str := fmt.Sprintf("failed to create bucket `%s`", name)
+			return storeError(ErrDatabase, str, err)
+		}
+	}
+
+	return putVersion(ns, latestVersion)
+}
+
+func putVersion(ns walletdb.ReadWriteBucket, version uint32) error {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], version)
+	err := ns.NestedReadWriteBucket(bucketMeta).Put(versionKey, v[:])
+	if err != nil {
+		str := "failed to store database version"
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+// upgrade brings a store written by an older version up to latestVersion.
+func upgrade(ns walletdb.ReadWriteBucket, version uint32) error {
+	if version < 2 {
+		// Version 2 added transaction labels.
+		if _, err := ns.CreateBucketIfNotExists(bucketTxLabels); err != nil {
+			str := fmt.Sprintf("failed to create bucket `%s`",
+				bucketTxLabels)
+			return storeError(ErrDatabase, str, err)
+		}
+	}
+	if version < 3 {
+		// Version 3 added the replaced transactions.
+		if _, err := ns.CreateBucketIfNotExists(bucketReplaced); err != nil {
+			str := fmt.Sprintf("failed to create bucket `%s`",
+				bucketReplaced)
+			return storeError(ErrDatabase, str, err)
+		}
+	}
+	return putVersion(ns, latestVersion)
+}
+
+func fetchVersion(ns walletdb.ReadBucket) (uint32, error) {
+	meta := ns.NestedReadBucket(bucketMeta)
+	if meta == nil {
+		str := "transaction store does not exist"
+		return 0, storeError(ErrNoExists, str, nil)
+	}
+
+	v := meta.Get(versionKey)
+	if len(v) != 4 {
+		str := "no transaction store exists in namespace"
+		return 0, storeError(ErrNoExists, str, nil)
+	}
+	return binary.LittleEndian.Uint32(v), nil
+}
+
+func canonicalOutPoint(op *wire.OutPoint) []byte {
+	k := make([]byte, outpointSize)
+	copy(k, op.Hash[:])
+	binary.LittleEndian.PutUint32(k[32:], op.Index)
+	return k
+}
+
+func readCanonicalOutPoint(k []byte, op *wire.OutPoint) error {
+	if len(k) != outpointSize {
+		str := "short canonical outpoint"
+		return storeError(ErrData, str, nil)
+	}
+	copy(op.Hash[:], k[:32])
+	op.Index = binary.LittleEndian.Uint32(k[32:])
+	return nil
+}
+
+// txRecord is the stored form of a wallet transaction together with the
+// block it was mined in. Unmined transactions have a block height of -1.
+type txRecord struct {
+	TxRecord
+	block BlockMeta
+}
+
+func (r *txRecord) mined() bool {
+	return r.block.Height != -1
+}
+
+func valueTxRecord(rec *TxRecord, block *BlockMeta) ([]byte, error) {
+	serialized := rec.SerializedTx
+	if serialized == nil {
+		var buf bytes.Buffer
+		if err := rec.MsgTx.Serialize(&buf); err != nil {
+			str := "failed to serialize transaction"
+			return nil, storeError(ErrInput, str, err)
+		}
+		serialized = buf.Bytes()
+	}
+
+	v := make([]byte, txRecordHeaderSize+len(serialized))
+	binary.LittleEndian.PutUint64(v[0:8], uint64(rec.Received.Unix()))
+	if block == nil {
+		binary.LittleEndian.PutUint32(v[8:12], ^uint32(0))
+	} else {
+		binary.LittleEndian.PutUint32(v[8:12], uint32(block.Height))
+		copy(v[12:44], block.Hash[:])
+		binary.LittleEndian.PutUint64(v[44:52], uint64(block.Time.Unix()))
+	}
+	copy(v[txRecordHeaderSize:], serialized)
+	return v, nil
+}
+
+func readTxRecord(txHash *chainhash.Hash, v []byte) (*txRecord, error) {
+	if len(v) < txRecordHeaderSize {
+		str := fmt.Sprintf("%s: short read for tx record", bucketTxRecords)
+		return nil, storeError(ErrData, str, nil)
+	}
+
+	rec := &txRecord{}
+	rec.Hash = *txHash
+	rec.Received = time.Unix(int64(binary.LittleEndian.Uint64(v[0:8])), 0)
+	rec.block.Height = int32(binary.LittleEndian.Uint32(v[8:12]))
+	copy(rec.block.Hash[:], v[12:44])
+	rec.block.Time = time.Unix(int64(binary.LittleEndian.Uint64(v[44:52])), 0)
+
+	rec.SerializedTx = make([]byte, len(v)-txRecordHeaderSize)
+	copy(rec.SerializedTx, v[txRecordHeaderSize:])
+	err := rec.MsgTx.Deserialize(bytes.NewReader(rec.SerializedTx))
+	if err != nil {
+		str := fmt.Sprintf("failed to deserialize transaction %v", txHash)
+		return nil, storeError(ErrData, str, err)
+	}
+
+	return rec, nil
+}
+
+func putTxRecord(ns walletdb.ReadWriteBucket, rec *TxRecord,
+	block *BlockMeta) error {
+
+	v, err := valueTxRecord(rec, block)
+	if err != nil {
+		return err
+	}
+
+	err = ns.NestedReadWriteBucket(bucketTxRecords).Put(rec.Hash[:], v)
+	if err != nil {
+		str := fmt.Sprintf("failed to store tx record %v", rec.Hash)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func fetchTxRecord(ns walletdb.ReadBucket,
+	txHash *chainhash.Hash) (*txRecord, error) {
+
+	v := ns.NestedReadBucket(bucketTxRecords).Get(txHash[:])
+	if v == nil {
+		return nil, nil
+	}
+	return readTxRecord(txHash, v)
+}
+
+func deleteTxRecord(ns walletdb.ReadWriteBucket, txHash *chainhash.Hash) error {
+	err := ns.NestedReadWriteBucket(bucketTxRecords).Delete(txHash[:])
+	if err != nil {
+		str := fmt.Sprintf("failed to delete tx record %v", txHash)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+// creditValue is the stored form of a wallet credit.
+type creditValue struct {
+	amount btcutil.Amount
+	change bool
+}
+
+func putCredit(ns walletdb.ReadWriteBucket, op *wire.OutPoint,
+	amount btcutil.Amount, change bool) error {
+
+	v := make([]byte, creditValueSize)
+	binary.LittleEndian.PutUint64(v[0:8], uint64(amount))
+	if change {
+		v[8] |= flagChange
+	}
+
+	err := ns.NestedReadWriteBucket(bucketCredits).Put(canonicalOutPoint(op), v)
+	if err != nil {
+		str := fmt.Sprintf("failed to store credit %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func readCredit(v []byte) (*creditValue, error) {
+	if len(v) != creditValueSize {
+		str := fmt.Sprintf("%s: short read for credit", bucketCredits)
+		return nil, storeError(ErrData, str, nil)
+	}
+	return &creditValue{
+		amount: btcutil.Amount(binary.LittleEndian.Uint64(v[0:8])),
+		change: v[8]&flagChange != 0,
+	}, nil
+}
+
+func fetchCredit(ns walletdb.ReadBucket, op *wire.OutPoint) (*creditValue, error) {
+	v := ns.NestedReadBucket(bucketCredits).Get(canonicalOutPoint(op))
+	if v == nil {
+		return nil, nil
+	}
+	return readCredit(v)
+}
+
+func deleteCredit(ns walletdb.ReadWriteBucket, op *wire.OutPoint) error {
+	err := ns.NestedReadWriteBucket(bucketCredits).Delete(canonicalOutPoint(op))
+	if err != nil {
+		str := fmt.Sprintf("failed to delete credit %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+// spendValue records which transaction input spends a credit.
+type spendValue struct {
+	txHash chainhash.Hash
+	index  uint32
+}
+
+func putSpend(ns walletdb.ReadWriteBucket, op *wire.OutPoint,
+	spender *chainhash.Hash, index uint32) error {
+
+	v := make([]byte, spendValueSize)
+	copy(v[0:32], spender[:])
+	binary.LittleEndian.PutUint32(v[32:36], index)
+
+	err := ns.NestedReadWriteBucket(bucketSpends).Put(canonicalOutPoint(op), v)
+	if err != nil {
+		str := fmt.Sprintf("failed to store spend of %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func fetchSpend(ns walletdb.ReadBucket, op *wire.OutPoint) (*spendValue, error) {
+	v := ns.NestedReadBucket(bucketSpends).Get(canonicalOutPoint(op))
+	if v == nil {
+		return nil, nil
+	}
+	if len(v) != spendValueSize {
+		str := fmt.Sprintf("%s: short read for spend", bucketSpends)
+		return nil, storeError(ErrData, str, nil)
+	}
+
+	var s spendValue
+	copy(s.txHash[:], v[0:32])
+	s.index = binary.LittleEndian.Uint32(v[32:36])
+	return &s, nil
+}
+
+func deleteSpend(ns walletdb.ReadWriteBucket, op *wire.OutPoint) error {
+	err := ns.NestedReadWriteBucket(bucketSpends).Delete(canonicalOutPoint(op))
+	if err != nil {
+		str := fmt.Sprintf("failed to delete spend of %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func putLock(ns walletdb.ReadWriteBucket, op *wire.OutPoint, id LockID,
+	expiry time.Time) error {
+
+	v := make([]byte, lockValueSize)
+	copy(v[0:32], id[:])
+	binary.LittleEndian.PutUint64(v[32:40], uint64(expiry.Unix()))
+
+	err := ns.NestedReadWriteBucket(bucketLocks).Put(canonicalOutPoint(op), v)
+	if err != nil {
+		str := fmt.Sprintf("failed to lock output %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func readLock(v []byte) (LockID, time.Time, error) {
+	var id LockID
+	if len(v) != lockValueSize {
+		str := fmt.Sprintf("%s: short read for lock", bucketLocks)
+		return id, time.Time{}, storeError(ErrData, str, nil)
+	}
+	copy(id[:], v[0:32])
+	expiry := time.Unix(int64(binary.LittleEndian.Uint64(v[32:40])), 0)
+	return id, expiry, nil
+}
+
+func fetchLock(ns walletdb.ReadBucket, op *wire.OutPoint) (LockID, time.Time,
+	bool, error) {
+
+	v := ns.NestedReadBucket(bucketLocks).Get(canonicalOutPoint(op))
+	if v == nil {
+		return LockID{}, time.Time{}, false, nil
+	}
+	id, expiry, err := readLock(v)
+	return id, expiry, err == nil, err
+}
+
+func deleteLock(ns walletdb.ReadWriteBucket, op *wire.OutPoint) error {
+	err := ns.NestedReadWriteBucket(bucketLocks).Delete(canonicalOutPoint(op))
+	if err != nil {
+		str := fmt.Sprintf("failed to unlock output %v", op)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func putTxLabel(ns walletdb.ReadWriteBucket, txHash *chainhash.Hash,
+	label string) error {
+
+	err := ns.NestedReadWriteBucket(bucketTxLabels).Put(
+		txHash[:], []byte(label))
+	if err != nil {
+		str := fmt.Sprintf("failed to store label for %v", txHash)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func fetchTxLabel(ns walletdb.ReadBucket, txHash *chainhash.Hash) (string,
+	bool) {
+
+	v := ns.NestedReadBucket(bucketTxLabels).Get(txHash[:])
+	if v == nil {
+		return "", false
+	}
+	return string(v), true
+}
+
+func putReplaced(ns walletdb.ReadWriteBucket, txHash,
+	replacement *chainhash.Hash) error {
+
+	err := ns.NestedReadWriteBucket(bucketReplaced).Put(
+		txHash[:], replacement[:])
+	if err != nil {
+		str := fmt.Sprintf("failed to store replacement of %v", txHash)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
+
+func fetchReplaced(ns walletdb.ReadBucket,
+	txHash *chainhash.Hash) (*chainhash.Hash, error) {
+
+	v := ns.NestedReadBucket(bucketReplaced).Get(txHash[:])
+	if v == nil {
+		return nil, nil
+	}
+	if len(v) != chainhash.HashSize {
+		str := fmt.Sprintf("%s: short read for replacement",
+			bucketReplaced)
+		return nil, storeError(ErrData, str, nil)
+	}
+
+	var replacement chainhash.Hash
+	copy(replacement[:], v)
+	return &replacement, nil
+}
+
+func deleteReplaced(ns walletdb.ReadWriteBucket, txHash *chainhash.Hash) error {
+	err := ns.NestedReadWriteBucket(bucketReplaced).Delete(txHash[:])
+	if err != nil {
+		str := fmt.Sprintf("failed to delete replacement of %v", txHash)
+		return storeError(ErrDatabase, str, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package wtxmgr
+
+import "fmt"
+
+// ErrorCode identifies a category of error.
+type ErrorCode uint8
+
+// These constants are used to identify a specific Error.
+const (
+	// ErrDatabase indicates an error with the underlying database. When
+	// this error code is set, the Err field of the Error will be set to
+	// the underlying error returned from the database.
+	ErrDatabase ErrorCode = iota
+
+	// ErrData describes an error where data stored in the transaction
+	// database is incorrect.
+	ErrData
+
+	// ErrInput describes an error where the variables passed into this
+	// function by the caller are obviously incorrect.
+	ErrInput
+
+	// ErrAlreadyExists describes an error where creating the store cannot
+	// continue because a store already exists in the namespace.
+	ErrAlreadyExists
+
+	// ErrNoExists describes an error where the store cannot be opened due
+	// to it not already existing in the namespace.
+	ErrNoExists
+
+	// ErrUnknownOutput describes an error where an output being locked or
+	// leased is not a known wallet credit.
+	ErrUnknownOutput
+
+	// ErrOutputAlreadyLocked describes an error where an output is
+	// already locked under a different lock ID.
+	ErrOutputAlreadyLocked
+
+	// ErrOutputUnlockNotAllowed describes an error where an output is
+	// being unlocked with a lock ID that does not match the one it was
+	// locked with.
+	ErrOutputUnlockNotAllowed
+)
+
+var errStrs = [...]string{
+	ErrDatabase:               "ErrDatabase",
+	ErrData:                   "ErrData",
+	ErrInput:                  "ErrInput",
+	ErrAlreadyExists:          "ErrAlreadyExists",
+	ErrNoExists:               "ErrNoExists",
+	ErrUnknownOutput:          "ErrUnknownOutput",
+	ErrOutputAlreadyLocked:    "ErrOutputAlreadyLocked",
+	ErrOutputUnlockNotAllowed: "ErrOutputUnlockNotAllowed",
+}
+
+// String returns the ErrorCode as a human-readable name.
+func (e ErrorCode) String() string {
+	if int(e) < len(errStrs) {
+		return errStrs[e]
+	}
+	return fmt.Sprintf("ErrorCode(%d)", e)
+}
+
+// Error provides a single type for errors that can happen during Store
+// operation.
+type Error struct {
+	Code ErrorCode // Describes the kind of error
+	Desc string    // Human readable description of the issue
+	Err  error     // Underlying error, optional
+}
+
+// Error satisfies the error interface and prints human-readable errors.
+func (e Error) Error() string {
+	if e.Err != nil {
+		return e.Desc + ": " + e.Err.Error()
+	}
+	return e.Desc
+}
+
+// Unwrap returns the underlying error, if any.
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+func storeError(c ErrorCode, desc string, err error) Error {
+	return Error{Code: c, Desc: desc, Err: err}
+}
+
+// IsError returns whether err is an Error with a matching error code.
+func IsError(err error, code ErrorCode) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == code
+}
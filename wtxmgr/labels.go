@@ -0,0 +1,45 @@
+package wtxmgr
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// TxLabelLimit is the length limit we impose on transaction labels.
+const TxLabelLimit = 500
+
+// PutTxLabel validates a transaction label and stores it for the given
+// transaction, replacing any previous label. The transaction must be known
+// to the store.
+func (s *Store) PutTxLabel(ns walletdb.ReadWriteBucket, txid chainhash.Hash,
+	label string) error {
+
+	if len(label) == 0 {
+		return storeError(ErrInput, "empty transaction label", nil)
+	}
+	if len(label) > TxLabelLimit {
+		str := fmt.Sprintf("transaction label of %d bytes exceeds "+
+			"limit of %d", len(label), TxLabelLimit)
+		return storeError(ErrInput, str, nil)
+	}
+
+	rec, err := fetchTxRecord(ns, &txid)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		str := fmt.Sprintf("transaction %v not found", txid)
+		return storeError(ErrInput, str, nil)
+	}
+
+	return putTxLabel(ns, &txid, label)
+}
+
+// FetchTxLabel returns the label of a transaction, or an empty string if it
+// has none.
+func (s *Store) FetchTxLabel(ns walletdb.ReadBucket, txid chainhash.Hash) string {
+	label, _ := fetchTxLabel(ns, &txid)
+	return label
+}
@@ -0,0 +1,138 @@
+package wtxmgr
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// LockID represents a unique context-specific ID assigned to an output lock.
+type LockID [32]byte
+
+// LockedOutput is a type that contains an outpoint of an UTXO and its lock
+// lease information.
+type LockedOutput struct {
+	Outpoint   wire.OutPoint
+	LockID     LockID
+	Expiration time.Time
+}
+
+// LockOutput locks an output to the given ID, preventing it from being
+// available for coin selection. The absolute time of the lock's expiration is
+// returned. The expiration of the lock can be extended by successive
+// invocations of this call.
+//
+// Outputs can be unlocked before their expiration through `UnlockOutput`.
+// Otherwise, they are unlocked lazily through calls which iterate through
+// all known outputs, e.g., `UnspentOutputs`.
+//
+// If the output is not known, ErrUnknownOutput is returned. If the output has
+// already been locked to a different ID, then ErrOutputAlreadyLocked is
+// returned.
+func (s *Store) LockOutput(ns walletdb.ReadWriteBucket, id LockID,
+	op wire.OutPoint, duration time.Duration) (time.Time, error) {
+
+	credit, err := fetchCredit(ns, &op)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if credit == nil {
+		return time.Time{}, storeError(ErrUnknownOutput, op.String(), nil)
+	}
+	spend, err := fetchSpend(ns, &op)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if spend != nil {
+		return time.Time{}, storeError(ErrUnknownOutput, op.String(), nil)
+	}
+
+	now := s.now()
+	lockedID, expiry, locked, err := fetchLock(ns, &op)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if locked && lockedID != id && now.Before(expiry) {
+		return time.Time{}, storeError(
+			ErrOutputAlreadyLocked, op.String(), nil)
+	}
+
+	expiry = now.Add(duration)
+	if err := putLock(ns, &op, id, expiry); err != nil {
+		return time.Time{}, err
+	}
+	return expiry, nil
+}
+
+// UnlockOutput unlocks an output, allowing it to be available for coin
+// selection if it remains unspent. The ID should match the one used to
+// originally lock the output.
+func (s *Store) UnlockOutput(ns walletdb.ReadWriteBucket, id LockID,
+	op wire.OutPoint) error {
+
+	lockedID, expiry, locked, err := fetchLock(ns, &op)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	if lockedID != id && s.now().Before(expiry) {
+		return storeError(ErrOutputUnlockNotAllowed, op.String(), nil)
+	}
+
+	return deleteLock(ns, &op)
+}
+
+// DeleteExpiredLockedOutputs iterates through all existing locked outputs
+// and deletes those which have already expired.
+func (s *Store) DeleteExpiredLockedOutputs(ns walletdb.ReadWriteBucket) error {
+	locked, err := s.listLockedOutputs(ns, true)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	for _, lo := range locked {
+		if now.Before(lo.Expiration) {
+			continue
+		}
+		if err := deleteLock(ns, &lo.Outpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListLockedOutputs returns a list of objects representing the currently
+// locked utxos.
+func (s *Store) ListLockedOutputs(ns walletdb.ReadBucket) ([]*LockedOutput,
+	error) {
+
+	return s.listLockedOutputs(ns, false)
+}
+
+func (s *Store) listLockedOutputs(ns walletdb.ReadBucket,
+	includeExpired bool) ([]*LockedOutput, error) {
+
+	var outputs []*LockedOutput
+	now := s.now()
+	err := ns.NestedReadBucket(bucketLocks).ForEach(func(k, v []byte) error {
+		var lo LockedOutput
+		if err := readCanonicalOutPoint(k, &lo.Outpoint); err != nil {
+			return err
+		}
+		id, expiry, err := readLock(v)
+		if err != nil {
+			return err
+		}
+		if !includeExpired && !now.Before(expiry) {
+			return nil
+		}
+		lo.LockID, lo.Expiration = id, expiry
+		outputs = append(outputs, &lo)
+		return nil
+	})
+	return outputs, err
+}
@@ -0,0 +1,69 @@
+package wtxmgr
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/czh0526/btc-wallet/walletdb"
+)
+
+// ReplaceTx records an unmined transaction replacing another one under
+// BIP-125. The replaced transaction is removed along with every unmined
+// transaction depending on it, releasing the credits it spent, and is
+// marked as replaced by rec. The replacement is then inserted as unmined.
+//
+// The replacement must spend at least one output the replaced transaction
+// spends, as it would otherwise not conflict with it.
+func (s *Store) ReplaceTx(ns walletdb.ReadWriteBucket, replaced chainhash.Hash,
+	rec *TxRecord) error {
+
+	stored, err := fetchTxRecord(ns, &replaced)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		str := fmt.Sprintf("transaction %v not found", replaced)
+		return storeError(ErrInput, str, nil)
+	}
+	if stored.mined() {
+		str := fmt.Sprintf("transaction %v is mined", replaced)
+		return storeError(ErrInput, str, nil)
+	}
+
+	spent := make(map[[outpointSize]byte]struct{}, len(stored.MsgTx.TxIn))
+	for _, txIn := range stored.MsgTx.TxIn {
+		var k [outpointSize]byte
+		copy(k[:], canonicalOutPoint(&txIn.PreviousOutPoint))
+		spent[k] = struct{}{}
+	}
+	conflicts := false
+	for _, txIn := range rec.MsgTx.TxIn {
+		var k [outpointSize]byte
+		copy(k[:], canonicalOutPoint(&txIn.PreviousOutPoint))
+		if _, ok := spent[k]; ok {
+			conflicts = true
+			break
+		}
+	}
+	if !conflicts {
+		str := fmt.Sprintf("transaction %v does not conflict with %v",
+			rec.Hash, replaced)
+		return storeError(ErrInput, str, nil)
+	}
+
+	if err := s.removeUnmined(ns, stored); err != nil {
+		return err
+	}
+	if err := s.InsertTx(ns, rec, nil); err != nil {
+		return err
+	}
+	return putReplaced(ns, &replaced, &rec.Hash)
+}
+
+// ReplacedBy returns the hash of the transaction that replaced a
+// transaction, or nil if it was not replaced.
+func (s *Store) ReplacedBy(ns walletdb.ReadBucket,
+	txHash chainhash.Hash) (*chainhash.Hash, error) {
+
+	return fetchReplaced(ns, &txHash)
+}
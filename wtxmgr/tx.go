@@ -1,21 +1,576 @@
 package wtxmgr
 
 import (
+	"bytes"
 	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/czh0526/btc-wallet/walletdb"
 )
 
+// Block contains the minimum amount of data to uniquely identify any block on
+// either the best or side chain.
+type Block struct {
+	Hash   chainhash.Hash
+	Height int32
+}
+
+// BlockMeta contains the unique identification for a block and any metadata
+// pertaining to the block. At the moment, this additional metadata only
+// includes the block time from the block header.
+type BlockMeta struct {
+	Block
+	Time time.Time
+}
+
+// TxRecord represents a transaction managed by the Store.
+type TxRecord struct {
+	MsgTx        wire.MsgTx
+	Hash         chainhash.Hash
+	Received     time.Time
+	SerializedTx []byte // Optional: may be nil
+}
+
+// NewTxRecord creates a new transaction record that may be inserted into the
+// store. It uses memoization to save the transaction hash and the serialized
+// transaction.
+func NewTxRecord(serializedTx []byte, received time.Time) (*TxRecord, error) {
+	rec := &TxRecord{
+		Received:     received,
+		SerializedTx: serializedTx,
+	}
+	err := rec.MsgTx.Deserialize(bytes.NewReader(serializedTx))
+	if err != nil {
+		str := "failed to deserialize transaction"
+		return nil, storeError(ErrInput, str, err)
+	}
+	rec.Hash = rec.MsgTx.TxHash()
+	return rec, nil
+}
+
+// NewTxRecordFromMsgTx creates a new transaction record that may be inserted
+// into the store.
+func NewTxRecordFromMsgTx(msgTx *wire.MsgTx, received time.Time) (*TxRecord, error) {
+	var buf bytes.Buffer
+	buf.Grow(msgTx.SerializeSize())
+	if err := msgTx.Serialize(&buf); err != nil {
+		str := "failed to serialize transaction"
+		return nil, storeError(ErrInput, str, err)
+	}
+	rec := &TxRecord{
+		MsgTx:        *msgTx,
+		Received:     received,
+		SerializedTx: buf.Bytes(),
+		Hash:         msgTx.TxHash(),
+	}
+	return rec, nil
+}
+
+// Credit is the type representing a transaction output which was spent or is
+// still spendable by wallet. A UTXO is an unspent Credit, but not all Credits
+// are UTXOs.
+type Credit struct {
+	wire.OutPoint
+	BlockMeta
+	Amount       btcutil.Amount
+	PkScript     []byte
+	Received     time.Time
+	FromCoinBase bool
+	Change       bool
+}
+
+// CreditRecord contains metadata regarding a transaction credit for a known
+// transaction. Further details may be looked up by indexing a wire.MsgTx.TxOut
+// with the Index field.
+type CreditRecord struct {
+	Amount btcutil.Amount
+	Index  uint32
+	Spent  bool
+	Change bool
+}
+
+// DebitRecord contains metadata regarding a transaction debit for a known
+// transaction. Further details may be looked up by indexing a wire.MsgTx.TxIn
+// with the Index field.
+type DebitRecord struct {
+	Amount btcutil.Amount
+	Index  uint32
+}
+
+// TxDetails is intended to provide callers with access to rich details
+// regarding a relevant transaction and which inputs and outputs are credit or
+// debits. An unmined transaction has a block height of -1.
+type TxDetails struct {
+	TxRecord
+	Block   BlockMeta
+	Credits []CreditRecord
+	Debits  []DebitRecord
+}
+
+// Store implements a transaction store for storing and managing wallet
+// transactions.
 type Store struct {
 	chainParams *chaincfg.Params
+
+	// now returns the current time. It is replaced in tests to control
+	// output lease expiry.
+	now func() time.Time
 }
 
+// Create creates a new persistent transaction store in the walletdb namespace.
+// Creating the store when one already exists in this namespace will error with
+// ErrAlreadyExists.
 func Create(ns walletdb.ReadWriteBucket) error {
-	fmt.Println("wtxmgr.Create() has not been implemented yet")
-	return nil
+	if ns.NestedReadBucket(bucketMeta) != nil {
+		str := "transaction store already exists"
+		return storeError(ErrAlreadyExists, str, nil)
+	}
+	return createBuckets(ns)
 }
 
+// Open opens the wallet transaction store from a walletdb namespace. If the
+// store does not exist, ErrNoExist is returned.
 func Open(ns walletdb.ReadWriteBucket, chainParams *chaincfg.Params) (*Store, error) {
-	fmt.Println("wtxmgr.Open() has not been implemented yet")
-	return &Store{}, nil
+	version, err := fetchVersion(ns)
+	if err != nil {
+		return nil, err
+	}
+	if version > latestVersion {
+		str := fmt.Sprintf("transaction store version %d is newer than "+
+			"latest supported version %d", version, latestVersion)
+		return nil, storeError(ErrData, str, nil)
+	}
+	if version < latestVersion {
+		if err := upgrade(ns, version); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{
+		chainParams: chainParams,
+		now:         time.Now,
+	}, nil
+}
+
+// InsertTx records a transaction as belonging to a wallet's transaction
+// history. If block is nil, the transaction is considered unspent, and the
+// transaction's index must be unset. Inserting an already known unmined
+// transaction with a block marks it mined.
+//
+// Any wallet credits spent by the transaction are marked spent. When a mined
+// transaction spends a credit that an unmined transaction also spends, the
+// unmined double spend and everything depending on it is removed.
+func (s *Store) InsertTx(ns walletdb.ReadWriteBucket, rec *TxRecord,
+	block *BlockMeta) error {
+
+	existing, err := fetchTxRecord(ns, &rec.Hash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.mined() || block == nil {
+			return nil
+		}
+		return putTxRecord(ns, &existing.TxRecord, block)
+	}
+
+	for i, txIn := range rec.MsgTx.TxIn {
+		prevOut := &txIn.PreviousOutPoint
+		credit, err := fetchCredit(ns, prevOut)
+		if err != nil {
+			return err
+		}
+		if credit == nil {
+			continue
+		}
+
+		spend, err := fetchSpend(ns, prevOut)
+		if err != nil {
+			return err
+		}
+		if spend != nil && spend.txHash != rec.Hash {
+			// Only a confirmed transaction may evict a conflicting
+			// one. Otherwise the first seen spend wins.
+			if block == nil {
+				str := fmt.Sprintf("output %v already spent by "+
+					"unmined transaction %v", prevOut, spend.txHash)
+				return storeError(ErrInput, str, nil)
+			}
+			if err := s.removeConflict(ns, &spend.txHash); err != nil {
+				return err
+			}
+		}
+
+		if err := putSpend(ns, prevOut, &rec.Hash, uint32(i)); err != nil {
+			return err
+		}
+	}
+
+	// A replaced transaction that is seen again, e.g. because it was
+	// mined instead of its replacement, is no longer replaced.
+	if err := deleteReplaced(ns, &rec.Hash); err != nil {
+		return err
+	}
+
+	return putTxRecord(ns, rec, block)
+}
+
+// removeConflict removes an unmined transaction that double spends a mined
+// one, along with all of its unmined descendants.
+func (s *Store) removeConflict(ns walletdb.ReadWriteBucket,
+	txHash *chainhash.Hash) error {
+
+	rec, err := fetchTxRecord(ns, txHash)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return nil
+	}
+	if rec.mined() {
+		str := fmt.Sprintf("conflicting transaction %v is already mined",
+			txHash)
+		return storeError(ErrData, str, nil)
+	}
+	return s.removeUnmined(ns, rec)
+}
+
+// RemoveUnminedTx attempts to remove an unmined transaction from the
+// transaction store. This is to be used in the scenario that a transaction
+// that we attempt to rebroadcast, turns out to double spend one of our
+// existing inputs. This function removes the conflicting transaction
+// identified by the tx record, and also recursively removes all transactions
+// that depend on it.
+func (s *Store) RemoveUnminedTx(ns walletdb.ReadWriteBucket, rec *TxRecord) error {
+	stored, err := fetchTxRecord(ns, &rec.Hash)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		str := fmt.Sprintf("transaction %v not found", rec.Hash)
+		return storeError(ErrInput, str, nil)
+	}
+	if stored.mined() {
+		str := fmt.Sprintf("transaction %v is mined", rec.Hash)
+		return storeError(ErrInput, str, nil)
+	}
+	return s.removeUnmined(ns, stored)
+}
+
+func (s *Store) removeUnmined(ns walletdb.ReadWriteBucket, rec *txRecord) error {
+	// Remove any spenders of this transaction's outputs first.
+	for i := range rec.MsgTx.TxOut {
+		op := wire.OutPoint{Hash: rec.Hash, Index: uint32(i)}
+		spend, err := fetchSpend(ns, &op)
+		if err != nil {
+			return err
+		}
+		if spend != nil {
+			if err := s.removeConflict(ns, &spend.txHash); err != nil {
+				return err
+			}
+			if err := deleteSpend(ns, &op); err != nil {
+				return err
+			}
+		}
+
+		credit, err := fetchCredit(ns, &op)
+		if err != nil {
+			return err
+		}
+		if credit != nil {
+			if err := deleteCredit(ns, &op); err != nil {
+				return err
+			}
+			if err := deleteLock(ns, &op); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Release the credits this transaction spent.
+	for _, txIn := range rec.MsgTx.TxIn {
+		prevOut := &txIn.PreviousOutPoint
+		spend, err := fetchSpend(ns, prevOut)
+		if err != nil {
+			return err
+		}
+		if spend != nil && spend.txHash == rec.Hash {
+			if err := deleteSpend(ns, prevOut); err != nil {
+				return err
+			}
+		}
+	}
+
+	return deleteTxRecord(ns, &rec.Hash)
+}
+
+// Rollback removes all blocks at height onwards, moving any transactions
+// within each block to the unconfirmed pool. Coinbase transactions of the
+// removed blocks can never be mined in another block, so they are removed
+// along with every transaction spending their outputs.
+func (s *Store) Rollback(ns walletdb.ReadWriteBucket, height int32) error {
+	// Collect the affected records first, as the bucket can't be modified
+	// while iterating it.
+	var detached []*txRecord
+	records := ns.NestedReadWriteBucket(bucketTxRecords)
+	err := records.ForEach(func(k, v []byte) error {
+		var txHash chainhash.Hash
+		copy(txHash[:], k)
+		rec, err := readTxRecord(&txHash, v)
+		if err != nil {
+			return err
+		}
+		if rec.mined() && rec.block.Height >= height {
+			detached = append(detached, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every detached transaction is marked unmined before the coinbases
+	// are removed, so their spenders are all unmined when removed too.
+	var coinbases []*chainhash.Hash
+	for _, rec := range detached {
+		if err := putTxRecord(ns, &rec.TxRecord, nil); err != nil {
+			return err
+		}
+		if blockchain.IsCoinBaseTx(&rec.MsgTx) {
+			coinbases = append(coinbases, &rec.Hash)
+		}
+	}
+	for _, txHash := range coinbases {
+		if err := s.removeConflict(ns, txHash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddCredit marks a transaction record as containing a transaction output
+// spendable by wallet. The output is added unspent, and is marked spent
+// when a new transaction spending the output is inserted into the store.
+//
+// The transaction must already have been inserted with InsertTx.
+func (s *Store) AddCredit(ns walletdb.ReadWriteBucket, rec *TxRecord,
+	block *BlockMeta, index uint32, change bool) error {
+
+	if int(index) >= len(rec.MsgTx.TxOut) {
+		str := "transaction output does not exist"
+		return storeError(ErrInput, str, nil)
+	}
+
+	stored, err := fetchTxRecord(ns, &rec.Hash)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if err := s.InsertTx(ns, rec, block); err != nil {
+			return err
+		}
+	}
+
+	op := wire.OutPoint{Hash: rec.Hash, Index: index}
+	existing, err := fetchCredit(ns, &op)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+
+	amount := btcutil.Amount(rec.MsgTx.TxOut[index].Value)
+	return putCredit(ns, &op, amount, change)
+}
+
+// IsCredit returns whether the output is a credit of the wallet, spent or
+// not.
+func (s *Store) IsCredit(ns walletdb.ReadBucket, op wire.OutPoint) (bool,
+	error) {
+
+	credit, err := fetchCredit(ns, &op)
+	return credit != nil, err
+}
+
+// UnspentOutputs returns all unspent received transaction outputs. Outputs
+// spent by unmined transactions and locked outputs are not included. The
+// order is undefined.
+func (s *Store) UnspentOutputs(ns walletdb.ReadBucket) ([]Credit, error) {
+	var unspent []Credit
+	err := s.forEachUnspent(ns, func(c *Credit) error {
+		_, expiry, locked, err := fetchLock(ns, &c.OutPoint)
+		if err != nil {
+			return err
+		}
+		if locked && s.now().Before(expiry) {
+			return nil
+		}
+		unspent = append(unspent, *c)
+		return nil
+	})
+	return unspent, err
+}
+
+// forEachUnspent calls f for every credit that is not spent by any known
+// transaction, mined or not.
+func (s *Store) forEachUnspent(ns walletdb.ReadBucket,
+	f func(*Credit) error) error {
+
+	// Transactions with several credits are only decoded once.
+	records := make(map[chainhash.Hash]*txRecord)
+
+	spends := ns.NestedReadBucket(bucketSpends)
+	return ns.NestedReadBucket(bucketCredits).ForEach(func(k, v []byte) error {
+		if spends.Get(k) != nil {
+			return nil
+		}
+
+		var op wire.OutPoint
+		if err := readCanonicalOutPoint(k, &op); err != nil {
+			return err
+		}
+		cv, err := readCredit(v)
+		if err != nil {
+			return err
+		}
+
+		rec, ok := records[op.Hash]
+		if !ok {
+			rec, err = fetchTxRecord(ns, &op.Hash)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				str := fmt.Sprintf("missing transaction %v for "+
+					"credit", op.Hash)
+				return storeError(ErrData, str, nil)
+			}
+			records[op.Hash] = rec
+		}
+
+		return f(&Credit{
+			OutPoint:     op,
+			BlockMeta:    rec.block,
+			Amount:       cv.amount,
+			PkScript:     rec.MsgTx.TxOut[op.Index].PkScript,
+			Received:     rec.Received,
+			FromCoinBase: blockchain.IsCoinBaseTx(&rec.MsgTx),
+			Change:       cv.change,
+		})
+	})
+}
+
+// Balance returns the spendable wallet balance (total value of all unspent
+// transaction outputs) given a minimum of minConf confirmations, calculated
+// at a current chain height of curHeight. Coinbase outputs are only
+// included in the balance if maturity has been reached.
+func (s *Store) Balance(ns walletdb.ReadBucket, minConf int32,
+	syncHeight int32) (btcutil.Amount, error) {
+
+	var bal btcutil.Amount
+	err := s.forEachUnspent(ns, func(c *Credit) error {
+		if c.Height == -1 {
+			if minConf == 0 && !c.FromCoinBase {
+				bal += c.Amount
+			}
+			return nil
+		}
+
+		confs := syncHeight - c.Height + 1
+		if confs < minConf {
+			return nil
+		}
+		if c.FromCoinBase && s.chainParams != nil &&
+			confs < int32(s.chainParams.CoinbaseMaturity) {
+
+			return nil
+		}
+		bal += c.Amount
+		return nil
+	})
+	return bal, err
+}
+
+// TxDetails looks up all recorded details regarding a transaction with some
+// hash. In case of a hash collision, the most recent transaction with a
+// matching hash is returned.
+//
+// Not finding a transaction with this hash is not an error. In this case, a
+// nil TxDetails is returned.
+func (s *Store) TxDetails(ns walletdb.ReadBucket,
+	txHash *chainhash.Hash) (*TxDetails, error) {
+
+	rec, err := fetchTxRecord(ns, txHash)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	details := &TxDetails{
+		TxRecord: rec.TxRecord,
+		Block:    rec.block,
+	}
+
+	for i := range rec.MsgTx.TxOut {
+		op := wire.OutPoint{Hash: *txHash, Index: uint32(i)}
+		credit, err := fetchCredit(ns, &op)
+		if err != nil {
+			return nil, err
+		}
+		if credit == nil {
+			continue
+		}
+		spend, err := fetchSpend(ns, &op)
+		if err != nil {
+			return nil, err
+		}
+		details.Credits = append(details.Credits, CreditRecord{
+			Amount: credit.amount,
+			Index:  uint32(i),
+			Spent:  spend != nil,
+			Change: credit.change,
+		})
+	}
+
+	for i, txIn := range rec.MsgTx.TxIn {
+		credit, err := fetchCredit(ns, &txIn.PreviousOutPoint)
+		if err != nil {
+			return nil, err
+		}
+		if credit == nil {
+			continue
+		}
+		details.Debits = append(details.Debits, DebitRecord{
+			Amount: credit.amount,
+			Index:  uint32(i),
+		})
+	}
+
+	return details, nil
+}
+
+// UnminedTxs returns the underlying transactions for all unmined transactions
+// which are not known to have been mined in a block.
+func (s *Store) UnminedTxs(ns walletdb.ReadBucket) ([]*wire.MsgTx, error) {
+	var txs []*wire.MsgTx
+	err := ns.NestedReadBucket(bucketTxRecords).ForEach(func(k, v []byte) error {
+		var txHash chainhash.Hash
+		copy(txHash[:], k)
+		rec, err := readTxRecord(&txHash, v)
+		if err != nil {
+			return err
+		}
+		if !rec.mined() {
+			txs = append(txs, &rec.MsgTx)
+		}
+		return nil
+	})
+	return txs, err
 }
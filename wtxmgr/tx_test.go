@@ -0,0 +1,468 @@
+package wtxmgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/czh0526/btc-wallet/walletdb"
+	_ "github.com/czh0526/btc-wallet/walletdb/bdb"
+	"github.com/stretchr/testify/assert"
+)
+
+var namespaceKey = []byte("txstore")
+
+// testStore creates a transaction store backed by a temporary database.
+func testStore(t *testing.T) (*Store, walletdb.DB, func()) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "wtxmgrtest")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	db, err := walletdb.Create(
+		"bdb", filepath.Join(dir, "tx.db"), true, 10*time.Second)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("unable to create db: %v", err)
+	}
+	cleanUp := func() {
+		db.Close()
+		_ = os.RemoveAll(dir)
+	}
+
+	var s *Store
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns, err := tx.CreateTopLevelBucket(namespaceKey)
+		if err != nil {
+			return err
+		}
+		if err := Create(ns); err != nil {
+			return err
+		}
+		s, err = Open(ns, &chaincfg.RegressionNetParams)
+		return err
+	})
+	if err != nil {
+		cleanUp()
+		t.Fatalf("unable to create store: %v", err)
+	}
+	return s, db, cleanUp
+}
+
+func update(t *testing.T, db walletdb.DB,
+	f func(ns walletdb.ReadWriteBucket) error) {
+
+	t.Helper()
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		return f(tx.ReadWriteBucket(namespaceKey))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spendTx(t *testing.T, value int64, prevOuts ...wire.OutPoint) *TxRecord {
+	t.Helper()
+
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	for i := range prevOuts {
+		msgTx.AddTxIn(wire.NewTxIn(&prevOuts[i], nil, nil))
+	}
+	msgTx.AddTxOut(wire.NewTxOut(value, []byte{0x00, 0x14}))
+	rec, err := NewTxRecordFromMsgTx(msgTx, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create tx record: %v", err)
+	}
+	return rec
+}
+
+func fundingTx(t *testing.T, values ...int64) *TxRecord {
+	t.Helper()
+
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Hash: chainhash.Hash{0x01}, Index: 0}, nil, nil))
+	for _, v := range values {
+		msgTx.AddTxOut(wire.NewTxOut(v, []byte{0x00, 0x14}))
+	}
+	rec, err := NewTxRecordFromMsgTx(msgTx, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create tx record: %v", err)
+	}
+	return rec
+}
+
+var testBlock = &BlockMeta{
+	Block: Block{Hash: chainhash.Hash{0xaa}, Height: 100},
+	Time:  time.Unix(1700000000, 0),
+}
+
+func TestInsertCreditAndSpend(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	fund := fundingTx(t, 1e6, 2e6)
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.InsertTx(ns, fund, testBlock); err != nil {
+			return err
+		}
+		if err := s.AddCredit(ns, fund, testBlock, 0, false); err != nil {
+			return err
+		}
+		return s.AddCredit(ns, fund, testBlock, 1, true)
+	})
+
+	var bal btcutil.Amount
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		unspent, err := s.UnspentOutputs(ns)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, unspent, 2)
+		for _, c := range unspent {
+			assert.Equal(t, testBlock.Height, c.Height)
+			assert.Equal(t, c.Index == 1, c.Change)
+		}
+		bal, err = s.Balance(ns, 1, 100)
+		return err
+	})
+	assert.Equal(t, btcutil.Amount(3e6), bal)
+
+	// Spending an output in an unmined transaction removes it from the
+	// unspent set immediately.
+	spend := spendTx(t, 9e5, wire.OutPoint{Hash: fund.Hash, Index: 0})
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.InsertTx(ns, spend, nil); err != nil {
+			return err
+		}
+		unspent, err := s.UnspentOutputs(ns)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, unspent, 1)
+		assert.Equal(t, uint32(1), unspent[0].Index)
+
+		details, err := s.TxDetails(ns, &fund.Hash)
+		if err != nil {
+			return err
+		}
+		assert.True(t, details.Credits[0].Spent)
+		assert.False(t, details.Credits[1].Spent)
+
+		unmined, err := s.UnminedTxs(ns)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, unmined, 1)
+		return nil
+	})
+
+	// A second unmined spend of the same output is rejected.
+	double := spendTx(t, 8e5, wire.OutPoint{Hash: fund.Hash, Index: 0})
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		return s.InsertTx(tx.ReadWriteBucket(namespaceKey), double, nil)
+	})
+	if !IsError(err, ErrInput) {
+		t.Fatalf("expected ErrInput for double spend, got %v", err)
+	}
+}
+
+func TestMinedConflictRemovesUnmined(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	fund := fundingTx(t, 1e6)
+	op := wire.OutPoint{Hash: fund.Hash, Index: 0}
+	unmined := spendTx(t, 9e5, op)
+	child := spendTx(t, 8e5, wire.OutPoint{Hash: unmined.Hash, Index: 0})
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.AddCredit(ns, fund, testBlock, 0, false); err != nil {
+			return err
+		}
+		if err := s.AddCredit(ns, unmined, nil, 0, true); err != nil {
+			return err
+		}
+		return s.InsertTx(ns, child, nil)
+	})
+
+	mined := spendTx(t, 7e5, op)
+	minedBlock := &BlockMeta{Block: Block{Height: 101}}
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.InsertTx(ns, mined, minedBlock); err != nil {
+			return err
+		}
+
+		// The unmined double spend and its descendant are gone.
+		for _, hash := range []chainhash.Hash{unmined.Hash, child.Hash} {
+			details, err := s.TxDetails(ns, &hash)
+			if err != nil {
+				return err
+			}
+			assert.Nil(t, details)
+		}
+		details, err := s.TxDetails(ns, &mined.Hash)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, int32(101), details.Block.Height)
+
+		txs, err := s.UnminedTxs(ns)
+		assert.Empty(t, txs)
+		return err
+	})
+}
+
+func TestLockOutput(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	fund := fundingTx(t, 1e6)
+	op := wire.OutPoint{Hash: fund.Hash, Index: 0}
+	id1, id2 := LockID{1}, LockID{2}
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.AddCredit(ns, fund, testBlock, 0, false); err != nil {
+			return err
+		}
+
+		expiry, err := s.LockOutput(ns, id1, op, time.Minute)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, now.Add(time.Minute), expiry)
+
+		unspent, err := s.UnspentOutputs(ns)
+		assert.Empty(t, unspent)
+		return err
+	})
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		ns := tx.ReadWriteBucket(namespaceKey)
+		if _, err := s.LockOutput(ns, id2, op, time.Minute); !IsError(
+			err, ErrOutputAlreadyLocked) {
+
+			t.Fatalf("expected ErrOutputAlreadyLocked, got %v", err)
+		}
+		return s.UnlockOutput(ns, id2, op)
+	})
+	if !IsError(err, ErrOutputUnlockNotAllowed) {
+		t.Fatalf("expected ErrOutputUnlockNotAllowed, got %v", err)
+	}
+
+	// Once the lease expires, the output is spendable again and the lock
+	// can be cleaned up.
+	now = now.Add(2 * time.Minute)
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		unspent, err := s.UnspentOutputs(ns)
+		if err != nil {
+			return err
+		}
+		assert.Len(t, unspent, 1)
+
+		if err := s.DeleteExpiredLockedOutputs(ns); err != nil {
+			return err
+		}
+		locked, err := s.ListLockedOutputs(ns)
+		assert.Empty(t, locked)
+		return err
+	})
+
+	unknown := wire.OutPoint{Hash: chainhash.Hash{0x02}}
+	err = walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		_, err := s.LockOutput(
+			tx.ReadWriteBucket(namespaceKey), id1, unknown, time.Minute)
+		return err
+	})
+	if !IsError(err, ErrUnknownOutput) {
+		t.Fatalf("expected ErrUnknownOutput, got %v", err)
+	}
+}
+
+func TestTxLabels(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	fund := fundingTx(t, 1e6)
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.InsertTx(ns, fund, nil); err != nil {
+			return err
+		}
+		if err := s.PutTxLabel(ns, fund.Hash, "payroll"); err != nil {
+			return err
+		}
+		assert.Equal(t, "payroll", s.FetchTxLabel(ns, fund.Hash))
+
+		unknown := chainhash.Hash{0x03}
+		assert.Equal(t, "", s.FetchTxLabel(ns, unknown))
+		err := s.PutTxLabel(ns, unknown, "x")
+		assert.True(t, IsError(err, ErrInput))
+
+		err = s.PutTxLabel(ns, fund.Hash, "")
+		assert.True(t, IsError(err, ErrInput))
+
+		long := make([]byte, TxLabelLimit+1)
+		err = s.PutTxLabel(ns, fund.Hash, string(long))
+		assert.True(t, IsError(err, ErrInput))
+		return nil
+	})
+}
+
+func TestReplaceTx(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	fund := fundingTx(t, 1e6, 2e6)
+	op := wire.OutPoint{Hash: fund.Hash, Index: 0}
+	original := spendTx(t, 9e5, op)
+	child := spendTx(t, 8e5, wire.OutPoint{Hash: original.Hash, Index: 0})
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		for i := uint32(0); i < 2; i++ {
+			err := s.AddCredit(ns, fund, testBlock, i, false)
+			if err != nil {
+				return err
+			}
+		}
+		if err := s.AddCredit(ns, original, nil, 0, true); err != nil {
+			return err
+		}
+		return s.InsertTx(ns, child, nil)
+	})
+
+	// The replacement spends an extra credit and must conflict with the
+	// replaced transaction.
+	replacement := spendTx(t, 2.5e6, op, wire.OutPoint{
+		Hash: fund.Hash, Index: 1})
+	unrelated := spendTx(t, 1e6, wire.OutPoint{Hash: fund.Hash, Index: 1})
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		err := s.ReplaceTx(ns, original.Hash, unrelated)
+		assert.Error(t, err)
+
+		if err := s.ReplaceTx(ns, original.Hash, replacement); err != nil {
+			return err
+		}
+
+		for _, hash := range []chainhash.Hash{original.Hash, child.Hash} {
+			details, err := s.TxDetails(ns, &hash)
+			if err != nil {
+				return err
+			}
+			assert.Nil(t, details)
+		}
+		replacedBy, err := s.ReplacedBy(ns, original.Hash)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, &replacement.Hash, replacedBy)
+
+		txs, err := s.UnminedTxs(ns)
+		assert.Len(t, txs, 1)
+		assert.Equal(t, replacement.Hash, txs[0].TxHash())
+
+		// The credits of the funding tx are spent by the replacement.
+		unspent, err := s.UnspentOutputs(ns)
+		assert.Empty(t, unspent)
+		return err
+	})
+
+	// Mining the replaced transaction evicts the replacement, and it is
+	// no longer marked replaced.
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		minedBlock := &BlockMeta{Block: Block{Height: 101}}
+		if err := s.InsertTx(ns, original, minedBlock); err != nil {
+			return err
+		}
+		replacedBy, err := s.ReplacedBy(ns, original.Hash)
+		if err != nil {
+			return err
+		}
+		assert.Nil(t, replacedBy)
+
+		details, err := s.TxDetails(ns, &replacement.Hash)
+		assert.Nil(t, details)
+		return err
+	})
+}
+
+func TestRollback(t *testing.T) {
+	s, db, cleanUp := testStore(t)
+	defer cleanUp()
+
+	nextBlock := &BlockMeta{
+		Block: Block{Hash: chainhash.Hash{0xbb}, Height: 101},
+		Time:  time.Unix(1700000600, 0),
+	}
+
+	coinbaseTx := wire.NewMsgTx(wire.TxVersion)
+	coinbaseTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{
+		Index: wire.MaxPrevOutIndex}, []byte{0x51, 0x51}, nil))
+	coinbaseTx.AddTxOut(wire.NewTxOut(5e9, []byte{0x00, 0x14}))
+	coinbase, err := NewTxRecordFromMsgTx(coinbaseTx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fund := fundingTx(t, 1e6)
+	spend := spendTx(t, 9e5, wire.OutPoint{Hash: fund.Hash})
+	spendCoinbase := spendTx(t, 4e9, wire.OutPoint{Hash: coinbase.Hash})
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.AddCredit(ns, fund, testBlock, 0, false); err != nil {
+			return err
+		}
+		if err := s.InsertTx(ns, spend, nextBlock); err != nil {
+			return err
+		}
+		err := s.AddCredit(ns, coinbase, nextBlock, 0, false)
+		if err != nil {
+			return err
+		}
+		return s.InsertTx(ns, spendCoinbase, nil)
+	})
+
+	update(t, db, func(ns walletdb.ReadWriteBucket) error {
+		if err := s.Rollback(ns, nextBlock.Height); err != nil {
+			return err
+		}
+
+		details, err := s.TxDetails(ns, &fund.Hash)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, testBlock.Height, details.Block.Height)
+
+		// The spend of a block that was rolled back is unmined again,
+		// but still spends the credit.
+		details, err = s.TxDetails(ns, &spend.Hash)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, int32(-1), details.Block.Height)
+		details, err = s.TxDetails(ns, &fund.Hash)
+		if err != nil {
+			return err
+		}
+		assert.True(t, details.Credits[0].Spent)
+
+		// The coinbase and its spender are gone.
+		for _, txHash := range []chainhash.Hash{
+			coinbase.Hash, spendCoinbase.Hash,
+		} {
+			details, err = s.TxDetails(ns, &txHash)
+			if err != nil {
+				return err
+			}
+			assert.Nil(t, details)
+		}
+
+		unspent, err := s.UnspentOutputs(ns)
+		assert.Empty(t, unspent)
+		return err
+	})
+}